@@ -30,6 +30,7 @@ const getTimestamp = () => {
  */
 const App = () => {
   const [textToSend, setTextToSend] = useState('');
+  const [peersToSend, setPeersToSend] = useState('');
   const [processorList, setProcessorList] = useState([]);
   const [processors, setProcessors] = useState([]);
   const [channelList, setChannelList] = useState([]);
@@ -37,6 +38,7 @@ const App = () => {
   const [channelIsOpen, setChannelIsOpen] = useState(false);
   const [consoleIsVisible, setConsoleIsVisible] = useState(true);
   const [config, setConfig] = useState({});
+  const [configErrors, setConfigErrors] = useState({});
   const [isLoading, setLoading] = useState(true);
   const [ws, setWS] = useState(null);
   const [systemMessages, setSystemMessages] = useState([]);
@@ -46,6 +48,8 @@ const App = () => {
   const sendInitialConfig = (localWS) => {
     const cmd = JSON.stringify({ OpCode: 'config' });
     localWS.send(cmd, { binary: true });
+    // Restore the messages received before the page was loaded
+    localWS.send(JSON.stringify({ OpCode: 'history', Direction: 'receive', Error: false }), { binary: true });
   };
 
   const addSystemMessage = (newMsg) => {
@@ -76,11 +80,26 @@ const App = () => {
   };
 
   const sendMessage = () => {
-    const cmd = JSON.stringify({ OpCode: 'write', Message: textToSend });
+    const peers = peersToSend.split(',').map(p => p.trim()).filter(p => p);
+    const cmd = JSON.stringify({ OpCode: 'write', Message: textToSend, Peers: peers });
     ws.send(cmd, { binary: true });
     setTextToSend('');
   };
 
+  const downloadFile = (msg) => {
+    const bytes = Uint8Array.from(atob(msg.Message), c => c.charCodeAt(0));
+    const url = URL.createObjectURL(new Blob([bytes]));
+    const link = document.createElement('a');
+    link.href = url;
+    link.download = msg.Name;
+    link.click();
+    URL.revokeObjectURL(url);
+  };
+
+  // Messages that are not valid text are sent base64 encoded, so they are
+  // labelled rather than shown as if they were the text that was received
+  const messageText = msg => (msg.Encoding === 'base64' ? `[binary, base64] ${msg.Message}` : msg.Message);
+
   const handleMessage = (msg) => {
     switch (msg.OpCode) {
       case 'config':
@@ -92,20 +111,55 @@ const App = () => {
       case 'open':
         addSystemMessage('Covert channel successfully opened.');
         setChannelIsOpen(true);
+        setConfigErrors({});
         break;
       case 'close':
         setChannelIsOpen(false);
         addSystemMessage('Covert channel closed.');
         break;
       case 'write':
+        addSystemMessage('Covert message queued.');
+        break;
+      case 'queued':
+      case 'sending':
+        break;
+      case 'sent':
         addSystemMessage('Covert message sent.');
         break;
+      case 'cancelled':
+        addSystemMessage('Covert message cancelled.');
+        break;
+      case 'scheduled':
+        addSystemMessage(`Scheduled message ${msg.ScheduleID} queued (${msg.Runs} sent).`);
+        break;
+      case 'scheduleDone':
+        addSystemMessage(`${msg.Message} (schedule ${msg.ScheduleID}).`);
+        break;
       case 'read':
         addSystemMessage('Covert message received.');
-        addCovertMessage(msg.Message);
+        addCovertMessage(msg.Peer && msg.Peer !== 'friend' ? `${msg.Peer}: ${messageText(msg)}` : messageText(msg));
+        break;
+      case 'sendfile':
+        addSystemMessage('Covert file queued.');
+        break;
+      case 'progress':
+        addSystemMessage(`File ${msg.Name}: ${msg.Bytes}/${msg.Size} bytes ${msg.Direction === 'send' ? 'sent' : 'received'}.`);
+        break;
+      case 'file':
+        addSystemMessage(`Covert file ${msg.Name} received.`);
+        downloadFile(msg);
+        break;
+      case 'history':
+        setCovertMessages(msg.Messages.map(m => `[${new Date(m.Time).toLocaleTimeString()}] ${messageText(m)}`));
+        break;
+      case 'peer':
+        addSystemMessage(msg.Peer && msg.Peer !== 'friend' ? `${msg.Message} (${msg.Peer}).` : `${msg.Message}.`);
         break;
       case 'error':
-        addSystemMessage(`[ERROR]: ${msg.Message}`);
+        addSystemMessage(`[ERROR] (${msg.Code}): ${msg.Message}`);
+        if (msg.Code === 'invalidConfig') {
+          setConfigErrors(msg);
+        }
         break;
       default:
         console.log('ERROR: Unknown message');
@@ -116,7 +170,8 @@ const App = () => {
   useEffect(() => {
     // Matches just the "127.0.0.1:8080" portion of the address
     const addressRegex = /[a-zA-Z0-9.]+:[\d]+/g;
-    const newWS = new WebSocket(`ws://${window.location.href.match(addressRegex)[0]}/api/ws`);
+    const protocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
+    const newWS = new WebSocket(`${protocol}://${window.location.href.match(addressRegex)[0]}/api/ws`);
     // TODO: The line below exists for easy personal debugging
     // const newWS = new WebSocket('ws://localhost:8080/api/ws');
     newWS.binaryType = 'arraybuffer';
@@ -160,6 +215,7 @@ const App = () => {
               closeChannel={closeChannel}
               config={config}
               setConfig={setConfig}
+              configErrors={configErrors}
               processorList={processorList}
               processors={processors}
               setProcessors={setProcessors}
@@ -173,6 +229,8 @@ const App = () => {
             <MessagingScreen
               textToSend={textToSend}
               setTextToSend={setTextToSend}
+              peersToSend={peersToSend}
+              setPeersToSend={setPeersToSend}
               covertMessages={covertMessages}
               sendMessage={sendMessage}
             />
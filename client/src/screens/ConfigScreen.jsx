@@ -14,12 +14,37 @@ import Select from '../ui-components/Select';
 import StringInput from '../ui-components/StringInput';
 import TextArea from '../ui-components/TextArea';
 
+/**
+ * Floats are kept as text while they are typed, e.g. "0.", so that the
+ * decimal point is not lost. Otherwise they are sent to the server as numbers.
+ */
+const toFloat = text => ((text === '' || text.endsWith('.') || Number.isNaN(Number(text))) ? text : Number(text));
+
+/**
+ * The inputs of fields rejected by the server are outlined, with the reason below them.
+ * fields maps the names of the rejected fields to their errors.
+ */
+const withFieldError = (input, fields) => (fields[input.key] ? (
+  <div key={input.key} className="cc-config__invalid">
+    {input}
+    <small className="text-danger ml-1">{fields[input.key]}</small>
+  </div>
+) : input);
+
+/**
+ * The field errors of a config error, if it is for the given layer and entity
+ */
+const fieldErrors = (configErrors, layer, entity) => (
+  (configErrors.Layer === layer && configErrors.Entity === entity && configErrors.Fields) || {}
+);
+
 const ConfigScreen = (props) => {
   const {
     openChannel,
     closeChannel,
     config,
     setConfig,
+    configErrors,
     processorList,
     processors,
     setProcessors,
@@ -204,7 +229,35 @@ const ConfigScreen = (props) => {
                     />
                   );
                 case 'exactu64':
+                case 'duration':
+                case 'ip':
+                case 'prefix':
+                case 'string':
                   return (<StringInput {...propsForComponent} />);
+                case 'float':
+                  return (
+                    <StringInput
+                      {...propsForComponent}
+                      value={String(opt.Value)}
+                      parentOnChange={e => setProcessors([
+                        ...processors.slice(0, i),
+                        {
+                          ...processor,
+                          Data: {
+                            ...processor.Data,
+                            [processor.Type]: {
+                              ...processor.Data[processor.Type],
+                              [key]: {
+                                ...opt,
+                                Value: toFloat(e.target.value),
+                              },
+                            },
+                          },
+                        },
+                        ...processors.slice(i + 1, processors.length + 1),
+                      ])}
+                    />
+                  );
                 case 'bool':
                   return (
                     <Checkbox
@@ -238,11 +291,12 @@ const ConfigScreen = (props) => {
                 case 'hexkey':
                   return (<HexKey {...propsForComponent} acceptedLengths={opt.Range} />);
                 case 'key':
+                case 'peers':
                   return (<TextArea {...propsForComponent} />);
                 default:
                   return (<div key={key}>UNIMPLEMENTED</div>);
               }
-            })}
+            }).map(input => withFieldError(input, fieldErrors(configErrors, 'processor', processor.Type)))}
           </div>
         ))
       }
@@ -319,7 +373,25 @@ const ConfigScreen = (props) => {
               />
             );
           case 'exactu64':
+          case 'duration':
+          case 'ip':
+          case 'prefix':
+          case 'string':
             return (<StringInput {...propsForComponent} />);
+          case 'float':
+            return (
+              <StringInput
+                {...propsForComponent}
+                value={String(opt.Value)}
+                parentOnChange={e => setConfig({
+                  ...config,
+                  [key]: {
+                    ...config[key],
+                    Value: toFloat(e.target.value),
+                  },
+                })}
+              />
+            );
           case 'bool':
             return (
               <Checkbox
@@ -343,11 +415,12 @@ const ConfigScreen = (props) => {
           case 'hexkey':
             return (<HexKey {...propsForComponent} />);
           case 'key':
+          case 'peers':
             return (<TextArea {...propsForComponent} />);
           default:
             return (<div key={key}>UNIMPLEMENTED</div>);
         }
-      })}
+      }).map(input => withFieldError(input, fieldErrors(configErrors, 'channel', channel.value)))}
       {channelIsOpen ? (
         <Button variant="danger" onClick={closeChannel} className="m-1 w-100">Close Covert Channel</Button>
       ) : (
@@ -385,6 +458,7 @@ ConfigScreen.propTypes = {
   closeChannel: PropTypes.func.isRequired,
   config: PropTypes.object.isRequired,
   setConfig: PropTypes.func.isRequired,
+  configErrors: PropTypes.object,
   processorList: PropTypes.object.isRequired,
   processors: PropTypes.array.isRequired,
   setProcessors: PropTypes.func.isRequired,
@@ -395,4 +469,8 @@ ConfigScreen.propTypes = {
   addSystemMessage: PropTypes.func.isRequired,
 };
 
+ConfigScreen.defaultProps = {
+  configErrors: {},
+};
+
 export default ConfigScreen;
@@ -7,6 +7,8 @@ const MessagingScreen = (props) => {
   const {
     textToSend,
     setTextToSend,
+    peersToSend,
+    setPeersToSend,
     covertMessages,
     sendMessage,
   } = props;
@@ -19,6 +21,12 @@ const MessagingScreen = (props) => {
         value={textToSend}
         onChange={e => setTextToSend(e.target.value)}
       />
+      <FormControl
+        className="cc-messaging__peers w-75 m-1"
+        placeholder="Peers, separated by commas, or * for every peer. Your friend if empty."
+        value={peersToSend}
+        onChange={e => setPeersToSend(e.target.value)}
+      />
       <Button
         variant="primary"
         onClick={sendMessage}
@@ -42,6 +50,8 @@ const MessagingScreen = (props) => {
 MessagingScreen.propTypes = {
   textToSend: PropTypes.string.isRequired,
   setTextToSend: PropTypes.func.isRequired,
+  peersToSend: PropTypes.string.isRequired,
+  setPeersToSend: PropTypes.func.isRequired,
   covertMessages: PropTypes.array.isRequired,
   sendMessage: PropTypes.func.isRequired,
 };
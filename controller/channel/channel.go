@@ -1,7 +1,235 @@
 package channel
 
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"../config"
+	"../registry"
+)
+
 type Channel interface {
 	Receive(data []byte) (uint64, error)
 	Send(data []byte) (uint64, error)
 	Close() error
 }
+
+// A covert channel whose individual operations can be cancelled
+// or given a deadline by a context.
+// The timeouts in the config of the channel still apply, with the
+// earlier of the timeout and the context deadline being used.
+// Receive and Send are equivalent to ReceiveContext and SendContext
+// with context.Background().
+type ContextChannel interface {
+	Channel
+	ReceiveContext(ctx context.Context, data []byte) (uint64, error)
+	SendContext(ctx context.Context, data []byte) (uint64, error)
+}
+
+// A covert channel that communicates with a group of peers rather than a single friend
+// Peers are identified by their index in the list of peers, with the friend of
+// the channel first (see Peers). Send sends to the friend, while Receive receives
+// from any peer. Every peer uses the same ports.
+type PeerChannel interface {
+	ContextChannel
+	// The names of the peers
+	Peers() []string
+	// Send a covert message to one of the peers
+	SendTo(ctx context.Context, peer int, data []byte) (uint64, error)
+	// Receive a covert message from any of the peers
+	// Returns the index of the peer that sent the message
+	ReceiveFrom(ctx context.Context, data []byte) (uint64, int, error)
+}
+
+// A covert channel that counts the packets its messages are made of
+// A single Send or Receive may use many packets, depending on the embedder,
+// so these counts can be used to compare the cost of different embedders.
+type PacketCounter interface {
+	// The number of packets written and read since the channel was created
+	Packets() (written uint64, read uint64)
+}
+
+// The packet counts of a channel, for implementing PacketCounter
+// It is safe for concurrent use, since sends and receives may be concurrent.
+type PacketCount struct {
+	written uint64
+	read    uint64
+	lock    sync.Mutex
+}
+
+// Record packets written by the channel
+func (pc *PacketCount) AddWritten(n uint64) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	pc.written += n
+}
+
+// Record packets of messages read by the channel
+func (pc *PacketCount) AddRead(n uint64) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	pc.read += n
+}
+
+func (pc *PacketCount) Packets() (uint64, uint64) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	return pc.written, pc.read
+}
+
+// The name of the peer at the FriendIP of a channel
+const FriendPeer = "friend"
+
+// The peers of a channel, starting with its friend
+type Peers []config.Peer
+
+// Create the list of peers from the friend of a channel and the other peers in its config
+func MakePeers(friendIP [4]byte, peers []config.Peer) (Peers, error) {
+	var ps Peers = Peers{{Name: FriendPeer, IP: friendIP}}
+	for _, p := range peers {
+		if p.Name == FriendPeer {
+			return nil, errors.New("The peer name " + FriendPeer + " is reserved for the FriendIP")
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// The index of the peer with an IP address, or -1 if it is not a peer
+// The friend is found first if other peers share its address
+func (ps Peers) Index(ip net.IP) int {
+	if ip = ip.To4(); ip == nil {
+		return -1
+	}
+	for i, p := range ps {
+		if ip.Equal(p.IP[:]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// The names of the peers
+func (ps Peers) Names() []string {
+	var names []string = make([]string, len(ps))
+	for i, p := range ps {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// Check that a peer index is in range
+func (ps Peers) Valid(peer int) error {
+	if peer < 0 || peer >= len(ps) {
+		return errors.New("Invalid peer index")
+	}
+	return nil
+}
+
+var channels *registry.Registry = registry.New("Channel", reflect.TypeOf((*Channel)(nil)).Elem())
+
+// Check that both receive ports of a channel can be listened on
+// A friend on the loopback interface is on the same host, where
+// the two ends of the channel cannot listen on the same port.
+// This is for the ValidateAll method of a ConfigClient (see config.AllValidator)
+// with FriendReceivePort and OriginReceivePort fields.
+func ReceivePortErrors(friendIP config.IPV4Param, friendPort config.U16Param, originPort config.U16Param) config.FieldErrors {
+	ip, err := friendIP.GetValue()
+	if err != nil || !net.IP(ip[:]).IsLoopback() || friendPort.Value != originPort.Value {
+		return nil
+	}
+	const msg = "Your friend is on this host, so your receive ports must differ"
+	return config.FieldErrors{"FriendReceivePort": msg, "OriginReceivePort": msg}
+}
+
+// Make a covert channel available to the controller
+// This should be called from the init function of the channel's package:
+//
+//	func init() {
+//		channel.Register("TcpSyn", GetDefault, ToChannel)
+//	}
+//
+// getDefault must be a func() ConfigClient and toChannel a func(ConfigClient) (*Channel, error),
+// where ConfigClient is the struct of config params for the channel.
+func Register(name string, getDefault interface{}, toChannel interface{}) {
+	channels.Register(name, getDefault, toChannel)
+}
+
+// The names of every registered covert channel, in alphabetical order
+func Names() []string {
+	return channels.Names()
+}
+
+// Retrieve a pointer to the default ConfigClient of a covert channel
+func GetDefault(name string) (interface{}, error) {
+	return channels.GetDefault(name)
+}
+
+// Create a covert channel from its ConfigClient
+func ToChannel(name string, conf interface{}) (Channel, error) {
+	if c, err := channels.Create(name, conf); err != nil {
+		return nil, err
+	} else {
+		return c.(Channel), nil
+	}
+}
+
+// The deadline of an operation given both a timeout and a context
+// The earlier of the context deadline and the timeout from now is returned.
+// A zero timeout means no timeout, and the zero time (no deadline) is
+// returned if there is neither a timeout nor a context deadline.
+func Deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return deadline
+}
+
+// Set the deadline of a blocking operation on a connection,
+// such as the SetReadDeadline method of a net.Conn, using Deadline.
+// If the context is cancelled before the operation is complete, the
+// deadline is moved to the past to interrupt the operation.
+// The returned function must be called once the operation is complete.
+func SetDeadline(ctx context.Context, timeout time.Duration, setDeadline func(time.Time) error) func() {
+	setDeadline(Deadline(ctx, timeout))
+	if ctx.Done() == nil {
+		// The context can never be cancelled
+		return func() {}
+	}
+	var (
+		done    chan interface{} = make(chan interface{})
+		stopped chan interface{} = make(chan interface{})
+	)
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			setDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	// We wait for the go routine to exit so that it cannot
+	// interrupt a later operation on the same connection
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// The error of an operation that may have been interrupted by a context
+// If the context is done, its error is returned in place of the error
+// of the interrupted operation (usually a timeout).
+func ContextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -124,6 +124,11 @@ func (c *Channel) Close() error {
 
 //receive information from another computer in the form of data in a byte array
 func (c *Channel) Receive(data []byte) (uint64, error) {
+	return c.ReceiveContext(context.Background(), data)
+}
+
+//receive information, returning early if the context is done
+func (c *Channel) ReceiveContext(ctx context.Context, data []byte) (uint64, error) {
 
 	// if the user is a server type computer
 	if c.conf.UserType == Server {
@@ -142,6 +147,8 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 				}
 			case <-c.cancel:
 				return 0, errors.New("Channel closed")
+			case <-ctx.Done():
+				return 0, ctx.Err()
 			}
 			// this is with timeout
 		} else {
@@ -157,12 +164,14 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 				return 0, errors.New("Read Timeout")
 			case <-c.cancel:
 				return 0, errors.New("Channel closed")
+			case <-ctx.Done():
+				return 0, ctx.Err()
 			}
 		}
 
 		// if the user is client type computer
 	} else {
-		n, success, err := c.clientRequest(data)
+		n, success, err := c.clientRequest(ctx, data)
 		if success || err != nil {
 			return n, err
 		} else {
@@ -176,19 +185,21 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 					for {
 						select {
 						case <-ticker.C:
-							n, success, err := c.clientRequest(data)
+							n, success, err := c.clientRequest(ctx, data)
 							if success || err != nil {
 								return n, err
 							}
 						case <-c.cancel:
 							return 0, errors.New("Channel closed")
+						case <-ctx.Done():
+							return 0, ctx.Err()
 						}
 					}
 				} else {
 					for {
 						select {
 						case <-ticker.C:
-							n, success, err := c.clientRequest(data)
+							n, success, err := c.clientRequest(ctx, data)
 							if success || err != nil {
 								return n, err
 							}
@@ -196,6 +207,8 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 							return 0, errors.New("Client Timeout")
 						case <-c.cancel:
 							return 0, errors.New("Channel closed")
+						case <-ctx.Done():
+							return 0, ctx.Err()
 						}
 					}
 				}
@@ -208,6 +221,11 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 
 // send information to another computer in the form of data in a byte array
 func (c *Channel) Send(data []byte) (uint64, error) {
+	return c.SendContext(context.Background(), data)
+}
+
+// send information, returning early if the context is done
+func (c *Channel) SendContext(ctx context.Context, data []byte) (uint64, error) {
 
 	//copy the data into a new slice so that even if the original slice is modified,
 	// the data sent on the channel will stay the same
@@ -226,6 +244,8 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 				return uint64(len(dataCopy)), nil
 			case <-c.cancel:
 				return 0, errors.New("Channel closed")
+			case <-ctx.Done():
+				return 0, ctx.Err()
 			}
 
 			//this is with timeout
@@ -237,6 +257,8 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 				return 0, errors.New("Write Timeout")
 			case <-c.cancel:
 				return 0, errors.New("Channel closed")
+			case <-ctx.Done():
+				return 0, ctx.Err()
 			}
 		}
 
@@ -248,7 +270,10 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 
 		client := &http.Client{}
 
-		req, err := http.NewRequest("POST", "http://"+addr.String()+"/", nil)
+		req, err := http.NewRequestWithContext(ctx, "POST", "http://"+addr.String()+"/", nil)
+		if err != nil {
+			return 0, err
+		}
 
 		req.Header.Add("Cookie", string(data))
 
@@ -264,9 +289,13 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 	}
 }
 
-func (c *Channel) clientRequest(data []byte) (uint64, bool, error) {
+func (c *Channel) clientRequest(ctx context.Context, data []byte) (uint64, bool, error) {
 	addr := &net.TCPAddr{IP: c.conf.FriendIP[:], Port: int(c.conf.FriendPort)}
-	resp, err := http.Get("http://" + addr.String() + "/")
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+addr.String()+"/", nil)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := http.DefaultClient.Do(req)
 
 	//as long as there is no error
 	//extract the information from the body of the reponse message
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"time"
 
+	"../../channel"
 	"../../config"
 )
 
@@ -19,6 +20,10 @@ type ConfigClient struct {
 	WriteTimeout   config.U64Param
 }
 
+func init() {
+	channel.Register("HttpCovert", GetDefault, ToChannel)
+}
+
 func GetDefault() ConfigClient {
 	return ConfigClient{
 		FriendIP:       config.MakeIPV4("127.0.0.1", config.Display{Description: "Your friend's IP address.", Name: "Friend's IP", Group: "IP Addresses"}),
@@ -1,6 +1,8 @@
 package httpNormal
 
 import (
+	"../../channel"
+	"../../config"
 	"bytes"
 	"context"
 	"errors"
@@ -31,18 +33,28 @@ type Config struct {
 	ClientTimeout  time.Duration
 	ReadTimeout    time.Duration
 	WriteTimeout   time.Duration
+	// Other friends that messages can be sent to and received from
+	Peers []config.Peer
+}
+
+// A message posted to the server by one of the peers
+type received struct {
+	data []byte
+	peer int
 }
 
 // A HTTP covert channel
 type Channel struct {
-	conf Config
-	srv  *http.Server
-	clt  *http.Client
+	conf  Config
+	peers channel.Peers
+	srv   *http.Server
+	clt   *http.Client
 
 	cancel chan bool
 
-	serverSendBuf chan []byte
-	serverRecBuf  chan []byte
+	// The messages waiting to be fetched by each peer
+	serverSendBufs []chan []byte
+	serverRecBuf   chan received
 }
 
 // Create the covert channel, filling in the SeqEncoder
@@ -51,7 +63,12 @@ type Channel struct {
 // that this function may one day be used for validating
 // the data structure
 func MakeChannel(conf Config) (*Channel, error) {
+	var err error
+
 	c := &Channel{conf: conf, cancel: make(chan bool)}
+	if c.peers, err = channel.MakePeers(conf.FriendIP, conf.Peers); err != nil {
+		return nil, err
+	}
 
 	// if the channel has been specified as the server
 	if c.conf.UserType == Server {
@@ -70,20 +87,48 @@ func MakeChannel(conf Config) (*Channel, error) {
 		go func() { c.srv.Serve(l) }()
 
 		//buffers used to hold the server sent messages and received messages
-		c.serverSendBuf = make(chan []byte, maxMsg)
-		c.serverRecBuf = make(chan []byte, maxMsg)
+		for range c.peers {
+			c.serverSendBufs = append(c.serverSendBufs, make(chan []byte, maxMsg))
+		}
+		c.serverRecBuf = make(chan received, maxMsg)
+	} else {
+		// Requests are sent from the origin IP so that the server can tell who sent them
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: c.conf.OriginIP[:]}}
+		c.clt = &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
 	}
 	return c, nil
 }
 
+func (c *Channel) Peers() []string {
+	return c.peers.Names()
+}
+
+// The URL of the server of a peer
+func (c *Channel) peerURL(peer int) string {
+	addr := &net.TCPAddr{IP: c.peers[peer].IP[:], Port: int(c.conf.FriendPort)}
+	return "http://" + addr.String() + "/"
+}
+
 //Handler function that is called everytime a new http request is received
 func (c *Channel) handleFunc(w http.ResponseWriter, r *http.Request) {
 
+	//requests from addresses that are not peers are refused
+	peer := -1
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			peer = c.peers.Index(ip)
+		}
+	}
+	if peer < 0 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	//if the request message is a get request
 	//extract the data from the servers send buffer and send it to the client
 	if r.Method == "GET" {
 		select {
-		case data := <-c.serverSendBuf:
+		case data := <-c.serverSendBufs[peer]:
 			w.Header().Add("Valid", "1")
 			io.WriteString(w, string(data))
 		case <-time.After(time.Millisecond * 50):
@@ -99,7 +144,7 @@ func (c *Channel) handleFunc(w http.ResponseWriter, r *http.Request) {
 		buf := bytes.Buffer{}
 		buf.ReadFrom(r.Body)
 		select {
-		case c.serverRecBuf <- buf.Bytes():
+		case c.serverRecBuf <- received{data: buf.Bytes(), peer: peer}:
 		case <-time.After(time.Millisecond * 50):
 			//log.Println("POST Request timeout")
 		case <-c.cancel:
@@ -127,6 +172,18 @@ func (c *Channel) Close() error {
 
 //receive information from another computer in the form of data in a byte array
 func (c *Channel) Receive(data []byte) (uint64, error) {
+	return c.ReceiveContext(context.Background(), data)
+}
+
+//receive information, returning early if the context is done
+func (c *Channel) ReceiveContext(ctx context.Context, data []byte) (uint64, error) {
+	n, _, err := c.ReceiveFrom(ctx, data)
+	return n, err
+}
+
+// Receive a message from any peer
+// The client polls the server of each peer in turn
+func (c *Channel) ReceiveFrom(ctx context.Context, data []byte) (uint64, int, error) {
 
 	// if the user is a server type computer
 	if c.conf.UserType == Server {
@@ -136,38 +193,42 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 		//this is without timeout
 		if c.conf.ReadTimeout == 0 {
 			select {
-			case httpdata := <-c.serverRecBuf:
-				copy(data, httpdata)
-				if len(httpdata) > len(data) {
-					return uint64(len(data)), errors.New("Buffer overflow")
+			case msg := <-c.serverRecBuf:
+				copy(data, msg.data)
+				if len(msg.data) > len(data) {
+					return uint64(len(data)), msg.peer, errors.New("Buffer overflow")
 				} else {
-					return uint64(len(httpdata)), nil
+					return uint64(len(msg.data)), msg.peer, nil
 				}
 			case <-c.cancel:
-				return 0, errors.New("Channel closed")
+				return 0, 0, errors.New("Channel closed")
+			case <-ctx.Done():
+				return 0, 0, ctx.Err()
 			}
 			// this is with timeout
 		} else {
 			select {
-			case httpdata := <-c.serverRecBuf:
-				copy(data, httpdata)
-				if len(httpdata) > len(data) {
-					return uint64(len(data)), errors.New("Buffer overflow")
+			case msg := <-c.serverRecBuf:
+				copy(data, msg.data)
+				if len(msg.data) > len(data) {
+					return uint64(len(data)), msg.peer, errors.New("Buffer overflow")
 				} else {
-					return uint64(len(httpdata)), nil
+					return uint64(len(msg.data)), msg.peer, nil
 				}
 			case <-time.After(c.conf.ReadTimeout):
-				return 0, errors.New("Read Timeout")
+				return 0, 0, errors.New("Read Timeout")
 			case <-c.cancel:
-				return 0, errors.New("Channel closed")
+				return 0, 0, errors.New("Channel closed")
+			case <-ctx.Done():
+				return 0, 0, ctx.Err()
 			}
 		}
 
 		// if the user is client type computer
 	} else {
-		n, success, err := c.clientRequest(data)
+		n, peer, success, err := c.clientPoll(ctx, data)
 		if success || err != nil {
-			return n, err
+			return n, peer, err
 		} else {
 			if c.conf.ClientPollRate > 0 {
 				// Loop while making requests
@@ -178,31 +239,35 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 					for {
 						select {
 						case <-ticker.C:
-							n, success, err := c.clientRequest(data)
+							n, peer, success, err := c.clientPoll(ctx, data)
 							if success || err != nil {
-								return n, err
+								return n, peer, err
 							}
 						case <-c.cancel:
-							return 0, errors.New("Channel closed")
+							return 0, 0, errors.New("Channel closed")
+						case <-ctx.Done():
+							return 0, 0, ctx.Err()
 						}
 					}
 				} else {
 					for {
 						select {
 						case <-ticker.C:
-							n, success, err := c.clientRequest(data)
+							n, peer, success, err := c.clientPoll(ctx, data)
 							if success || err != nil {
-								return n, err
+								return n, peer, err
 							}
 						case <-time.After(c.conf.ClientTimeout):
-							return 0, errors.New("Client Timeout")
+							return 0, 0, errors.New("Client Timeout")
 						case <-c.cancel:
-							return 0, errors.New("Channel closed")
+							return 0, 0, errors.New("Channel closed")
+						case <-ctx.Done():
+							return 0, 0, ctx.Err()
 						}
 					}
 				}
 			} else {
-				return n, errors.New("No message on server")
+				return n, peer, errors.New("No message on server")
 			}
 		}
 	}
@@ -210,6 +275,19 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 
 // send information to another computer in the form of data in a byte array
 func (c *Channel) Send(data []byte) (uint64, error) {
+	return c.SendContext(context.Background(), data)
+}
+
+// send information, returning early if the context is done
+func (c *Channel) SendContext(ctx context.Context, data []byte) (uint64, error) {
+	return c.SendTo(ctx, 0, data)
+}
+
+// send information to one of the peers
+func (c *Channel) SendTo(ctx context.Context, peer int, data []byte) (uint64, error) {
+	if err := c.peers.Valid(peer); err != nil {
+		return 0, err
+	}
 
 	//copy the data into a new slice so that even if the original slice is modified,
 	// the data sent on the channel will stay the same
@@ -224,21 +302,25 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 		//this is without timeout
 		if c.conf.WriteTimeout == 0 {
 			select {
-			case c.serverSendBuf <- dataCopy:
+			case c.serverSendBufs[peer] <- dataCopy:
 				return uint64(len(dataCopy)), nil
 			case <-c.cancel:
 				return 0, errors.New("Channel closed")
+			case <-ctx.Done():
+				return 0, ctx.Err()
 			}
 
 			//this is with timeout
 		} else {
 			select {
-			case c.serverSendBuf <- dataCopy:
+			case c.serverSendBufs[peer] <- dataCopy:
 				return uint64(len(dataCopy)), nil
 			case <-time.After(c.conf.WriteTimeout):
 				return 0, errors.New("Write Timeout")
 			case <-c.cancel:
 				return 0, errors.New("Channel closed")
+			case <-ctx.Done():
+				return 0, ctx.Err()
 			}
 		}
 
@@ -246,12 +328,21 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 	} else {
 
 		//post the http request message
-		addr := &net.TCPAddr{IP: c.conf.FriendIP[:], Port: int(c.conf.FriendPort)}
-		_, err := http.Post("http://"+addr.String()+"/", "text/plain", bytes.NewBuffer(dataCopy))
+		req, err := http.NewRequestWithContext(ctx, "POST", c.peerURL(peer), bytes.NewBuffer(dataCopy))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Content-Type", "text/plain")
+
+		resp, err := c.clt.Do(req)
 
 		//as long as there is no error
 		//return an integer with the length of the data to be sent
 		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return 0, errors.New("Request refused: " + resp.Status)
+			}
 			return uint64(len(dataCopy)), nil
 		} else {
 			return 0, err
@@ -259,14 +350,42 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 	}
 }
 
-func (c *Channel) clientRequest(data []byte) (uint64, bool, error) {
-	addr := &net.TCPAddr{IP: c.conf.FriendIP[:], Port: int(c.conf.FriendPort)}
-	resp, err := http.Get("http://" + addr.String() + "/")
+// Request a message from the server of each peer in turn
+// An error is only returned if no peer could be reached
+func (c *Channel) clientPoll(ctx context.Context, data []byte) (uint64, int, bool, error) {
+	var lastErr error
+	reached := false
+	for peer := range c.peers {
+		n, success, err := c.clientRequest(ctx, peer, data)
+		if success {
+			return n, peer, true, err
+		}
+		if err != nil {
+			lastErr = err
+		} else {
+			reached = true
+		}
+	}
+	if reached {
+		return 0, 0, false, nil
+	}
+	return 0, 0, false, lastErr
+}
+
+func (c *Channel) clientRequest(ctx context.Context, peer int, data []byte) (uint64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.peerURL(peer), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := c.clt.Do(req)
 
 	//as long as there is no error
 	//extract the information from the body of the reponse message
 	if err == nil {
-		if resp.Header.Get("Valid") == "1" {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return 0, false, errors.New("Request refused: " + resp.Status)
+		} else if resp.Header.Get("Valid") == "1" {
 			buf := bytes.Buffer{}
 			buf.ReadFrom(resp.Body)
 			copy(data, buf.Bytes())
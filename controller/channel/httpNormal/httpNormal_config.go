@@ -4,6 +4,7 @@ import (
 	"errors"
 	"time"
 
+	"../../channel"
 	"../../config"
 )
 
@@ -17,6 +18,11 @@ type ConfigClient struct {
 	ClientTimeout  config.U64Param
 	ReadTimeout    config.U64Param
 	WriteTimeout   config.U64Param
+	Peers          config.PeersParam
+}
+
+func init() {
+	channel.Register("HttpNormal", GetDefault, ToChannel)
 }
 
 func GetDefault() ConfigClient {
@@ -30,6 +36,7 @@ func GetDefault() ConfigClient {
 		ClientTimeout:  config.MakeU64(0, [2]uint64{0, 65535}, config.Display{Description: "The client timeout in milliseconds.", Name: "Client Timeout", Group: "Timing"}),
 		WriteTimeout:   config.MakeU64(0, [2]uint64{0, 65535}, config.Display{Description: "The write timeout in milliseconds.", Name: "Write Timeout", Group: "Timing"}),
 		ReadTimeout:    config.MakeU64(0, [2]uint64{0, 65535}, config.Display{Description: "The read timeout in milliseconds.", Name: "Read Timeout", Group: "Timing"}),
+		Peers:          config.MakePeers("", config.Display{Description: "Other friends to send to and receive from, as name=IP on each line. They use the same ports as your friend.", Name: "Peers", Group: "IP Addresses"}),
 	}
 }
 
@@ -52,6 +59,9 @@ func ToChannel(cc ConfigClient) (*Channel, error) {
 	c.ClientTimeout = time.Duration(cc.ClientTimeout.Value) * time.Millisecond
 	c.ReadTimeout = time.Duration(cc.ReadTimeout.Value) * time.Millisecond
 	c.WriteTimeout = time.Duration(cc.WriteTimeout.Value) * time.Millisecond
+	if c.Peers, err = cc.Peers.GetValue(); err != nil {
+		return nil, errors.New("Invalid Peers value")
+	}
 
 	switch cc.UserType.Value {
 	case "client":
@@ -1,8 +1,11 @@
 package httpNormal
 
 import (
+	"../../config"
 	"bytes"
+	"context"
 	"log"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -132,6 +135,80 @@ func TestReceiveSendPost(t *testing.T) {
 	}
 }
 
+// A server with peers must send to each peer separately, report which peer
+// sent each message, and refuse requests from other addresses
+func TestPeers(t *testing.T) {
+
+	log.Println("Starting TestPeers")
+
+	group, err := MakeChannel(Config{
+		FriendIP:   [4]byte{127, 0, 0, 2},
+		OriginIP:   [4]byte{127, 0, 0, 1},
+		FriendPort: 4001,
+		OriginPort: 4000,
+		UserType:   Server,
+		Peers:      []config.Peer{{Name: "carol", IP: [4]byte{127, 0, 0, 3}}},
+	})
+	if err != nil {
+		t.Fatalf("err = '%s'; want nil", err.Error())
+	}
+	defer group.Close()
+	if peers := group.Peers(); !reflect.DeepEqual(peers, []string{"friend", "carol"}) {
+		t.Errorf("peers = %v; want [friend carol]", peers)
+	}
+
+	var members []*Channel
+	for _, ip := range [][4]byte{{127, 0, 0, 2}, {127, 0, 0, 3}, {127, 0, 0, 4}} {
+		rconfcopy := rconf
+		rconfcopy.OriginIP = ip
+		rconfcopy.FriendPort = 4000
+		rconfcopy.ClientPollRate = time.Millisecond * 50
+		ch, err := MakeChannel(rconfcopy)
+		if err != nil {
+			t.Fatalf("err = '%s'; want nil", err.Error())
+		}
+		defer ch.Close()
+		members = append(members, ch)
+	}
+
+	var data [15]byte
+	for peer, input := range []string{"Hello friend", "Hello carol"} {
+		if _, err := group.SendTo(context.Background(), peer, []byte(input)); err != nil {
+			t.Errorf("err = '%s'; want nil", err.Error())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		n, from, err := members[peer].ReceiveFrom(ctx, data[:])
+		cancel()
+		if err != nil || string(data[:n]) != input || from != 0 {
+			t.Errorf("received = %s from %d, %v; want %s from 0", string(data[:n]), from, err, input)
+		}
+	}
+	if _, err := group.SendTo(context.Background(), 2, []byte("Hello")); err == nil {
+		t.Errorf("err = nil; want invalid peer error")
+	}
+
+	// The last member is not a peer of the group
+	if _, err := members[2].Send([]byte{2}); err == nil {
+		t.Errorf("err = nil; want refused request error")
+	}
+	if _, err := members[2].Receive(data[:]); err == nil {
+		t.Errorf("err = nil; want refused request error")
+	}
+	for _, peer := range []int{1, 0} {
+		if _, err := members[peer].Send([]byte{byte(peer)}); err != nil {
+			t.Errorf("err = '%s'; want nil", err.Error())
+		}
+	}
+	for _, peer := range []int{1, 0} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		n, from, err := group.ReceiveFrom(ctx, data[:])
+		cancel()
+		if err != nil || n != 1 || data[0] != byte(peer) || from != peer {
+			t.Errorf("received %v from %d, %v; want [%d] from %d", data[:n], from, err, peer, peer)
+		}
+	}
+}
+
 func sendAndCheck(t *testing.T, input []byte, sch *Channel) {
 	n, err := sch.Send(input)
 	if err != nil {
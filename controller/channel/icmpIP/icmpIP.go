@@ -1,8 +1,10 @@
 package icmpIP
 
 import (
+	"../../channel"
+	"../../config"
 	"../embedders"
-	"bytes"
+	"context"
 	"errors"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -25,16 +27,37 @@ type Config struct {
 	// The timeout for writing the packet to a raw socket. Set zero for no timeout.
 	WriteTimeout time.Duration
 	Identifier   uint16
+	// Other friends that messages can be sent to and received from
+	Peers []config.Peer
+}
+
+// The number of packets from other peers that may be held back while
+// receiving a message, before they begin to be dropped
+const maxHeld = 1024
+
+// A packet read from the raw socket
+type rawPacket struct {
+	h *ipv4.Header
+	p []byte
 }
 
 type Channel struct {
 	conf    Config
+	peers   channel.Peers
 	rawConn *ipv4.RawConn
 	cancel  chan bool
 
 	// We make the mutex a pointer to avoid the risk of copying
 	writeMutex *sync.Mutex
 	closeMutex *sync.Mutex
+
+	// Packets from other peers that arrived while a message was being received
+	// They are read before the raw socket by the next receive
+	// This must only be accessed by the receive method
+	held []rawPacket
+
+	// The packets written and read, for channel.PacketCounter
+	channel.PacketCount
 }
 
 func (c *Channel) Close() error {
@@ -64,6 +87,11 @@ func MakeChannel(conf Config) (*Channel, error) {
 		c.conf.Embedder = &IDEncoder{}
 	}
 
+	var err error
+	if c.peers, err = channel.MakePeers(conf.FriendIP, conf.Peers); err != nil {
+		return nil, err
+	}
+
 	//ip network within the ICMP protocol
 	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
 	if err != nil {
@@ -79,15 +107,34 @@ func MakeChannel(conf Config) (*Channel, error) {
 	return c, nil
 }
 
+func (c *Channel) Peers() []string {
+	return c.peers.Names()
+}
+
 func (c *Channel) Send(data []byte) (uint64, error) {
+	return c.SendContext(context.Background(), data)
+}
+
+// Send a covert message, stopping before the next packet if the context is done
+func (c *Channel) SendContext(ctx context.Context, data []byte) (uint64, error) {
+	return c.SendTo(ctx, 0, data)
+}
+
+// Send a covert message to one of the peers
+func (c *Channel) SendTo(ctx context.Context, peer int, data []byte) (uint64, error) {
+	if err := c.peers.Valid(peer); err != nil {
+		return 0, err
+	}
+	var friendIP [4]byte = c.peers[peer].IP
+
 	data, err := embedders.EncodeFromMask(c.conf.Embedder.GetMask(), data)
 	if err != nil {
 		return 0, err
 	}
 
 	var (
-		ipv4h ipv4.Header         = createIPHeader(c.conf.OriginIP, c.conf.FriendIP)
-		cm    ipv4.ControlMessage = createCM(c.conf.OriginIP, c.conf.FriendIP)
+		ipv4h ipv4.Header         = createIPHeader(c.conf.OriginIP, friendIP)
+		cm    ipv4.ControlMessage = createCM(c.conf.OriginIP, friendIP)
 		icmph layers.ICMPv4
 		wbuf  []byte
 		rem   []byte = data
@@ -97,6 +144,9 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 
 	// Send each packet
 	for len(rem) > 0 {
+		if err = ctx.Err(); err != nil {
+			break
+		}
 
 		var payload []byte = make([]byte, 26) //set payload of length 26
 		if ipv4h, icmph, rem, state, err = c.conf.Embedder.SetByte(ipv4h, icmph, rem, state); err != nil {
@@ -107,7 +157,7 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 			break
 		}
 
-		if err = c.sendPacket(&ipv4h, wbuf, &cm); err != nil {
+		if err = c.sendPacket(ctx, &ipv4h, wbuf, &cm); err != nil {
 			break
 		}
 		state = state.IncrementState()
@@ -126,7 +176,7 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 		return n, err
 	}
 
-	err = c.sendPacket(&ipv4h, wbuf, &cm)
+	err = c.sendPacket(ctx, &ipv4h, wbuf, &cm)
 	return n, nil
 }
 
@@ -149,17 +199,36 @@ func createicmpheader(icmph layers.ICMPv4, payload []byte, identifier uint16) ([
 }
 
 func (c *Channel) Receive(data []byte) (uint64, error) {
+	return c.ReceiveContext(context.Background(), data)
+}
+
+// Receive a covert message, returning early if the context is done
+func (c *Channel) ReceiveContext(ctx context.Context, data []byte) (uint64, error) {
+	n, _, err := c.ReceiveFrom(ctx, data)
+	return n, err
+}
+
+// Receive a covert message from any peer
+// The message is read from the first peer to send a packet. Packets from
+// other peers are held back until the message is complete, so that their
+// messages can be read by the following receives.
+func (c *Channel) ReceiveFrom(ctx context.Context, data []byte) (uint64, int, error) {
 
 	// We must expand out the input storage array to
 	// the correct size to potentially handle variable size inputs
 	dataBuf, err := embedders.GetBuf(c.conf.Embedder.GetMask(), data)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	var (
-		buf   []byte = make([]byte, 1024)
-		saddr [4]byte
+		buf []byte = make([]byte, 1024)
+		// The peer sending the message, once its first packet has arrived
+		peer int = -1
+		// The held packets that have not yet been read, followed by
+		// the packets held back during this receive
+		queue []rawPacket = c.held
+		held  []rawPacket
 		// There is guaranteed to be at least one space for a byte in the
 		// data buffer at this point
 		pos uint64 = 0
@@ -175,21 +244,29 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 		state          embedders.State = embedders.MakeState(c.conf.Embedder.GetMask())
 	)
 
-	saddr = c.conf.FriendIP
+	c.held = nil
 
 	prevPacketTime = time.Now()
 
 	for {
-		h, p, _, err = c.readConn(buf)
-
-		if err != nil {
+		if len(queue) > 0 {
+			h, p, queue = queue[0].h, queue[0].p, queue[1:]
+		} else if h, p, _, err = c.readConn(ctx, buf); err != nil {
 			break
 		}
 		icmph := layers.ICMPv4{}
 		if err = icmph.DecodeFromBytes(p, gopacket.NilDecodeFeedback); err == nil {
-			// We check for the expected source IP, source port, and destination port
-			if bytes.Equal(h.Src.To4(), saddr[:]) {
+			// We check for the IP of a peer, the identifier, and the type
+			if from := c.peers.Index(h.Src); from >= 0 {
 				if icmph.Id == c.conf.Identifier && icmph.TypeCode == layers.CreateICMPv4TypeCode(1, 0) {
+					if peer >= 0 && from != peer { //part of another peer's message
+						if len(held) < maxHeld {
+							held = append(held, rawPacket{h: h, p: append([]byte{}, p...)})
+						}
+						continue
+					}
+					peer = from
+					c.AddRead(1)
 					if len(p) == 8 { //end of message
 						break
 					} else { //the rest of the message
@@ -219,30 +296,30 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 			break
 		}
 	}
-	return embedders.CopyData(c.conf.Embedder.GetMask(), pos, dataBuf, data, err)
+	c.held = append(held, queue...)
+	if peer < 0 {
+		peer = 0
+	}
+	n, err := embedders.CopyData(c.conf.Embedder.GetMask(), pos, dataBuf, data, err)
+	return n, peer, err
 }
 
-func (c *Channel) sendPacket(h *ipv4.Header, b []byte, cm *ipv4.ControlMessage) error {
-	if c.conf.WriteTimeout > 0 {
-		c.rawConn.SetWriteDeadline(time.Now().Add(c.conf.WriteTimeout))
-	} else {
-		// A deadline of zero means never timeout
-		// The initial Time struct is zero
-		c.rawConn.SetWriteDeadline(time.Time{})
+// A deadline of zero means never timeout
+func (c *Channel) sendPacket(ctx context.Context, h *ipv4.Header, b []byte, cm *ipv4.ControlMessage) error {
+	c.rawConn.SetWriteDeadline(channel.Deadline(ctx, c.conf.WriteTimeout))
+	if err := c.rawConn.WriteTo(h, b, cm); err != nil {
+		return channel.ContextError(ctx, err)
 	}
-	return c.rawConn.WriteTo(h, b, cm)
+	c.AddWritten(1)
+	return nil
 }
 
 // Read from a raw connection whil setting a timeout if necessary
-func (c *Channel) readConn(buf []byte) (*ipv4.Header, []byte, *ipv4.ControlMessage, error) {
-	if c.conf.ReadTimeout > 0 {
-		c.rawConn.SetReadDeadline(time.Now().Add(c.conf.ReadTimeout))
-	} else {
-		// A deadline of zero means never timeout
-		// The initial Time struct is zero
-		c.rawConn.SetReadDeadline(time.Time{})
-	}
-	return c.rawConn.ReadFrom(buf)
+// The read is interrupted if the context is done
+func (c *Channel) readConn(ctx context.Context, buf []byte) (*ipv4.Header, []byte, *ipv4.ControlMessage, error) {
+	defer channel.SetDeadline(ctx, c.conf.ReadTimeout, c.rawConn.SetReadDeadline)()
+	h, p, cm, err := c.rawConn.ReadFrom(buf)
+	return h, p, cm, channel.ContextError(ctx, err)
 }
 
 // Creates the ip header message
@@ -1,6 +1,7 @@
 package icmpIP
 
 import (
+	"../../channel"
 	"../../config"
 	"errors"
 	"time"
@@ -13,6 +14,11 @@ type ConfigClient struct {
 	WriteTimeout config.U64Param
 	ReadTimeout  config.U64Param
 	Identifier   config.U16Param
+	Peers        config.PeersParam
+}
+
+func init() {
+	channel.Register("IcmpIP", GetDefault, ToChannel)
 }
 
 func GetDefault() ConfigClient {
@@ -23,12 +29,20 @@ func GetDefault() ConfigClient {
 		ReadTimeout:  config.MakeU64(0, [2]uint64{0, 65535}, config.Display{Description: "The read timeout in milliseconds.", Name: "Read Timeout", Group: "Timing"}),
 		Embedder:     config.MakeSelect("id", []string{"id"}, config.Display{Description: "The embedding mechanism to use for this protocol.", Name: "Embeddingcbc", Group: "Settings"}),
 		Identifier:   config.MakeU16(1234, [2]uint16{0, 65535}, config.Display{Description: "A unique key to distingish covert ICMP packets from other ICMP packets", Name: "Identifier", Group: "Timing"}),
+		Peers:        config.MakePeers("", config.Display{Description: "Other friends to send to and receive from, as name=IP on each line.", Name: "Peers", Group: "IP Addresses"}),
 	}
 }
 
 func ToChannel(cc ConfigClient) (*Channel, error) {
 	var c Config
 	var friendIP, originIP [4]byte
+	var err error
+	if friendIP, err = cc.FriendIP.GetValue(); err != nil {
+		return nil, errors.New("Invalid FriendIP value")
+	}
+	if originIP, err = cc.OriginIP.GetValue(); err != nil {
+		return nil, errors.New("Invalid OriginIP value")
+	}
 
 	c.FriendIP = friendIP
 	c.OriginIP = originIP
@@ -36,6 +50,9 @@ func ToChannel(cc ConfigClient) (*Channel, error) {
 	c.ReadTimeout = time.Duration(cc.ReadTimeout.Value) * time.Millisecond
 	c.WriteTimeout = time.Duration(cc.WriteTimeout.Value) * time.Millisecond
 	c.Identifier = cc.Identifier.Value
+	if c.Peers, err = cc.Peers.GetValue(); err != nil {
+		return nil, errors.New("Invalid Peers value")
+	}
 
 	switch cc.Embedder.Value {
 	case "id":
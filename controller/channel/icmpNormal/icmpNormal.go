@@ -1,6 +1,9 @@
 package icmpNormal
 
 import (
+	"../../channel"
+	"../../config"
+	"context"
 	"errors"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -13,26 +16,32 @@ type Config struct {
 	OriginIP        [4]byte
 	DestinationPort uint16
 	OriginPort      uint16
+	// Other friends that messages can be sent to and received from
+	Peers []config.Peer
 }
 
 // This is a normal, non-covert IMCP messaging channel
 // The message is sent using normal simiply ICMP packets
 type Channel struct {
-	conf       Config
-	clientConn net.Conn
-	rawConn    *ipv4.RawConn
+	conf  Config
+	peers channel.Peers
+	// The conn used to send to each peer
+	clientConns []net.Conn
+	rawConn     *ipv4.RawConn
+
+	// The packets written and read, for channel.PacketCounter
+	channel.PacketCount
 }
 
 // closes the ICMP channel
 func (c *Channel) Close() error {
 	// close the channel and check if any errors occur
 	err := c.rawConn.Close()
-	if err != nil {
-		c.clientConn.Close()
-		return err
+	for _, conn := range c.clientConns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
 	}
-	err = c.clientConn.Close()
-
 	return err
 }
 
@@ -44,6 +53,9 @@ func MakeChannel(conf Config) (*Channel, error) {
 	c := &Channel{
 		conf: conf,
 	}
+	if c.peers, err = channel.MakePeers(conf.FriendIP, conf.Peers); err != nil {
+		return nil, err
+	}
 
 	//server ready for incoming icmp interaction to server address
 	packetConn, err := net.ListenPacket("ip4:icmp", (&net.IPAddr{IP: c.conf.OriginIP[:]}).String())
@@ -57,34 +69,72 @@ func MakeChannel(conf Config) (*Channel, error) {
 		return nil, err
 	}
 
-	//client connection
-	clientConn, err := net.Dial("ip4:icmp", (&net.IPAddr{IP: c.conf.FriendIP[:]}).String())
-	if err != nil {
-		return nil, err
+	//client connections
+	//These are sent from the origin IP so that peers can tell who sent each message
+	for _, p := range c.peers {
+		clientConn, err := net.DialIP("ip4:icmp", &net.IPAddr{IP: c.conf.OriginIP[:]}, &net.IPAddr{IP: p.IP[:]})
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.clientConns = append(c.clientConns, clientConn)
 	}
-	c.clientConn = clientConn
 
 	return c, nil
 }
 
+func (c *Channel) Peers() []string {
+	return c.peers.Names()
+}
+
 // the server receives the data as it reads
 func (c *Channel) Receive(data []byte) (uint64, error) {
+	return c.ReceiveContext(context.Background(), data)
+}
+
+func (c *Channel) ReceiveContext(ctx context.Context, data []byte) (uint64, error) {
+	n, _, err := c.ReceiveFrom(ctx, data)
+	return n, err
+}
+
+// Receive a message from any peer
+// Packets from other addresses are ignored
+func (c *Channel) ReceiveFrom(ctx context.Context, data []byte) (uint64, int, error) {
+	defer channel.SetDeadline(ctx, 0, c.rawConn.SetReadDeadline)()
 	buf := make([]byte, 1024)
-	_, b, _, err := c.rawConn.ReadFrom(buf)
-	if err != nil {
-		return 0, err
-	}
-	b = b[8:]
-	copy(data, b)
-	if len(b) > len(data) {
-		return uint64(len(data)), errors.New("Buffer Overflow")
-	} else {
-		return uint64(len(b)), nil
+	for {
+		h, b, _, err := c.rawConn.ReadFrom(buf)
+		if err != nil {
+			return 0, 0, channel.ContextError(ctx, err)
+		}
+		peer := c.peers.Index(h.Src)
+		if peer < 0 || len(b) < 8 {
+			continue
+		}
+		c.AddRead(1)
+		b = b[8:]
+		copy(data, b)
+		if len(b) > len(data) {
+			return uint64(len(data)), peer, errors.New("Buffer Overflow")
+		} else {
+			return uint64(len(b)), peer, nil
+		}
 	}
 }
 
 // the client sends the data
 func (c *Channel) Send(data []byte) (uint64, error) {
+	return c.SendContext(context.Background(), data)
+}
+
+func (c *Channel) SendContext(ctx context.Context, data []byte) (uint64, error) {
+	return c.SendTo(ctx, 0, data)
+}
+
+func (c *Channel) SendTo(ctx context.Context, peer int, data []byte) (uint64, error) {
+	if err := c.peers.Valid(peer); err != nil {
+		return 0, err
+	}
 
 	var icmph layers.ICMPv4 = layers.ICMPv4{
 		TypeCode: layers.CreateICMPv4TypeCode(1, 0),
@@ -100,7 +150,12 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 		return 0, err
 	}
 
-	n, err := c.clientConn.Write(sb.Bytes())
+	stop := channel.SetDeadline(ctx, 0, c.clientConns[peer].SetWriteDeadline)
+	n, err := c.clientConns[peer].Write(sb.Bytes())
+	stop()
+	if err == nil {
+		c.AddWritten(1)
+	}
 
 	if n >= 8 {
 		n = n - 8
@@ -108,5 +163,5 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 		n = 0
 	}
 
-	return uint64(n), err
+	return uint64(n), channel.ContextError(ctx, err)
 }
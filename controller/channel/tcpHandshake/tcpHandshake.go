@@ -1,8 +1,9 @@
 package tcpHandshake
 
 import (
+	"../../channel"
+	"../../config"
 	"../embedders"
-	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
@@ -30,6 +31,8 @@ type acceptedConn struct {
 	conn net.Conn
 	// The TCP port used by our Friend IP in this covert message
 	friendPort uint16
+	// The index of the peer that dialed the connection
+	peer int
 }
 
 type portRequest struct {
@@ -99,11 +102,15 @@ type Config struct {
 	ReadTimeout time.Duration
 	// The timeout for writing the packet to a raw socket. Set zero for no timeout.
 	WriteTimeout time.Duration
+	// Other friends that messages can be sent to and received from
+	// They must use the same receive port as the friend
+	Peers []config.Peer
 }
 
 // A TCP covert channel
 type Channel struct {
 	conf     Config
+	peers    channel.Peers
 	rawConn  *ipv4.RawConn
 	listener net.Listener
 
@@ -128,6 +135,9 @@ type Channel struct {
 	// We make the mutex a pointer to avoid the risk of copying
 	writeMutex *sync.Mutex
 	closeMutex *sync.Mutex
+
+	// The packets written and read, for channel.PacketCounter
+	channel.PacketCount
 }
 
 // Create the covert channel, filling in the SeqEncoder
@@ -161,6 +171,11 @@ func MakeChannel(conf Config) (*Channel, error) {
 		c.conf.Embedder = &embedders.TcpIpIDEncoder{}
 	}
 
+	var err error
+	if c.peers, err = channel.MakePeers(conf.FriendIP, conf.Peers); err != nil {
+		return nil, err
+	}
+
 	conn, err := net.ListenPacket("ip4:6", "0.0.0.0")
 	if err != nil {
 		return nil, err
@@ -228,7 +243,7 @@ func (c *Channel) Close() error {
 // go channel in enough time or if there are packets coming along the go channel
 // but they are not valid packets. We check for both cases here.
 // Set timeout to zero for no timeout
-func waitPacket(pktChan chan embedders.TcpIpPacket, timeout time.Duration, f func(p embedders.TcpIpPacket) (bool, error), cancel chan bool) error {
+func waitPacket(ctx context.Context, pktChan chan embedders.TcpIpPacket, timeout time.Duration, f func(p embedders.TcpIpPacket) (bool, error), cancel chan bool) error {
 	var startTime time.Time = time.Now()
 	if timeout == 0 {
 		for {
@@ -241,6 +256,8 @@ func waitPacket(pktChan chan embedders.TcpIpPacket, timeout time.Duration, f fun
 				}
 			case <-cancel:
 				return errors.New("Cancel")
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 		}
 	} else {
@@ -258,18 +275,37 @@ func waitPacket(pktChan chan embedders.TcpIpPacket, timeout time.Duration, f fun
 				return errors.New("Timeout")
 			case <-cancel:
 				return errors.New("Cancel")
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 		}
 	}
 }
 
+func (c *Channel) Peers() []string {
+	return c.peers.Names()
+}
+
 func (c *Channel) Receive(data []byte) (uint64, error) {
+	return c.ReceiveContext(context.Background(), data)
+}
+
+// Receive a covert message, returning early if the context is done
+func (c *Channel) ReceiveContext(ctx context.Context, data []byte) (uint64, error) {
+	n, _, err := c.ReceiveFrom(ctx, data)
+	return n, err
+}
+
+// Receive a covert message from any peer
+// Each message has its own TCP connection, so messages from different peers
+// are received one at a time in the order that their connections were accepted
+func (c *Channel) ReceiveFrom(ctx context.Context, data []byte) (uint64, int, error) {
 
 	// We must expand out the input storage array to
 	// the correct size to potentially handle variable size inputs
 	dataBuf, err := embedders.GetBuf(c.conf.Embedder.GetMask(), data)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	var (
@@ -289,16 +325,20 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 		case ac = <-c.acceptChan:
 		// Check if the covert channel has been closed
 		case <-c.cancel:
-			return 0, errors.New("Receive Cancelled")
+			return 0, 0, errors.New("Receive Cancelled")
+		case <-ctx.Done():
+			return 0, 0, ctx.Err()
 		}
 	} else {
 		select {
 		case ac = <-c.acceptChan:
 		// Check if the covert channel has been closed
 		case <-c.cancel:
-			return 0, errors.New("Receive Cancelled")
+			return 0, 0, errors.New("Receive Cancelled")
+		case <-ctx.Done():
+			return 0, 0, ctx.Err()
 		case <-time.After(c.conf.AcceptTimeout):
-			return 0, errors.New("Accept timeout")
+			return 0, 0, errors.New("Accept timeout")
 		}
 	}
 
@@ -309,7 +349,7 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 	// that only provides packets from the desired friendPort
 	recvPktChan, err := c.receiveRouter.getPktChan(ac.friendPort, c.cancel)
 	if err != nil {
-		return 0, err
+		return 0, ac.peer, err
 	}
 
 	// Once we are done receiving the message we let the portRouter loop
@@ -335,18 +375,19 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 		// This way we measure the time between valid packets.
 		// If no valid packet is received within timeout of the previous valid packet
 		// we exit with an error
-		err = waitPacket(recvPktChan, c.conf.ReadTimeout, func(p embedders.TcpIpPacket) (bool, error) {
+		err = waitPacket(ctx, recvPktChan, c.conf.ReadTimeout, func(p embedders.TcpIpPacket) (bool, error) {
 			var (
 				valid bool
 				err   error
 			)
-			n, handshake, valid, fin, state, err = c.handleReceivedPacket(p, dataBuf, n, ac.friendPort, handshake, state)
+			n, handshake, valid, fin, state, err = c.handleReceivedPacket(p, dataBuf, n, ac, handshake, state)
 
 			// If packets are sent with payload then it will fill up the internal
 			// tcp buffer.
 			// This space must be cleared or else the tcp socket may reply to those packets
 			// with rst packets to indicate that it can't take any more data
 			if valid {
+				c.AddRead(1)
 				nPayload += (p.Ipv4h.TotalLen - p.Ipv4h.Len) - (int(p.Tcph.DataOffset) * 4)
 			}
 			// We always leave at least one byte in the TCP socket buffer
@@ -378,7 +419,8 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 		}
 	}
 
-	return embedders.CopyData(c.conf.Embedder.GetMask(), n, dataBuf, data, err)
+	n, err = embedders.CopyData(c.conf.Embedder.GetMask(), n, dataBuf, data, err)
+	return n, ac.peer, err
 
 	/*
 		// This code allows the TCP conn to reply with a proper FIN/Ack
@@ -409,7 +451,7 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 // TCP connection). RST or second SYN packets are interpreted as an error in the connection and
 // cause the Receive method to abort.
 // We return a valid flag to indicate if the packet forms part of the TCP covert communication (three way handshake, message, or FIN packet )
-func (c *Channel) handleReceivedPacket(p embedders.TcpIpPacket, data []byte, n uint64, friendPort uint16, handshake byte, state embedders.State) (uint64, byte, bool, bool, embedders.State, error) {
+func (c *Channel) handleReceivedPacket(p embedders.TcpIpPacket, data []byte, n uint64, ac acceptedConn, handshake byte, state embedders.State) (uint64, byte, bool, bool, embedders.State, error) {
 
 	var (
 		valid         bool // Was this packet a valid part of the message
@@ -418,8 +460,9 @@ func (c *Channel) handleReceivedPacket(p embedders.TcpIpPacket, data []byte, n u
 		receivedBytes []byte
 	)
 	// Verify that the source port is the one associated with this connection
-	if layers.TCPPort(friendPort) != p.Tcph.SrcPort {
-		// Incorrect source Port
+	// Packets are routed by port, so we also check that they are from the peer that dialed
+	if layers.TCPPort(ac.friendPort) != p.Tcph.SrcPort || c.peers.Index(p.Ipv4h.Src) != ac.peer {
+		// Incorrect source Port or IP
 	} else if handshake == 0 && p.Tcph.SYN {
 		// three way handshake SYN
 		handshake = 1
@@ -470,6 +513,20 @@ func (c *Channel) handleReceivedPacket(p embedders.TcpIpPacket, data []byte, n u
 }
 
 func (c *Channel) Send(data []byte) (uint64, error) {
+	return c.SendContext(context.Background(), data)
+}
+
+// Send a covert message, stopping before the next packet if the context is done
+func (c *Channel) SendContext(ctx context.Context, data []byte) (uint64, error) {
+	return c.SendTo(ctx, 0, data)
+}
+
+// Send a covert message to one of the peers
+func (c *Channel) SendTo(ctx context.Context, peer int, data []byte) (uint64, error) {
+	if err := c.peers.Valid(peer); err != nil {
+		return 0, err
+	}
+	var friendIP [4]byte = c.peers[peer].IP
 
 	data, err := embedders.EncodeFromMask(c.conf.Embedder.GetMask(), data)
 	if err != nil {
@@ -481,7 +538,7 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 		Timeout: c.conf.DialTimeout,
 	}
 
-	ctx, cancelFn := context.WithCancel(context.Background())
+	dialCtx, cancelFn := context.WithCancel(ctx)
 	// A channel to be closed after message sending is over
 	// to end the goroutine used for cancelling the dial
 	doneMsg := make(chan byte)
@@ -500,11 +557,13 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 	defer close(doneMsg)
 
 	// DialContext
-	conn, err := nd.DialContext(ctx, "tcp4", (&net.TCPAddr{IP: c.conf.FriendIP[:], Port: int(c.conf.FriendReceivePort)}).String())
+	conn, err := nd.DialContext(dialCtx, "tcp4", (&net.TCPAddr{IP: friendIP[:], Port: int(c.conf.FriendReceivePort)}).String())
 	if err != nil {
 		return 0, err
 	}
 	systemTime = time.Now()
+	// The SYN and ACK of the three way handshake are written by the dial
+	c.AddWritten(2)
 
 	defer conn.Close()
 
@@ -531,7 +590,7 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 	defer c.sendRouter.donePktChan(originPort, false, c.cancel)
 
 	// Wait for the SYN/ACK packet
-	err = waitPacket(recvPktChan, time.Second*3, func(p embedders.TcpIpPacket) (bool, error) {
+	err = waitPacket(ctx, recvPktChan, time.Second*3, func(p embedders.TcpIpPacket) (bool, error) {
 		// We empty packets from the channel until we get the SYN/ACK packet
 		// from the 3-way handshake. This packet can be used to retrieve
 		// the seq and ack numbers
@@ -564,11 +623,11 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 	}
 
 	var (
-		cm    ipv4.ControlMessage = createCM(c.conf.OriginIP, c.conf.FriendIP)
+		cm    ipv4.ControlMessage = createCM(c.conf.OriginIP, friendIP)
 		wbuf  []byte
 		tm    time.Duration
 		state embedders.State       = embedders.MakeState(c.conf.Embedder.GetMask())
-		p     embedders.TcpIpPacket = embedders.TcpIpPacket{Ipv4h: createIPHeader(c.conf.OriginIP, c.conf.FriendIP)}
+		p     embedders.TcpIpPacket = embedders.TcpIpPacket{Ipv4h: createIPHeader(c.conf.OriginIP, friendIP)}
 	)
 
 	if timestamp != nil {
@@ -594,9 +653,12 @@ sendloop:
 		case <-c.cancel:
 			err = errors.New("Cancel")
 			break sendloop
+		case <-ctx.Done():
+			err = ctx.Err()
+			break sendloop
 		}
 
-		if wbuf, p.Tcph, err = createTCPHeader(p.Tcph, seq, ack, c.conf.OriginIP, c.conf.FriendIP, originPort, c.conf.FriendReceivePort, payload); err != nil {
+		if wbuf, p.Tcph, err = createTCPHeader(p.Tcph, seq, ack, c.conf.OriginIP, friendIP, originPort, c.conf.FriendReceivePort, payload); err != nil {
 			break sendloop
 		}
 
@@ -607,7 +669,7 @@ sendloop:
 			p.Tcph.Options[i].OptionData = append([]byte{}, p.Tcph.Options[i].OptionData...)
 		}
 
-		if err = c.sendPacket(&p.Ipv4h, wbuf, &cm); err != nil {
+		if err = c.sendPacket(ctx, &p.Ipv4h, wbuf, &cm); err != nil {
 			break sendloop
 		}
 		state = state.IncrementState()
@@ -625,18 +687,18 @@ sendloop:
 	p.Tcph.ACK = true
 	p.Tcph.FIN = true
 	p.Tcph.PSH = false
-	if wbuf, p.Tcph, err = createTCPHeader(p.Tcph, seq, ack, c.conf.OriginIP, c.conf.FriendIP, originPort, c.conf.FriendReceivePort, []byte{}); err != nil {
+	if wbuf, p.Tcph, err = createTCPHeader(p.Tcph, seq, ack, c.conf.OriginIP, friendIP, originPort, c.conf.FriendReceivePort, []byte{}); err != nil {
 		return n, err
 	}
 
-	if err = c.sendPacket(&p.Ipv4h, wbuf, &cm); err != nil {
+	if err = c.sendPacket(ctx, &p.Ipv4h, wbuf, &cm); err != nil {
 		return n, err
 	}
 
 	// We craft a packet for the fin packet
 	// Otherwise the close method for the socket conn mediates the close and
 	// it ends up with the wrong sequence number, causing the close to look weird.
-	err = waitPacket(recvPktChan, time.Second*1, func(p embedders.TcpIpPacket) (bool, error) {
+	err = waitPacket(ctx, recvPktChan, time.Second*1, func(p embedders.TcpIpPacket) (bool, error) {
 		if p.Tcph.ACK && (p.Tcph.FIN || p.Tcph.RST) {
 			return true, nil
 		}
@@ -661,13 +723,15 @@ sendloop:
 // to the socket.
 // Nevertheless, from my perspective the frequency of errors did appear to be very noticably greater
 // when no lock was present.
-func (c *Channel) sendPacket(h *ipv4.Header, b []byte, cm *ipv4.ControlMessage) error {
+func (c *Channel) sendPacket(ctx context.Context, h *ipv4.Header, b []byte, cm *ipv4.ControlMessage) error {
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
-	if c.conf.WriteTimeout != 0 {
-		c.rawConn.SetWriteDeadline(time.Now().Add(c.conf.WriteTimeout))
+	c.rawConn.SetWriteDeadline(channel.Deadline(ctx, c.conf.WriteTimeout))
+	if err := c.rawConn.WriteTo(h, b, cm); err != nil {
+		return channel.ContextError(ctx, err)
 	}
-	return c.rawConn.WriteTo(h, b, cm)
+	c.AddWritten(1)
+	return nil
 }
 
 // We return the tcph header so that it can be logged if needed for debugging
@@ -732,7 +796,7 @@ func createCM(sip, dip [4]byte) ipv4.ControlMessage {
 
 // A loop that continuously receives packets across the raw socket
 // Incoming packets are analysed to confirm that they
-// have the expected source IP address (Our friend's IP address)
+// have one of the expected source IP addresses (Our peers' IP addresses)
 // Based on the port numbers, we
 // The receiver chan is for packets destined to calls to the Receive method
 // The sender chan is for packets destined to calls to the Send method
@@ -757,7 +821,7 @@ func (c *Channel) readLoop(recieverChan chan embedders.TcpIpPacket, senderChan c
 
 		tcph := layers.TCP{}
 		if err = tcph.DecodeFromBytes(p, gopacket.NilDecodeFeedback); err == nil {
-			if bytes.Equal(h.Src.To4(), c.conf.FriendIP[:]) {
+			if c.peers.Index(h.Src) >= 0 {
 				var pckChan chan embedders.TcpIpPacket
 
 				// When reading options DecodeFromBytes does not copy option data,
@@ -820,19 +884,19 @@ func (c *Channel) acceptLoop() {
 			continue
 		}
 
-		// Check that the TCP connection is being established from the correct
-		// peer IP address
+		// Check that the TCP connection is being established from the IP
+		// address of one of the peers
 		// If not, we close the connection and continue the receive loop
 		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok {
 			conn.Close()
-		} else if tcpAddr.IP == nil || bytes.Compare(tcpAddr.IP, c.conf.OriginIP[:]) != 0 {
+		} else if peer := c.peers.Index(tcpAddr.IP); peer < 0 {
 			conn.Close()
 		} else {
 			// We have the correct IP address.
 			// We must now record the port associated with that address to
 			// restrict incoming packets to that port, and not a different port on the same machine.
 			select {
-			case c.acceptChan <- acceptedConn{conn: conn, friendPort: uint16(tcpAddr.Port)}:
+			case c.acceptChan <- acceptedConn{conn: conn, friendPort: uint16(tcpAddr.Port), peer: peer}:
 			default:
 				l.Println("Too many connections: Dropped TCP Connection")
 				conn.Close()
@@ -1,6 +1,7 @@
 package tcpHandshake
 
 import (
+	"../../channel"
 	"../../config"
 	"../embedders"
 	"errors"
@@ -17,12 +18,18 @@ type ConfigClient struct {
 	AcceptTimeout     config.U64Param
 	ReadTimeout       config.U64Param
 	WriteTimeout      config.U64Param
+	Peers             config.PeersParam
+}
+
+func init() {
+	channel.Register("TcpHandshake", GetDefault, ToChannel)
 }
 
 func GetDefault() ConfigClient {
 	return ConfigClient{
 		FriendIP:          config.MakeIPV4("127.0.0.1", config.Display{Description: "Your friend's IP address.", Name: "Friend's IP", Group: "IP Addresses"}),
 		OriginIP:          config.MakeIPV4("127.0.0.1", config.Display{Description: "Your IP address.", Name: "Your IP", Group: "IP Addresses"}),
+		Peers:             config.MakePeers("", config.Display{Description: "Other friends to send to and receive from, as name=IP on each line. They use the same receive port as your friend.", Name: "Peers", Group: "IP Addresses"}),
 		FriendReceivePort: config.MakeU16(8123, [2]uint16{0, 65535}, config.Display{Description: "Your friend's TCP receive port. Their send port is chosen randomly.", Name: "Friend's Receive Port", Group: "Ports"}),
 		OriginReceivePort: config.MakeU16(8124, [2]uint16{0, 65535}, config.Display{Description: "Your TCP receive port. Your send port is chosen randomly.", Name: "Your Receive Port", Group: "Ports"}),
 		DialTimeout:       config.MakeU64(500, [2]uint64{0, 65535}, config.Display{Description: "The dial timeout for the send method in milliseconds. Zero for no timeout.", Name: "Dial Timeout", Group: "Timing"}),
@@ -33,6 +40,11 @@ func GetDefault() ConfigClient {
 	}
 }
 
+// The receive ports must differ if your friend is on this host
+func (cc ConfigClient) ValidateAll() config.FieldErrors {
+	return channel.ReceivePortErrors(cc.FriendIP, cc.FriendReceivePort, cc.OriginReceivePort)
+}
+
 func ToChannel(cc ConfigClient) (*Channel, error) {
 	var c Config
 	var friendIP, originIP [4]byte
@@ -48,6 +60,9 @@ func ToChannel(cc ConfigClient) (*Channel, error) {
 	c.OriginIP = originIP
 	c.FriendReceivePort = cc.FriendReceivePort.Value
 	c.OriginReceivePort = cc.OriginReceivePort.Value
+	if c.Peers, err = cc.Peers.GetValue(); err != nil {
+		return nil, errors.New("Invalid Peers value")
+	}
 
 	c.DialTimeout = time.Duration(cc.DialTimeout.Value) * time.Millisecond
 	c.AcceptTimeout = time.Duration(cc.AcceptTimeout.Value) * time.Millisecond
@@ -1,7 +1,8 @@
 package tcpNormal
 
 import (
-	"bytes"
+	"../../channel"
+	"../../config"
 	"context"
 	"errors"
 	"io"
@@ -18,6 +19,8 @@ type acceptedConn struct {
 	conn net.Conn
 	// The TCP port used by our Friend IP in this covert message
 	friendPort uint16
+	// The index of the peer that connected
+	peer int
 }
 
 // This is a normal, non-covert tcp messaging channel
@@ -38,11 +41,14 @@ type Config struct {
 	ReadTimeout time.Duration
 	// The timeout for writing the packet to a raw socket. Set zero for no timeout.
 	WriteTimeout time.Duration
+	// Other friends that messages can be sent to and received from
+	Peers []config.Peer
 }
 
 // A TCP covert channel
 type Channel struct {
 	conf     Config
+	peers    channel.Peers
 	listener net.Listener
 
 	cancel     chan bool
@@ -63,6 +69,9 @@ func MakeChannel(conf Config) (*Channel, error) {
 		// Only 32 connections can be accepted before they begin to be dropped
 		acceptChan: make(chan acceptedConn, maxAccept),
 	}
+	if c.peers, err = channel.MakePeers(conf.FriendIP, conf.Peers); err != nil {
+		return nil, err
+	}
 
 	c.listener, err = net.Listen("tcp4", ":"+strconv.Itoa(int(c.conf.OriginReceivePort)))
 	if err != nil {
@@ -86,7 +95,21 @@ func (c *Channel) Close() error {
 	return c.listener.Close()
 }
 
+func (c *Channel) Peers() []string {
+	return c.peers.Names()
+}
+
 func (c *Channel) Receive(data []byte) (uint64, error) {
+	return c.ReceiveContext(context.Background(), data)
+}
+
+func (c *Channel) ReceiveContext(ctx context.Context, data []byte) (uint64, error) {
+	n, _, err := c.ReceiveFrom(ctx, data)
+	return n, err
+}
+
+// Receive a message from any peer
+func (c *Channel) ReceiveFrom(ctx context.Context, data []byte) (uint64, int, error) {
 
 	var (
 		ac acceptedConn
@@ -98,16 +121,20 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 		case ac = <-c.acceptChan:
 		// Check if the covert channel has been closed
 		case <-c.cancel:
-			return 0, errors.New("Receive Cancelled")
+			return 0, 0, errors.New("Receive Cancelled")
+		case <-ctx.Done():
+			return 0, 0, ctx.Err()
 		}
 	} else {
 		select {
 		case ac = <-c.acceptChan:
 		// Check if the covert channel has been closed
 		case <-c.cancel:
-			return 0, errors.New("Receive Cancelled")
+			return 0, 0, errors.New("Receive Cancelled")
+		case <-ctx.Done():
+			return 0, 0, ctx.Err()
 		case <-time.After(c.conf.AcceptTimeout):
-			return 0, errors.New("Accept timeout")
+			return 0, 0, errors.New("Accept timeout")
 		}
 	}
 
@@ -117,24 +144,23 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 	var total uint64 = 0
 
 	for total < uint64(len(data)) {
-		if c.conf.ReadTimeout != 0 {
-			ac.conn.SetReadDeadline(time.Now().Add(c.conf.ReadTimeout))
-		}
+		stop := channel.SetDeadline(ctx, c.conf.ReadTimeout, ac.conn.SetReadDeadline)
 		readn, err := ac.conn.Read(data[total:])
+		stop()
 
 		total += uint64(readn)
 		// EOF indicates that the stream has been closed
 		// Strangely, https://stackoverflow.com/questions/12741386/how-to-know-tcp-connection-is-closed-in-net-package
 		// seems to claim that zero byte reads never return an error. From my experiments this is false.
 		if err == io.EOF {
-			return total, nil
+			return total, ac.peer, nil
 		} else if err != io.EOF && err != nil {
 			// There is a different error (such as timeout) so we must return with that error
-			return total, err
+			return total, ac.peer, channel.ContextError(ctx, err)
 		} else if readn == 0 {
 			// As stated above, it is implied in some sources that reading from the closed channel
 			// will return 0 bytes and no error. This does not appear to be true, but I am checking anyway
-			return total, nil
+			return total, ac.peer, nil
 		}
 	}
 	// Once we have filled the buffer we must check if the full message has been read
@@ -146,25 +172,38 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 	dummyBuffer := make([]byte, 1)
 	// We always set a short timeout here. That way, we can check handle the case
 	// where no more bytes arrive but the close handshake packets were lost.
-	ac.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-
+	stop := channel.SetDeadline(ctx, time.Second*5, ac.conn.SetReadDeadline)
 	readn, err := ac.conn.Read(dummyBuffer)
-	if err == io.EOF || readn == 0 {
-		return total, nil
+	stop()
+	if ctx.Err() != nil {
+		return total, ac.peer, ctx.Err()
+	} else if err == io.EOF || readn == 0 {
+		return total, ac.peer, nil
 	} else {
 		// Too many bytes have been received (more than can be held in the buffer)
 		// so we return an error message
-		return total, errors.New("Buffer Full")
+		return total, ac.peer, errors.New("Buffer Full")
 	}
 }
 
 func (c *Channel) Send(data []byte) (uint64, error) {
+	return c.SendContext(context.Background(), data)
+}
+
+func (c *Channel) SendContext(ctx context.Context, data []byte) (uint64, error) {
+	return c.SendTo(ctx, 0, data)
+}
+
+func (c *Channel) SendTo(ctx context.Context, peer int, data []byte) (uint64, error) {
+	if err := c.peers.Valid(peer); err != nil {
+		return 0, err
+	}
 
 	nd := net.Dialer{
 		Timeout: c.conf.DialTimeout,
 	}
 
-	ctx, cancelFn := context.WithCancel(context.Background())
+	dialCtx, cancelFn := context.WithCancel(ctx)
 	// A channel to be closed after message sending is over
 	// to end the goroutine used for cancelling the dial
 	doneMsg := make(chan byte)
@@ -183,23 +222,21 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 	defer close(doneMsg)
 
 	// DialContext
-	conn, err := nd.DialContext(ctx, "tcp4", (&net.TCPAddr{IP: c.conf.FriendIP[:], Port: int(c.conf.FriendReceivePort)}).String())
+	conn, err := nd.DialContext(dialCtx, "tcp4", (&net.TCPAddr{IP: c.peers[peer].IP[:], Port: int(c.conf.FriendReceivePort)}).String())
 	if err != nil {
 		return 0, err
 	}
 
 	defer conn.Close()
 
-	if c.conf.WriteTimeout != 0 {
-		conn.SetWriteDeadline(time.Now().Add(c.conf.WriteTimeout))
-	}
+	defer channel.SetDeadline(ctx, c.conf.WriteTimeout, conn.SetWriteDeadline)()
 
 	n, err := conn.Write(data)
-	return uint64(n), err
+	return uint64(n), channel.ContextError(ctx, err)
 }
 
 // A loop to accept incoming TCP connections,
-// verify if they are to the correct friend IP address,
+// verify if they are from the IP address of a peer,
 // and if so, extract the friend port and send it to the receive method
 func (c *Channel) acceptLoop() {
 	var l *log.Logger = log.New(os.Stderr, "", log.Flags())
@@ -227,19 +264,19 @@ func (c *Channel) acceptLoop() {
 			continue
 		}
 
-		// Check that the TCP connection is being established from the correct
-		// peer IP address
+		// Check that the TCP connection is being established from the
+		// IP address of a peer
 		// If not, we close the connection and continue the receive loop
 		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok {
 			conn.Close()
-		} else if tcpAddr.IP == nil || bytes.Compare(tcpAddr.IP, c.conf.OriginIP[:]) != 0 {
+		} else if peer := c.peers.Index(tcpAddr.IP); peer < 0 {
 			conn.Close()
 		} else {
 			// We have the correct IP address.
 			// We must now record the port associated with that address to
 			// restrict incoming packets to that port, and not a different port on the same machine.
 			select {
-			case c.acceptChan <- acceptedConn{conn: conn, friendPort: uint16(tcpAddr.Port)}:
+			case c.acceptChan <- acceptedConn{conn: conn, friendPort: uint16(tcpAddr.Port), peer: peer}:
 			default:
 				l.Println("Too many connections: Dropped TCP Connection")
 				conn.Close()
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"time"
 
+	"../../channel"
 	"../../config"
 )
 
@@ -16,6 +17,11 @@ type ConfigClient struct {
 	AcceptTimeout     config.U64Param
 	ReadTimeout       config.U64Param
 	WriteTimeout      config.U64Param
+	Peers             config.PeersParam
+}
+
+func init() {
+	channel.Register("TcpNormal", GetDefault, ToChannel)
 }
 
 func GetDefault() ConfigClient {
@@ -28,9 +34,15 @@ func GetDefault() ConfigClient {
 		AcceptTimeout:     config.MakeU64(0, [2]uint64{0, 65535}, config.Display{Description: "The accept timeout for the Receive method in milliseconds. Zero for no timeout."}),
 		ReadTimeout:       config.MakeU64(500, [2]uint64{0, 65535}, config.Display{Description: "The intra-packet read timeout for the receive method in milliseconds. Zero for no timeout."}),
 		WriteTimeout:      config.MakeU64(500, [2]uint64{0, 65535}, config.Display{Description: "The a timeout for writing packets to the raw socket, in milliseconds. Zero for no timeout."}),
+		Peers:             config.MakePeers("", config.Display{Description: "Other friends to send to and receive from, as name=IP on each line. They use the same ports as your friend."}),
 	}
 }
 
+// The receive ports must differ if your friend is on this host
+func (cc ConfigClient) ValidateAll() config.FieldErrors {
+	return channel.ReceivePortErrors(cc.FriendIP, cc.FriendReceivePort, cc.OriginReceivePort)
+}
+
 func ToChannel(cc ConfigClient) (*Channel, error) {
 	var c Config
 	var friendIP, originIP [4]byte
@@ -51,6 +63,9 @@ func ToChannel(cc ConfigClient) (*Channel, error) {
 	c.AcceptTimeout = time.Duration(cc.AcceptTimeout.Value) * time.Millisecond
 	c.ReadTimeout = time.Duration(cc.ReadTimeout.Value) * time.Millisecond
 	c.WriteTimeout = time.Duration(cc.WriteTimeout.Value) * time.Millisecond
+	if c.Peers, err = cc.Peers.GetValue(); err != nil {
+		return nil, errors.New("Invalid Peers value")
+	}
 
 	if ch, err := MakeChannel(c); err != nil {
 		return nil, err
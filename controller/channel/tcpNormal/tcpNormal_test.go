@@ -2,11 +2,14 @@ package tcpNormal
 
 import (
 	"bytes"
+	"context"
 	"log"
 	"math/rand"
 	"sort"
 	"testing"
 	"time"
+
+	"../../config"
 )
 
 var sconf Config = Config{
@@ -387,6 +390,43 @@ func TestStress(t *testing.T) {
 	}
 }
 
+// Receive and Send must return once their context is done
+func TestContext(t *testing.T) {
+
+	log.Println("Starting TestContext")
+
+	rch, err := MakeChannel(rconfTimeout)
+	if err != nil {
+		t.Errorf("err = '%s'; want nil", err.Error())
+	}
+
+	var data [15]byte
+
+	// The context deadline is earlier than the accept timeout
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	if _, err := rch.ReceiveContext(ctx, data[:]); err != context.DeadlineExceeded {
+		t.Errorf("err = '%v'; want '%v'", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Millisecond*500 {
+		t.Errorf("Receive took %s; want the context deadline", d)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := rch.ReceiveContext(ctx, data[:]); err != context.Canceled {
+		t.Errorf("err = '%v'; want '%v'", err, context.Canceled)
+	}
+	if _, err := rch.SendContext(ctx, []byte("Hello world!")); err == nil {
+		t.Errorf("err = nil; want cancelled dial")
+	}
+
+	if err := rch.Close(); err != nil {
+		t.Errorf("err = '%s'; want nil", err.Error())
+	}
+}
+
 /*
 func TestReceiveNone(t *testing.T) {
 
@@ -431,3 +471,18 @@ func receiveAndCheck(t *testing.T, input []byte, c chan []byte) {
 		t.Errorf("Read timeout")
 	}
 }
+
+func TestValidateAll(t *testing.T) {
+	cc := GetDefault()
+	cc.OriginReceivePort.Value = cc.FriendReceivePort.Value
+	err := config.Validate(cc)
+	if fe, ok := err.(config.FieldErrors); !ok || len(fe) != 2 || fe["FriendReceivePort"] == "" || fe["OriginReceivePort"] == "" {
+		t.Errorf("Expected receive port errors; found %v", err)
+	}
+
+	// The same ports are fine if your friend is on another host
+	cc.FriendIP.Value = "192.0.2.1"
+	if err := config.Validate(cc); err != nil {
+		t.Errorf("err = '%s'; want nil", err.Error())
+	}
+}
@@ -1,8 +1,11 @@
 package tcpSyn
 
 import (
+	"../../channel"
+	"../../config"
 	"../embedders"
 	"bytes"
+	"context"
 	"errors"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -56,15 +59,34 @@ type Config struct {
 	// since at this time each packet may only contain one byte
 	WriteTimeout time.Duration
 	ReadTimeout  time.Duration
+
+	// Other friends that messages can be sent to and received from
+	// In bounce mode, messages to a peer are bounced by spoofing the peer's IP,
+	// and every message received is reported as from the friend, since the
+	// bouncer hides who sent it
+	Peers []config.Peer
 }
 
+// The number of packets from other peers that may be held back while
+// receiving a message, before they begin to be dropped
+const maxHeld = 1024
+
 // A TCP covert channel
 type Channel struct {
 	conf       Config
+	peers      channel.Peers
 	rawConn    *ipv4.RawConn
 	cancel     chan bool
 	recvChan   chan embedders.TcpIpPacket
 	closeMutex *sync.Mutex
+
+	// Packets from other peers that arrived while a message was being received
+	// They are read before the receive channel by the next receive
+	// This must only be accessed by the receive method
+	held []embedders.TcpIpPacket
+
+	// The packets written and read, for channel.PacketCounter
+	channel.PacketCount
 }
 
 // Create the covert channel, filling in the SeqEncoder
@@ -78,6 +100,11 @@ func MakeChannel(conf Config) (*Channel, error) {
 		c.conf.Embedder = &embedders.TcpIpSeqEncoder{}
 	}
 
+	var err error
+	if c.peers, err = channel.MakePeers(conf.FriendIP, conf.Peers); err != nil {
+		return nil, err
+	}
+
 	conn, err := net.ListenPacket("ip4:6", "0.0.0.0")
 	if err != nil {
 		return nil, err
@@ -90,23 +117,38 @@ func MakeChannel(conf Config) (*Channel, error) {
 	}
 
 	var (
-		saddr        [4]byte
+		saddrs       []net.IP
 		sport, dport uint16
 	)
 
 	// Figure out the expected source and destination IP address
 	// These change depending on whether or not we are in bounce mode
 	if c.conf.Bounce {
-		saddr, sport, dport = c.conf.BounceIP, c.conf.BouncePort, c.conf.OriginPort
+		saddrs, sport, dport = []net.IP{c.conf.BounceIP[:]}, c.conf.BouncePort, c.conf.OriginPort
 	} else {
-		saddr, sport, dport = c.conf.FriendIP, c.conf.FriendPort, c.conf.OriginPort
+		for _, p := range c.peers {
+			saddrs = append(saddrs, net.IP(append([]byte{}, p.IP[:]...)))
+		}
+		sport, dport = c.conf.FriendPort, c.conf.OriginPort
 	}
 
-	go c.readLoop(saddr, sport, dport)
+	go c.readLoop(saddrs, sport, dport)
 
 	return c, nil
 }
 
+func (c *Channel) Peers() []string {
+	return c.peers.Names()
+}
+
+// The peer that sent a packet
+func (c *Channel) packetPeer(p embedders.TcpIpPacket) int {
+	if c.conf.Bounce {
+		return 0
+	}
+	return c.peers.Index(p.Ipv4h.Src)
+}
+
 // Receive a covert message
 // data is a buffer for the message.
 // If the channel is in protocol delimiter mode then this function
@@ -115,16 +157,30 @@ func MakeChannel(conf Config) (*Channel, error) {
 // We return the number of bytes received even if an error is encountered,
 // in which case data will have valid received bytes up to that point.
 func (c *Channel) Receive(data []byte) (uint64, error) {
+	return c.ReceiveContext(context.Background(), data)
+}
+
+// Receive a covert message, returning early if the context is done
+func (c *Channel) ReceiveContext(ctx context.Context, data []byte) (uint64, error) {
+	n, _, err := c.ReceiveFrom(ctx, data)
+	return n, err
+}
+
+// Receive a covert message from any peer
+// The message is read from the first peer to send a packet. Packets from
+// other peers are held back until the message is complete, so that their
+// messages can be read by the following receives.
+func (c *Channel) ReceiveFrom(ctx context.Context, data []byte) (uint64, int, error) {
 
 	// We must expand out the input storage array to
 	// the correct size to potentially handle variable size inputs
 	dataBuf, err := embedders.GetBuf(c.conf.Embedder.GetMask(), data)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	if len(dataBuf) == 0 && c.conf.Delimiter == Buffer {
-		return 0, nil
+		return 0, 0, nil
 	}
 
 	var (
@@ -136,10 +192,29 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 		fin   bool
 		p     embedders.TcpIpPacket
 		state embedders.State = embedders.MakeState(c.conf.Embedder.GetMask())
+		// The peer sending the message, once its first packet has arrived
+		peer int = -1
+		// The held packets that have not yet been read
+		queue []embedders.TcpIpPacket = c.held
+		held  []embedders.TcpIpPacket
 	)
+	c.held = nil
 readloop:
 	for {
-		p, fin, err = c.readPacket(func(p embedders.TcpIpPacket) (embedders.TcpIpPacket, bool, bool, error) {
+		p, fin, err = c.readPacket(ctx, &queue, func(p embedders.TcpIpPacket) (embedders.TcpIpPacket, bool, bool, error) {
+			if from := c.packetPeer(p); from < 0 {
+				return p, false, false, nil
+			} else if peer >= 0 && from != peer {
+				// Part of another peer's message
+				if len(held) < maxHeld {
+					held = append(held, p)
+				}
+				return p, false, false, nil
+			} else {
+				peer = from
+				c.AddRead(1)
+			}
+
 			// Check if done
 			if c.conf.Delimiter == Protocol {
 				if (!c.conf.Bounce && p.Tcph.ACK && !p.Tcph.RST) || (c.conf.Bounce && p.Tcph.RST) {
@@ -201,7 +276,12 @@ readloop:
 		}
 	}
 
-	return embedders.CopyData(c.conf.Embedder.GetMask(), pos, dataBuf, data, err)
+	c.held = append(held, queue...)
+	if peer < 0 {
+		peer = 0
+	}
+	n, err := embedders.CopyData(c.conf.Embedder.GetMask(), pos, dataBuf, data, err)
+	return n, peer, err
 }
 
 // Send a covert message
@@ -210,6 +290,19 @@ readloop:
 // inter packet delay to help obscure the communication.
 // We return the number of bytes sent even if an error is encountered
 func (c *Channel) Send(data []byte) (uint64, error) {
+	return c.SendContext(context.Background(), data)
+}
+
+// Send a covert message, stopping before the next packet if the context is done
+func (c *Channel) SendContext(ctx context.Context, data []byte) (uint64, error) {
+	return c.SendTo(ctx, 0, data)
+}
+
+// Send a covert message to one of the peers
+func (c *Channel) SendTo(ctx context.Context, peer int, data []byte) (uint64, error) {
+	if err := c.peers.Valid(peer); err != nil {
+		return 0, err
+	}
 
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 
@@ -235,9 +328,9 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 
 	// The source and destination depend on whether or not we are in bounce mode
 	if c.conf.Bounce {
-		saddr, daddr, sport, dport = c.conf.FriendIP, c.conf.BounceIP, c.conf.FriendPort, c.conf.BouncePort
+		saddr, daddr, sport, dport = c.peers[peer].IP, c.conf.BounceIP, c.conf.FriendPort, c.conf.BouncePort
 	} else {
-		saddr, daddr, sport, dport = c.conf.OriginIP, c.conf.FriendIP, c.conf.OriginPort, c.conf.FriendPort
+		saddr, daddr, sport, dport = c.conf.OriginIP, c.peers[peer].IP, c.conf.OriginPort, c.conf.FriendPort
 	}
 
 	rem = data
@@ -267,9 +360,12 @@ readloop:
 		case <-c.cancel:
 			err = &WriteWaitCancel{}
 			break readloop
+		case <-ctx.Done():
+			err = ctx.Err()
+			break readloop
 		}
 
-		if err = c.writeConn(&p.Ipv4h, payload, &cm); err != nil {
+		if err = c.writeConn(ctx, &p.Ipv4h, payload, &cm); err != nil {
 			break readloop
 		}
 		state = state.IncrementState()
@@ -310,7 +406,7 @@ readloop:
 			return n, err
 		}
 
-		if err = c.writeConn(&p.Ipv4h, payload, &cm); err != nil {
+		if err = c.writeConn(ctx, &p.Ipv4h, payload, &cm); err != nil {
 			return n, err
 		}
 	}
@@ -333,7 +429,8 @@ func (c *Channel) Close() error {
 }
 
 // Read from a raw connection whil setting a timeout if necessary
-func (c *Channel) readPacket(f func(p embedders.TcpIpPacket) (embedders.TcpIpPacket, bool, bool, error)) (embedders.TcpIpPacket, bool, error) {
+// Packets in the queue are read first
+func (c *Channel) readPacket(ctx context.Context, queue *[]embedders.TcpIpPacket, f func(p embedders.TcpIpPacket) (embedders.TcpIpPacket, bool, bool, error)) (embedders.TcpIpPacket, bool, error) {
 	var (
 		p         embedders.TcpIpPacket
 		err       error
@@ -342,7 +439,13 @@ func (c *Channel) readPacket(f func(p embedders.TcpIpPacket) (embedders.TcpIpPac
 		startTime time.Time = time.Now()
 	)
 	for {
-		if c.conf.ReadTimeout > 0 {
+		if len(*queue) > 0 {
+			p, *queue = (*queue)[0], (*queue)[1:]
+			p, valid, fin, err = f(p)
+			if valid || err != nil {
+				return p, fin, err
+			}
+		} else if c.conf.ReadTimeout > 0 {
 			select {
 			case p = <-c.recvChan:
 				p, valid, fin, err = f(p)
@@ -355,6 +458,8 @@ func (c *Channel) readPacket(f func(p embedders.TcpIpPacket) (embedders.TcpIpPac
 				return p, fin, errors.New("Read Timeout")
 			case <-c.cancel:
 				return p, fin, errors.New("Cancel")
+			case <-ctx.Done():
+				return p, fin, ctx.Err()
 			}
 		} else {
 			select {
@@ -365,21 +470,22 @@ func (c *Channel) readPacket(f func(p embedders.TcpIpPacket) (embedders.TcpIpPac
 				}
 			case <-c.cancel:
 				return p, fin, errors.New("Cancel")
+			case <-ctx.Done():
+				return p, fin, ctx.Err()
 			}
 		}
 	}
 }
 
 // Write to a raw connection while setting a timeout if necessary
-func (c *Channel) writeConn(h *ipv4.Header, p []byte, cm *ipv4.ControlMessage) error {
-	if c.conf.WriteTimeout > 0 {
-		c.rawConn.SetWriteDeadline(time.Now().Add(c.conf.WriteTimeout))
-	} else {
-		// A deadline of zero means never timeout
-		// The initial Time struct is zero
-		c.rawConn.SetWriteDeadline(time.Time{})
+// A deadline of zero means never timeout
+func (c *Channel) writeConn(ctx context.Context, h *ipv4.Header, p []byte, cm *ipv4.ControlMessage) error {
+	c.rawConn.SetWriteDeadline(channel.Deadline(ctx, c.conf.WriteTimeout))
+	if err := c.rawConn.WriteTo(h, p, cm); err != nil {
+		return channel.ContextError(ctx, err)
 	}
-	return c.rawConn.WriteTo(h, p, cm)
+	c.AddWritten(1)
+	return nil
 }
 
 // Creates the ip header message
@@ -480,8 +586,8 @@ func createTcpHeadBuf(tcph layers.TCP, sip, dip [4]byte, sport, dport uint16) ([
 
 // A loop that continuously receives packets across the raw socket
 // Incoming packets are analysed to confirm that they
-// have the expected source IP address (Our friend's IP address)
-func (c *Channel) readLoop(saddr [4]byte, sport, dport uint16) {
+// have one of the expected source IP addresses (Our peers' IP addresses)
+func (c *Channel) readLoop(saddrs []net.IP, sport, dport uint16) {
 	var (
 		buf [1024]byte
 		l   *log.Logger = log.New(os.Stderr, "", log.Flags())
@@ -502,7 +608,7 @@ func (c *Channel) readLoop(saddr [4]byte, sport, dport uint16) {
 
 		tcph := layers.TCP{}
 		if err = tcph.DecodeFromBytes(p, gopacket.NilDecodeFeedback); err == nil {
-			if bytes.Equal(h.Src.To4(), saddr[:]) {
+			if containsIP(saddrs, h.Src) {
 
 				// When reading options DecodeFromBytes does not copy option data,
 				// it merely slices into the array. We copy here to make sure that the data
@@ -522,3 +628,12 @@ func (c *Channel) readLoop(saddr [4]byte, sport, dport uint16) {
 		}
 	}
 }
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if bytes.Equal(i, ip.To4()) {
+			return true
+		}
+	}
+	return false
+}
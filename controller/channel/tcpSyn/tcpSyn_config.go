@@ -4,6 +4,7 @@ import (
 	"errors"
 	"time"
 
+	"../../channel"
 	"../../config"
 	"../embedders"
 )
@@ -20,12 +21,18 @@ type ConfigClient struct {
 	Embedder     config.SelectParam
 	WriteTimeout config.U64Param
 	ReadTimeout  config.U64Param
+	Peers        config.PeersParam
+}
+
+func init() {
+	channel.Register("TcpSyn", GetDefault, ToChannel)
 }
 
 func GetDefault() ConfigClient {
 	return ConfigClient{
 		FriendIP:     config.MakeIPV4("127.0.0.1", config.Display{Description: "Your friend's IP address.", Name: "Friend's IP", Group: "IP Addresses"}),
 		OriginIP:     config.MakeIPV4("127.0.0.1", config.Display{Description: "Your IP address.", Name: "Your IP", Group: "IP Addresses"}),
+		Peers:        config.MakePeers("", config.Display{Description: "Other friends to send to and receive from, as name=IP on each line. They use the same ports as your friend.", Name: "Peers", Group: "IP Addresses"}),
 		FriendPort:   config.MakeU16(8123, [2]uint16{0, 65535}, config.Display{Description: "Your friend's port.", Name: "Friend's Port", Group: "Ports"}),
 		OriginPort:   config.MakeU16(8124, [2]uint16{0, 65535}, config.Display{Description: "Your port.", Name: "Your Port", Group: "Ports"}),
 		Bounce:       config.MakeBool(false, config.Display{Description: "Toggle bounce mode, which spoofs your IP address.", Name: "Bounce", Group: "Bouncing", GroupToggle: true}),
@@ -38,6 +45,15 @@ func GetDefault() ConfigClient {
 	}
 }
 
+// In bounce mode the bouncer's port is the destination of every packet,
+// so it cannot be zero
+func (cc ConfigClient) ValidateAll() config.FieldErrors {
+	if cc.Bounce.Value && cc.BouncePort.Value == 0 {
+		return config.FieldErrors{"BouncePort": "The bouncer's port must be set in bounce mode"}
+	}
+	return nil
+}
+
 func ToChannel(cc ConfigClient) (*Channel, error) {
 	var c Config
 	var friendIP, originIP, bounceIP [4]byte
@@ -58,6 +74,9 @@ func ToChannel(cc ConfigClient) (*Channel, error) {
 	c.OriginPort = cc.OriginPort.Value
 	c.BouncePort = cc.BouncePort.Value
 	c.Bounce = cc.Bounce.Value
+	if c.Peers, err = cc.Peers.GetValue(); err != nil {
+		return nil, errors.New("Invalid Peers value")
+	}
 
 	c.WriteTimeout = time.Duration(cc.WriteTimeout.Value) * time.Millisecond
 	c.ReadTimeout = time.Duration(cc.ReadTimeout.Value) * time.Millisecond
@@ -1,6 +1,7 @@
 package tcpSyn
 
 import (
+	"../../config"
 	"../embedders"
 	"bytes"
 	"log"
@@ -243,3 +244,17 @@ func receiveAndCheck(t *testing.T, input []byte, c chan []byte) {
 		t.Errorf("Read timeout")
 	}
 }
+
+func TestValidateAll(t *testing.T) {
+	cc := GetDefault()
+	cc.Bounce.Value = true
+	err := config.Validate(cc)
+	if fe, ok := err.(config.FieldErrors); !ok || len(fe) != 1 || fe["BouncePort"] == "" {
+		t.Errorf("Expected a BouncePort error; found %v", err)
+	}
+
+	cc.BouncePort.Value = 8125
+	if err := config.Validate(cc); err != nil {
+		t.Errorf("err = '%s'; want nil", err.Error())
+	}
+}
@@ -1,8 +1,9 @@
 package udpIP
 
 import (
+	"../../channel"
+	"../../config"
 	"../embedders"
-	"bytes"
 	"context"
 	"errors"
 	"github.com/google/gopacket"
@@ -15,12 +16,22 @@ import (
 
 const maxAccept = 32
 
+// The number of packets from other peers that may be held back while
+// receiving a message, before they begin to be dropped
+const maxHeld = 1024
+
 // We make the fields public to facilitate logging
 type packet struct {
 	Ipv4h ipv4.Header
 	Udph  layers.UDP
 }
 
+// A packet read from the raw socket
+type rawPacket struct {
+	h *ipv4.Header
+	p []byte
+}
+
 type syncPktMap struct {
 	mutex  *sync.Mutex
 	pktMap map[uint16][]packet
@@ -62,10 +73,13 @@ type Config struct {
 	ReadTimeout time.Duration
 	// The timeout for writing the packet to a raw socket. Set zero for no timeout.
 	WriteTimeout time.Duration
+	// Other friends that messages can be sent to and received from
+	Peers []config.Peer
 }
 
 type Channel struct {
 	conf    Config
+	peers   channel.Peers
 	rawConn *ipv4.RawConn
 	cancel  chan bool
 
@@ -78,6 +92,14 @@ type Channel struct {
 	closeMutex *sync.Mutex
 
 	acceptChan chan acceptedConn
+
+	// Packets from other peers that arrived while a message was being received
+	// They are read before the raw socket by the next receive
+	// This must only be accessed by the receive method
+	held []rawPacket
+
+	// The packets written and read, for channel.PacketCounter
+	channel.PacketCount
 }
 
 func (c *Channel) Close() error {
@@ -111,6 +133,11 @@ func MakeChannel(conf Config) (*Channel, error) {
 		c.conf.Embedder = &IDEncoder{}
 	}
 
+	var err error
+	if c.peers, err = channel.MakePeers(conf.FriendIP, conf.Peers); err != nil {
+		return nil, err
+	}
+
 	//ip network with udp protocol
 	conn, err := net.ListenPacket("ip4:17", "0.0.0.0")
 	if err != nil {
@@ -126,7 +153,25 @@ func MakeChannel(conf Config) (*Channel, error) {
 	return c, nil
 }
 
+func (c *Channel) Peers() []string {
+	return c.peers.Names()
+}
+
 func (c *Channel) Send(data []byte) (uint64, error) {
+	return c.SendContext(context.Background(), data)
+}
+
+// Send a covert message, stopping before the next packet if the context is done
+func (c *Channel) SendContext(ctx context.Context, data []byte) (uint64, error) {
+	return c.SendTo(ctx, 0, data)
+}
+
+// Send a covert message to one of the peers
+func (c *Channel) SendTo(ctx context.Context, peer int, data []byte) (uint64, error) {
+	if err := c.peers.Valid(peer); err != nil {
+		return 0, err
+	}
+	var friendIP [4]byte = c.peers[peer].IP
 
 	data, err := embedders.EncodeFromMask(c.conf.Embedder.GetMask(), data)
 	if err != nil {
@@ -137,7 +182,7 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 		Timeout: c.conf.DialTimeout,
 	}
 
-	ctx, cancelFn := context.WithCancel(context.Background())
+	dialCtx, cancelFn := context.WithCancel(ctx)
 	// A channel to be closed after message sending is over
 	// to end the goroutine used for cancelling the dial
 	doneMsg := make(chan byte)
@@ -156,7 +201,7 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 	defer close(doneMsg)
 
 	// DialContext
-	conn, err := nd.DialContext(ctx, "udp4", (&net.UDPAddr{IP: c.conf.FriendIP[:], Port: int(c.conf.FriendReceivePort)}).String())
+	conn, err := nd.DialContext(dialCtx, "udp4", (&net.UDPAddr{IP: friendIP[:], Port: int(c.conf.FriendReceivePort)}).String())
 	if err != nil {
 		return 0, err
 	}
@@ -164,8 +209,8 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 	defer conn.Close()
 
 	var (
-		ipv4h ipv4.Header         = createIPHeader(c.conf.OriginIP, c.conf.FriendIP)
-		cm    ipv4.ControlMessage = createCM(c.conf.OriginIP, c.conf.FriendIP)
+		ipv4h ipv4.Header         = createIPHeader(c.conf.OriginIP, friendIP)
+		cm    ipv4.ControlMessage = createCM(c.conf.OriginIP, friendIP)
 		udph  layers.UDP
 		wbuf  []byte
 		rem   []byte = data
@@ -175,12 +220,15 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 
 	// Send each packet
 	for len(rem) > 0 {
+		if err = ctx.Err(); err != nil {
+			break
+		}
 		var payload []byte = make([]byte, 26) //set payload of length 26
 		if ipv4h, udph, rem, state, err = c.conf.Embedder.SetByte(ipv4h, udph, rem, state); err != nil {
 			break
 		}
 
-		if wbuf, udph, err = createUDPHeader(udph, c.conf.OriginIP, c.conf.FriendIP, c.conf.OriginReceivePort, c.conf.FriendReceivePort, payload); err != nil {
+		if wbuf, udph, err = createUDPHeader(udph, c.conf.OriginIP, friendIP, c.conf.OriginReceivePort, c.conf.FriendReceivePort, payload); err != nil {
 			break
 		}
 
@@ -188,7 +236,7 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 			c.sendPktLog.Add(c.conf.OriginReceivePort, packet{Ipv4h: ipv4h, Udph: udph})
 		}
 
-		if err = c.sendPacket(&ipv4h, wbuf, &cm); err != nil {
+		if err = c.sendPacket(ctx, &ipv4h, wbuf, &cm); err != nil {
 			break
 		}
 		state = state.IncrementState()
@@ -204,7 +252,7 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 	//last payload determining the end of the message
 	var payload []byte = make([]byte, 24) //length 24 signifies the end of the message
 
-	if wbuf, udph, err = createUDPHeader(udph, c.conf.OriginIP, c.conf.FriendIP, c.conf.OriginReceivePort, c.conf.FriendReceivePort, payload); err != nil {
+	if wbuf, udph, err = createUDPHeader(udph, c.conf.OriginIP, friendIP, c.conf.OriginReceivePort, c.conf.FriendReceivePort, payload); err != nil {
 		return n, err
 	}
 
@@ -212,17 +260,19 @@ func (c *Channel) Send(data []byte) (uint64, error) {
 		c.sendPktLog.Add(c.conf.OriginReceivePort, packet{Ipv4h: ipv4h, Udph: udph})
 	}
 
-	err = c.sendPacket(&ipv4h, wbuf, &cm)
+	err = c.sendPacket(ctx, &ipv4h, wbuf, &cm)
 	return n, err
 }
 
-func (c *Channel) sendPacket(h *ipv4.Header, b []byte, cm *ipv4.ControlMessage) error {
+func (c *Channel) sendPacket(ctx context.Context, h *ipv4.Header, b []byte, cm *ipv4.ControlMessage) error {
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
-	if c.conf.WriteTimeout != 0 {
-		c.rawConn.SetWriteDeadline(time.Now().Add(c.conf.WriteTimeout))
+	c.rawConn.SetWriteDeadline(channel.Deadline(ctx, c.conf.WriteTimeout))
+	if err := c.rawConn.WriteTo(h, b, cm); err != nil {
+		return channel.ContextError(ctx, err)
 	}
-	return c.rawConn.WriteTo(h, b, cm)
+	c.AddWritten(1)
+	return nil
 }
 
 // We return the tcph header so that it can be logged if needed for debugging
@@ -257,22 +307,41 @@ func createUDPHeader(udph layers.UDP, sip, dip [4]byte, sport, dport uint16, pay
 }
 
 func (c *Channel) Receive(data []byte) (uint64, error) {
+	return c.ReceiveContext(context.Background(), data)
+}
+
+// Receive a covert message, returning early if the context is done
+func (c *Channel) ReceiveContext(ctx context.Context, data []byte) (uint64, error) {
+	n, _, err := c.ReceiveFrom(ctx, data)
+	return n, err
+}
+
+// Receive a covert message from any peer
+// The message is read from the first peer to send a packet. Packets from
+// other peers are held back until the message is complete, so that their
+// messages can be read by the following receives.
+func (c *Channel) ReceiveFrom(ctx context.Context, data []byte) (uint64, int, error) {
 
 	// We must expand out the input storage array to
 	// the correct size to potentially handle variable size inputs
 	dataBuf, err := embedders.GetBuf(c.conf.Embedder.GetMask(), data)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	if len(dataBuf) == 0 {
-		return 0, nil
+		return 0, 0, nil
 	}
 
 	var (
 		buf          []byte = make([]byte, 1024)
-		saddr        [4]byte
 		sport, dport uint16
+		// The peer sending the message, once its first packet has arrived
+		peer int = -1
+		// The held packets that have not yet been read, followed by
+		// the packets held back during this receive
+		queue []rawPacket = c.held
+		held  []rawPacket
 		// There is guaranteed to be at least one space for a byte in the
 		// data buffer at this point
 		pos uint64 = 0
@@ -288,24 +357,36 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 		p              []byte
 	)
 
-	saddr, sport, dport = c.conf.FriendIP, c.conf.FriendReceivePort, c.conf.OriginReceivePort
+	c.held = nil
+	sport, dport = c.conf.FriendReceivePort, c.conf.OriginReceivePort
 
 	prevPacketTime = time.Now()
 
 	for {
 
-		h, p, _, err = c.readConn(buf)
-		if err != nil {
+		if len(queue) > 0 {
+			h, p, queue = queue[0].h, queue[0].p, queue[1:]
+		} else if h, p, _, err = c.readConn(ctx, buf); err != nil {
 			break
 		}
 		udph := layers.UDP{}
 		if err = udph.DecodeFromBytes(p, gopacket.NilDecodeFeedback); err == nil {
-			// We check for the expected source IP, source port, and destination port
-			if bytes.Equal(h.Src.To4(), saddr[:]) {
+			// We check for the IP of a peer, the expected source port, and destination port
+			if from := c.peers.Index(h.Src); from >= 0 {
 				if udph.SrcPort == layers.UDPPort(sport) && udph.DstPort == layers.UDPPort(dport) {
+					if udph.Length != uint16(32) && udph.Length != uint16(34) { //not packet from friend port
+						continue
+					} else if peer >= 0 && from != peer { //part of another peer's message
+						if len(held) < maxHeld {
+							held = append(held, rawPacket{h: h, p: append([]byte{}, p...)})
+						}
+						continue
+					}
+					peer = from
+					c.AddRead(1)
 					if udph.Length == uint16(32) { //end of message
 						break
-					} else if udph.Length == uint16(34) { //the rest of the message
+					} else { //the rest of the message
 						var b []byte
 						b, state, err = c.conf.Embedder.GetByte(*h, udph, state)
 						if err != nil {
@@ -321,8 +402,6 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 								pos++
 							}
 						}
-					} else { //not packet from friend port
-						continue
 					}
 				}
 			}
@@ -332,19 +411,20 @@ func (c *Channel) Receive(data []byte) (uint64, error) {
 			break
 		}
 	}
-	return embedders.CopyData(c.conf.Embedder.GetMask(), pos, dataBuf, data, err)
+	c.held = append(held, queue...)
+	if peer < 0 {
+		peer = 0
+	}
+	n, err := embedders.CopyData(c.conf.Embedder.GetMask(), pos, dataBuf, data, err)
+	return n, peer, err
 }
 
 // Read from a raw connection whil setting a timeout if necessary
-func (c *Channel) readConn(buf []byte) (*ipv4.Header, []byte, *ipv4.ControlMessage, error) {
-	if c.conf.ReadTimeout > 0 {
-		c.rawConn.SetReadDeadline(time.Now().Add(c.conf.ReadTimeout))
-	} else {
-		// A deadline of zero means never timeout
-		// The initial Time struct is zero
-		c.rawConn.SetReadDeadline(time.Time{})
-	}
-	return c.rawConn.ReadFrom(buf)
+// The read is interrupted if the context is done
+func (c *Channel) readConn(ctx context.Context, buf []byte) (*ipv4.Header, []byte, *ipv4.ControlMessage, error) {
+	defer channel.SetDeadline(ctx, c.conf.ReadTimeout, c.rawConn.SetReadDeadline)()
+	h, p, cm, err := c.rawConn.ReadFrom(buf)
+	return h, p, cm, channel.ContextError(ctx, err)
 }
 
 // Creates the ip header message
@@ -1,7 +1,9 @@
 package udpIP
 
 import (
+	"../../config"
 	"bytes"
+	"context"
 	"log"
 	"testing"
 	"time"
@@ -125,6 +127,64 @@ func TestReceiveSendSelf(t *testing.T) {
 
 }
 
+// Messages sent by several peers at once must each be received whole,
+// along with the peer that sent them
+func TestPeers(t *testing.T) {
+
+	log.Println("Starting TestPeers")
+
+	group, err := MakeChannel(Config{
+		FriendIP:          [4]byte{127, 0, 0, 2},
+		OriginIP:          [4]byte{127, 0, 0, 1},
+		FriendReceivePort: 8085,
+		OriginReceivePort: 8084,
+		ReadTimeout:       time.Second,
+		Peers:             []config.Peer{{Name: "carol", IP: [4]byte{127, 0, 0, 3}}},
+	})
+	if err != nil {
+		t.Fatalf("err = '%s'; want nil", err.Error())
+	}
+	defer group.Close()
+
+	var members []*Channel
+	for _, ip := range [][4]byte{{127, 0, 0, 2}, {127, 0, 0, 3}} {
+		ch, err := MakeChannel(Config{FriendIP: [4]byte{127, 0, 0, 1}, OriginIP: ip, FriendReceivePort: 8084, OriginReceivePort: 8085, ReadTimeout: time.Second})
+		if err != nil {
+			t.Fatalf("err = '%s'; want nil", err.Error())
+		}
+		defer ch.Close()
+		members = append(members, ch)
+	}
+
+	var (
+		inputs   []string       = []string{"Hello from bob", "Hi from carol"}
+		received map[int]string = make(map[int]string)
+		data     [20]byte
+	)
+	for i := range members {
+		go members[i].Send([]byte(inputs[i]))
+	}
+	for range members {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		n, from, err := group.ReceiveFrom(ctx, data[:])
+		cancel()
+		if err != nil {
+			t.Errorf("err = '%s'; want nil", err.Error())
+		}
+		received[from] = string(data[:n])
+	}
+	if received[0] != inputs[0] || received[1] != inputs[1] {
+		t.Errorf("received = %v; want %v", received, inputs)
+	}
+
+	go group.SendTo(context.Background(), 1, []byte("Hello carol"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if n, from, err := members[1].ReceiveFrom(ctx, data[:]); err != nil || string(data[:n]) != "Hello carol" || from != 0 {
+		t.Errorf("received = %s from %d, %v; want Hello carol from 0", string(data[:n]), from, err)
+	}
+}
+
 func sendAndCheck(t *testing.T, input []byte, sch *Channel) {
 	n, err := sch.Send(input)
 	if err != nil {
@@ -3,6 +3,7 @@ package udpIP
 import ()
 
 import (
+	"../../channel"
 	"../../config"
 	"errors"
 	"time"
@@ -18,6 +19,11 @@ type ConfigClient struct {
 	ReadTimeout       config.U64Param
 	DialTimeout       config.U64Param
 	AcceptTimeout     config.U64Param
+	Peers             config.PeersParam
+}
+
+func init() {
+	channel.Register("UdpIP", GetDefault, ToChannel)
 }
 
 func GetDefault() ConfigClient {
@@ -31,9 +37,15 @@ func GetDefault() ConfigClient {
 		DialTimeout:       config.MakeU64(500, [2]uint64{0, 65535}, config.Display{Description: "The dial timeout for the send method in milliseconds. Zero for no timeout.", Name: "Dial Timeout", Group: "Timing"}),
 		Embedder:          config.MakeSelect("id", []string{"id"}, config.Display{Description: "The embedding mechanism to use for this protocol.", Name: "Embedding", Group: "Settings"}),
 		AcceptTimeout:     config.MakeU64(0, [2]uint64{0, 65535}, config.Display{Description: "The accept timeout for the receive method in milliseconds. Zero for no timeout.", Name: "Accept Timeout", Group: "Timing"}),
+		Peers:             config.MakePeers("", config.Display{Description: "Other friends to send to and receive from, as name=IP on each line. They use the same ports as your friend.", Name: "Peers", Group: "IP Addresses"}),
 	}
 }
 
+// The receive ports must differ if your friend is on this host
+func (cc ConfigClient) ValidateAll() config.FieldErrors {
+	return channel.ReceivePortErrors(cc.FriendIP, cc.FriendReceivePort, cc.OriginReceivePort)
+}
+
 func ToChannel(cc ConfigClient) (*Channel, error) {
 	var c Config
 	var friendIP, originIP [4]byte
@@ -54,6 +66,9 @@ func ToChannel(cc ConfigClient) (*Channel, error) {
 	c.AcceptTimeout = time.Duration(cc.AcceptTimeout.Value) * time.Millisecond
 	c.ReadTimeout = time.Duration(cc.ReadTimeout.Value) * time.Millisecond
 	c.WriteTimeout = time.Duration(cc.WriteTimeout.Value) * time.Millisecond
+	if c.Peers, err = cc.Peers.GetValue(); err != nil {
+		return nil, errors.New("Invalid Peers value")
+	}
 
 	switch cc.Embedder.Value {
 	case "id":
@@ -1,6 +1,9 @@
 package udpNormal
 
 import (
+	"../../channel"
+	"../../config"
+	"context"
 	"net"
 )
 
@@ -9,23 +12,29 @@ type Config struct {
 	OriginIP        [4]byte
 	DestinationPort uint16
 	OriginPort      uint16
+	// Other friends that messages can be sent to and received from
+	Peers []config.Peer
 }
 
 // A UDP channel
 type Channel struct {
 	conf       Config
+	peers      channel.Peers
 	packetConn net.PacketConn
-	clientConn net.Conn
+	// The conn used to send to each peer
+	clientConns []net.Conn
+
+	// The packets written and read, for channel.PacketCounter
+	channel.PacketCount
 }
 
 func (c *Channel) Close() error {
 	err := c.packetConn.Close()
-	if err != nil {
-		c.clientConn.Close()
-		return err
+	for _, conn := range c.clientConns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
 	}
-	err = c.clientConn.Close()
-
 	return err
 }
 
@@ -36,6 +45,9 @@ func MakeChannel(conf Config) (*Channel, error) {
 	c := &Channel{
 		conf: conf,
 	}
+	if c.peers, err = channel.MakePeers(conf.FriendIP, conf.Peers); err != nil {
+		return nil, err
+	}
 
 	//server ready for incoming udp interaction to server address
 	packetConn, err := net.ListenPacket("udp4", (&net.UDPAddr{IP: c.conf.OriginIP[:], Port: int(c.conf.OriginPort)}).String())
@@ -44,26 +56,71 @@ func MakeChannel(conf Config) (*Channel, error) {
 	}
 	c.packetConn = packetConn
 
-	//client conn
-	clientConn, err := net.Dial("udp4", (&net.UDPAddr{IP: c.conf.FriendIP[:], Port: int(c.conf.DestinationPort)}).String())
-	if err != nil {
-		return nil, err
+	//client conns
+	//These are sent from the origin IP so that peers can tell who sent each message
+	for _, p := range c.peers {
+		clientConn, err := net.DialUDP("udp4", &net.UDPAddr{IP: c.conf.OriginIP[:]}, &net.UDPAddr{IP: p.IP[:], Port: int(c.conf.DestinationPort)})
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.clientConns = append(c.clientConns, clientConn)
 	}
-	c.clientConn = clientConn
 
 	return c, nil
 }
 
+func (c *Channel) Peers() []string {
+	return c.peers.Names()
+}
+
 func (c *Channel) Receive(data []byte) (uint64, error) {
+	return c.ReceiveContext(context.Background(), data)
+}
+
+func (c *Channel) ReceiveContext(ctx context.Context, data []byte) (uint64, error) {
+	n, _, err := c.ReceiveFrom(ctx, data)
+	return n, err
+}
+
+// Receive a message from any peer
+// Messages from other addresses are ignored
+func (c *Channel) ReceiveFrom(ctx context.Context, data []byte) (uint64, int, error) {
+	defer channel.SetDeadline(ctx, 0, c.packetConn.SetReadDeadline)()
 
 	//server reads
-	n, _, err := c.packetConn.ReadFrom(data)
-	return uint64(n), err
+	for {
+		n, addr, err := c.packetConn.ReadFrom(data)
+		if err != nil {
+			return uint64(n), 0, channel.ContextError(ctx, err)
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok {
+			if peer := c.peers.Index(udpAddr.IP); peer >= 0 {
+				c.AddRead(1)
+				return uint64(n), peer, nil
+			}
+		}
+	}
 }
 
 func (c *Channel) Send(data []byte) (uint64, error) {
-	//client sends
-	n, err := c.clientConn.Write(data)
-	return uint64(n), err
+	return c.SendContext(context.Background(), data)
+}
 
+func (c *Channel) SendContext(ctx context.Context, data []byte) (uint64, error) {
+	return c.SendTo(ctx, 0, data)
+}
+
+func (c *Channel) SendTo(ctx context.Context, peer int, data []byte) (uint64, error) {
+	if err := c.peers.Valid(peer); err != nil {
+		return 0, err
+	}
+	defer channel.SetDeadline(ctx, 0, c.clientConns[peer].SetWriteDeadline)()
+
+	//client sends
+	n, err := c.clientConns[peer].Write(data)
+	if err == nil {
+		c.AddWritten(1)
+	}
+	return uint64(n), channel.ContextError(ctx, err)
 }
@@ -1,6 +1,7 @@
 package udpNormal
 
 import (
+	"../../channel"
 	"../../config"
 	"errors"
 )
@@ -10,6 +11,11 @@ type ConfigClient struct {
 	OriginIP        config.IPV4Param
 	DestinationPort config.U16Param
 	OriginPort      config.U16Param
+	Peers           config.PeersParam
+}
+
+func init() {
+	channel.Register("UdpNormal", GetDefault, ToChannel)
 }
 
 func GetDefault() ConfigClient {
@@ -18,6 +24,7 @@ func GetDefault() ConfigClient {
 		OriginIP:        config.MakeIPV4("127.0.0.1", config.Display{Description: "Your IP Address."}),
 		DestinationPort: config.MakeU16(8123, [2]uint16{0, 65535}, config.Display{Description: "Your friends tcp receive Port. Their send port is chosen randomly."}),
 		OriginPort:      config.MakeU16(8124, [2]uint16{0, 65535}, config.Display{Description: "Your tcp receive Port. Send port is chosen randomly."}),
+		Peers:           config.MakePeers("", config.Display{Description: "Other friends to send to and receive from, as name=IP on each line. They use the same ports as your friend."}),
 	}
 }
 
@@ -36,6 +43,9 @@ func ToChannel(cc ConfigClient) (*Channel, error) {
 	c.OriginIP = originIP
 	c.DestinationPort = cc.DestinationPort.Value
 	c.OriginPort = cc.OriginPort.Value
+	if c.Peers, err = cc.Peers.GetValue(); err != nil {
+		return nil, errors.New("Invalid Peers value")
+	}
 
 	if ch, err := MakeChannel(c); err != nil {
 		return nil, err
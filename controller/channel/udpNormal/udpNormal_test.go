@@ -1,8 +1,11 @@
 package udpNormal
 
 import (
+	"../../config"
 	"bytes"
+	"context"
 	"log"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -61,6 +64,75 @@ func TestReceiveSend(t *testing.T) {
 			t.Errorf("err = '%s'; want nil", rErr.Error())
 		}
 	}
+	// Each message is a single datagram
+	if written, _ := sch.Packets(); written != 2 {
+		t.Errorf("written = %d; want 2", written)
+	}
+	if _, read := rch.Packets(); read != 2 {
+		t.Errorf("read = %d; want 2", read)
+	}
+	if err := sch.Close(); err != nil {
+		t.Errorf("err = '%s'; want nil", err.Error())
+	}
+	if err := rch.Close(); err != nil {
+		t.Errorf("err = '%s'; want nil", err.Error())
+	}
+}
+
+// A receive must return once its context is done, and must not
+// affect later receives
+func TestReceiveContext(t *testing.T) {
+
+	log.Println("Starting TestReceiveContext")
+
+	sch, err := MakeChannel(sconf)
+	if err != nil {
+		t.Errorf("err = '%s'; want nil", err.Error())
+	}
+
+	rch, err := MakeChannel(rconf)
+	if err != nil {
+		t.Errorf("err = '%s'; want nil", err.Error())
+	}
+
+	var data [15]byte
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if _, err := rch.ReceiveContext(ctx, data[:]); err != context.DeadlineExceeded {
+		t.Errorf("err = '%v'; want '%v'", err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+	if _, err := rch.ReceiveContext(ctx, data[:]); err != context.Canceled {
+		t.Errorf("err = '%v'; want '%v'", err, context.Canceled)
+	}
+
+	var (
+		c     chan []byte = make(chan []byte)
+		rErr  error
+		nr    uint64
+		input []byte = []byte("Hello world!")
+	)
+	go func() {
+		nr, rErr = rch.Receive(data[:])
+		select {
+		case c <- data[:nr]:
+		case <-time.After(time.Second * 5):
+		}
+	}()
+
+	sendAndCheck(t, input, sch)
+
+	receiveAndCheck(t, input, c)
+
+	if rErr != nil {
+		t.Errorf("err = '%s'; want nil", rErr.Error())
+	}
 	if err := sch.Close(); err != nil {
 		t.Errorf("err = '%s'; want nil", err.Error())
 	}
@@ -69,6 +141,69 @@ func TestReceiveSend(t *testing.T) {
 	}
 }
 
+// A channel with peers must send to each peer separately, report which peer
+// sent each message, and ignore messages from other addresses
+func TestPeers(t *testing.T) {
+
+	log.Println("Starting TestPeers")
+
+	group, err := MakeChannel(Config{
+		FriendIP:        [4]byte{127, 0, 0, 2},
+		OriginIP:        [4]byte{127, 0, 0, 1},
+		DestinationPort: 8083,
+		OriginPort:      8082,
+		Peers:           []config.Peer{{Name: "carol", IP: [4]byte{127, 0, 0, 3}}},
+	})
+	if err != nil {
+		t.Fatalf("err = '%s'; want nil", err.Error())
+	}
+	defer group.Close()
+	if peers := group.Peers(); !reflect.DeepEqual(peers, []string{"friend", "carol"}) {
+		t.Errorf("peers = %v; want [friend carol]", peers)
+	}
+
+	var members []*Channel
+	for _, ip := range [][4]byte{{127, 0, 0, 2}, {127, 0, 0, 3}, {127, 0, 0, 4}} {
+		ch, err := MakeChannel(Config{FriendIP: [4]byte{127, 0, 0, 1}, OriginIP: ip, DestinationPort: 8082, OriginPort: 8083})
+		if err != nil {
+			t.Fatalf("err = '%s'; want nil", err.Error())
+		}
+		defer ch.Close()
+		members = append(members, ch)
+	}
+
+	var data [15]byte
+	for peer, input := range []string{"Hello friend", "Hello carol"} {
+		if _, err := group.SendTo(context.Background(), peer, []byte(input)); err != nil {
+			t.Errorf("err = '%s'; want nil", err.Error())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+		n, from, err := members[peer].ReceiveFrom(ctx, data[:])
+		cancel()
+		if err != nil || string(data[:n]) != input || from != 0 {
+			t.Errorf("received = %s from %d, %v; want %s from 0", string(data[:n]), from, err, input)
+		}
+	}
+	if _, err := group.SendTo(context.Background(), 2, []byte("Hello")); err == nil {
+		t.Errorf("err = nil; want invalid peer error")
+	}
+
+	// The last member is not a peer of the group
+	for i := len(members) - 1; i >= 0; i-- {
+		if _, err := members[i].Send([]byte{byte(i)}); err != nil {
+			t.Errorf("err = '%s'; want nil", err.Error())
+		}
+	}
+	for _, peer := range []int{1, 0} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+		n, from, err := group.ReceiveFrom(ctx, data[:])
+		cancel()
+		if err != nil || n != 1 || data[0] != byte(peer) || from != peer {
+			t.Errorf("received %v from %d, %v; want [%d] from %d", data[:n], from, err, peer, peer)
+		}
+	}
+}
+
 func sendAndCheck(t *testing.T, input []byte, sch *Channel) {
 	n, err := sch.Send(input)
 	if err != nil {
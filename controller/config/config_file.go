@@ -0,0 +1,210 @@
+package config
+
+import (
+	"encoding/hex"
+	"errors"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"strconv"
+)
+
+// A param of a config, as described by ParamsOf
+type ParamInfo struct {
+	// The name of the field of the param
+	Name string
+	Type string
+	// The value of the param, in the format accepted by SetValue
+	Value   string
+	Display Display
+}
+
+// Describe the params of a config struct, in the order of its fields
+// This is used for presenting configs outside of the web interface, such as with command-line flags
+func ParamsOf(c interface{}) ([]ParamInfo, error) {
+	v := reflect.ValueOf(c)
+	// We support pointers
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	t := v.Type()
+	if t.Kind() != reflect.Struct {
+		return nil, errors.New("Config is not a struct")
+	}
+	var params []ParamInfo
+	for i := 0; i < t.NumField(); i++ {
+		fieldName := t.Field(i).Name
+		if !v.Field(i).CanInterface() {
+			return nil, errors.New(fieldName + " : Could not retrieve unexported field")
+		}
+		if _, ok := v.Field(i).Interface().(param); !ok {
+			return nil, errors.New(fieldName + " : Invalid struct field type")
+		}
+		params = append(params, ParamInfo{
+			Name:    fieldName,
+			Type:    v.Field(i).FieldByName("Type").String(),
+			Value:   valueText(v.Field(i).FieldByName("Value")),
+			Display: v.Field(i).FieldByName("Display").Interface().(Display),
+		})
+	}
+	return params, nil
+}
+
+// The value of a param as text
+// Keys are given in hexadecimal, as they are in the web interface
+func valueText(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	case reflect.Slice:
+		return hex.EncodeToString(v.Bytes())
+	default:
+		return v.String()
+	}
+}
+
+// Set the value of a param of a config from text, such as a command-line flag
+// c must be a pointer to a config struct. The text is in the format given by
+// ParamsOf, and the new value is checked with the Validate method of the param.
+// Combinations of params are not checked (see AllValidator).
+func SetValue(c interface{}, field string, text string) error {
+	v := reflect.ValueOf(c)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return errors.New("Config must be pointer to struct")
+	}
+	f := v.Elem().FieldByName(field)
+	if !f.IsValid() || !f.CanInterface() {
+		return errors.New(field + " : Unknown param")
+	}
+	if _, ok := f.Interface().(param); !ok {
+		return errors.New(field + " : Unknown param")
+	}
+
+	var (
+		value reflect.Value = f.FieldByName("Value")
+		err   error
+	)
+	switch value.Kind() {
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(text); err == nil {
+			value.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		if n, err = strconv.ParseInt(text, 10, value.Type().Bits()); err == nil {
+			value.SetInt(n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		if n, err = strconv.ParseUint(text, 10, value.Type().Bits()); err == nil {
+			value.SetUint(n)
+		}
+	case reflect.Float32, reflect.Float64:
+		var n float64
+		if n, err = strconv.ParseFloat(text, value.Type().Bits()); err == nil {
+			value.SetFloat(n)
+		}
+	case reflect.Slice:
+		var b []byte
+		if b, err = hex.DecodeString(text); err == nil {
+			value.SetBytes(b)
+		}
+	case reflect.String:
+		value.SetString(text)
+	default:
+		return errors.New(field + " : Unsupported value type")
+	}
+	if err != nil {
+		return errors.New(field + " : Invalid value " + text)
+	}
+	if err = f.Interface().(param).Validate(); err != nil {
+		return errors.New(field + " : " + err.Error())
+	}
+	return nil
+}
+
+// The most values read from a config file, counting each use of an alias
+// separately, so that aliases cannot be used to expand a small file
+const maxFileValues = 10000
+
+// Read a config file, which is either YAML or JSON
+// The file must contain a mapping, whose values may be mappings, lists or values.
+// Every value is read as text, as it is written in the file, in the format
+// accepted by SetValue, so that numbers and keys are not converted. Null values
+// are read as empty text.
+func ParseFile(data []byte) (map[string]interface{}, error) {
+	var (
+		doc    yaml.Node
+		values int
+	)
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	// The file is empty or only has comments
+	if len(doc.Content) == 0 {
+		return make(map[string]interface{}), nil
+	}
+	v, err := nodeText(doc.Content[0], &values)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		return m, nil
+	}
+	return nil, errors.New("Config file must contain a mapping")
+}
+
+func nodeError(n *yaml.Node, msg string) error {
+	return errors.New("Line " + strconv.Itoa(n.Line) + " : " + msg)
+}
+
+// Convert a YAML node to text, or to lists and mappings of text
+func nodeText(n *yaml.Node, values *int) (interface{}, error) {
+	if *values++; *values > maxFileValues {
+		return nil, nodeError(n, "Too many values")
+	}
+	switch n.Kind {
+	case yaml.AliasNode:
+		return nodeText(n.Alias, values)
+	case yaml.ScalarNode:
+		if n.ShortTag() == "!!null" {
+			return "", nil
+		}
+		return n.Value, nil
+	case yaml.SequenceNode:
+		var list []interface{} = make([]interface{}, 0, len(n.Content))
+		for _, c := range n.Content {
+			v, err := nodeText(c, values)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case yaml.MappingNode:
+		var m map[string]interface{} = make(map[string]interface{})
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			if key.Kind != yaml.ScalarNode {
+				return nil, nodeError(key, "Keys must be values")
+			}
+			if _, ok := m[key.Value]; ok {
+				return nil, nodeError(key, "Duplicate key "+key.Value)
+			}
+			v, err := nodeText(n.Content[i+1], values)
+			if err != nil {
+				return nil, err
+			}
+			m[key.Value] = v
+		}
+		return m, nil
+	default:
+		return nil, nodeError(n, "Unexpected value")
+	}
+}
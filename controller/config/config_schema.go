@@ -0,0 +1,109 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+)
+
+// A JSON Schema (https://json-schema.org)
+type Schema map[string]interface{}
+
+// The JSON Schema of a config struct, for validating configs without the server
+// Each param is an object with the schema of its Value, which gives the type,
+// range and default value of the param. The name and description of the param
+// are given as the title and description of the object, and its group in "x-group".
+// Only the values of params are read from configs (see CopyValue), so no fields
+// are required. Checks of combinations of params (see AllValidator) cannot be described.
+func ConfigSchema(c interface{}) (Schema, error) {
+	v := reflect.ValueOf(c)
+	// We support pointers
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	t := v.Type()
+	if t.Kind() != reflect.Struct {
+		return nil, errors.New("Config is not a struct")
+	}
+	var properties map[string]interface{} = make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		fieldName := t.Field(i).Name
+		if !v.Field(i).CanInterface() {
+			return nil, errors.New(fieldName + " : Could not retrieve unexported field")
+		}
+		value, ok := valueSchema(v.Field(i).Interface())
+		if !ok {
+			return nil, errors.New(fieldName + " : Invalid struct field type")
+		}
+		var display Display = v.Field(i).FieldByName("Display").Interface().(Display)
+		s := Schema{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"Type":  Schema{"const": v.Field(i).FieldByName("Type").String()},
+				"Value": value,
+			},
+		}
+		if s["title"] = display.Name; display.Name == "" {
+			s["title"] = fieldName
+		}
+		if display.Description != "" {
+			s["description"] = display.Description
+		}
+		if display.Group != "" {
+			s["x-group"] = display.Group
+		}
+		properties[fieldName] = s
+	}
+	return Schema{"type": "object", "properties": properties, "additionalProperties": false}, nil
+}
+
+// The schema of the Value of a param, with its default value
+// Returns false if p is not a param
+func valueSchema(p interface{}) (Schema, bool) {
+	var s Schema
+	switch p := p.(type) {
+	case I8Param:
+		s = Schema{"type": "integer", "minimum": p.Range[0], "maximum": p.Range[1], "default": p.Value}
+	case U16Param:
+		s = Schema{"type": "integer", "minimum": p.Range[0], "maximum": p.Range[1], "default": p.Value}
+	case U64Param:
+		s = Schema{"type": "integer", "minimum": p.Range[0], "maximum": p.Range[1], "default": p.Value}
+	case ExactU64Param:
+		s = Schema{"type": "string", "pattern": "^[0-9]+$", "default": p.Value}
+	case DurationParam:
+		// The range cannot be checked by JSON Schema, so it is only described
+		s = Schema{"type": "string", "pattern": "^[-+]?(([0-9]+(\\.[0-9]*)?|\\.[0-9]+)(ns|us|µs|μs|ms|s|m|h))+$|^[-+]?0$", "default": p.Value,
+			"description": "A duration from " + p.Range[0] + " to " + p.Range[1] + ", such as 1.5s or 500ms"}
+	case FloatParam:
+		s = Schema{"type": "number", "minimum": p.Range[0], "maximum": p.Range[1], "default": p.Value}
+	case StringParam:
+		s = Schema{"type": "string", "pattern": "^(?:" + p.Pattern + ")$", "default": p.Value}
+	case BoolParam:
+		s = Schema{"type": "boolean", "default": p.Value}
+	case SelectParam:
+		s = Schema{"type": "string", "enum": p.Range, "default": p.Value}
+	case IPV4Param:
+		s = Schema{"type": "string", "format": "ipv4", "default": p.Value}
+	case IPParam:
+		formats := []interface{}{Schema{"format": "ipv4"}, Schema{"format": "ipv6"}}
+		if p.Hostname {
+			formats = append(formats, Schema{"format": "hostname"})
+		}
+		s = Schema{"type": "string", "anyOf": formats, "default": p.Value}
+	case PrefixParam:
+		s = Schema{"type": "string", "description": "An IPV4 or IPV6 address or network prefix, such as 10.0.0.0/8", "default": p.Value}
+	case PeersParam:
+		s = Schema{"type": "string", "description": "Entries of the form name=address, on separate lines or separated by commas", "default": p.Value}
+	case HexKeyParam:
+		// Byte slices are base64 encoded, so the key length cannot be checked by JSON Schema
+		var lengths []interface{}
+		for _, l := range p.Range {
+			lengths = append(lengths, l)
+		}
+		s = Schema{"type": "string", "contentEncoding": "base64", "x-lengths": lengths, "default": p.Value}
+	case KeyParam:
+		s = Schema{"type": "string", "default": p.Value}
+	default:
+		return nil, false
+	}
+	return s, true
+}
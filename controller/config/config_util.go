@@ -2,15 +2,48 @@ package config
 
 import (
 	"errors"
+	"math"
 	"net"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type param interface {
 	Validate() error
 }
 
+// A config that checks the combinations of its params
+// ValidateAll is called by Validate once every param is valid on its own.
+// It returns the errors keyed by the names of the offending fields,
+// or nil if the config is valid.
+type AllValidator interface {
+	ValidateAll() FieldErrors
+}
+
+// The errors of the params of a config, keyed by the name of the field
+// An error may be reported for several fields, so that each can be highlighted
+type FieldErrors map[string]string
+
+// The errors are listed in the order of their fields' names
+func (e FieldErrors) Error() string {
+	var (
+		names []string
+		msgs  []string
+	)
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		msgs = append(msgs, name+" : "+e[name])
+	}
+	return strings.Join(msgs, ", ")
+}
+
 type Display struct {
 	Description string
 	Name        string
@@ -59,6 +92,34 @@ type ExactU64Param struct {
 	Display Display
 }
 
+// A length of time, such as a timeout
+// The value is a string with a unit, such as "500ms", "1.5s" or "2m" (see time.ParseDuration),
+// so that durations are not limited to a single unit. The range is given the same way.
+// Use GetValue to retrieve the duration.
+type DurationParam struct {
+	Type    string
+	Value   string
+	Range   [2]string
+	Display Display
+}
+
+// A floating point number, such as a probability or the parameter of a distribution
+type FloatParam struct {
+	Type    string
+	Value   float64
+	Range   [2]float64
+	Display Display
+}
+
+// A string that must match a regular expression
+// The whole value must match Pattern, which uses the syntax of the regexp package
+type StringParam struct {
+	Type    string
+	Value   string
+	Pattern string
+	Display Display
+}
+
 type BoolParam struct {
 	Type    string
 	Value   bool
@@ -80,6 +141,45 @@ type IPV4Param struct {
 	Display Display
 }
 
+// An IPV4 or IPV6 address, or a hostname if Hostname is set
+// Hostnames are looked up with Resolver each time the value is retrieved, but
+// not when the param is validated, so that validation never waits for a lookup.
+// Use GetValue to retrieve the address, such as when a channel is opened.
+type IPParam struct {
+	Type     string
+	Value    string
+	Hostname bool
+	Display  Display
+}
+
+// An IPV4 or IPV6 network prefix in CIDR notation, such as "10.0.0.0/8" or "fe80::/10"
+// A single address is accepted as a prefix containing only that address.
+// Use GetValue to retrieve the network.
+type PrefixParam struct {
+	Type    string
+	Value   string
+	Display Display
+}
+
+// Looks up the addresses of the hostnames of IPParams
+// This may be replaced, for example to resolve names without DNS in tests
+var Resolver func(host string) ([]net.IP, error) = net.LookupIP
+
+// A list of named IPV4 addresses, such as the peers of a covert channel
+// Like IPV4Param, the value is a string, with an entry of the form name=address
+// on each line or separated by commas. Use GetValue to retrieve the entries.
+type PeersParam struct {
+	Type    string
+	Value   string
+	Display Display
+}
+
+// An entry of a PeersParam
+type Peer struct {
+	Name string
+	IP   [4]byte
+}
+
 type HexKeyParam struct {
 	Type    string
 	Value   []byte
@@ -130,6 +230,52 @@ func (p ExactU64Param) GetValue() (uint64, error) {
 	}
 }
 
+func (p DurationParam) Validate() error {
+	_, err := p.GetValue()
+	return err
+}
+
+func (p DurationParam) GetValue() (time.Duration, error) {
+	d, err := time.ParseDuration(p.Value)
+	if err != nil {
+		return 0, errors.New("Invalid duration " + p.Value)
+	}
+	min, err := time.ParseDuration(p.Range[0])
+	if err != nil {
+		return 0, errors.New("Invalid minimum duration " + p.Range[0])
+	}
+	max, err := time.ParseDuration(p.Range[1])
+	if err != nil {
+		return 0, errors.New("Invalid maximum duration " + p.Range[1])
+	}
+	if d < min || d > max {
+		return 0, errors.New("Duration value out of range")
+	}
+	return d, nil
+}
+
+func (p FloatParam) Validate() error {
+	if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+		return errors.New("Float value must be a finite number")
+	}
+	if p.Value >= p.Range[0] && p.Value <= p.Range[1] {
+		return nil
+	} else {
+		return errors.New("Float value out of range")
+	}
+}
+
+func (p StringParam) Validate() error {
+	re, err := regexp.Compile("^(?:" + p.Pattern + ")$")
+	if err != nil {
+		return errors.New("Invalid string pattern")
+	}
+	if !re.MatchString(p.Value) {
+		return errors.New("String value does not match " + p.Pattern)
+	}
+	return nil
+}
+
 func (p BoolParam) Validate() error {
 	return nil
 }
@@ -159,6 +305,116 @@ func (p IPV4Param) GetValue() ([4]byte, error) {
 	return buf, errors.New("Invalid IPV4 address")
 }
 
+// Only the syntax of a hostname is checked
+func (p IPParam) Validate() error {
+	if net.ParseIP(p.Value) != nil {
+		return nil
+	}
+	if !p.Hostname {
+		return errors.New("Invalid IP address")
+	}
+	if !validHostname(p.Value) {
+		return errors.New("Invalid IP address or hostname")
+	}
+	return nil
+}
+
+// If the value is a hostname, the first address found for it is returned
+func (p IPParam) GetValue() (net.IP, error) {
+	if ip := net.ParseIP(p.Value); ip != nil {
+		return ip, nil
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	ips, err := Resolver(p.Value)
+	if err != nil {
+		return nil, errors.New("Unable to resolve " + p.Value)
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("No addresses found for " + p.Value)
+	}
+	return ips[0], nil
+}
+
+var hostnamePattern *regexp.Regexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.?$`)
+
+func validHostname(host string) bool {
+	return len(host) <= 253 && hostnamePattern.MatchString(host)
+}
+
+func (p PrefixParam) Validate() error {
+	_, err := p.GetValue()
+	return err
+}
+
+func (p PrefixParam) GetValue() (*net.IPNet, error) {
+	if strings.Contains(p.Value, "/") {
+		_, n, err := net.ParseCIDR(p.Value)
+		if err != nil {
+			return nil, errors.New("Invalid network prefix")
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(p.Value)
+	if ip == nil {
+		return nil, errors.New("Invalid network prefix")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func (p PeersParam) Validate() error {
+	_, err := p.GetValue()
+	return err
+}
+
+// Names must be unique and only contain letters, digits, '-' and '_'
+func (p PeersParam) GetValue() ([]Peer, error) {
+	var (
+		peers []Peer
+		names map[string]bool = make(map[string]bool)
+	)
+	for _, entry := range strings.FieldsFunc(p.Value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid peer " + entry + ", expected name=address")
+		}
+		var peer Peer = Peer{Name: strings.TrimSpace(parts[0])}
+		if !validPeerName(peer.Name) {
+			return nil, errors.New("Invalid peer name " + peer.Name)
+		}
+		if names[peer.Name] {
+			return nil, errors.New("Duplicate peer name " + peer.Name)
+		}
+		names[peer.Name] = true
+		ip, err := IPV4Param{Value: strings.TrimSpace(parts[1])}.GetValue()
+		if err != nil {
+			return nil, errors.New("Invalid IPV4 address for peer " + peer.Name)
+		}
+		peer.IP = ip
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+func validPeerName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
 func (p HexKeyParam) Validate() error {
 	for _, l := range p.Range {
 		if len(p.Value) == l {
@@ -184,6 +440,15 @@ func MakeU64(value uint64, rng [2]uint64, display Display) U64Param {
 func MakeExactU64(value uint64, display Display) ExactU64Param {
 	return ExactU64Param{"exactu64", strconv.FormatUint(value, 10), display}
 }
+func MakeDuration(value time.Duration, rng [2]time.Duration, display Display) DurationParam {
+	return DurationParam{"duration", value.String(), [2]string{rng[0].String(), rng[1].String()}, display}
+}
+func MakeFloat(value float64, rng [2]float64, display Display) FloatParam {
+	return FloatParam{"float", value, rng, display}
+}
+func MakeString(value string, pattern string, display Display) StringParam {
+	return StringParam{"string", value, pattern, display}
+}
 func MakeSelect(value string, rng []string, display Display) SelectParam {
 	return SelectParam{"select", value, rng, display}
 }
@@ -193,6 +458,16 @@ func MakeBool(value bool, display Display) BoolParam {
 func MakeIPV4(value string, display Display) IPV4Param {
 	return IPV4Param{"ipv4", value, display}
 }
+func MakeIP(value string, hostname bool, display Display) IPParam {
+	return IPParam{"ip", value, hostname, display}
+}
+func MakePrefix(value string, display Display) PrefixParam {
+	return PrefixParam{"prefix", value, display}
+}
+
+func MakePeers(value string, display Display) PeersParam {
+	return PeersParam{"peers", value, display}
+}
 
 func MakeHexKey(value []byte, rng []int, display Display) HexKeyParam {
 	return HexKeyParam{"hexkey", value, rng, display}
@@ -202,6 +477,9 @@ func MakeKey(value string, display Display) KeyParam {
 	return KeyParam{"key", value, display}
 }
 
+// Check every param of a config struct, and then the combinations of params
+// if the config is an AllValidator
+// The errors of the params are returned as FieldErrors
 func Validate(c interface{}) error {
 	v := reflect.ValueOf(c)
 	// We support pointers
@@ -212,13 +490,13 @@ func Validate(c interface{}) error {
 	if t.Kind() != reflect.Struct {
 		return errors.New("Config is not a struct")
 	}
+	var errs FieldErrors = make(FieldErrors)
 	for i := 0; i < t.NumField(); i++ {
 		fieldName := t.Field(i).Name
 		if v.Field(i).CanInterface() {
 			if p, ok := v.Field(i).Interface().(param); ok {
-				err := p.Validate()
-				if err != nil {
-					return errors.New(fieldName + " : " + err.Error())
+				if err := p.Validate(); err != nil {
+					errs[fieldName] = err.Error()
 				}
 			} else {
 				return errors.New(fieldName + " : Invalid struct field type")
@@ -227,11 +505,22 @@ func Validate(c interface{}) error {
 			return errors.New(fieldName + " : Could not retrieve unexported field")
 		}
 	}
+	// Combinations are only checked once every param is valid,
+	// so ValidateAll may rely on the values of the params
+	if len(errs) == 0 {
+		if av, ok := v.Interface().(AllValidator); ok {
+			errs = av.ValidateAll()
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
 // This function analysis a struct containing several config structs
 // to ensure that they are all valid
+// A map from names to config structs (or pointers to them) is also supported
 func ValidateConfigSet(c interface{}) error {
 	v := reflect.ValueOf(c)
 	// We support pointers
@@ -239,6 +528,16 @@ func ValidateConfigSet(c interface{}) error {
 		v = v.Elem()
 	}
 	t := v.Type()
+	if t.Kind() == reflect.Map {
+		for _, name := range configNames(v) {
+			if f := configByName(v, name); !f.IsValid() {
+				return errors.New(name + " : Invalid config")
+			} else if err := Validate(f.Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	if t.Kind() != reflect.Struct {
 		return errors.New("Config is not a struct")
 	}
@@ -314,6 +613,8 @@ func performCopy(v1 reflect.Value, v2 reflect.Value) {
 }
 
 // Copy the set of config param values betweem the config structs
+// The sets may also be maps from names to pointers to config structs,
+// in which case fields are the keys of the configs to copy
 func CopyValueSet(c1 interface{}, c2 interface{}, fields []string) error {
 	p1 := reflect.ValueOf(c1)
 	v2 := reflect.ValueOf(c2)
@@ -333,19 +634,17 @@ func CopyValueSet(c1 interface{}, c2 interface{}, fields []string) error {
 	}
 
 	t := v1.Type()
-	if t.Kind() != reflect.Struct {
+	if t.Kind() != reflect.Struct && (t.Kind() != reflect.Map || t.Key().Kind() != reflect.String) {
 		return errors.New("Configs must be struct")
 	}
 	// If nil is supplied we copy all fields
 	if fields == nil {
-		for i := 0; i < t.NumField(); i++ {
-			fields = append(fields, t.Field(i).Name)
-		}
+		fields = configNames(v1)
 	}
 	for _, fname := range fields {
-		f1 := v1.FieldByName(fname)
-		f2 := v2.FieldByName(fname)
-		if f1.IsValid() || f2.IsValid() {
+		f1 := configByName(v1, fname)
+		f2 := configByName(v2, fname)
+		if f1.IsValid() && f2.IsValid() {
 			if err := validateCopy(f1, f2); err != nil {
 				return errors.New(fname + " : " + err.Error())
 			}
@@ -354,9 +653,42 @@ func CopyValueSet(c1 interface{}, c2 interface{}, fields []string) error {
 		}
 	}
 	for _, fname := range fields {
-		f1 := v1.FieldByName(fname)
-		f2 := v2.FieldByName(fname)
-		performCopy(f1, f2)
+		performCopy(configByName(v1, fname), configByName(v2, fname))
 	}
 	return nil
 }
+
+// The names of the configs in a set, which are either
+// the fields of a struct or the keys of a map
+// Map keys are sorted so that errors are reported consistently
+func configNames(v reflect.Value) []string {
+	var names []string
+	if v.Kind() == reflect.Map {
+		for _, k := range v.MapKeys() {
+			names = append(names, k.String())
+		}
+		sort.Strings(names)
+	} else {
+		for i := 0; i < v.NumField(); i++ {
+			names = append(names, v.Type().Field(i).Name)
+		}
+	}
+	return names
+}
+
+// Retrieve a config from a set by name
+// Pointers and interfaces are followed so that map entries,
+// which must be pointers to be settable, can be used like struct fields
+// The returned value is invalid if the config is not in the set
+func configByName(v reflect.Value, name string) reflect.Value {
+	var f reflect.Value
+	if v.Kind() == reflect.Map {
+		f = v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+	} else {
+		f = v.FieldByName(name)
+	}
+	for f.IsValid() && (f.Kind() == reflect.Ptr || f.Kind() == reflect.Interface) {
+		f = f.Elem()
+	}
+	return f
+}
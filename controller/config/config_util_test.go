@@ -2,8 +2,14 @@ package config
 
 import (
 	"bytes"
+	"errors"
+	"math"
+	"net"
+	"reflect"
+	"regexp"
 	"strconv"
 	"testing"
+	"time"
 )
 
 type testCase struct {
@@ -492,6 +498,46 @@ func TestSetCopy(t *testing.T) {
 	}
 }
 
+func TestMapSetCopy(t *testing.T) {
+
+	type conf1 struct {
+		P1 ValStruct
+	}
+
+	var m1 map[string]interface{} = map[string]interface{}{"C1": &conf1{P1: ValStruct{Value: 1}}, "C2": &conf1{P1: ValStruct{Value: 1}}}
+	var m2 map[string]interface{} = map[string]interface{}{"C1": &conf1{P1: ValStruct{Value: 2}}, "C2": &conf1{P1: ValStruct{Value: 3}}}
+
+	err := CopyValueSet(&m1, m2, []string{"C1"})
+	if err != nil {
+		t.Errorf("Unexpected error %s", err.Error())
+	} else if v := m1["C1"].(*conf1).P1.Value; v != 2 {
+		t.Errorf("Expected %d: Found %d", 2, v)
+	} else if v := m1["C2"].(*conf1).P1.Value; v != 1 {
+		t.Errorf("Expected %d: Found %d", 1, v)
+	}
+
+	err = CopyValueSet(&m1, m2, nil)
+	if err != nil {
+		t.Errorf("Unexpected error %s", err.Error())
+	} else if v := m1["C2"].(*conf1).P1.Value; v != 3 {
+		t.Errorf("Expected %d: Found %d", 3, v)
+	} else if m1["C1"] == m2["C1"] {
+		t.Errorf("Expected values to be copied, not the configs")
+	}
+
+	err = CopyValueSet(&m1, m2, []string{"C3"})
+	if err == nil || err.Error() != "C3 : field not in struct" {
+		t.Errorf("Expected error %s: Found %v", "C3 : field not in struct", err)
+	}
+
+	// Map entries must be pointers so that they can be set
+	var m3 map[string]interface{} = map[string]interface{}{"C1": conf1{}}
+	err = CopyValueSet(&m3, m3, nil)
+	if err == nil || err.Error() != "C1 : P1 : struct Value field must be settable" {
+		t.Errorf("Expected error %s: Found %v", "C1 : P1 : struct Value field must be settable", err)
+	}
+}
+
 func TestSetNoUpdateUnlessAllValid(t *testing.T) {
 
 	type conf1 struct {
@@ -580,3 +626,381 @@ func TestHexKey(t *testing.T) {
 		t.Errorf("Expected error %s; found %s", "Invalid key length", hKey.Validate().Error())
 	}
 }
+
+func TestPeers(t *testing.T) {
+	peers := MakePeers("alice=10.0.0.2, bob = 10.0.0.3\n\ncarol=10.0.0.4,", Display{})
+	if v, err := peers.GetValue(); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	} else if len(v) != 3 || v[0] != (Peer{"alice", [4]byte{10, 0, 0, 2}}) || v[1] != (Peer{"bob", [4]byte{10, 0, 0, 3}}) || v[2] != (Peer{"carol", [4]byte{10, 0, 0, 4}}) {
+		t.Errorf("Unexpected peers %v", v)
+	}
+
+	peers.Value = ""
+	if v, err := peers.GetValue(); err != nil || len(v) != 0 {
+		t.Errorf("Expected no peers; found %v, %v", v, err)
+	}
+
+	for _, value := range []string{"alice", "alice=10.0.0", "=10.0.0.2", "a b=10.0.0.2", "alice=10.0.0.2,alice=10.0.0.3"} {
+		peers.Value = value
+		if peers.Validate() == nil {
+			t.Errorf("Expected error for %s", value)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	d := MakeDuration(1500*time.Millisecond, [2]time.Duration{time.Millisecond, time.Minute}, Display{})
+	if d.Value != "1.5s" || d.Range != [2]string{"1ms", "1m0s"} {
+		t.Errorf("Unexpected duration param %v", d)
+	} else if v, err := d.GetValue(); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	} else if v != 1500*time.Millisecond {
+		t.Errorf("Expected %s; found %s", 1500*time.Millisecond, v)
+	}
+
+	d.Value = "250us"
+	if d.Validate() == nil || d.Validate().Error() != "Duration value out of range" {
+		t.Errorf("Expected out of range error; found %v", d.Validate())
+	}
+	for _, value := range []string{"", "10", "1.5 s", "2h"} {
+		d.Value = value
+		if d.Validate() == nil {
+			t.Errorf("Expected error for %s", value)
+		}
+	}
+
+	// Durations must copy between configs like other params
+	type conf struct {
+		Prm DurationParam
+	}
+	type set struct {
+		C conf
+	}
+	s1 := set{C: conf{Prm: d}}
+	s2 := set{C: conf{Prm: MakeDuration(20*time.Millisecond, [2]time.Duration{0, time.Hour}, Display{})}}
+	if err := CopyValueSet(&s1, s2, nil); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	} else if s1.C.Prm.Value != "20ms" || s1.C.Prm.Range != [2]string{"1ms", "1m0s"} {
+		t.Errorf("Unexpected copied param %v", s1.C.Prm)
+	}
+}
+
+func TestFloat(t *testing.T) {
+	f := MakeFloat(0.25, [2]float64{0, 1}, Display{})
+	if f.Validate() != nil {
+		t.Errorf("Expected no error; found %s", f.Validate().Error())
+	}
+	for _, value := range []float64{-0.1, 1.5, math.NaN(), math.Inf(1)} {
+		f.Value = value
+		if f.Validate() == nil {
+			t.Errorf("Expected error for %f", value)
+		}
+	}
+
+	type conf struct {
+		Prm FloatParam
+	}
+	type set struct {
+		C conf
+	}
+	s1 := set{C: conf{Prm: MakeFloat(0.5, [2]float64{0, 1}, Display{})}}
+	s2 := set{C: conf{Prm: MakeFloat(0.75, [2]float64{0, 1}, Display{})}}
+	if err := CopyValueSet(&s1, s2, nil); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	} else if s1.C.Prm.Value != 0.75 {
+		t.Errorf("Expected %f; found %f", 0.75, s1.C.Prm.Value)
+	}
+}
+
+func TestString(t *testing.T) {
+	s := MakeString("/index.html", "/[a-z.]*", Display{})
+	if s.Validate() != nil {
+		t.Errorf("Expected no error; found %s", s.Validate().Error())
+	}
+
+	// The whole value must match
+	s.Value = "/index.html?q=1"
+	if s.Validate() == nil || s.Validate().Error() != "String value does not match /[a-z.]*" {
+		t.Errorf("Expected match error; found %v", s.Validate())
+	}
+
+	s.Pattern = "("
+	if s.Validate() == nil || s.Validate().Error() != "Invalid string pattern" {
+		t.Errorf("Expected pattern error; found %v", s.Validate())
+	}
+
+	type conf struct {
+		Prm StringParam
+	}
+	type set struct {
+		C conf
+	}
+	s1 := set{C: conf{Prm: MakeString("a", "[a-z]+", Display{})}}
+	s2 := set{C: conf{Prm: MakeString("abc", "[a-z]+", Display{})}}
+	if err := CopyValueSet(&s1, s2, nil); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	} else if err := ValidateConfigSet(s1); err != nil || s1.C.Prm.Value != "abc" {
+		t.Errorf("Unexpected copied param %v, %v", s1.C.Prm, err)
+	}
+}
+
+func TestIP(t *testing.T) {
+	for _, value := range []string{"127.0.0.1", "::1", "fe80::1", "2001:db8::ff00:42:8329"} {
+		if err := MakeIP(value, false, Display{}).Validate(); err != nil {
+			t.Errorf("Expected no error for %s; found %s", value, err.Error())
+		}
+	}
+	if MakeIP("example.com", false, Display{}).Validate() == nil {
+		t.Errorf("Expected error for hostname when hostnames are not allowed")
+	}
+
+	// Hostnames are looked up with the resolver, but only when the value is retrieved
+	var lookups int
+	defer func(r func(string) ([]net.IP, error)) { Resolver = r }(Resolver)
+	Resolver = func(host string) ([]net.IP, error) {
+		lookups++
+		if host == "peer.example" {
+			return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	if ip, err := MakeIP("peer.example", true, Display{}).GetValue(); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	} else if !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Expected %s; found %s", "2001:db8::1", ip)
+	}
+	if err := MakeIP("unknown.example", true, Display{}).Validate(); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	}
+	if lookups != 1 {
+		t.Errorf("Expected 1 lookup; found %d", lookups)
+	}
+	if _, err := MakeIP("unknown.example", true, Display{}).GetValue(); err == nil || err.Error() != "Unable to resolve unknown.example" {
+		t.Errorf("Expected resolve error; found %v", err)
+	}
+	if err := MakeIP("bad host!", true, Display{}).Validate(); err == nil || err.Error() != "Invalid IP address or hostname" {
+		t.Errorf("Expected hostname error; found %v", err)
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	cases := map[string]string{
+		"10.1.2.3/8":  "10.0.0.0/8",
+		"fe80::1/10":  "fe80::/10",
+		"192.0.2.7":   "192.0.2.7/32",
+		"2001:db8::1": "2001:db8::1/128",
+	}
+	for value, expected := range cases {
+		if n, err := MakePrefix(value, Display{}).GetValue(); err != nil {
+			t.Errorf("Expected no error for %s; found %s", value, err.Error())
+		} else if n.String() != expected {
+			t.Errorf("Expected %s; found %s", expected, n.String())
+		}
+	}
+	for _, value := range []string{"", "10.0.0.0/33", "example.com", "::1/129"} {
+		if MakePrefix(value, Display{}).Validate() == nil {
+			t.Errorf("Expected error for %s", value)
+		}
+	}
+
+	type conf struct {
+		Address IPParam
+		Filter  PrefixParam
+	}
+	type set struct {
+		C conf
+	}
+	s1 := set{C: conf{MakeIP("127.0.0.1", false, Display{}), MakePrefix("127.0.0.0/8", Display{})}}
+	s2 := set{C: conf{MakeIP("::1", false, Display{}), MakePrefix("::1/128", Display{})}}
+	if err := CopyValueSet(&s1, s2, nil); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	} else if err := ValidateConfigSet(s1); err != nil || s1.C.Address.Value != "::1" || s1.C.Filter.Value != "::1/128" {
+		t.Errorf("Unexpected copied params %v, %v", s1.C, err)
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	type conf struct {
+		Shift   I8Param
+		Mode    SelectParam
+		Timeout DurationParam
+	}
+	c := conf{
+		Shift:   MakeI8(3, [2]int8{-10, 10}, Display{Description: "The shift", Name: "Shift", Group: "Cipher"}),
+		Mode:    MakeSelect("a", []string{"a", "b"}, Display{}),
+		Timeout: MakeDuration(time.Second, [2]time.Duration{0, time.Minute}, Display{}),
+	}
+	s, err := ConfigSchema(&c)
+	if err != nil {
+		t.Fatalf("Expected no error; found %s", err.Error())
+	}
+
+	properties := s["properties"].(map[string]interface{})
+	shift := properties["Shift"].(Schema)
+	if shift["title"] != "Shift" || shift["description"] != "The shift" || shift["x-group"] != "Cipher" {
+		t.Errorf("Unexpected Shift schema %v", shift)
+	}
+	value := shift["properties"].(map[string]interface{})["Value"].(Schema)
+	if value["type"] != "integer" || value["minimum"] != int8(-10) || value["maximum"] != int8(10) || value["default"] != int8(3) {
+		t.Errorf("Unexpected Shift value schema %v", value)
+	}
+
+	// Params without a name are titled by their field
+	mode := properties["Mode"].(Schema)
+	value = mode["properties"].(map[string]interface{})["Value"].(Schema)
+	if mode["title"] != "Mode" || !reflect.DeepEqual(value["enum"], []string{"a", "b"}) {
+		t.Errorf("Unexpected Mode schema %v", mode)
+	}
+
+	value = properties["Timeout"].(Schema)["properties"].(map[string]interface{})["Value"].(Schema)
+	re := regexp.MustCompile(value["pattern"].(string))
+	for _, d := range []string{"1s", "1.5h", "500ms", "1h30m", "0"} {
+		if !re.MatchString(d) {
+			t.Errorf("Expected %s to match the duration pattern", d)
+		}
+	}
+	for _, d := range []string{"", "1", "1 s", "s"} {
+		if re.MatchString(d) {
+			t.Errorf("Expected %s not to match the duration pattern", d)
+		}
+	}
+
+	type invalid struct {
+		Shift int
+	}
+	if _, err := ConfigSchema(invalid{}); err == nil || err.Error() != "Shift : Invalid struct field type" {
+		t.Errorf("Expected field type error; found %v", err)
+	}
+}
+
+func TestSetValue(t *testing.T) {
+	type conf struct {
+		Shift   I8Param
+		Port    U16Param
+		Rate    FloatParam
+		Enable  BoolParam
+		Mode    SelectParam
+		Key     HexKeyParam
+		Timeout DurationParam
+	}
+	c := conf{
+		Shift:   MakeI8(3, [2]int8{-10, 10}, Display{Name: "Shift"}),
+		Port:    MakeU16(8080, [2]uint16{1, 65535}, Display{}),
+		Rate:    MakeFloat(0.5, [2]float64{0, 1}, Display{}),
+		Enable:  MakeBool(false, Display{}),
+		Mode:    MakeSelect("a", []string{"a", "b"}, Display{}),
+		Key:     MakeHexKey([]byte{1, 2}, []int{2, 4}, Display{}),
+		Timeout: MakeDuration(time.Second, [2]time.Duration{0, time.Minute}, Display{}),
+	}
+
+	// Values are described in the format accepted by SetValue
+	params, err := ParamsOf(&c)
+	if err != nil {
+		t.Fatalf("Expected no error; found %s", err.Error())
+	}
+	var values []string
+	for _, p := range params {
+		values = append(values, p.Name+"="+p.Value)
+	}
+	expected := []string{"Shift=3", "Port=8080", "Rate=0.5", "Enable=false", "Mode=a", "Key=0102", "Timeout=1s"}
+	if !reflect.DeepEqual(values, expected) || params[0].Type != "i8" || params[0].Display.Name != "Shift" {
+		t.Errorf("Expected %v; found %v", expected, params)
+	}
+
+	for field, text := range map[string]string{"Shift": "-4", "Port": "9000", "Rate": "0.25", "Enable": "true", "Mode": "b", "Key": "0a0b0c0d", "Timeout": "30s"} {
+		if err := SetValue(&c, field, text); err != nil {
+			t.Errorf("Expected no error for %s; found %s", field, err.Error())
+		}
+	}
+	if c.Shift.Value != -4 || c.Port.Value != 9000 || c.Rate.Value != 0.25 || !c.Enable.Value || c.Mode.Value != "b" ||
+		!bytes.Equal(c.Key.Value, []byte{10, 11, 12, 13}) {
+		t.Errorf("Unexpected values %v", c)
+	}
+
+	cases := map[string][2]string{
+		"Shift":   {"300", "Shift : Invalid value 300"},
+		"Port":    {"0", "Port : U16 value out of range"},
+		"Mode":    {"c", "Mode : Select value not in list"},
+		"Key":     {"xyz", "Key : Invalid value xyz"},
+		"Timeout": {"2h", "Timeout : Duration value out of range"},
+		"Missing": {"1", "Missing : Unknown param"},
+	}
+	for field, tc := range cases {
+		if err := SetValue(&c, field, tc[0]); err == nil || err.Error() != tc[1] {
+			t.Errorf("Expected error %s; found %v", tc[1], err)
+		}
+	}
+	if err := SetValue(c, "Shift", "1"); err == nil {
+		t.Errorf("Expected error for config that is not a pointer")
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	expected := map[string]interface{}{
+		"channel":    "TcpSyn",
+		"processors": []interface{}{"Caesar", "Checksum"},
+		"TcpSyn": map[string]interface{}{
+			"FriendIP": "10.0.0.2",
+			"Embedder": "temporal",
+			"Peers":    "bob=10.0.0.3, carol=10.0.0.4",
+		},
+		"Caesar.Shift": "3",
+		"Framing": map[string]interface{}{
+			"Enable": "true",
+		},
+	}
+
+	yaml := `# The channel to use
+channel: TcpSyn
+processors:
+- Caesar
+- Checksum
+TcpSyn:
+  FriendIP: 10.0.0.2   # Your friend
+  Embedder: "temporal"
+  Peers: 'bob=10.0.0.3, carol=10.0.0.4'
+
+Caesar.Shift: 3
+Framing:
+  Enable: true
+`
+	if m, err := ParseFile([]byte(yaml)); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	} else if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected %v; found %v", expected, m)
+	}
+
+	json := `{"channel" : "TcpSyn", "processors" : ["Caesar", "Checksum"],
+		"TcpSyn" : {"FriendIP" : "10.0.0.2", "Embedder" : "temporal", "Peers" : "bob=10.0.0.3, carol=10.0.0.4"},
+		"Caesar.Shift" : 3, "Framing" : {"Enable" : true}}`
+	if m, err := ParseFile([]byte(json)); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	} else if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected %v; found %v", expected, m)
+	}
+
+	// Values are read as written, and anchors and flow collections may be used
+	flow := "TcpSyn: &tcp {FriendIP: 10.0.0.2, Key: 0011}\nTcpNormal: *tcp\nprocessors: [Caesar, \"Check,sum\"]\nHandshake: {Enable: ~}"
+	if m, err := ParseFile([]byte(flow)); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	} else if tcp := map[string]interface{}{"FriendIP": "10.0.0.2", "Key": "0011"}; !reflect.DeepEqual(m["TcpSyn"], tcp) || !reflect.DeepEqual(m["TcpNormal"], tcp) ||
+		!reflect.DeepEqual(m["processors"], []interface{}{"Caesar", "Check,sum"}) || !reflect.DeepEqual(m["Handshake"], map[string]interface{}{"Enable": ""}) {
+		t.Errorf("Unexpected values %v", m)
+	}
+	if m, err := ParseFile([]byte("# Nothing to configure\n")); err != nil || len(m) != 0 {
+		t.Errorf("Expected empty mapping; found %v, %v", m, err)
+	}
+
+	for _, invalid := range []string{
+		"channel: TcpSyn\n  Embedder: id",
+		"TcpSyn:\n  FriendIP: 10.0.0.2\n  FriendIP: 10.0.0.3",
+		"channel",
+		"\tchannel: TcpSyn",
+		"[1, 2]",
+		"a: &a [x, x, x, x, x, x, x, x, x, x]\nb: &b [*a, *a, *a, *a, *a, *a, *a, *a, *a, *a]\nc: &c [*b, *b, *b, *b, *b, *b, *b, *b, *b, *b]\nd: [*c, *c, *c, *c, *c, *c, *c, *c, *c, *c]",
+	} {
+		if _, err := ParseFile([]byte(invalid)); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
@@ -1,45 +1,70 @@
 package controller
 
 import (
-	"./channel/httpCovert"
-	"./channel/httpNormal"
-	"./channel/icmpIP"
-	"./channel/icmpNormal"
-	"./channel/tcpHandshake"
-	"./channel/tcpNormal"
-	"./channel/tcpSyn"
-	"./channel/udpIP"
-	"./channel/udpNormal"
+	"./channel"
+	// The built-in channels and processors register themselves when imported
+	_ "./channel/httpCovert"
+	_ "./channel/httpNormal"
+	_ "./channel/icmpIP"
+	_ "./channel/icmpNormal"
+	_ "./channel/tcpHandshake"
+	_ "./channel/tcpNormal"
+	_ "./channel/tcpSyn"
+	_ "./channel/udpIP"
+	_ "./channel/udpNormal"
 	"./config"
-	"./processor/asymmetricEncryption"
-	"./processor/caesar"
-	"./processor/checksum"
-	"./processor/gZipCompression"
-	"./processor/none"
-	"./processor/symmetricEncryption"
-	"./processor/zLibCompression"
+	"./processor"
+	_ "./processor/asymmetricEncryption"
+	_ "./processor/caesar"
+	_ "./processor/checksum"
+	_ "./processor/gZipCompression"
+	_ "./processor/none"
+	_ "./processor/symmetricEncryption"
+	_ "./processor/zLibCompression"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"github.com/gorilla/websocket"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"time"
+	"unicode/utf8"
+)
+
+// The session used by commands that do not specify one
+const defaultSession = "default"
+
+// Encodings for the Message field of messages carrying covert data
+// Text messages are sent as is. This is only safe for valid UTF-8,
+// since the JSON encoder replaces invalid characters.
+// Base64 messages can carry arbitrary bytes.
+const (
+	encodingText   = "text"
+	encodingBase64 = "base64"
 )
 
 // Constructor for the controller
 func CreateController() (*Controller, error) {
 	var ctr *Controller = &Controller{
 		config:     DefaultConfig(),
+		sessions:   make(map[string]*Layers),
+		history:    newHistory(),
+		recorder:   &recorder{},
 		clients:    make(map[*websocket.Conn]bool),
+		listeners:  make(map[chan []byte]bool),
 		clientStop: make(chan interface{}),
 		recvStop:   make(chan interface{}),
 		sendStop:   make(chan interface{}),
 		doneWsSend: make(chan interface{}),
 		doneWsRecv: make(chan interface{}),
 		wsSend:     make(chan []byte),
-		wsRecv:     make(chan []byte),
+		wsRecv:     make(chan clientMessage),
+		wsReply:    make(chan clientMessage),
 	}
+	ctr.upgrader.CheckOrigin = ctr.checkOrigin
 	// Validate the default values
 	if err := config.ValidateConfigSet(ctr.config.Default.Processor); err != nil {
 		return nil, err
@@ -75,84 +100,239 @@ func DefaultConfig() configData {
 			Type: "TcpHandshake",
 			Data: defaultChannel(),
 		},
+		Framing:   defaultFraming(),
+		Handshake: defaultHandshake(),
+		Sessions:  []sessionConfig{},
 	}
 }
 
+// The default config of every registered channel
 func defaultChannel() channelData {
-	return channelData{
-		IcmpIP:       icmpIP.GetDefault(),
-		IcmpNormal:   icmpNormal.GetDefault(),
-		TcpSyn:       tcpSyn.GetDefault(),
-		TcpHandshake: tcpHandshake.GetDefault(),
-		TcpNormal:    tcpNormal.GetDefault(),
-		HttpCovert:   httpCovert.GetDefault(),
-		HttpNormal:   httpNormal.GetDefault(),
-		UdpNormal:    udpNormal.GetDefault(),
-		UdpIP:        udpIP.GetDefault(),
+	data := make(channelData)
+	for _, name := range channel.Names() {
+		data[name], _ = channel.GetDefault(name)
 	}
+	return data
 }
 
+// The default config of every registered processor
 func defaultProcessor() processorData {
-	return processorData{
-		None:                 none.GetDefault(),
-		Caesar:               caesar.GetDefault(),
-		Checksum:             checksum.GetDefault(),
-		SymmetricEncryption:  symmetricEncryption.GetDefault(),
-		AsymmetricEncryption: asymmetricEncryption.GetDefault(),
-		GZipCompression:      gZipCompression.GetDefault(),
-		ZLibCompression:      zLibCompression.GetDefault(),
+	data := make(processorData)
+	for _, name := range processor.Names() {
+		data[name], _ = processor.GetDefault(name)
 	}
+	return data
 }
 
 // Callback when receiving a message from the client
 func (ctr *Controller) handleMessage(data []byte) []byte {
 	var cmd command
 	if err := json.Unmarshal(data, &cmd); err != nil {
-		return toMessage("error", "Unable to read command: "+err.Error())
+		return toErrorMessage("", "Unable to read command: ", err)
+	}
+	return ctr.handleCommand(cmd.OpCode, data)
+}
+
+// Perform an operation requested by a client
+// This is used by both the websocket and the REST API, so
+// commands are handled one at a time
+func (ctr *Controller) handleCommand(opcode string, data []byte) (reply []byte) {
+	ctr.recorder.add(recordCommand, opcode, data)
+	defer func() { ctr.recorder.add(recordReply, opcode, reply) }()
+
+	var cmd command
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return toErrorMessage("", "Unable to read command: ", err)
 	}
 
+	if cmd.Version != 0 && cmd.Version != protocolVersion {
+		reply = toCodeMessage(codeUnsupportedVersion, "Unsupported protocol version "+strconv.Itoa(cmd.Version)+", the controller uses version "+strconv.Itoa(protocolVersion))
+	} else {
+		reply = ctr.runCommand(opcode, sessionID(cmd.Session), data)
+	}
+	if cmd.RequestID == "" {
+		return reply
+	}
+	return withField(reply, "RequestID", cmd.RequestID)
+}
+
+func (ctr *Controller) runCommand(opcode string, id string, data []byte) []byte {
+	ctr.cmdLock.Lock()
+	defer ctr.cmdLock.Unlock()
+
 	// Determine the operation to perform
-	switch cmd.OpCode {
+	switch opcode {
 	case "open":
-		// Close a channel if it is already open
-		if err := ctr.handleClose(); err != nil {
-			return toMessage("error", "Unable to close channel: "+err.Error())
-		} else if err := ctr.handleOpen(data); err != nil {
-			return toMessage("error", "Unable to open channel: "+err.Error())
+		if err := ctr.handleOpen(id, data); err != nil {
+			return toErrorMessage(id, "Unable to open channel: ", err)
 		} else {
-			go ctr.readLoop()
-			return toMessage("open", "Open success")
+			return toSessionMessage("open", id, "Open success")
 		}
 	case "close":
-		if err := ctr.handleClose(); err != nil {
-			return toMessage("error", "Unable to close channel: "+err.Error())
+		if err := ctr.handleClose(id); err != nil {
+			return toErrorMessage(id, "Unable to close channel: ", err)
 		} else {
-			return toMessage("close", "Close success")
+			return toSessionMessage("close", id, "Close success")
 		}
 	case "write":
-		if err := ctr.handleWrite(data); err != nil {
-			return toMessage("error", "Unable to write to channel: "+err.Error())
+		if sendID, err := ctr.handleWrite(id, data); err != nil {
+			return toErrorMessage(id, "Unable to write to channel: ", err)
+		} else {
+			return toSendMessage("write", id, sendID, "Message queued")
+		}
+	case "cancel":
+		if err := ctr.handleCancel(id, data); err != nil {
+			return toErrorMessage(id, "Unable to cancel send: ", err)
+		} else {
+			return toSessionMessage("cancel", id, "Cancel success")
+		}
+	case "schedule":
+		if scheduleID, err := ctr.handleSchedule(id, data); err != nil {
+			return toErrorMessage(id, "Unable to schedule message: ", err)
+		} else {
+			return toScheduleMessage("schedule", id, scheduleID, 0, 0, "Schedule added")
+		}
+	case "listSchedules":
+		if data, err := ctr.handleListSchedules(id); err != nil {
+			return toErrorMessage(id, "Unable to list schedules: ", err)
+		} else {
+			return data
+		}
+	case "cancelSchedule":
+		if err := ctr.handleCancelSchedule(id, data); err != nil {
+			return toErrorMessage(id, "Unable to cancel schedule: ", err)
+		} else {
+			return toSessionMessage("cancelSchedule", id, "Schedule cancelled")
+		}
+	case "sendfile":
+		if sendID, err := ctr.handleSendFile(id, data); err != nil {
+			return toErrorMessage(id, "Unable to send file: ", err)
+		} else {
+			return toSendMessage("sendfile", id, sendID, "File queued")
+		}
+	case "saveProfile":
+		if err := ctr.handleSaveProfile(data); err != nil {
+			return toErrorMessage("", "Unable to save profile: ", err)
+		} else {
+			return toMessage("saveProfile", "Profile saved")
+		}
+	case "loadProfile":
+		if data, err := ctr.handleLoadProfile(data); err != nil {
+			return toErrorMessage("", "Unable to load profile: ", err)
+		} else {
+			return data
+		}
+	case "listProfiles":
+		if data, err := ctr.handleListProfiles(); err != nil {
+			return toErrorMessage("", "Unable to list profiles: ", err)
+		} else {
+			return data
+		}
+	case "deleteProfile":
+		if err := ctr.handleDeleteProfile(data); err != nil {
+			return toErrorMessage("", "Unable to delete profile: ", err)
 		} else {
-			return toMessage("write", "Message write success")
+			return toMessage("deleteProfile", "Profile deleted")
+		}
+	case "history":
+		if data, err := ctr.handleHistory(data); err != nil {
+			return toErrorMessage("", "Unable to retrieve history: ", err)
+		} else {
+			return data
+		}
+	case "stats":
+		if data, err := ctr.handleStats(id, data); err != nil {
+			return toErrorMessage(id, "Unable to retrieve stats: ", err)
+		} else {
+			return data
 		}
 	case "config":
 		if data, err := ctr.handleConfig(); err != nil {
-			return toMessage("error", "Could not encode config: "+err.Error())
+			return toErrorMessage("", "Could not encode config: ", err)
+		} else {
+			return data
+		}
+	case "setConfig":
+		if err := ctr.handleSetConfig(data); err != nil {
+			return toErrorMessage("", "Unable to update config: ", err)
+		} else if data, err := ctr.handleConfig(); err != nil {
+			return toErrorMessage("", "Could not encode config: ", err)
+		} else {
+			return data
+		}
+	case "schema":
+		if data, err := ctr.handleSchema(); err != nil {
+			return toErrorMessage("", "Could not encode schema: ", err)
+		} else {
+			return data
+		}
+	case "configSchema":
+		if data, err := ctr.handleConfigSchema(); err != nil {
+			return toErrorMessage("", "Could not encode config schema: ", err)
 		} else {
 			return data
 		}
 	default:
-		return toMessage("error", "Unknown operation code")
+		return toCodeMessage(codeUnknownOpCode, "Unknown operation code")
 	}
 }
 
+// Set a field of a message, such as the request ID of a reply
+func withField(msg []byte, key string, value interface{}) []byte {
+	var (
+		m    map[string]json.RawMessage
+		v    []byte
+		data []byte
+		err  error
+	)
+	if err = json.Unmarshal(msg, &m); err != nil {
+		return msg
+	}
+	if v, err = json.Marshal(value); err != nil {
+		return msg
+	}
+	m[key] = v
+	if data, err = json.Marshal(m); err != nil {
+		return msg
+	}
+	return data
+}
+
+// Retrieve the session ID to use for a command
+func sessionID(id string) string {
+	if id == "" {
+		return defaultSession
+	}
+	return id
+}
+
 // A helper function for preparing responses to the client
 // opcode is the type of message, and is one of the valid opCodes from the client or "error"
 // data is the message
 func toMessage(opcode string, data string) []byte {
+	return toSessionMessage(opcode, "", data)
+}
+
+// A helper function for preparing responses to the client about a specific session
+func toSessionMessage(opcode string, session string, data string) []byte {
 	var mt messageType
 	mt.OpCode = opcode
 	mt.Message = data
+	mt.Session = session
+	return marshalMessage(mt)
+}
+
+// Encode covert data for the Message field of a message
+// Returns the message and the encoding that was used
+func encodeData(data []byte, encoding string) (string, string) {
+	if encoding == encodingBase64 || !utf8.Valid(data) {
+		return base64.StdEncoding.EncodeToString(data), encodingBase64
+	} else {
+		return string(data), encodingText
+	}
+}
+
+func marshalMessage(mt messageType) []byte {
 	if data, err := json.Marshal(mt); err != nil {
 		return []byte("{\"OpCode\" : \"error\", \"Message\" : \"Marshal Error\" }")
 	} else {
@@ -160,9 +340,32 @@ func toMessage(opcode string, data string) []byte {
 	}
 }
 
+// Retrieve the bytes of a message sent by the client
+func decodeMessage(mt messageType) ([]byte, error) {
+	switch mt.Encoding {
+	case "", encodingText:
+		return []byte(mt.Message), nil
+	case encodingBase64:
+		return base64.StdEncoding.DecodeString(mt.Message)
+	default:
+		return nil, errors.New("Unknown message encoding: " + mt.Encoding)
+	}
+}
+
+// Check that an encoding requested by the client is supported
+func validEncoding(encoding string) error {
+	switch encoding {
+	case "", encodingText, encodingBase64:
+		return nil
+	default:
+		return errors.New("Unknown message encoding: " + encoding)
+	}
+}
+
 // Handle the config command
 func (ctr *Controller) handleConfig() ([]byte, error) {
 	ctr.config.OpCode = "config"
+	ctr.config.Sessions = ctr.sessionConfigs()
 	if data, err := json.Marshal(ctr.config); err != nil {
 		return nil, err
 	} else {
@@ -170,113 +373,293 @@ func (ctr *Controller) handleConfig() ([]byte, error) {
 	}
 }
 
+// Update the configuration without opening a channel
+// The new configuration is used as the starting point for the next open command
+func (ctr *Controller) handleSetConfig(data []byte) error {
+	if readCd, err := ctr.readConfig(data); err != nil {
+		return err
+	} else {
+		ctr.config.Processors = readCd.Processors
+		ctr.config.Channel = readCd.Channel
+		ctr.config.Framing = readCd.Framing
+		ctr.config.Handshake = readCd.Handshake
+		return nil
+	}
+}
+
 // Handle the write command
-func (ctr *Controller) handleWrite(b []byte) error {
+// The message is queued to be sent by the send loop of the session
+// Returns the ID of the send
+func (ctr *Controller) handleWrite(id string, b []byte) (uint64, error) {
 	var (
-		mt   messageType
-		err  error
-		data []byte
+		wc    writeCommand
+		err   error
+		data  []byte
+		peers []int
+		l     *Layers
 	)
-	if err = json.Unmarshal(b, &mt); err != nil {
-		return err
+	if err = json.Unmarshal(b, &wc); err != nil {
+		return 0, err
+	}
+	if l = ctr.getSession(id); l == nil {
+		return 0, errChannelClosed
 	}
-	if ctr.layers == nil {
-		return errors.New("Channel closed")
+
+	if data, err = decodeMessage(messageType{Message: wc.Message, Encoding: wc.Encoding}); err != nil {
+		return 0, err
 	}
+	if peers, err = l.peerIndexes(wc.Peers); err != nil {
+		return 0, err
+	}
+	return ctr.queueSend(l, data, peers)
+}
 
-	data = []byte(mt.Message)
-	for i := range ctr.layers.processors {
-		if data, err = ctr.layers.processors[i].Process(data); err != nil {
-			return errors.New("Unable to process outgoing message: " + err.Error())
+// Send a message along the covert channel of a session and record it in the history
+// Unlike the write command, this waits until the message has been sent
+func (ctr *Controller) writeData(l *Layers, data []byte) error {
+	n, err := ctr.sendData(l, data, nil, nil)
+	ctr.history.add(l, "send", data, n, err)
+	return err
+}
+
+// Process a message and send it along the covert channel of a session
+// The message is sent to each of the peers in turn, or to the friend if peers is empty.
+// The send stops before the next fragment if cancel or the session is closed.
+// The fragment being sent is also interrupted if the covert channel is a ContextChannel.
+// Returns the size of the processed message
+func (ctr *Controller) sendData(l *Layers, data []byte, peers []int, cancel chan interface{}) (int, error) {
+	var (
+		err       error
+		fragments [][]byte
+		size      int       = len(data)
+		start     time.Time = time.Now()
+	)
+	for i := range l.processors {
+		if data, err = l.processors[i].Process(data); err != nil {
+			l.stats.addError(statsErrorProcess)
+			return 0, processorError(l.conf.Processors[i].Type, "Unable to process outgoing message: ", err)
 		}
 	}
-	if n, err := ctr.layers.channel.Send(data); err != nil {
-		return errors.New("Write fail: Wrote " + strconv.FormatUint(n, 10) + "bytes out of " + strconv.FormatUint(uint64(len(b)), 10) + ": " + err.Error())
-	} else {
-		return nil
+
+	l.sendLock.Lock()
+	defer l.sendLock.Unlock()
+	if fragments, err = l.framing.fragment(data); err != nil {
+		l.stats.addError(statsErrorFraming)
+		return len(data), newError(codeFraming, layerController, "", err.Error())
+	}
+	if len(peers) == 0 {
+		peers = []int{0}
+	}
+	ctx, cancelFn := cancelContext(cancel, l.readClose)
+	defer cancelFn()
+	for _, peer := range peers {
+		for _, frag := range fragments {
+			select {
+			case <-cancel:
+				return len(data), errSendCancelled
+			case <-l.readClose:
+				return len(data), errChannelClosed
+			default:
+			}
+			if n, err := sendFragment(ctx, l.channel, peer, frag); err != nil {
+				select {
+				case <-cancel:
+					return len(data), errSendCancelled
+				default:
+				}
+				l.stats.addError(statsErrorWrite)
+				return len(data), channelError(l.conf.Channel.Type, "Write fail to "+l.peers[peer]+": Wrote "+strconv.FormatUint(n, 10)+"bytes out of "+strconv.FormatUint(uint64(len(frag)), 10)+": ", err)
+			}
+			l.stats.addFragmentWritten()
+		}
 	}
+	l.stats.addSent(size, len(data), time.Since(start))
+	return len(data), nil
 }
 
 // Handle a read operation
-func (ctr *Controller) handleRead() ([]byte, error) {
+// The receive is interrupted when ctx is done if the covert channel supports it
+// Returns the message, the size of the message before it was unprocessed
+// and the index of the peer that sent it
+func (ctr *Controller) handleRead(ctx context.Context, l *Layers) ([]byte, int, int, error) {
 
 	var (
-		buffer [1024]byte
-		data   []byte
+		buffer   []byte = l.framing.buffer
+		data     []byte
+		peer     int
+		complete bool
+		err      error
 	)
 
-	if n, err := ctr.layers.channel.Receive(buffer[:]); err != nil {
-		return nil, errors.New("Read fail: Read " + strconv.FormatUint(n, 10) + " bytes out of " + strconv.FormatUint(uint64(len(buffer)), 10) + " available bytes: " + err.Error())
-	} else {
-		data = buffer[:n]
-		for i := len(ctr.layers.processors) - 1; i >= 0; i-- {
-			if data, err = ctr.layers.processors[i].Unprocess(data); err != nil {
-				return nil, errors.New("Unable to unprocess incoming message: " + err.Error())
+	// Keep receiving until a whole message has been reassembled
+	// The fragments of messages from different peers may be interleaved
+	for !complete {
+		if n, from, err := receiveFragment(ctx, l.channel, buffer); err != nil {
+			l.stats.addError(statsErrorRead)
+			return nil, 0, from, channelError(l.conf.Channel.Type, "Read fail: Read "+strconv.FormatUint(n, 10)+" bytes out of "+strconv.FormatUint(uint64(len(buffer)), 10)+" available bytes: ", err)
+		} else {
+			l.stats.addFragmentRead()
+			peer = from
+			// Handshake packets are not framed or processed
+			if l.handshake.enabled && isHandshakeMessage(buffer[:n]) {
+				ctr.handleHandshake(l, peer, buffer[:n])
+				continue
+			}
+			if data, complete, err = l.framing.reassemble(peer, buffer[:n]); err != nil {
+				l.stats.addError(statsErrorFraming)
+				return nil, 0, peer, newError(codeFraming, layerController, "", err.Error())
 			}
 		}
 	}
-	return data, nil
+
+	processed := len(data)
+	for i := len(l.processors) - 1; i >= 0; i-- {
+		if data, err = l.processors[i].Unprocess(data); err != nil {
+			l.stats.addError(statsErrorUnprocess)
+			return nil, processed, peer, processorError(l.conf.Processors[i].Type, "Unable to unprocess incoming message: ", err)
+		}
+	}
+	l.stats.addReceived(len(data), processed)
+	return data, processed, peer, nil
 }
 
-// Loop for repeatedly reading from  any open Covert Channel
-func (ctr *Controller) readLoop() {
+// Loop for repeatedly reading from an open Covert Channel
+// Each session has its own read loop
+func (ctr *Controller) readLoop(l *Layers) {
+	// Closing the session interrupts the receive in progress
+	ctx, cancelFn := cancelContext(nil, l.readClose)
+	defer cancelFn()
 loop:
 	for {
 		select {
-		case <-ctr.layers.readClose:
-			close(ctr.layers.readCloseDone)
+		case <-l.readClose:
+			close(l.readCloseDone)
 			break loop
 		default:
-			data, err := ctr.handleRead()
+			l.expireTransfers(time.Now())
+			data, n, peer, err := ctr.handleRead(ctx, l)
+			if err == nil && isFileMessage(data) {
+				// File transfer messages are reported as progress
+				// or file events instead of read events
+				if data, err = l.handleFileMessage(data); err != nil {
+					l.stats.addError(statsErrorFile)
+					err = newError(codeFileTransfer, layerController, "", err.Error())
+				}
+			} else if err == nil {
+				ctr.history.add(l, "receive", data, n, nil)
+				data = toReadMessage(l.id, l.peers[peer], data, l.encoding)
+			}
 			if err != nil {
 				// First, check if we are closing the covert channel
 				// If so, then that is the likely explanation of the error
 				// and we don't neet to report it
 				select {
-				case <-ctr.layers.readClose:
+				case <-l.readClose:
 				default:
+					ctr.history.add(l, "receive", nil, n, err)
 					// Else we try to report the error
 					// This select also includes the readClose
 					// to handle the case where the server is being shutdown
 					select {
-					case ctr.wsSend <- toMessage("error", err.Error()):
+					case ctr.wsSend <- toErrorMessage(l.id, "", err):
 						// If there has been a read error wait
 						// to avoid a constant stream of data
 						// to the UI
 						time.Sleep(time.Second)
 						// If we have closed we return immediately
-					case <-ctr.layers.readClose:
+					case <-l.readClose:
 					}
 				}
 			} else {
-				ctr.wsSend <- toMessage("read", string(data))
+				select {
+				case ctr.wsSend <- data:
+				case <-l.readClose:
+				}
 			}
 		}
 	}
 }
 
+// Retrieve an open session
+// Returns nil if the session is not open
+func (ctr *Controller) getSession(id string) *Layers {
+	ctr.sessionLock.Lock()
+	defer ctr.sessionLock.Unlock()
+	return ctr.sessions[id]
+}
+
+// Retrieve the configuration of every open session, sorted by session ID
+func (ctr *Controller) sessionConfigs() []sessionConfig {
+	ctr.sessionLock.Lock()
+	defer ctr.sessionLock.Unlock()
+	// This ensures that null is not sent to the client
+	var confs []sessionConfig = make([]sessionConfig, 0, len(ctr.sessions))
+	for _, l := range ctr.sessions {
+		confs = append(confs, l.conf)
+	}
+	sort.Slice(confs, func(i, j int) bool { return confs[i].ID < confs[j].ID })
+	return confs
+}
+
 // Handle the close operation
-func (ctr *Controller) handleClose() error {
-	var err error
-	if ctr.layers != nil {
+func (ctr *Controller) handleClose(id string) error {
+	ctr.sessionLock.Lock()
+	l := ctr.sessions[id]
+	delete(ctr.sessions, id)
+	ctr.sessionLock.Unlock()
 
-		close(ctr.layers.readClose)
-		err = ctr.layers.channel.Close()
+	if l == nil {
+		return nil
+	}
+	return l.close()
+}
 
-		// We must wait to ensure that the read loop is complete
-		// In case closing the channel failed to cause handleRead to return
-		select {
-		case <-ctr.layers.readCloseDone:
-		case <-time.After(time.Second * 5):
-			var l *log.Logger = log.New(os.Stderr, "", log.Flags())
-			l.Println("Failed to close read loop. Covert channel did not return from cancel.")
+// Close every open session
+func (ctr *Controller) closeAllSessions() error {
+	var err error
+	ctr.sessionLock.Lock()
+	sessions := ctr.sessions
+	ctr.sessions = make(map[string]*Layers)
+	ctr.sessionLock.Unlock()
+
+	for _, l := range sessions {
+		if e := l.close(); e != nil {
+			err = e
 		}
-		ctr.layers = nil
+	}
+	return err
+}
+
+// Close the covert channel of a session and stop its read loop
+func (l *Layers) close() error {
+	close(l.readClose)
+	err := l.channel.Close()
+
+	// We must wait to ensure that the read and send loops are complete
+	// In case closing the channel failed to cause handleRead or sendData to return
+	select {
+	case <-l.readCloseDone:
+	case <-time.After(time.Second * 5):
+		var lg *log.Logger = log.New(os.Stderr, "", log.Flags())
+		lg.Println("Failed to close read loop for session " + l.id + ". Covert channel did not return from cancel.")
+	}
+	select {
+	case <-l.sendLoopDone:
+	case <-time.After(time.Second * 5):
+		var lg *log.Logger = log.New(os.Stderr, "", log.Flags())
+		lg.Println("Failed to close send loop for session " + l.id + ". Covert channel did not return from cancel.")
 	}
 	return err
 }
 
 // Shutdown the controller
 func (ctr *Controller) Shutdown() error {
-	return ctr.webShutdown()
+	err := ctr.webShutdown()
+	if e := ctr.history.close(); e != nil && err == nil {
+		err = e
+	}
+	if e := ctr.recorder.close(); e != nil && err == nil {
+		err = e
+	}
+	return err
 }
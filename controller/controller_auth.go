@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The cookie set by the login page
+const authCookie = "covert_token"
+
+// The access control for the websocket and the HTTP API
+type AuthConfig struct {
+	// The shared token that clients must provide
+	// If empty, no token is required
+	Token string
+	// Origins that may connect in addition to the server's own origin,
+	// e.g. "https://example.com:3000"
+	Origins []string
+	// Set if the server uses TLS, so that the login cookie is only sent securely
+	Secure bool
+}
+
+// Set the access control for the websocket and the HTTP API
+// This must be called before the server is started
+func (ctr *Controller) SetAuth(ac AuthConfig) {
+	ctr.auth = ac
+}
+
+// Check that a request comes from an allowed origin and carries the token
+// If not, an error is sent and false is returned
+func (ctr *Controller) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if !ctr.checkOrigin(r) {
+		writeReplyStatus(w, http.StatusForbidden, toCodeMessage(codeForbidden, "Origin not allowed"))
+		return false
+	}
+	if !ctr.checkToken(r) {
+		writeReplyStatus(w, http.StatusUnauthorized, toCodeMessage(codeUnauthorized, "Unauthorized"))
+		return false
+	}
+	return true
+}
+
+// Check the token of a request
+// The token may be given in the Authorization header as a bearer token,
+// or in the cookie set by the login page
+func (ctr *Controller) checkToken(r *http.Request) bool {
+	if ctr.auth.Token == "" {
+		return true
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return ctr.validToken(strings.TrimPrefix(h, "Bearer "))
+	}
+	if c, err := r.Cookie(authCookie); err == nil {
+		return ctr.validToken(c.Value)
+	}
+	return false
+}
+
+func (ctr *Controller) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(ctr.auth.Token)) == 1
+}
+
+// Check the origin of a request
+// Requests without an Origin header do not come from a browser, and are allowed
+func (ctr *Controller) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range ctr.auth.Origins {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// The HTTP handler for the login page
+// A POST with the correct token sets a cookie that authorizes the browser
+func (ctr *Controller) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(loginPage))
+	case http.MethodPost:
+		if !ctr.checkOrigin(r) {
+			writeReplyStatus(w, http.StatusForbidden, toCodeMessage(codeForbidden, "Origin not allowed"))
+			return
+		}
+		token := r.PostFormValue("token")
+		if ctr.auth.Token != "" && !ctr.validToken(token) {
+			// Slow down attempts to guess the token
+			time.Sleep(time.Second)
+			writeReplyStatus(w, http.StatusUnauthorized, toCodeMessage(codeUnauthorized, "Invalid token"))
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     authCookie,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   ctr.auth.Secure,
+			SameSite: http.SameSiteStrictMode,
+		})
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeReplyStatus(w, http.StatusMethodNotAllowed, toCodeMessage(codeMethodNotAllowed, "Method not allowed"))
+	}
+}
+
+// Wrap a handler so that browsers without the token are sent to the login page
+func (ctr *Controller) LoginRequired(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ctr.checkToken(r) {
+			http.Redirect(w, r, "/api/login", http.StatusSeeOther)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+const loginPage = `<!DOCTYPE html>
+<html>
+<head><title>Covert Client Login</title></head>
+<body>
+<form method="POST" action="/api/login">
+<label>Token <input type="password" name="token" autofocus></label>
+<input type="submit" value="Login">
+</form>
+</body>
+</html>
+`
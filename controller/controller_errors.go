@@ -0,0 +1,219 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+
+	"./config"
+	"./processor/checksum"
+)
+
+// The layers that errors can come from
+const (
+	layerChannel    = "channel"
+	layerProcessor  = "processor"
+	layerController = "controller"
+)
+
+// The codes of the errors sent to clients
+// Clients should use these to handle errors rather than the text of the message
+const (
+	// The command could not be read or has an invalid field
+	codeInvalidCommand = "invalidCommand"
+	codeUnknownOpCode  = "unknownOpCode"
+	// The command was sent with a protocol version this controller does not support
+	codeUnsupportedVersion = "unsupportedVersion"
+	// The configuration of a channel, processor or framing is invalid
+	codeInvalidConfig = "invalidConfig"
+	// The session has no open channel, or was closed during the operation
+	codeSessionClosed = "sessionClosed"
+	codeNotFound      = "notFound"
+	codeQueueFull     = "queueFull"
+	codeTimeout       = "timeout"
+	codeCancelled     = "cancelled"
+	// An incoming message failed the checksum of the Checksum processor
+	codeChecksum = "checksum"
+	// A channel failed for any other reason
+	codeChannelFailed = "channelFailed"
+	// A processor failed for any other reason
+	codeProcessorFailed = "processorFailed"
+	// A message could not be split into or reassembled from fragments
+	codeFraming      = "framing"
+	codeFileTransfer = "fileTransfer"
+	codeUnauthorized = "unauthorized"
+	codeForbidden    = "forbidden"
+	// The HTTP method is not supported by the endpoint
+	codeMethodNotAllowed = "methodNotAllowed"
+	// Any other failure
+	codeFailed = "failed"
+)
+
+// Every error code, for the schema
+var errorCodes []string = []string{
+	codeInvalidCommand,
+	codeUnknownOpCode,
+	codeUnsupportedVersion,
+	codeInvalidConfig,
+	codeSessionClosed,
+	codeNotFound,
+	codeQueueFull,
+	codeTimeout,
+	codeCancelled,
+	codeChecksum,
+	codeChannelFailed,
+	codeProcessorFailed,
+	codeFraming,
+	codeFileTransfer,
+	codeUnauthorized,
+	codeForbidden,
+	codeMethodNotAllowed,
+	codeFailed,
+}
+
+// Returned when the channel of a session is not open or has been closed
+var errChannelClosed error = newError(codeSessionClosed, layerController, "", "Channel closed")
+
+// An error that can be reported to clients with its code, layer and entity
+type covertError struct {
+	Code  string
+	Layer string
+	// The type of the channel or processor the error came from, if any
+	Entity string
+	// The error from the channel, processor or controller,
+	// without the description of the operation that failed
+	Detail string
+	// The errors of the fields of an invalid config, keyed by field name
+	Fields map[string]string
+	// The full message of the error
+	msg string
+}
+
+func (e *covertError) Error() string {
+	return e.msg
+}
+
+func newError(code string, layer string, entity string, detail string) *covertError {
+	return &covertError{Code: code, Layer: layer, Entity: entity, Detail: detail, msg: detail}
+}
+
+// An invalid config of a channel, processor or the controller
+// The errors of each field are kept if the config was checked with config.Validate
+func configError(layer string, entity string, err error) error {
+	ce := newError(codeInvalidConfig, layer, entity, err.Error())
+	if fe, ok := err.(config.FieldErrors); ok {
+		ce.Fields = fe
+	}
+	return ce
+}
+
+// An error returned by a covert channel
+// Timeouts and cancellations are given their own codes
+func channelError(entity string, prefix string, err error) error {
+	var code string = codeChannelFailed
+	if isTimeout(err) {
+		code = codeTimeout
+	} else if err == context.Canceled {
+		code = codeCancelled
+	}
+	return wrapError(prefix, newError(code, layerChannel, entity, err.Error()))
+}
+
+// An error returned by a processor
+func processorError(entity string, prefix string, err error) error {
+	var code string = codeProcessorFailed
+	if err == checksum.ErrChecksumFailure || err == checksum.ErrChecksumLength {
+		code = codeChecksum
+	}
+	return wrapError(prefix, newError(code, layerProcessor, entity, err.Error()))
+}
+
+// The channels report timeouts as net errors, context deadlines,
+// or as errors of their own with timeout in the message
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "timeout")
+}
+
+// Retrieve the code, layer and entity of any error
+// Errors that are not covertErrors are treated as controller errors
+func asCovertError(err error) *covertError {
+	switch e := err.(type) {
+	case *covertError:
+		return e
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return newError(codeInvalidCommand, layerController, "", err.Error())
+	default:
+		return newError(codeFailed, layerController, "", err.Error())
+	}
+}
+
+// Describe the operation that failed in the message of an error,
+// keeping its code, layer, entity and detail
+func wrapError(prefix string, err error) error {
+	var ce covertError = *asCovertError(err)
+	ce.msg = prefix + ce.msg
+	return &ce
+}
+
+// The error message
+// Message is the full text of the error, for displaying to users
+type errorMessage struct {
+	OpCode  string
+	Session string
+	Message string
+	Code    string
+	Layer   string
+	Entity  string
+	Detail  string
+	// The ID of the send that failed, for errors of queued sends
+	SendID uint64
+	// The ID of the schedule, for errors of scheduled writes
+	ScheduleID uint64
+	// The errors of the fields of an invalid config, keyed by field name,
+	// so that the fields can be highlighted
+	Fields map[string]string
+}
+
+func toError(session string, prefix string, err error) errorMessage {
+	ce := asCovertError(err)
+	// This ensures that null is not sent to the client
+	var fields map[string]string = make(map[string]string)
+	for name, msg := range ce.Fields {
+		fields[name] = msg
+	}
+	return errorMessage{
+		OpCode:  "error",
+		Session: session,
+		Message: prefix + ce.Error(),
+		Code:    ce.Code,
+		Layer:   ce.Layer,
+		Entity:  ce.Entity,
+		Detail:  ce.Detail,
+		Fields:  fields,
+	}
+}
+
+// A helper function for preparing error messages to the client
+// prefix describes the operation that failed, and is prepended to the message of err
+func toErrorMessage(session string, prefix string, err error) []byte {
+	return marshalError(toError(session, prefix, err))
+}
+
+// A helper function for preparing error messages from the controller
+func toCodeMessage(code string, msg string) []byte {
+	return toErrorMessage("", "", newError(code, layerController, "", msg))
+}
+
+func marshalError(em errorMessage) []byte {
+	if data, err := json.Marshal(em); err != nil {
+		return toMessage("error", "Marshal Error")
+	} else {
+		return data
+	}
+}
@@ -0,0 +1,504 @@
+package controller
+
+import (
+	"./channel"
+	"./config"
+	"./processor"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/bits"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The configuration for running an experiment without a web interface
+type ExperimentConfig struct {
+	// The JSON description of the experiment
+	Config []byte
+	// A CSV row with the results of each run is written to Output
+	Output io.Writer
+	// Close to stop the experiment once the current message has been sent
+	Stop chan interface{}
+}
+
+// An experiment sends random messages between a sending and a receiving
+// covert channel on the same host for every combination of channel,
+// processor chain and message size, and measures how well they arrive.
+type experiment struct {
+	Channels []experimentChannel
+	// The processor chains each channel is run with
+	// If empty, each channel is run without processors
+	Processors [][]processorConfig
+	// The framing used by every run
+	Framing framingConfig
+	// The sizes of the messages sent, in bytes
+	MessageSizes []int
+	// The number of messages sent in each run
+	Repetitions int
+	// How long to wait for each message to be received, in milliseconds
+	Timeout uint64
+}
+
+type experimentChannel struct {
+	Type string
+	// The configs of the sending and receiving channels, in the same format
+	// as the config of the channel in the open command. Omitted params use
+	// their default values.
+	Sender   json.RawMessage
+	Receiver json.RawMessage
+	// Params that are set to each of the listed values on both channels,
+	// with a run for each combination of values. If the list of a select
+	// param is empty, every value in its range is used.
+	Vary map[string][]json.RawMessage
+}
+
+// A single combination of channel config, processor chain and message size
+type experimentRun struct {
+	channel    string
+	variant    string
+	sender     channelConfig
+	receiver   channelConfig
+	processors []processorConfig
+	size       int
+}
+
+// The results of a run
+type experimentResult struct {
+	sent      int
+	received  int
+	failures  int
+	bytes     int
+	bitErrors int
+	latency   time.Duration
+	elapsed   time.Duration
+	// The most recent failure
+	err error
+}
+
+// A message received by the receiving channel of a run
+type experimentRead struct {
+	data []byte
+	at   time.Time
+	err  error
+}
+
+// The number of bytes at the start of each message that hold its sequence number
+const sequenceBytes = 4
+
+// The columns of the CSV output
+var experimentColumns []string = []string{
+	"channel",
+	"variant",
+	"processors",
+	"framing",
+	"message_size",
+	"sent",
+	"received",
+	"failures",
+	"throughput_bytes_per_second",
+	"mean_latency_ms",
+	"bit_error_rate",
+	"error",
+}
+
+// Run an experiment and write the results as CSV
+// A run that cannot be started, for example because the channel could not
+// be created, is reported as failing every message rather than stopping the experiment.
+func (ctr *Controller) RunExperiment(ec ExperimentConfig) error {
+	var (
+		exp  experiment = experiment{Framing: defaultFraming(), Repetitions: 1, Timeout: 5000}
+		runs []experimentRun
+		w    *csv.Writer = csv.NewWriter(ec.Output)
+		err  error
+	)
+	if err = json.Unmarshal(ec.Config, &exp); err != nil {
+		return errors.New("Invalid experiment: " + err.Error())
+	}
+	if exp.Framing, err = framingConfigFrom(exp.Framing); err != nil {
+		return errors.New("Invalid experiment framing: " + err.Error())
+	}
+	if exp.Repetitions < 1 {
+		return errors.New("Invalid experiment: Repetitions must be at least 1")
+	}
+	if runs, err = ctr.experimentRuns(exp); err != nil {
+		return errors.New("Invalid experiment: " + err.Error())
+	}
+
+	if err = w.Write(experimentColumns); err != nil {
+		return err
+	}
+	for _, run := range runs {
+		select {
+		case <-ec.Stop:
+			w.Flush()
+			return w.Error()
+		default:
+		}
+		res := ctr.runExperiment(exp, run, ec.Stop)
+		if err = w.Write(run.row(exp, res)); err != nil {
+			return err
+		}
+		// Flush each row so that partial results are kept if the experiment is stopped
+		if w.Flush(); w.Error() != nil {
+			return w.Error()
+		}
+	}
+	return nil
+}
+
+// Retrieve every combination of channel config, processor chain and message size
+func (ctr *Controller) experimentRuns(exp experiment) ([]experimentRun, error) {
+	var (
+		runs   []experimentRun
+		chains [][]processorConfig = exp.Processors
+	)
+	if len(chains) == 0 {
+		chains = [][]processorConfig{{}}
+	}
+	for i := range chains {
+		for j := range chains[i] {
+			// Processors may be given without a Data field to use their default config
+			if chains[i][j].Data == nil {
+				chains[i][j].Data = defaultProcessor()
+			}
+			if pconf, err := ctr.processorConfigFrom(chains[i][j]); err != nil {
+				return nil, errors.New("Processor " + chains[i][j].Type + ": " + err.Error())
+			} else {
+				chains[i][j] = *pconf
+			}
+		}
+	}
+	for _, size := range exp.MessageSizes {
+		if size < 1 {
+			return nil, errors.New("Message sizes must be at least 1")
+		}
+	}
+
+	for _, ec := range exp.Channels {
+		variants, err := ec.variants()
+		if err != nil {
+			return nil, errors.New("Channel " + ec.Type + ": " + err.Error())
+		}
+		for _, v := range variants {
+			var run experimentRun = experimentRun{channel: ec.Type, variant: variantName(v)}
+			if run.sender, err = ctr.experimentChannelConfig(ec.Type, ec.Sender, v); err != nil {
+				return nil, errors.New("Channel " + ec.Type + " sender: " + err.Error())
+			}
+			if run.receiver, err = ctr.experimentChannelConfig(ec.Type, ec.Receiver, v); err != nil {
+				return nil, errors.New("Channel " + ec.Type + " receiver: " + err.Error())
+			}
+			for _, chain := range chains {
+				for _, size := range exp.MessageSizes {
+					run.processors = chain
+					run.size = size
+					runs = append(runs, run)
+				}
+			}
+		}
+	}
+	return runs, nil
+}
+
+// Retrieve every combination of the values of the varied params
+func (ec experimentChannel) variants() ([]map[string]json.RawMessage, error) {
+	var (
+		variants []map[string]json.RawMessage = []map[string]json.RawMessage{{}}
+		names    []string
+	)
+	for name := range ec.Vary {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := ec.Vary[name]
+		if len(values) == 0 {
+			var err error
+			if values, err = selectRange(ec.Type, name); err != nil {
+				return nil, err
+			}
+		}
+		var next []map[string]json.RawMessage
+		for _, v := range variants {
+			for _, value := range values {
+				nv := make(map[string]json.RawMessage)
+				for k := range v {
+					nv[k] = v[k]
+				}
+				nv[name] = value
+				next = append(next, nv)
+			}
+		}
+		variants = next
+	}
+	return variants, nil
+}
+
+// Retrieve every value of a select param of a channel
+func selectRange(channelType string, name string) ([]json.RawMessage, error) {
+	var values []json.RawMessage
+	conf, err := channel.GetDefault(channelType)
+	if err != nil {
+		return nil, err
+	}
+	f := reflect.Indirect(reflect.ValueOf(conf)).FieldByName(name)
+	if !f.IsValid() || f.Type() != reflect.TypeOf(config.SelectParam{}) {
+		return nil, errors.New("No select param " + name + " to vary")
+	}
+	for _, v := range f.Interface().(config.SelectParam).Range {
+		if data, err := json.Marshal(v); err != nil {
+			return nil, err
+		} else {
+			values = append(values, data)
+		}
+	}
+	return values, nil
+}
+
+// The name of a variant in the results, such as Embedder=id
+func variantName(v map[string]json.RawMessage) string {
+	var names []string
+	for name, value := range v {
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			s = string(value)
+		}
+		names = append(names, name+"="+s)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ";")
+}
+
+// Retrieve the validated config of a channel, with the varied params set
+func (ctr *Controller) experimentChannelConfig(channelType string, data json.RawMessage, variant map[string]json.RawMessage) (channelConfig, error) {
+	var cconf channelConfig = channelConfig{Type: channelType, Data: defaultChannel()}
+	conf, ok := cconf.Data[channelType]
+	if !ok {
+		return cconf, errors.New("Unknown channel type")
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, conf); err != nil {
+			return cconf, err
+		}
+	}
+	for name, value := range variant {
+		if param, err := json.Marshal(map[string]map[string]json.RawMessage{name: {"Value": value}}); err != nil {
+			return cconf, err
+		} else if err = json.Unmarshal(param, conf); err != nil {
+			return cconf, err
+		}
+	}
+	if newConf, err := ctr.channelConfigFrom(cconf); err != nil {
+		return cconf, err
+	} else {
+		return *newConf, nil
+	}
+}
+
+// Create the state of one end of a run
+func experimentLayers(cconf channelConfig, pconfs []processorConfig, fconf framingConfig) (*Layers, error) {
+	var ps []processor.Processor
+	for i := range pconfs {
+		if p, err := toProcessor(&pconfs[i]); err != nil {
+			return nil, newError(codeProcessorFailed, layerProcessor, pconfs[i].Type, err.Error())
+		} else {
+			ps = append(ps, p)
+		}
+	}
+	c, err := toChannel(&cconf)
+	if err != nil {
+		return nil, channelError(cconf.Type, "", err)
+	}
+	return newLayers(sessionConfig{Processors: pconfs, Channel: cconf, Framing: fconf, Handshake: defaultHandshake()}, ps, c), nil
+}
+
+// Send the messages of a run and measure how they are received
+// The messages are sent one at a time, each once the previous one has been
+// received or has timed out.
+func (ctr *Controller) runExperiment(exp experiment, run experimentRun, stop chan interface{}) experimentResult {
+	var (
+		res      experimentResult
+		sender   *Layers
+		receiver *Layers
+		reads    chan experimentRead = make(chan experimentRead)
+		r        *rand.Rand          = rand.New(rand.NewSource(time.Now().UnixNano()))
+		timeout  time.Duration       = time.Duration(exp.Timeout) * time.Millisecond
+		err      error
+	)
+	if receiver, err = experimentLayers(run.receiver, run.processors, exp.Framing); err != nil {
+		res.failures, res.err = exp.Repetitions, err
+		return res
+	}
+	defer closeExperimentLayers(receiver)
+	if sender, err = experimentLayers(run.sender, run.processors, exp.Framing); err != nil {
+		res.failures, res.err = exp.Repetitions, err
+		return res
+	}
+	defer closeExperimentLayers(sender)
+
+	// Every read is passed on, including the receive timeouts of the channel
+	// and the errors of stray packets, which only fail a message if nothing
+	// that matches it arrives before it times out
+	go func() {
+		ctx, cancelFn := cancelContext(nil, receiver.readClose)
+		defer cancelFn()
+		for {
+			data, _, _, err := ctr.handleRead(ctx, receiver)
+			select {
+			case reads <- experimentRead{data: data, at: time.Now(), err: err}:
+			case <-receiver.readClose:
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < exp.Repetitions; i++ {
+		select {
+		case <-stop:
+			res.elapsed = time.Since(start)
+			return res
+		default:
+		}
+		// Discard any message that arrived after it timed out
+		drainReads(reads)
+		msg := make([]byte, run.size)
+		r.Read(msg)
+		setSequence(msg, uint32(i))
+		sent := time.Now()
+		res.sent++
+		if _, err = ctr.sendData(sender, msg, nil, nil); err != nil {
+			res.failures, res.err = res.failures+1, err
+			continue
+		}
+		if read, err := awaitRead(reads, msg, timeout); err != nil {
+			res.failures, res.err = res.failures+1, err
+		} else {
+			res.received++
+			res.bytes += len(msg)
+			res.bitErrors += bitErrors(msg, read.data)
+			res.latency += read.at.Sub(sent)
+		}
+	}
+	res.elapsed = time.Since(start)
+	return res
+}
+
+// Number each message of a run in its first bytes, so that a message that
+// arrives after it timed out is not mistaken for a later one
+// Messages shorter than the sequence number hold its lowest bytes.
+func setSequence(msg []byte, seq uint32) {
+	for i := 0; i < len(msg) && i < sequenceBytes; i++ {
+		msg[i] = byte(seq >> (8 * uint(i)))
+	}
+}
+
+// Whether a received message has the sequence number of the sent one
+// A message whose sequence number was corrupted cannot be matched, so it
+// counts as a failure rather than adding to the bit errors.
+func sameSequence(sent []byte, received []byte) bool {
+	n := len(sent)
+	if n > sequenceBytes {
+		n = sequenceBytes
+	}
+	return len(received) >= n && bytes.Equal(sent[:n], received[:n])
+}
+
+// Discard the reads waiting to be handled
+func drainReads(reads chan experimentRead) {
+	for {
+		select {
+		case <-reads:
+		default:
+			return
+		}
+	}
+}
+
+// Wait for the message that was sent to be received
+// Errors and earlier messages are skipped until the message times out,
+// which is then reported with the last error if there was one.
+func awaitRead(reads chan experimentRead, msg []byte, timeout time.Duration) (experimentRead, error) {
+	var (
+		deadline <-chan time.Time = time.After(timeout)
+		lastErr  error            = newError(codeTimeout, layerController, "", "Receive timeout")
+	)
+	for {
+		select {
+		case read := <-reads:
+			if read.err != nil {
+				lastErr = read.err
+			} else if sameSequence(msg, read.data) {
+				return read, nil
+			}
+		case <-deadline:
+			return experimentRead{}, lastErr
+		}
+	}
+}
+
+// Close a channel of a run
+// There are no read or send loops to wait for, unlike a session
+func closeExperimentLayers(l *Layers) {
+	close(l.readClose)
+	l.channel.Close()
+}
+
+// The number of bits that differ between the sent and received message
+// Missing or extra bytes count as 8 bit errors each
+func bitErrors(sent []byte, received []byte) int {
+	var n int
+	for i := 0; i < len(sent) && i < len(received); i++ {
+		n += bits.OnesCount8(sent[i] ^ received[i])
+	}
+	if len(sent) > len(received) {
+		n += 8 * (len(sent) - len(received))
+	} else {
+		n += 8 * (len(received) - len(sent))
+	}
+	return n
+}
+
+// The CSV row of the results of a run
+func (run experimentRun) row(exp experiment, res experimentResult) []string {
+	var (
+		processors []string
+		throughput float64
+		latency    float64
+		ber        float64
+		msg        string
+	)
+	for _, p := range run.processors {
+		processors = append(processors, p.Type)
+	}
+	if res.elapsed > 0 {
+		throughput = float64(res.bytes) / res.elapsed.Seconds()
+	}
+	if res.received > 0 {
+		latency = res.latency.Seconds() * 1000 / float64(res.received)
+		ber = float64(res.bitErrors) / float64(8*res.bytes)
+	}
+	if res.err != nil {
+		msg = res.err.Error()
+	}
+	return []string{
+		run.channel,
+		run.variant,
+		strings.Join(processors, "+"),
+		strconv.FormatBool(exp.Framing.Enable.Value),
+		strconv.Itoa(run.size),
+		strconv.Itoa(res.sent),
+		strconv.Itoa(res.received),
+		strconv.Itoa(res.failures),
+		strconv.FormatFloat(throughput, 'f', 2, 64),
+		strconv.FormatFloat(latency, 'f', 3, 64),
+		strconv.FormatFloat(ber, 'g', 6, 64),
+		msg,
+	}
+}
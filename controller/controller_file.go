@@ -0,0 +1,407 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// File transfers are sent as a series of covert messages.
+// The first message is a manifest describing the file, followed
+// by one message for each chunk of the file.
+// Each message starts with fileMagic so that the receiver can
+// distinguish them from normal messages, followed by a byte
+// identifying the type of the message.
+var fileMagic []byte = []byte{0x00, 'C', 'C', 'F', 'T', 0x00}
+
+const (
+	fileManifestType = 'M'
+	fileChunkType    = 'C'
+)
+
+// The bytes before the file data in each chunk: the magic, the type,
+// the ID of the transfer and the index of the chunk
+var fileChunkHeaderSize int = len(fileMagic) + 9
+
+// Each chunk is sent as one message, so once processed it must be at most the
+// MaxMessageSize of the session. By default, chunks are as large as fits, up
+// to maxDefaultChunkSize so that the progress of large files is still reported.
+const maxDefaultChunkSize = 64 * 1024
+
+// The largest file that will be accepted by the receiver
+const maxFileSize = 64 * 1024 * 1024
+
+// The space for incoming files is allocated when their manifest is received,
+// so the number and total size of the files each session receives at once are
+// limited. A transfer is dropped if none of its chunks are received within
+// transferTimeout, so that incomplete transfers do not hold their space.
+const (
+	maxTransfers     = 4
+	maxTransferBytes = maxFileSize
+	transferTimeout  = 2 * time.Minute
+)
+
+type sendFileCommand struct {
+	OpCode   string
+	Session  string
+	Name     string
+	Message  string
+	Encoding string
+	// The number of bytes of the file sent in each covert message
+	// If zero, the largest chunks that fit in a message of the session are used
+	ChunkSize uint64
+}
+
+// The manifest sent at the start of a file transfer
+type fileManifest struct {
+	ID        uint32
+	Name      string
+	Size      uint64
+	ChunkSize uint64
+	Chunks    uint32
+	// The hex encoded SHA-256 hash of the file
+	Hash string
+}
+
+// Reports the progress of a file transfer to the client
+type progressMessage struct {
+	OpCode  string
+	Session string
+	ID      uint32
+	Name    string
+	// Either "send" or "receive"
+	Direction string
+	Bytes     uint64
+	Size      uint64
+}
+
+// Sent to the client once a file has been received and verified
+// The file is always base64 encoded in Message
+type fileMessage struct {
+	OpCode   string
+	Session  string
+	ID       uint32
+	Name     string
+	Size     uint64
+	Hash     string
+	Message  string
+	Encoding string
+}
+
+// A file being received
+type fileTransfer struct {
+	manifest fileManifest
+	data     []byte
+	received []bool
+	count    uint32
+	bytes    uint64
+	// When the manifest or the most recent new chunk was received
+	updated time.Time
+}
+
+// A file waiting to be sent by the send loop of a session
+type fileJob struct {
+	name      string
+	chunkSize uint64
+}
+
+// Handle the sendfile command
+// The file is queued like a written message, and the send loop splits it into
+// chunks and sends the manifest and each chunk through the processors and the
+// covert channel as separate messages
+// Returns the ID of the send
+func (ctr *Controller) handleSendFile(id string, b []byte) (uint64, error) {
+	var (
+		cmd       sendFileCommand
+		l         *Layers
+		file      []byte
+		chunkSize uint64
+		err       error
+	)
+	if err = json.Unmarshal(b, &cmd); err != nil {
+		return 0, err
+	}
+	if l = ctr.getSession(id); l == nil {
+		return 0, errChannelClosed
+	}
+	if file, err = decodeMessage(messageType{Message: cmd.Message, Encoding: cmd.Encoding}); err != nil {
+		return 0, err
+	}
+	if chunkSize, err = l.fileChunkSize(file, cmd.ChunkSize); err != nil {
+		return 0, err
+	}
+	return ctr.queueJob(l, &sendJob{data: file, file: &fileJob{name: cmd.Name, chunkSize: chunkSize}})
+}
+
+// Check that a file can be sent along a session, and return the number of
+// bytes to send in each chunk
+// Chunks are checked with random data, which the processors cannot compress.
+// If chunkSize is zero, the largest chunk size that fits is found.
+func (l *Layers) fileChunkSize(file []byte, chunkSize uint64) (uint64, error) {
+	if len(file) > maxFileSize {
+		return 0, errors.New("File too large")
+	}
+	if chunkSize > 0 {
+		var (
+			size uint64 = uint64(fileChunkHeaderSize) + chunkSize
+			err  error
+		)
+		// Processing never makes chunks of random data much smaller, so
+		// chunks that are already too large are not processed
+		if size <= l.framing.maxSize {
+			if size, err = l.processedSize(randomBytes(int(size))); err != nil {
+				return 0, err
+			}
+		}
+		if size > l.framing.maxSize {
+			return 0, errors.New("Chunks of " + strconv.FormatUint(chunkSize, 10) + " bytes are larger than the max message size of " + strconv.FormatUint(l.framing.maxSize, 10) + " bytes once processed")
+		}
+		return chunkSize, nil
+	}
+
+	if l.framing.maxSize > uint64(fileChunkHeaderSize) {
+		chunkSize = l.framing.maxSize - uint64(fileChunkHeaderSize)
+	}
+	if chunkSize > maxDefaultChunkSize {
+		chunkSize = maxDefaultChunkSize
+	}
+	// Shrink the chunks by the overhead of the processors until they fit,
+	// or halve them if the processors cannot process chunks that large
+	for chunkSize > 0 {
+		size, err := l.processedSize(randomBytes(fileChunkHeaderSize + int(chunkSize)))
+		if err == nil && size <= l.framing.maxSize {
+			return chunkSize, nil
+		} else if err == nil && size-l.framing.maxSize < chunkSize {
+			chunkSize -= size - l.framing.maxSize
+		} else {
+			chunkSize /= 2
+		}
+	}
+	return 0, errors.New("The max message size of " + strconv.FormatUint(l.framing.maxSize, 10) + " bytes is too small to send files once processed")
+}
+
+// The size of a message once it has been processed by the processors of a session
+func (l *Layers) processedSize(data []byte) (uint64, error) {
+	var err error
+	for i := range l.processors {
+		if data, err = l.processors[i].Process(data); err != nil {
+			return 0, processorError(l.conf.Processors[i].Type, "Unable to process outgoing message: ", err)
+		}
+	}
+	return uint64(len(data)), nil
+}
+
+// Random bytes, for checking the size of processed messages
+func randomBytes(n int) []byte {
+	var data []byte = make([]byte, n)
+	rand.New(rand.NewSource(time.Now().UnixNano())).Read(data)
+	return data
+}
+
+// Send a file along the covert channel of a session
+// If chunkSize is zero, the largest chunks that fit are used. Nothing is sent
+// unless the manifest fits in a message. The send stops before the next chunk
+// if cancel or the session is closed.
+func (ctr *Controller) sendFile(l *Layers, name string, file []byte, chunkSize uint64, cancel chan interface{}) error {
+	var err error
+	if chunkSize == 0 {
+		if chunkSize, err = l.fileChunkSize(file, 0); err != nil {
+			return err
+		}
+	}
+
+	hash := sha256.Sum256(file)
+	manifest := fileManifest{
+		ID:        rand.New(rand.NewSource(time.Now().UnixNano())).Uint32(),
+		Name:      name,
+		Size:      uint64(len(file)),
+		ChunkSize: chunkSize,
+		Chunks:    uint32((uint64(len(file)) + chunkSize - 1) / chunkSize),
+		Hash:      hex.EncodeToString(hash[:]),
+	}
+
+	data, err := encodeManifest(manifest)
+	if err != nil {
+		return err
+	}
+	if size, err := l.processedSize(data); err != nil {
+		return err
+	} else if size > l.framing.maxSize {
+		return errors.New("File name too long: The manifest is " + strconv.FormatUint(size, 10) + " bytes once processed, more than the max message size of " + strconv.FormatUint(l.framing.maxSize, 10) + " bytes")
+	}
+	if _, err = ctr.sendData(l, data, nil, cancel); err == errSendCancelled {
+		return err
+	} else if err != nil {
+		return wrapError("Unable to send manifest: ", err)
+	}
+
+	for i := uint32(0); i < manifest.Chunks; i++ {
+		start := uint64(i) * chunkSize
+		end := start + chunkSize
+		if end > manifest.Size {
+			end = manifest.Size
+		}
+		if _, err = ctr.sendData(l, encodeChunk(manifest.ID, i, file[start:end]), nil, cancel); err == errSendCancelled {
+			return err
+		} else if err != nil {
+			return wrapError("Unable to send chunk "+strconv.FormatUint(uint64(i), 10)+": ", err)
+		}
+		ctr.sendEvent(l, toProgressMessage(l.id, manifest, "send", end))
+	}
+	return nil
+}
+
+func encodeManifest(m fileManifest) ([]byte, error) {
+	if data, err := json.Marshal(m); err != nil {
+		return nil, err
+	} else {
+		return append(append(append([]byte{}, fileMagic...), fileManifestType), data...), nil
+	}
+}
+
+func encodeChunk(id uint32, index uint32, data []byte) []byte {
+	var buf []byte = make([]byte, fileChunkHeaderSize, fileChunkHeaderSize+len(data))
+	copy(buf, fileMagic)
+	buf[len(fileMagic)] = fileChunkType
+	binary.BigEndian.PutUint32(buf[len(fileMagic)+1:], id)
+	binary.BigEndian.PutUint32(buf[len(fileMagic)+5:], index)
+	return append(buf, data...)
+}
+
+// Check if a received message is part of a file transfer
+func isFileMessage(data []byte) bool {
+	return len(data) > len(fileMagic) && bytes.Equal(data[:len(fileMagic)], fileMagic)
+}
+
+// Handle a received message that is part of a file transfer
+// Returns the message to send to the client, or nil if there is nothing to report
+// This is only called from the read loop of the session, so the transfers
+// do not need to be locked
+func (l *Layers) handleFileMessage(data []byte) ([]byte, error) {
+	data = data[len(fileMagic):]
+	switch data[0] {
+	case fileManifestType:
+		var m fileManifest
+		if err := json.Unmarshal(data[1:], &m); err != nil {
+			return nil, errors.New("Invalid file manifest: " + err.Error())
+		}
+		if m.Size > maxFileSize {
+			return nil, errors.New("Incoming file " + m.Name + " too large")
+		}
+		if m.ChunkSize == 0 || m.ChunkSize > maxFileSize || uint64(m.Chunks) != (m.Size+m.ChunkSize-1)/m.ChunkSize {
+			return nil, errors.New("Invalid file manifest: inconsistent size")
+		}
+		// A repeated manifest restarts the transfer
+		delete(l.transfers, m.ID)
+		if len(l.transfers) >= maxTransfers {
+			return nil, errors.New("Incoming file " + m.Name + " rejected: Too many files being received")
+		}
+		if l.transferBytes()+m.Size > maxTransferBytes {
+			return nil, errors.New("Incoming file " + m.Name + " rejected: Too many bytes being received")
+		}
+		ft := &fileTransfer{manifest: m, data: make([]byte, m.Size), received: make([]bool, m.Chunks), updated: time.Now()}
+		l.transfers[m.ID] = ft
+		if m.Chunks == 0 {
+			return l.completeFile(ft)
+		}
+		return toProgressMessage(l.id, m, "receive", 0), nil
+	case fileChunkType:
+		if len(data) < 9 {
+			return nil, errors.New("Invalid file chunk")
+		}
+		id := binary.BigEndian.Uint32(data[1:])
+		index := binary.BigEndian.Uint32(data[5:])
+		chunk := data[9:]
+		ft, ok := l.transfers[id]
+		if !ok {
+			return nil, errors.New("File chunk received without manifest")
+		}
+		if index >= ft.manifest.Chunks {
+			return nil, errors.New("Invalid file chunk index")
+		}
+		start := uint64(index) * ft.manifest.ChunkSize
+		if uint64(len(chunk)) > ft.manifest.ChunkSize || start+uint64(len(chunk)) > ft.manifest.Size {
+			return nil, errors.New("Invalid file chunk size")
+		}
+		if !ft.received[index] {
+			copy(ft.data[start:], chunk)
+			ft.received[index] = true
+			ft.count++
+			ft.bytes += uint64(len(chunk))
+			ft.updated = time.Now()
+		}
+		if ft.count == ft.manifest.Chunks {
+			return l.completeFile(ft)
+		}
+		return toProgressMessage(l.id, ft.manifest, "receive", ft.bytes), nil
+	default:
+		return nil, errors.New("Unknown file message type")
+	}
+}
+
+// The total size of the files being received
+func (l *Layers) transferBytes() uint64 {
+	var n uint64
+	for _, ft := range l.transfers {
+		n += ft.manifest.Size
+	}
+	return n
+}
+
+// Drop the transfers that have not received a chunk within transferTimeout
+// This is only called from the read loop of the session
+func (l *Layers) expireTransfers(now time.Time) {
+	for id, ft := range l.transfers {
+		if now.Sub(ft.updated) > transferTimeout {
+			delete(l.transfers, id)
+		}
+	}
+}
+
+// Verify a file once all chunks have been received
+func (l *Layers) completeFile(ft *fileTransfer) ([]byte, error) {
+	delete(l.transfers, ft.manifest.ID)
+	hash := sha256.Sum256(ft.data)
+	if hex.EncodeToString(hash[:]) != ft.manifest.Hash {
+		return nil, errors.New("File " + ft.manifest.Name + " failed hash verification")
+	}
+	fm := fileMessage{
+		OpCode:   "file",
+		Session:  l.id,
+		ID:       ft.manifest.ID,
+		Name:     ft.manifest.Name,
+		Size:     ft.manifest.Size,
+		Hash:     ft.manifest.Hash,
+		Message:  base64.StdEncoding.EncodeToString(ft.data),
+		Encoding: encodingBase64,
+	}
+	if data, err := json.Marshal(fm); err != nil {
+		return nil, err
+	} else {
+		return data, nil
+	}
+}
+
+func toProgressMessage(session string, m fileManifest, direction string, n uint64) []byte {
+	pm := progressMessage{
+		OpCode:    "progress",
+		Session:   session,
+		ID:        m.ID,
+		Name:      m.Name,
+		Direction: direction,
+		Bytes:     n,
+		Size:      m.Size,
+	}
+	if data, err := json.Marshal(pm); err != nil {
+		return toSessionMessage("error", session, "Marshal Error")
+	} else {
+		return data
+	}
+}
@@ -0,0 +1,280 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"./config"
+)
+
+// The names of the framing and handshake configs in config files and flags
+const (
+	framingConfigName   = "Framing"
+	handshakeConfigName = "Handshake"
+)
+
+// Configures the processors, channel, framing and handshake of a session
+// from a config file and command-line flags, rather than the web interface
+// A flag is added for every param of every channel and processor, and of the
+// framing and handshake, named by the config and the param, e.g.
+//
+//	-channel TcpSyn -TcpSyn.Embedder=temporal -TcpSyn.FriendIP=10.0.0.2 -Framing.Enable
+//
+// The config file is YAML or JSON, with the same names as the flags:
+//
+//	channel: TcpSyn
+//	processors: [Caesar]
+//	TcpSyn:
+//	  Embedder: temporal
+//	Caesar.Shift: 3
+//
+// Values from flags take precedence over the config file. Each processor
+// uses the params of its type, so processors of the same type are configured the same way.
+type ConfigFlags struct {
+	file       string
+	channel    string
+	processors string
+	// The values of the param flags, in the order they were given
+	values []flagValue
+	// The values of param flags are checked by setting them in these configs
+	check map[string]interface{}
+}
+
+// The value of a param flag
+type flagValue struct {
+	config string
+	param  string
+	text   string
+}
+
+// A flag for setting a param
+type paramFlag struct {
+	cf     *ConfigFlags
+	config string
+	param  string
+	// The default value of the param
+	def    string
+	isBool bool
+}
+
+func (f *paramFlag) String() string {
+	// The flag package calls this on a zero paramFlag
+	if f == nil {
+		return ""
+	}
+	return f.def
+}
+
+// The value is checked on its own, while combinations of params are checked
+// when the configuration is used
+func (f *paramFlag) Set(text string) error {
+	if err := config.SetValue(f.cf.check[f.config], f.param, text); err != nil {
+		return err
+	}
+	f.cf.values = append(f.cf.values, flagValue{f.config, f.param, text})
+	return nil
+}
+
+// Bool params may be set without a value, e.g. -Framing.Enable
+func (f *paramFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// Add the flags for configuring a session to a flag set
+func NewConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	var (
+		framing   framingConfig   = defaultFraming()
+		handshake handshakeConfig = defaultHandshake()
+		cf        *ConfigFlags    = &ConfigFlags{check: newConfigSet(defaultChannel(), defaultProcessor(), &framing, &handshake)}
+	)
+
+	fs.StringVar(&cf.file, "config", "", "a YAML or JSON file configuring the channel, processors, framing and handshake. The param flags take precedence over the file")
+	fs.StringVar(&cf.channel, "channel", "", "the covert channel to use, e.g. TcpSyn")
+	fs.StringVar(&cf.processors, "processors", "", "a comma separated list of the processors to use, in order")
+
+	var names []string
+	for name := range cf.check {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// The configs are the defaults, so they are always valid
+		params, _ := config.ParamsOf(cf.check[name])
+		for _, p := range params {
+			usage := p.Display.Description
+			if usage == "" {
+				usage = p.Display.Name
+			}
+			fs.Var(&paramFlag{cf: cf, config: name, param: p.Name, def: p.Value, isBool: p.Type == "bool"}, name+"."+p.Name, usage)
+		}
+	}
+	return cf
+}
+
+// Index the configs of every channel and processor, and of the framing and handshake, by name
+func newConfigSet(channels channelData, processors processorData, framing *framingConfig, handshake *handshakeConfig) map[string]interface{} {
+	var configs map[string]interface{} = map[string]interface{}{
+		framingConfigName:   framing,
+		handshakeConfigName: handshake,
+	}
+	for name, c := range channels {
+		configs[name] = c
+	}
+	for name, c := range processors {
+		configs[name] = c
+	}
+	return configs
+}
+
+// Whether a config file or any of the flags were given
+func (cf *ConfigFlags) IsSet() bool {
+	return cf.file != "" || cf.channel != "" || cf.processors != "" || len(cf.values) > 0
+}
+
+// The configuration given by the config file and flags, in the format of the open command
+// The configuration is validated when it is used, like configurations from the web interface.
+func (cf *ConfigFlags) Config() ([]byte, error) {
+	var (
+		oc openCommand = openCommand{
+			Processors: make([]processorConfig, 0),
+			Channel:    channelConfig{Data: defaultChannel()},
+			Framing:    defaultFraming(),
+			Handshake:  defaultHandshake(),
+		}
+		pdata      processorData = defaultProcessor()
+		configs                  = newConfigSet(oc.Channel.Data, pdata, &oc.Framing, &oc.Handshake)
+		processors []string
+	)
+
+	if cf.file != "" {
+		data, err := ioutil.ReadFile(cf.file)
+		if err != nil {
+			return nil, errors.New("Unable to read config file: " + err.Error())
+		}
+		if oc.Channel.Type, processors, err = readConfigFile(data, configs); err != nil {
+			return nil, errors.New("Invalid config file " + cf.file + ": " + err.Error())
+		}
+	}
+	if cf.channel != "" {
+		oc.Channel.Type = cf.channel
+	}
+	if cf.processors != "" {
+		processors = strings.Split(cf.processors, ",")
+	}
+	for _, v := range cf.values {
+		if err := config.SetValue(configs[v.config], v.param, v.text); err != nil {
+			return nil, errors.New(v.config + "." + err.Error())
+		}
+	}
+
+	if oc.Channel.Type == "" {
+		return nil, errors.New("No channel selected")
+	}
+	if _, ok := oc.Channel.Data[oc.Channel.Type]; !ok {
+		return nil, errors.New("Unknown channel " + oc.Channel.Type)
+	}
+	for _, name := range processors {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := pdata[name]; !ok {
+			return nil, errors.New("Unknown processor " + name)
+		}
+		oc.Processors = append(oc.Processors, processorConfig{Type: name, Data: pdata})
+	}
+	return json.Marshal(oc)
+}
+
+// Set the params of a config set from a config file
+// Returns the channel and processors given by the file
+func readConfigFile(data []byte, configs map[string]interface{}) (string, []string, error) {
+	var (
+		channel    string
+		processors []string
+		keys       []string
+	)
+	values, err := config.ParseFile(data)
+	if err != nil {
+		return "", nil, err
+	}
+	// The keys are sorted so that errors are reported consistently
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch value := values[key].(type) {
+		case string:
+			if key == "channel" {
+				channel = value
+			} else if key == "processors" {
+				processors = strings.Split(value, ",")
+			} else if i := strings.Index(key, "."); i >= 0 {
+				if err = setConfigValue(configs, key[:i], key[i+1:], value); err != nil {
+					return "", nil, err
+				}
+			} else {
+				return "", nil, errors.New(key + " : Expected the params of a config")
+			}
+		case []interface{}:
+			if key != "processors" {
+				return "", nil, errors.New(key + " : Unexpected list")
+			}
+			for _, p := range value {
+				if name, ok := p.(string); ok {
+					processors = append(processors, name)
+				} else {
+					return "", nil, errors.New(key + " : Expected a list of names")
+				}
+			}
+		case map[string]interface{}:
+			var params []string
+			for param := range value {
+				params = append(params, param)
+			}
+			sort.Strings(params)
+			for _, param := range params {
+				text, ok := value[param].(string)
+				if !ok {
+					return "", nil, errors.New(key + "." + param + " : Expected a value")
+				}
+				if err = setConfigValue(configs, key, param, text); err != nil {
+					return "", nil, err
+				}
+			}
+		}
+	}
+	return channel, processors, nil
+}
+
+func setConfigValue(configs map[string]interface{}, name string, param string, text string) error {
+	c, ok := configs[name]
+	if !ok {
+		return errors.New("Unknown config " + name)
+	}
+	if err := config.SetValue(c, param, text); err != nil {
+		return errors.New(name + "." + err.Error())
+	}
+	return nil
+}
+
+// Set the configuration reported to clients by the config command, which is
+// also used for the fields omitted from open commands
+// The configuration is in the format of the open command, and is validated.
+func (ctr *Controller) SetConfig(data []byte) error {
+	ctr.cmdLock.Lock()
+	defer ctr.cmdLock.Unlock()
+	cd, err := ctr.readConfig(data)
+	if err != nil {
+		return err
+	}
+	ctr.config.Processors = cd.Processors
+	ctr.config.Channel = cd.Channel
+	ctr.config.Framing = cd.Framing
+	ctr.config.Handshake = cd.Handshake
+	return nil
+}
@@ -0,0 +1,208 @@
+package controller
+
+import (
+	"./config"
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// When framing is enabled, each processed message is split into fragments
+// that are sent with separate calls to Send, and reassembled from separate
+// calls to Receive. Each fragment starts with a flags byte and the sequence
+// number of the message. The first fragment of a message is followed by the
+// length of the whole message.
+const (
+	fragmentFirst = 0x01
+	fragmentMore  = 0x02
+)
+
+const (
+	fragmentHeaderSize      = 3
+	firstFragmentHeaderSize = fragmentHeaderSize + 4
+)
+
+// The read buffer size used before framing was configurable
+const defaultMaxMessageSize = 1024
+
+// The largest message without framing
+// The receive buffer of each session is this large, so it is much smaller
+// than the largest framed message, which is only allocated once its first
+// fragment is received.
+const maxUnframedMessageSize = 65535
+
+type framingConfig struct {
+	Enable         config.BoolParam
+	FragmentSize   config.U64Param
+	MaxMessageSize config.U64Param
+}
+
+func defaultFraming() framingConfig {
+	return framingConfig{
+		Enable:         config.MakeBool(false, config.Display{Description: "Split messages into fragments sent separately along the covert channel. Your friend must also enable this.", Name: "Framing", Group: "Framing", GroupToggle: true}),
+		FragmentSize:   config.MakeU64(512, [2]uint64{1, 65535}, config.Display{Description: "The largest number of message bytes sent with each fragment.", Name: "Fragment Size", Group: "Framing"}),
+		MaxMessageSize: config.MakeU64(defaultMaxMessageSize, [2]uint64{1, maxFileSize}, config.Display{Description: "The largest message that can be sent or received, after processing. Without framing, this is the largest message the channel can receive at once, up to 65535 bytes.", Name: "Max Message Size", Group: "Framing"}),
+	}
+}
+
+// Without framing, the max message size is the size of the receive buffer
+func (fconf framingConfig) ValidateAll() config.FieldErrors {
+	if !fconf.Enable.Value && fconf.MaxMessageSize.Value > maxUnframedMessageSize {
+		return config.FieldErrors{"MaxMessageSize": "Without framing, the max message size must be at most " + strconv.Itoa(maxUnframedMessageSize) + " bytes"}
+	}
+	return nil
+}
+
+// Retrieve the validated framing configuration
+func framingConfigFrom(fconf framingConfig) (framingConfig, error) {
+	// We copy to the default config so that the ranges and descriptions are not modified
+	var newConf framingConfig = defaultFraming()
+	if err := config.CopyValue(&newConf, fconf); err != nil {
+		return newConf, err
+	}
+	if err := config.Validate(newConf); err != nil {
+		return newConf, err
+	}
+	return newConf, nil
+}
+
+// The framing state of a session
+type framing struct {
+	enabled      bool
+	fragmentSize uint64
+	maxSize      uint64
+	// The buffer passed to Receive
+	// This must only be accessed by the read loop of the session
+	buffer []byte
+	// The sequence number of the next message sent
+	// This must only be accessed while holding the send lock of the session
+	sendSeq uint16
+	// The message being reassembled from each peer, indexed by peer
+	// This must only be accessed by the read loop of the session
+	recv map[int]*reassembly
+}
+
+// A message being reassembled
+type reassembly struct {
+	active   bool
+	recvSeq  uint16
+	recvSize uint64
+	recvData []byte
+}
+
+func newFraming(fconf framingConfig) *framing {
+	f := &framing{
+		enabled:      fconf.Enable.Value,
+		fragmentSize: fconf.FragmentSize.Value,
+		maxSize:      fconf.MaxMessageSize.Value,
+		recv:         make(map[int]*reassembly),
+	}
+	f.buffer = make([]byte, receiveBufferSize(fconf))
+	return f
+}
+
+// The size of the buffer passed to Receive
+// Without framing each message must be received at once
+func receiveBufferSize(fconf framingConfig) uint64 {
+	if fconf.Enable.Value {
+		return fconf.FragmentSize.Value + firstFragmentHeaderSize
+	}
+	return fconf.MaxMessageSize.Value
+}
+
+// Split a processed message into the fragments to send
+func (f *framing) fragment(data []byte) ([][]byte, error) {
+	if uint64(len(data)) > f.maxSize {
+		return nil, errors.New("Message of " + strconv.Itoa(len(data)) + " bytes is larger than the maximum message size of " + strconv.FormatUint(f.maxSize, 10) + " bytes")
+	}
+	if !f.enabled {
+		return [][]byte{data}, nil
+	}
+
+	var (
+		fragments [][]byte
+		seq       uint16 = f.sendSeq
+	)
+	f.sendSeq++
+	for start := uint64(0); start == 0 || start < uint64(len(data)); start += f.fragmentSize {
+		end := start + f.fragmentSize
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		var frag []byte
+		if start == 0 {
+			frag = make([]byte, firstFragmentHeaderSize, firstFragmentHeaderSize+end-start)
+			frag[0] = fragmentFirst
+			binary.BigEndian.PutUint32(frag[fragmentHeaderSize:], uint32(len(data)))
+		} else {
+			frag = make([]byte, fragmentHeaderSize, fragmentHeaderSize+end-start)
+		}
+		if end < uint64(len(data)) {
+			frag[0] |= fragmentMore
+		}
+		binary.BigEndian.PutUint16(frag[1:], seq)
+		fragments = append(fragments, append(frag, data[start:end]...))
+	}
+	return fragments, nil
+}
+
+// Add a fragment received from a peer to the message being reassembled from that peer
+// Returns the message and true once it is complete, or false if more fragments are needed
+func (f *framing) reassemble(peer int, frag []byte) ([]byte, bool, error) {
+	if !f.enabled {
+		return frag, true, nil
+	}
+	r, ok := f.recv[peer]
+	if !ok {
+		r = &reassembly{}
+		f.recv[peer] = r
+	}
+	return r.add(frag, f.maxSize)
+}
+
+// Add a fragment to the message
+func (r *reassembly) add(frag []byte, maxSize uint64) ([]byte, bool, error) {
+	if len(frag) < fragmentHeaderSize {
+		return nil, false, errors.New("Invalid fragment")
+	}
+	flags := frag[0]
+	seq := binary.BigEndian.Uint16(frag[1:])
+
+	if flags&fragmentFirst != 0 {
+		if len(frag) < firstFragmentHeaderSize {
+			return nil, false, errors.New("Invalid fragment")
+		}
+		size := uint64(binary.BigEndian.Uint32(frag[fragmentHeaderSize:]))
+		if size > maxSize {
+			r.active = false
+			return nil, false, errors.New("Incoming message of " + strconv.FormatUint(size, 10) + " bytes is larger than the maximum message size")
+		}
+		// Any incomplete message is discarded
+		r.active = true
+		r.recvSeq = seq
+		r.recvSize = size
+		r.recvData = make([]byte, 0, size)
+		frag = frag[firstFragmentHeaderSize:]
+	} else {
+		if !r.active || seq != r.recvSeq {
+			r.active = false
+			return nil, false, errors.New("Fragment received out of order")
+		}
+		frag = frag[fragmentHeaderSize:]
+	}
+
+	if uint64(len(r.recvData)+len(frag)) > r.recvSize {
+		r.active = false
+		return nil, false, errors.New("Fragment exceeds message length")
+	}
+	r.recvData = append(r.recvData, frag...)
+	if flags&fragmentMore != 0 {
+		return nil, false, nil
+	}
+
+	r.active = false
+	if uint64(len(r.recvData)) != r.recvSize {
+		return nil, false, errors.New("Message length does not match fragments received")
+	}
+	return r.recvData, true, nil
+}
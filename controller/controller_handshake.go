@@ -0,0 +1,369 @@
+package controller
+
+import (
+	"./config"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// When the handshake is enabled, each side of a session sends a fingerprint
+// of its configuration to its friend when the channel is opened, and the
+// friend answers with its own. Both sides then report whether the
+// configurations match with a peer message. If the channel has several peers,
+// the handshake is performed with each of them and reported separately.
+// The handshake packets are sent directly along the covert channel, without
+// the processors or framing, so that they can be read even if the friend's
+// processors or framing are different. Each packet starts with handshakeMagic,
+// followed by the type of the packet, the version of the handshake and the
+// fingerprint. As the packets are easy to identify, they are only sent, detected
+// and answered by sessions that have the handshake enabled.
+var handshakeMagic []byte = []byte{0x00, 'C', 'H', 0x00}
+
+const (
+	// Sent when the channel is opened, and repeated until the friend answers
+	handshakeHello = 'H'
+	// The answer to a hello
+	handshakeAck = 'A'
+)
+
+// The version of the handshake packets
+const handshakeVersion = 1
+
+// The size of a handshake packet without the processors
+// Each processor adds 2 bytes
+const handshakeHeaderSize = 12
+
+// How often the hello is repeated until the friend answers
+const handshakeRetry = time.Second
+
+// The statuses of peer messages
+const (
+	peerConnected   = "connected"
+	peerMismatch    = "mismatch"
+	peerUnreachable = "unreachable"
+)
+
+// The params of a channel that must be the same for both friends
+// Other params, such as addresses, ports and timeouts, are expected to differ
+var peerChannelParams []string = []string{"Embedder", "Delimiter"}
+
+type handshakeConfig struct {
+	Enable  config.BoolParam
+	Timeout config.U64Param
+}
+
+func defaultHandshake() handshakeConfig {
+	return handshakeConfig{
+		Enable:  config.MakeBool(false, config.Display{Description: "Compare the processors, channel and framing with your friend when the channel is opened.", Name: "Handshake", Group: "Handshake", GroupToggle: true}),
+		Timeout: config.MakeU64(10000, [2]uint64{100, 600000}, config.Display{Description: "How long to wait for your friend to answer in milliseconds, before they are reported as unreachable.", Name: "Handshake Timeout", Group: "Handshake"}),
+	}
+}
+
+// Retrieve the validated handshake configuration
+func handshakeConfigFrom(hconf handshakeConfig) (handshakeConfig, error) {
+	// We copy to the default config so that the ranges and descriptions are not modified
+	var newConf handshakeConfig = defaultHandshake()
+	if err := config.CopyValue(&newConf, hconf); err != nil {
+		return newConf, err
+	}
+	if err := config.Validate(newConf); err != nil {
+		return newConf, err
+	}
+	return newConf, nil
+}
+
+// Reports the result of the handshake to the client
+type peerMessage struct {
+	OpCode  string
+	Session string
+	// The name of the peer
+	Peer string
+	// One of connected, mismatch or unreachable
+	Status  string
+	Message string
+}
+
+// A compact description of the configuration of a session
+// Each field is a hash, so that the configuration is not revealed
+type fingerprint struct {
+	framing         bool
+	channelType     uint16
+	channelSettings uint16
+	processors      []uint16
+}
+
+// The handshake state of a session
+type handshake struct {
+	enabled bool
+	timeout time.Duration
+	local   fingerprint
+	// Closed once a packet has been received from every peer
+	allSeen chan interface{}
+	// These must only be accessed while holding the status lock
+	// Whether a packet has been received from each peer
+	seen   []bool
+	unseen int
+	// The peer message most recently reported for each peer, so that it is only reported when it changes
+	status []string
+	// Whether an answer is being sent to each peer, so that only one is sent at a time
+	answering  []bool
+	statusLock sync.Mutex
+}
+
+func newHandshake(conf sessionConfig, peers int) *handshake {
+	return &handshake{
+		enabled: conf.Handshake.Enable.Value,
+		timeout: time.Duration(conf.Handshake.Timeout.Value) * time.Millisecond,
+		local:   configFingerprint(conf),
+		allSeen: make(chan interface{}),
+		seen:    make([]bool, peers),
+		unseen:  peers,
+		status:  make([]string, peers),
+		// The answers are sent by separate goroutines, so they are limited to one per peer
+		answering: make([]bool, peers),
+	}
+}
+
+// Check that the handshake packets fit in the receive buffer of the friend
+// The friend is expected to use the same framing config
+func handshakeFits(conf configData) error {
+	if !conf.Handshake.Enable.Value {
+		return nil
+	}
+	if size := uint64(handshakeHeaderSize + 2*len(conf.Processors)); size > receiveBufferSize(conf.Framing) {
+		return config.FieldErrors{"Enable": "The handshake needs " + strconv.FormatUint(size, 10) + " bytes, which is larger than the receive buffer. Increase the fragment size or the max message size."}
+	}
+	return nil
+}
+
+// The fingerprint of a session configuration
+// Secret params, such as keys, are left out of the fingerprint of a processor
+func configFingerprint(conf sessionConfig) fingerprint {
+	var fp fingerprint = fingerprint{
+		framing:     conf.Framing.Enable.Value,
+		channelType: hashValues(conf.Channel.Type),
+	}
+	var settings []interface{}
+	if v := reflect.Indirect(reflect.ValueOf(conf.Channel.Data[conf.Channel.Type])); v.Kind() == reflect.Struct {
+		for _, name := range peerChannelParams {
+			if f := v.FieldByName(name); f.IsValid() {
+				settings = append(settings, name, paramValue(f))
+			}
+		}
+	}
+	fp.channelSettings = hashValues(settings...)
+	for _, pconf := range conf.Processors {
+		var values []interface{} = []interface{}{pconf.Type}
+		if v := reflect.Indirect(reflect.ValueOf(pconf.Data[pconf.Type])); v.Kind() == reflect.Struct {
+			for i := 0; i < v.NumField(); i++ {
+				if !isSecretParam(v.Field(i).Type()) {
+					values = append(values, v.Type().Field(i).Name, paramValue(v.Field(i)))
+				}
+			}
+		}
+		fp.processors = append(fp.processors, hashValues(values...))
+	}
+	return fp
+}
+
+var (
+	keyParamType    reflect.Type = reflect.TypeOf(config.KeyParam{})
+	hexKeyParamType reflect.Type = reflect.TypeOf(config.HexKeyParam{})
+)
+
+func isSecretParam(t reflect.Type) bool {
+	return t == keyParamType || t == hexKeyParamType
+}
+
+// The value of a param, or nil if it is not a param
+func paramValue(v reflect.Value) interface{} {
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	if f := v.FieldByName("Value"); f.IsValid() {
+		return f.Interface()
+	}
+	return nil
+}
+
+// A 16 bit hash of the JSON encoding of values
+func hashValues(values ...interface{}) uint16 {
+	data, _ := json.Marshal(values)
+	return uint16(crc32.ChecksumIEEE(data))
+}
+
+// Encode a handshake packet
+func (fp fingerprint) packet(kind byte) []byte {
+	var data []byte = make([]byte, handshakeHeaderSize, handshakeHeaderSize+2*len(fp.processors))
+	copy(data, handshakeMagic)
+	data[4] = kind
+	data[5] = handshakeVersion
+	if fp.framing {
+		data[6] = 1
+	}
+	data[7] = byte(len(fp.processors))
+	binary.BigEndian.PutUint16(data[8:], fp.channelType)
+	binary.BigEndian.PutUint16(data[10:], fp.channelSettings)
+	for _, p := range fp.processors {
+		data = append(data, 0, 0)
+		binary.BigEndian.PutUint16(data[len(data)-2:], p)
+	}
+	return data
+}
+
+// Check if a received packet is a handshake packet
+func isHandshakeMessage(data []byte) bool {
+	return len(data) >= handshakeHeaderSize && bytes.Equal(data[:len(handshakeMagic)], handshakeMagic)
+}
+
+// Compare the fingerprint in a handshake packet with the local fingerprint
+// Returns the status of the peer and a description of the first difference
+func (fp fingerprint) compare(data []byte) (string, string) {
+	if data[5] != handshakeVersion {
+		return peerMismatch, "Peer mismatch: handshake version " + strconv.Itoa(int(data[5])) + " is not supported"
+	}
+	if binary.BigEndian.Uint16(data[8:]) != fp.channelType {
+		return peerMismatch, "Peer mismatch: channel types differ"
+	}
+	if binary.BigEndian.Uint16(data[10:]) != fp.channelSettings {
+		return peerMismatch, "Peer mismatch: channel settings differ"
+	}
+	if (data[6] == 1) != fp.framing {
+		return peerMismatch, "Peer mismatch: framing differs"
+	}
+	var count int = int(data[7])
+	if len(data) < handshakeHeaderSize+2*count {
+		return peerMismatch, "Peer mismatch: invalid handshake"
+	}
+	for i := 0; i < count || i < len(fp.processors); i++ {
+		if i >= count || i >= len(fp.processors) || binary.BigEndian.Uint16(data[handshakeHeaderSize+2*i:]) != fp.processors[i] {
+			return peerMismatch, "Peer mismatch: processors differ at index " + strconv.Itoa(i)
+		}
+	}
+	return peerConnected, "Peer connected"
+}
+
+// Record the status of a peer
+// Returns true if it has changed since it was last reported
+func (h *handshake) setStatus(peer int, msg string) bool {
+	h.statusLock.Lock()
+	defer h.statusLock.Unlock()
+	if h.status[peer] == msg {
+		return false
+	}
+	h.status[peer] = msg
+	return true
+}
+
+// Record that a packet has been received from a peer
+func (h *handshake) setSeen(peer int) {
+	h.statusLock.Lock()
+	defer h.statusLock.Unlock()
+	if h.seen[peer] {
+		return
+	}
+	h.seen[peer] = true
+	if h.unseen--; h.unseen == 0 {
+		close(h.allSeen)
+	}
+}
+
+// The peers that have not yet sent a packet
+func (h *handshake) unseenPeers() []int {
+	h.statusLock.Lock()
+	defer h.statusLock.Unlock()
+	var peers []int
+	for i, seen := range h.seen {
+		if !seen {
+			peers = append(peers, i)
+		}
+	}
+	return peers
+}
+
+func toPeerMessage(session string, peer string, status string, msg string) []byte {
+	if data, err := json.Marshal(peerMessage{OpCode: "peer", Session: session, Peer: peer, Status: status, Message: msg}); err != nil {
+		return toSessionMessage("error", session, "Marshal Error")
+	} else {
+		return data
+	}
+}
+
+// Send a handshake packet along the covert channel of a session to a peer
+func (ctr *Controller) sendHandshake(l *Layers, peer int, kind byte) error {
+	l.sendLock.Lock()
+	defer l.sendLock.Unlock()
+	ctx, cancelFn := cancelContext(nil, l.readClose)
+	defer cancelFn()
+	if _, err := sendFragment(ctx, l.channel, peer, l.handshake.local.packet(kind)); err != nil {
+		return err
+	}
+	l.stats.addFragmentWritten()
+	return nil
+}
+
+// Start the handshake of a newly opened session
+// The hello is repeated to each peer until it answers or the timeout expires,
+// since the peer may not have opened their channel yet. Errors sending
+// the hello are ignored for the same reason.
+func (ctr *Controller) peerHandshake(l *Layers) {
+	var timeout <-chan time.Time = time.After(l.handshake.timeout)
+	for {
+		for _, peer := range l.handshake.unseenPeers() {
+			ctr.sendHandshake(l, peer, handshakeHello)
+		}
+		select {
+		case <-l.handshake.allSeen:
+			return
+		case <-l.readClose:
+			return
+		case <-timeout:
+			for _, peer := range l.handshake.unseenPeers() {
+				if l.handshake.setStatus(peer, "Peer unreachable") {
+					ctr.sendEvent(l, toPeerMessage(l.id, l.peers[peer], peerUnreachable, "Peer unreachable"))
+				}
+			}
+			return
+		case <-time.After(handshakeRetry):
+		}
+	}
+}
+
+// Start answering a peer, unless an answer is already being sent to it
+func (h *handshake) startAnswer(peer int) bool {
+	h.statusLock.Lock()
+	defer h.statusLock.Unlock()
+	if h.answering[peer] {
+		return false
+	}
+	h.answering[peer] = true
+	return true
+}
+
+func (h *handshake) finishAnswer(peer int) {
+	h.statusLock.Lock()
+	defer h.statusLock.Unlock()
+	h.answering[peer] = false
+}
+
+// Handle a handshake packet received from a peer by the read loop
+// This is only called if the handshake is enabled for this session. Hellos are
+// answered by a separate goroutine, so that reading does not wait for a send.
+func (ctr *Controller) handleHandshake(l *Layers, peer int, data []byte) {
+	l.handshake.setSeen(peer)
+	if data[4] == handshakeHello && l.handshake.startAnswer(peer) {
+		go func() {
+			defer l.handshake.finishAnswer(peer)
+			ctr.sendHandshake(l, peer, handshakeAck)
+		}()
+	}
+	if status, msg := l.handshake.local.compare(data); l.handshake.setStatus(peer, msg) {
+		ctr.sendEvent(l, toPeerMessage(l.id, l.peers[peer], status, msg))
+	}
+}
@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The largest line that will be read from the headless input
+const maxHeadlessLine = 1024 * 1024
+
+// The configuration for running the controller without a web interface
+type HeadlessConfig struct {
+	// The JSON configuration of the processors and channel
+	// This uses the same format as the config command, though
+	// only the Processors and Channel fields are used
+	Config []byte
+	// Each line read from Input is sent as a covert message
+	Input io.Reader
+	// Each file is sent with the sendfile operation once Input is exhausted
+	Files []string
+	// Received messages are written to Output, one per line
+	Output io.Writer
+	// Received files are saved to this directory
+	FileDir string
+	// How long to keep receiving messages once all input has been sent
+	// Set zero to keep receiving until Stop is closed
+	Linger time.Duration
+	// Close to stop the controller
+	Stop chan interface{}
+}
+
+// Open a covert channel and exchange messages without the websocket server
+// This returns once all input has been sent and the linger time has passed,
+// or when Stop is closed
+func (ctr *Controller) RunHeadless(hc HeadlessConfig) error {
+	var (
+		lg        *log.Logger      = log.New(os.Stderr, "", log.Flags())
+		listener  chan []byte      = ctr.addListener()
+		inputDone chan error       = make(chan error, 1)
+		done      chan interface{} = make(chan interface{})
+		l         *Layers
+	)
+	defer ctr.removeListener(listener)
+
+	if err := ctr.handleOpen(defaultSession, hc.Config); err != nil {
+		return errors.New("Unable to open channel: " + err.Error())
+	}
+	defer ctr.handleClose(defaultSession)
+	if l = ctr.getSession(defaultSession); l == nil {
+		return errChannelClosed
+	}
+
+	// Report everything received on the covert channel
+	go func() {
+		for {
+			select {
+			case data, ok := <-listener:
+				if !ok {
+					lg.Println("Output fell behind, no longer reporting messages")
+					return
+				}
+				if err := hc.output(data, lg); err != nil {
+					lg.Println("Unable to write output: " + err.Error())
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	go func() {
+		inputDone <- ctr.sendHeadlessInput(l, hc)
+	}()
+
+	select {
+	case err := <-inputDone:
+		if err != nil {
+			return err
+		}
+	case <-hc.Stop:
+		return nil
+	}
+
+	if hc.Linger == 0 {
+		<-hc.Stop
+	} else {
+		select {
+		case <-time.After(hc.Linger):
+		case <-hc.Stop:
+		}
+	}
+	return nil
+}
+
+// Send every line of input followed by every file
+func (ctr *Controller) sendHeadlessInput(l *Layers, hc HeadlessConfig) error {
+	if hc.Input != nil {
+		scanner := bufio.NewScanner(hc.Input)
+		scanner.Buffer(make([]byte, 4096), maxHeadlessLine)
+		for scanner.Scan() {
+			if err := ctr.writeData(l, scanner.Bytes()); err != nil {
+				return err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return errors.New("Unable to read input: " + err.Error())
+		}
+	}
+	for _, name := range hc.Files {
+		if file, err := ioutil.ReadFile(name); err != nil {
+			return err
+		} else if err = ctr.sendFile(l, filepath.Base(name), file, 0, nil); err != nil {
+			return errors.New("Unable to send file " + name + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Write a message sent to the clients to the headless output
+func (hc HeadlessConfig) output(data []byte, lg *log.Logger) error {
+	var mt messageType
+	if err := json.Unmarshal(data, &mt); err != nil {
+		return err
+	}
+	switch mt.OpCode {
+	case "read":
+		if b, err := decodeMessage(mt); err != nil {
+			return err
+		} else if _, err = hc.Output.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	case "file":
+		var fm fileMessage
+		if err := json.Unmarshal(data, &fm); err != nil {
+			return err
+		}
+		b, err := base64.StdEncoding.DecodeString(fm.Message)
+		if err != nil {
+			return err
+		}
+		// Only the base name is used so that the peer cannot write outside of the directory
+		base := filepath.Base(fm.Name)
+		if base == "." || base == ".." || base == string(filepath.Separator) {
+			return errors.New("Invalid file name: " + fm.Name)
+		}
+		name := filepath.Join(hc.FileDir, base)
+		if err = ioutil.WriteFile(name, b, 0644); err != nil {
+			return err
+		}
+		lg.Println("Received file " + name)
+	case "error":
+		lg.Println(mt.Message)
+	}
+	return nil
+}
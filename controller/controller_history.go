@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of messages kept when the history is not stored in a file
+const maxHistory = 1000
+
+// The default and maximum number of messages returned by a history query
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// The largest line read from the history file
+const maxHistoryLine = 128 * 1024 * 1024
+
+// A message sent or received along a covert channel
+type historyEntry struct {
+	// Increases by one for each message recorded
+	ID      uint64
+	Time    time.Time
+	Session string
+	// Either "send" or "receive"
+	Direction string
+	// The type of the channel and each processor of the session
+	Channel    string
+	Processors []string
+	// The size of the message, and the size once processed
+	Bytes          int
+	ProcessedBytes int
+	Message        string
+	Encoding       string
+	// Set if the message could not be sent or received
+	Error string
+}
+
+// The history command
+// Every field other than OpCode is optional
+type historyQuery struct {
+	OpCode    string
+	Session   string
+	Direction string
+	Channel   string
+	// Only messages containing this text
+	Contains string
+	// Only messages with (true) or without (false) an error
+	Error *bool
+	Since time.Time
+	Until time.Time
+	// The number of the most recent matching messages to skip
+	Offset int
+	// The number of messages to return
+	Limit int
+}
+
+type historyMessage struct {
+	OpCode string
+	// The number of messages that match the query
+	Total    int
+	Offset   int
+	Messages []historyEntry
+}
+
+// The messages sent and received in every session
+// If a file is set, every message is appended to it as a line of JSON.
+// Otherwise, only the most recent messages are kept in memory.
+type history struct {
+	entries []historyEntry
+	file    *os.File
+	nextID  uint64
+	lock    sync.Mutex
+}
+
+func newHistory() *history {
+	return &history{entries: make([]historyEntry, 0), nextID: 1}
+}
+
+// The history file used unless another is given
+// It is kept in the config directory of the user rather than the working
+// directory, so that the history is the same wherever the server is started
+// and is not left in checkouts of the repository.
+func DefaultHistoryFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "history.jsonl"
+	}
+	return filepath.Join(dir, "covert-channels", "history.jsonl")
+}
+
+// Store the history in a file
+// Messages already in the file are kept, and new messages are appended.
+// The directory of the file is created if it does not exist.
+func (ctr *Controller) SetHistoryFile(name string) error {
+	return ctr.history.open(name)
+}
+
+func (h *history) open(name string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return errors.New("Unable to create history directory: " + err.Error())
+	}
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.New("Unable to open history file: " + err.Error())
+	}
+	// Continue numbering from the last message in the file
+	var nextID uint64 = 1
+	if err = eachLine(file, func(e historyEntry) {
+		if e.ID >= nextID {
+			nextID = e.ID + 1
+		}
+	}); err != nil {
+		file.Close()
+		return errors.New("Unable to read history file: " + err.Error())
+	}
+	if h.file != nil {
+		h.file.Close()
+	}
+	h.file = file
+	h.nextID = nextID
+	h.entries = make([]historyEntry, 0)
+	return nil
+}
+
+// Close the history file
+func (h *history) close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+// Record a message that was sent or received
+// The message is encoded in the same way as a read event
+func (h *history) add(l *Layers, direction string, data []byte, processed int, err error) {
+	var e historyEntry = historyEntry{
+		Time:           time.Now(),
+		Session:        l.id,
+		Direction:      direction,
+		Channel:        l.conf.Channel.Type,
+		Processors:     make([]string, 0, len(l.conf.Processors)),
+		Bytes:          len(data),
+		ProcessedBytes: processed,
+	}
+	for _, p := range l.conf.Processors {
+		e.Processors = append(e.Processors, p.Type)
+	}
+	e.Message, e.Encoding = encodeData(data, l.encoding)
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	e.ID = h.nextID
+	h.nextID++
+	if h.file != nil {
+		if b, err := json.Marshal(e); err != nil {
+			log.Println("Unable to encode history entry: " + err.Error())
+		} else if _, err = h.file.Write(append(b, '\n')); err != nil {
+			log.Println("Unable to write history file: " + err.Error())
+		}
+		return
+	}
+	if len(h.entries) >= maxHistory {
+		h.entries = append(h.entries[:0], h.entries[1:]...)
+	}
+	h.entries = append(h.entries, e)
+}
+
+// Retrieve the messages that match a query
+// The most recent matching messages are returned, skipping the
+// first Offset of them, in the order they were recorded
+func (h *history) query(q historyQuery) (historyMessage, error) {
+	var (
+		hm      historyMessage = historyMessage{OpCode: "history", Offset: q.Offset}
+		matches []historyEntry
+		err     error
+	)
+	if q.Offset < 0 {
+		return hm, newError(codeInvalidCommand, layerController, "", "Offset must not be negative")
+	}
+	if q.Limit < 0 || q.Limit > maxHistoryLimit {
+		return hm, newError(codeInvalidCommand, layerController, "", "Limit must be between 0 and 1000")
+	} else if q.Limit == 0 {
+		q.Limit = defaultHistoryLimit
+	}
+
+	// Only the most recent Offset + Limit matches must be kept
+	collect := func(e historyEntry) {
+		if !q.matches(e) {
+			return
+		}
+		hm.Total++
+		matches = append(matches, e)
+		if len(matches) > q.Offset+q.Limit {
+			matches = matches[1:]
+		}
+	}
+
+	h.lock.Lock()
+	if h.file != nil {
+		if _, err = h.file.Seek(0, 0); err == nil {
+			err = eachLine(h.file, collect)
+		}
+	} else {
+		for _, e := range h.entries {
+			collect(e)
+		}
+	}
+	h.lock.Unlock()
+	if err != nil {
+		return hm, errors.New("Unable to read history file: " + err.Error())
+	}
+
+	if len(matches) > q.Offset {
+		matches = matches[:len(matches)-q.Offset]
+	} else {
+		matches = matches[:0]
+	}
+	if len(matches) > q.Limit {
+		matches = matches[len(matches)-q.Limit:]
+	}
+	// This ensures that null is not sent to the client
+	hm.Messages = append(make([]historyEntry, 0, len(matches)), matches...)
+	return hm, nil
+}
+
+func (q historyQuery) matches(e historyEntry) bool {
+	switch {
+	case q.Session != "" && e.Session != q.Session:
+		return false
+	case q.Direction != "" && e.Direction != q.Direction:
+		return false
+	case q.Channel != "" && e.Channel != q.Channel:
+		return false
+	case q.Contains != "" && (e.Encoding != encodingText || !strings.Contains(e.Message, q.Contains)):
+		return false
+	case q.Error != nil && *q.Error != (e.Error != ""):
+		return false
+	case !q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && e.Time.After(q.Until):
+		return false
+	}
+	return true
+}
+
+// Call f for each entry in a history file
+// Lines that cannot be parsed are skipped, so that a partly written
+// line does not prevent the rest of the history from being read
+func eachLine(file *os.File, f func(historyEntry)) error {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 4096), maxHistoryLine)
+	for scanner.Scan() {
+		var e historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err == nil {
+			f(e)
+		}
+	}
+	return scanner.Err()
+}
+
+// Handle the history command
+func (ctr *Controller) handleHistory(data []byte) ([]byte, error) {
+	var q historyQuery
+	if err := json.Unmarshal(data, &q); err != nil {
+		return nil, err
+	}
+	if hm, err := ctr.history.query(q); err != nil {
+		return nil, err
+	} else {
+		return json.Marshal(hm)
+	}
+}
@@ -2,34 +2,41 @@ package controller
 
 import (
 	"encoding/json"
-	"errors"
 
 	"./channel"
-	"./channel/httpCovert"
-	"./channel/httpNormal"
-	"./channel/icmpIP"
-	"./channel/icmpNormal"
-	"./channel/tcpHandshake"
-	"./channel/tcpNormal"
-	"./channel/tcpSyn"
-	"./channel/udpIP"
-	"./channel/udpNormal"
 	"./config"
 	"./processor"
-	"./processor/asymmetricEncryption"
-	"./processor/caesar"
-	"./processor/checksum"
-	"./processor/gZipCompression"
-	"./processor/none"
-	"./processor/symmetricEncryption"
-	"./processor/zLibCompression"
 )
 
 // Function for opening a covert channel
+// id is the session to open the channel for. If a channel is already open
+// for this session, it is closed first. Channels in other sessions are not affected.
 // Input is the byte string representing a JSON object with the configuration for the channel
-func (ctr *Controller) handleOpen(data []byte) error {
+func (ctr *Controller) handleOpen(id string, data []byte) error {
+	var mt messageType
+	if err := json.Unmarshal(data, &mt); err != nil {
+		return err
+	}
+	if err := validEncoding(mt.Encoding); err != nil {
+		return err
+	}
+	// Close the channel for this session if it is already open
+	if err := ctr.handleClose(id); err != nil {
+		return wrapError("Unable to close previous channel: ", err)
+	}
 	if l, err := ctr.retrieveLayers(data); err == nil {
-		ctr.layers = l
+		l.id = id
+		l.conf.ID = id
+		l.encoding = mt.Encoding
+		l.conf.Encoding = mt.Encoding
+		ctr.sessionLock.Lock()
+		ctr.sessions[id] = l
+		ctr.sessionLock.Unlock()
+		go ctr.readLoop(l)
+		go ctr.sendLoop(l)
+		if l.handshake.enabled {
+			go ctr.peerHandshake(l)
+		}
 		return nil
 	} else {
 		return err
@@ -47,17 +54,53 @@ func channelConfigCopy(currConf *channelConfig) (channelConfig, error) {
 	}
 }
 
-// Retrieve the layer entities that make up the covert channel
-func (ctr *Controller) retrieveLayers(data []byte) (*Layers, error) {
+// Read the configs of the channels from JSON
+// Each config is read into the current value for that channel, so omitted params
+// keep their current values, as they would with a struct. The defaults are used
+// if there are no current values. Unknown channels are ignored.
+func (d *channelData) UnmarshalJSON(data []byte) error {
+	if *d == nil {
+		*d = defaultChannel()
+	}
+	return unmarshalEntityData(*d, data)
+}
+
+// Read the configs of the processors from JSON
+// This behaves the same way as for channels
+func (d *processorData) UnmarshalJSON(data []byte) error {
+	if *d == nil {
+		*d = defaultProcessor()
+	}
+	return unmarshalEntityData(*d, data)
+}
+
+func unmarshalEntityData(d map[string]interface{}, data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for name, conf := range raw {
+		if curr, ok := d[name]; ok {
+			if err := json.Unmarshal(conf, curr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Read a new configuration from the client
+// The configuration of each processor, the channel, the framing and the handshake
+// is validated, but the processors and channel are not created
+// Only the Processors, Channel, Framing and Handshake fields of the returned config are used
+func (ctr *Controller) readConfig(data []byte) (configData, error) {
 	var (
 		readCd configData = DefaultConfig()
-		c      channel.Channel
-		ps     []processor.Processor
-		cconf  *channelConfig
 		// We don't actually have to initialize these slices in go code (append does that for us)
 		// but doing this ensures that null is not sent to the client
 		// so that it loops properly
 		pconfs []processorConfig = make([]processorConfig, 0)
+		cconf  *channelConfig
 		err    error
 	)
 
@@ -70,40 +113,97 @@ func (ctr *Controller) retrieveLayers(data []byte) (*Layers, error) {
 	// The config is used for unmarshalling the data so that empty fields are populated with their
 	// current values (I have confirmed that this is how JSON unmarshal works)
 	if readCd.Channel, err = channelConfigCopy(&ctr.config.Channel); err != nil {
-		return nil, err
+		return readCd, err
 	}
+	readCd.Framing = ctr.config.Framing
+	readCd.Handshake = ctr.config.Handshake
 
 	// Read in the new config data
 	if err := json.Unmarshal(data, &readCd); err != nil {
-		return nil, err
+		return readCd, err
 	}
 
 	for i := range readCd.Processors {
-		var p processor.Processor
-		var pconf *processorConfig
-		if p, pconf, err = ctr.retrieveProcessor(readCd.Processors[i]); err != nil {
-			return nil, err
+		if pconf, err := ctr.processorConfigFrom(readCd.Processors[i]); err != nil {
+			return readCd, configError(layerProcessor, readCd.Processors[i].Type, err)
 		} else {
 			pconfs = append(pconfs, *pconf)
-			ps = append(ps, p)
 		}
 	}
-	if c, cconf, err = ctr.retrieveChannel(readCd.Channel); err != nil {
+	readCd.Processors = pconfs
+	if cconf, err = ctr.channelConfigFrom(readCd.Channel); err != nil {
+		return readCd, configError(layerChannel, readCd.Channel.Type, err)
+	}
+	readCd.Channel = *cconf
+	if readCd.Framing, err = framingConfigFrom(readCd.Framing); err != nil {
+		return readCd, configError(layerController, "", err)
+	}
+	if readCd.Handshake, err = handshakeConfigFrom(readCd.Handshake); err != nil {
+		return readCd, configError(layerController, "", err)
+	}
+	if err = handshakeFits(readCd); err != nil {
+		return readCd, configError(layerController, "", err)
+	}
+	return readCd, nil
+}
+
+// Retrieve the layer entities that make up the covert channel
+func (ctr *Controller) retrieveLayers(data []byte) (*Layers, error) {
+	var (
+		c      channel.Channel
+		ps     []processor.Processor
+		readCd configData
+		err    error
+	)
+
+	if readCd, err = ctr.readConfig(data); err != nil {
 		return nil, err
 	}
-	// We only update the Processor and Channel fields, as none others should be modified
-	ctr.config.Processors = pconfs
-	ctr.config.Channel = *cconf
 
-	return &Layers{processors: ps, channel: c, readClose: make(chan interface{}), readCloseDone: make(chan interface{})}, nil
+	for i := range readCd.Processors {
+		if p, err := toProcessor(&readCd.Processors[i]); err != nil {
+			return nil, newError(codeProcessorFailed, layerProcessor, readCd.Processors[i].Type, err.Error())
+		} else {
+			ps = append(ps, p)
+		}
+	}
+	if c, err = toChannel(&readCd.Channel); err != nil {
+		return nil, channelError(readCd.Channel.Type, "", err)
+	}
+	// We only update the Processor, Channel, Framing and Handshake fields, as none others should be modified
+	ctr.config.Processors = readCd.Processors
+	ctr.config.Channel = readCd.Channel
+	ctr.config.Framing = readCd.Framing
+	ctr.config.Handshake = readCd.Handshake
+
+	return newLayers(sessionConfig{Processors: readCd.Processors, Channel: readCd.Channel, Framing: readCd.Framing, Handshake: readCd.Handshake}, ps, c), nil
 }
 
-// Retrieve the channel entity
-// channelType is the type of channel
-// data is the byte string of the configuration struct JSON
-func (ctr *Controller) retrieveChannel(cconf channelConfig) (channel.Channel, *channelConfig, error) {
+// Create the state of a session from its processors and channel
+// The read and send loops are not started
+func newLayers(conf sessionConfig, ps []processor.Processor, c channel.Channel) *Layers {
+	return &Layers{
+		processors:    ps,
+		channel:       c,
+		peers:         channelPeers(c),
+		conf:          conf,
+		framing:       newFraming(conf.Framing),
+		handshake:     newHandshake(conf, len(channelPeers(c))),
+		transfers:     make(map[uint32]*fileTransfer),
+		stats:         newSessionStats(),
+		sendQueue:     make(chan *sendJob, maxSendQueue),
+		sendJobs:      make(map[uint64]*sendJob),
+		schedules:     make(map[uint64]*schedule),
+		readClose:     make(chan interface{}),
+		readCloseDone: make(chan interface{}),
+		sendLoopDone:  make(chan interface{}),
+	}
+}
+
+// Retrieve the validated configuration of a channel
+// Only the values of the selected channel type are taken from cconf
+func (ctr *Controller) channelConfigFrom(cconf channelConfig) (*channelConfig, error) {
 	var (
-		c       channel.Channel
 		newConf channelConfig
 		err     error
 	)
@@ -111,66 +211,31 @@ func (ctr *Controller) retrieveChannel(cconf channelConfig) (channel.Channel, *c
 	// We also populate it with the current values in the channel
 	// This is effectively a copy of the current channel config
 	if newConf, err = channelConfigCopy(&ctr.config.Channel); err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	newConf.Type = cconf.Type
 
 	// Then we populate the new config with the updated values only for the selected covert channel
 	if err = config.CopyValueSet(&newConf.Data, &cconf.Data, []string{newConf.Type}); err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	if err = config.ValidateConfigSet(&newConf.Data); err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	return &newConf, nil
+}
 
-	switch newConf.Type {
-	case "IcmpIP":
-		if c, err = icmpIP.ToChannel(newConf.Data.IcmpIP); err != nil {
-			return nil, nil, err
-		}
-	case "IcmpNormal":
-		if c, err = icmpNormal.ToChannel(newConf.Data.IcmpNormal); err != nil {
-			return nil, nil, err
-		}
-	case "TcpSyn":
-		if c, err = tcpSyn.ToChannel(newConf.Data.TcpSyn); err != nil {
-			return nil, nil, err
-		}
-	case "TcpHandshake":
-		if c, err = tcpHandshake.ToChannel(newConf.Data.TcpHandshake); err != nil {
-			return nil, nil, err
-		}
-	case "TcpNormal":
-		if c, err = tcpNormal.ToChannel(newConf.Data.TcpNormal); err != nil {
-			return nil, nil, err
-		}
-	case "HttpCovert":
-		if c, err = httpCovert.ToChannel(newConf.Data.HttpCovert); err != nil {
-			return nil, nil, err
-		}
-	case "HttpNormal":
-		if c, err = httpNormal.ToChannel(newConf.Data.HttpNormal); err != nil {
-			return nil, nil, err
-		}
-	case "UdpNormal":
-		if c, err = udpNormal.ToChannel(newConf.Data.UdpNormal); err != nil {
-			return nil, nil, err
-		}
-	case "UdpIP":
-		if c, err = udpIP.ToChannel(newConf.Data.UdpIP); err != nil {
-			return nil, nil, err
-		}
-	default:
-		err = errors.New("Invalid Channel Type")
-	}
-	return c, &newConf, err
+// Create the channel entity from a validated configuration
+func toChannel(cconf *channelConfig) (channel.Channel, error) {
+	return channel.ToChannel(cconf.Type, cconf.Data[cconf.Type])
 }
 
-func (ctr *Controller) retrieveProcessor(pconf processorConfig) (processor.Processor, *processorConfig, error) {
+// Retrieve the validated configuration of a processor
+// Only the values of the selected processor type are taken from pconf
+func (ctr *Controller) processorConfigFrom(pconf processorConfig) (*processorConfig, error) {
 	var (
-		p       processor.Processor
 		newConf processorConfig
 		err     error
 	)
@@ -180,44 +245,16 @@ func (ctr *Controller) retrieveProcessor(pconf processorConfig) (processor.Proce
 	// That way we don't override any descriptions or ranges
 	newConf.Type = pconf.Type
 	if err = config.CopyValueSet(&newConf.Data, &pconf.Data, []string{newConf.Type}); err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	if err = config.ValidateConfigSet(&newConf.Data); err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	return &newConf, nil
+}
 
-	switch newConf.Type {
-	case "None":
-		if p, err = none.ToProcessor(newConf.Data.None); err != nil {
-			return nil, nil, err
-		}
-	case "Caesar":
-		if p, err = caesar.ToProcessor(newConf.Data.Caesar); err != nil {
-			return nil, nil, err
-		}
-	case "Checksum":
-		if p, err = checksum.ToProcessor(newConf.Data.Checksum); err != nil {
-			return nil, nil, err
-		}
-	case "SymmetricEncryption":
-		if p, err = symmetricEncryption.ToProcessor(newConf.Data.SymmetricEncryption); err != nil {
-			return nil, nil, err
-		}
-	case "AsymmetricEncryption":
-		if p, err = asymmetricEncryption.ToProcessor(newConf.Data.AsymmetricEncryption); err != nil {
-			return nil, nil, err
-		}
-	case "GZipCompression":
-		if p, err = gZipCompression.ToProcessor(newConf.Data.GZipCompression); err != nil {
-			return nil, nil, err
-		}
-	case "ZLibCompression":
-		if p, err = zLibCompression.ToProcessor(newConf.Data.ZLibCompression); err != nil {
-			return nil, nil, err
-		}
-	default:
-		err = errors.New("Invalid Processor Type")
-	}
-	return p, &newConf, err
+// Create the processor entity from a validated configuration
+func toProcessor(pconf *processorConfig) (processor.Processor, error) {
+	return processor.ToProcessor(pconf.Type, pconf.Data[pconf.Type])
 }
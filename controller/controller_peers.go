@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"./channel"
+	"context"
+	"encoding/json"
+)
+
+// Channels that implement channel.PeerChannel can send to and receive from
+// several named peers. The friend is always the first peer. The write and
+// schedule commands take a list of peers, where "*" selects every peer and an
+// empty list selects the friend, and each read event names the peer that sent
+// the message. Channels without peers only have the friend.
+const allPeers = "*"
+
+// The write command
+type writeCommand struct {
+	OpCode   string
+	Session  string
+	Message  string
+	Encoding string
+	// The names of the peers to send the message to
+	// If empty, the message is sent to the friend
+	Peers []string
+}
+
+// A read event
+type readMessage struct {
+	OpCode   string
+	Session  string
+	Message  string
+	Encoding string
+	// The name of the peer that sent the message
+	Peer string
+}
+
+// A helper function for preparing read events
+// The data is sent as text if possible. It is base64 encoded if requested
+// by encoding or if it is not valid UTF-8, so that the bytes are never changed
+// by the JSON encoder.
+func toReadMessage(session string, peer string, data []byte, encoding string) []byte {
+	var rm readMessage = readMessage{OpCode: "read", Session: session, Peer: peer}
+	rm.Message, rm.Encoding = encodeData(data, encoding)
+	if msg, err := json.Marshal(rm); err != nil {
+		return toSessionMessage("error", session, "Marshal Error")
+	} else {
+		return msg
+	}
+}
+
+// The names of the peers of a covert channel
+func channelPeers(c channel.Channel) []string {
+	if pc, ok := c.(channel.PeerChannel); ok {
+		return pc.Peers()
+	}
+	return []string{channel.FriendPeer}
+}
+
+// Find the indexes of the named peers of a session
+// Each peer is only included once
+func (l *Layers) peerIndexes(names []string) ([]int, error) {
+	if len(names) == 0 {
+		return []int{0}, nil
+	}
+	var (
+		peers []int
+		added map[int]bool = make(map[int]bool)
+	)
+	for _, name := range names {
+		if name == allPeers {
+			peers = peers[:0]
+			for i := range l.peers {
+				peers = append(peers, i)
+			}
+			return peers, nil
+		}
+		i := indexOf(l.peers, name)
+		if i < 0 {
+			if _, ok := l.channel.(channel.PeerChannel); !ok {
+				return nil, newError(codeInvalidCommand, layerController, "", "The "+l.conf.Channel.Type+" channel only supports the "+channel.FriendPeer+" peer, not "+name)
+			}
+			return nil, newError(codeInvalidCommand, layerController, "", "Unknown peer: "+name)
+		}
+		if !added[i] {
+			added[i] = true
+			peers = append(peers, i)
+		}
+	}
+	return peers, nil
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// Receive a fragment from a covert channel, so that the receive
+// is interrupted when the context is done if the channel supports it
+// Returns the index of the peer that sent it
+func receiveFragment(ctx context.Context, c channel.Channel, data []byte) (uint64, int, error) {
+	if pc, ok := c.(channel.PeerChannel); ok {
+		return pc.ReceiveFrom(ctx, data)
+	}
+	if cc, ok := c.(channel.ContextChannel); ok {
+		n, err := cc.ReceiveContext(ctx, data)
+		return n, 0, err
+	}
+	n, err := c.Receive(data)
+	return n, 0, err
+}
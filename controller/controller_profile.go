@@ -0,0 +1,251 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Profile names are used as file names, so only simple names are allowed
+var profileName *regexp.Regexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+const profileExt = ".json"
+
+// The saveProfile, loadProfile and deleteProfile commands
+// saveProfile accepts the same configuration as the open command.
+// Any fields omitted are taken from the current configuration.
+type profileCommand struct {
+	OpCode string
+	Name   string
+}
+
+// A saved configuration
+type profile struct {
+	Name       string
+	Processors []processorConfig
+	Channel    channelConfig
+	Framing    framingConfig
+	Handshake  handshakeConfig
+}
+
+// A profile as stored in a file
+// The processors are read separately so that each one can be
+// populated with the default values before it is read
+type storedProfile struct {
+	Name       string
+	Processors []json.RawMessage
+	Channel    channelConfig
+	Framing    framingConfig
+	Handshake  handshakeConfig
+}
+
+type profileSummary struct {
+	Name       string
+	Channel    string
+	Processors []string
+	Modified   time.Time
+}
+
+type profileListMessage struct {
+	OpCode   string
+	Profiles []profileSummary
+}
+
+// Store profiles in a directory
+// The directory is only created once a profile is saved, so that it is not
+// left in the working directory of every run that does not use profiles
+func (ctr *Controller) SetProfileDir(dir string) error {
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		return errors.New("Invalid profile directory: " + dir + " is not a directory")
+	}
+	ctr.profileDir = dir
+	return nil
+}
+
+// Retrieve the file of a profile
+func (ctr *Controller) profileFile(name string) (string, error) {
+	if ctr.profileDir == "" {
+		return "", errors.New("No profile directory")
+	}
+	if !profileName.MatchString(name) {
+		return "", newError(codeInvalidCommand, layerController, "", "Invalid profile name: names may only contain letters, numbers, '-' and '_'")
+	}
+	return filepath.Join(ctr.profileDir, name+profileExt), nil
+}
+
+// Handle the saveProfile command
+func (ctr *Controller) handleSaveProfile(data []byte) error {
+	var (
+		cmd    profileCommand
+		readCd configData
+		file   string
+		err    error
+	)
+	if err = json.Unmarshal(data, &cmd); err != nil {
+		return err
+	}
+	if file, err = ctr.profileFile(cmd.Name); err != nil {
+		return err
+	}
+	if readCd, err = ctr.readConfig(data); err != nil {
+		return err
+	}
+	p := profile{
+		Name:       cmd.Name,
+		Processors: readCd.Processors,
+		Channel:    readCd.Channel,
+		Framing:    readCd.Framing,
+		Handshake:  readCd.Handshake,
+	}
+	if data, err = json.MarshalIndent(p, "", "  "); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(ctr.profileDir, 0700); err != nil {
+		return errors.New("Unable to create profile directory: " + err.Error())
+	}
+	// Write to a temporary file first so that an existing profile
+	// is not lost if writing fails
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// Handle the loadProfile command
+// The profile becomes the current configuration, which is returned
+func (ctr *Controller) handleLoadProfile(data []byte) ([]byte, error) {
+	var (
+		cmd  profileCommand
+		p    *profile
+		file string
+		err  error
+	)
+	if err = json.Unmarshal(data, &cmd); err != nil {
+		return nil, err
+	}
+	if file, err = ctr.profileFile(cmd.Name); err != nil {
+		return nil, err
+	}
+	if p, err = ctr.readProfile(file); err != nil {
+		return nil, err
+	}
+	ctr.config.Processors = p.Processors
+	ctr.config.Channel = p.Channel
+	ctr.config.Framing = p.Framing
+	ctr.config.Handshake = p.Handshake
+	if data, err = ctr.handleConfig(); err != nil {
+		return nil, err
+	}
+	return withField(data, "OpCode", "loadProfile"), nil
+}
+
+// Read and validate a profile
+// Params that were added since the profile was saved keep their default values
+func (ctr *Controller) readProfile(file string) (*profile, error) {
+	var (
+		sp   storedProfile
+		p    profile
+		data []byte
+		err  error
+	)
+	if data, err = ioutil.ReadFile(file); err != nil {
+		if os.IsNotExist(err) {
+			return nil, newError(codeNotFound, layerController, "", "Profile not found")
+		}
+		return nil, err
+	}
+	sp.Channel.Data = defaultChannel()
+	sp.Framing = defaultFraming()
+	sp.Handshake = defaultHandshake()
+	if err = json.Unmarshal(data, &sp); err != nil {
+		return nil, errors.New("Invalid profile: " + err.Error())
+	}
+
+	p.Name = sp.Name
+	// This ensures that null is not sent to the client
+	p.Processors = make([]processorConfig, 0, len(sp.Processors))
+	for i := range sp.Processors {
+		var pconf processorConfig = processorConfig{Data: defaultProcessor()}
+		if err = json.Unmarshal(sp.Processors[i], &pconf); err != nil {
+			return nil, errors.New("Invalid profile: " + err.Error())
+		}
+		// This copies the values with CopyValueSet and checks them with ValidateConfigSet
+		if newConf, err := ctr.processorConfigFrom(pconf); err != nil {
+			return nil, errors.New("Invalid profile: " + err.Error())
+		} else {
+			p.Processors = append(p.Processors, *newConf)
+		}
+	}
+	if newConf, err := ctr.channelConfigFrom(sp.Channel); err != nil {
+		return nil, errors.New("Invalid profile: " + err.Error())
+	} else {
+		p.Channel = *newConf
+	}
+	if p.Framing, err = framingConfigFrom(sp.Framing); err != nil {
+		return nil, errors.New("Invalid profile: " + err.Error())
+	}
+	if p.Handshake, err = handshakeConfigFrom(sp.Handshake); err != nil {
+		return nil, errors.New("Invalid profile: " + err.Error())
+	}
+	return &p, nil
+}
+
+// Handle the listProfiles command
+func (ctr *Controller) handleListProfiles() ([]byte, error) {
+	var (
+		files []os.FileInfo
+		err   error
+		// This ensures that null is not sent to the client
+		msg profileListMessage = profileListMessage{OpCode: "listProfiles", Profiles: make([]profileSummary, 0)}
+	)
+	if ctr.profileDir == "" {
+		return nil, errors.New("No profile directory")
+	}
+	// There are no profiles until the directory is created by saving one
+	if files, err = ioutil.ReadDir(ctr.profileDir); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), profileExt)
+		if f.IsDir() || !strings.HasSuffix(f.Name(), profileExt) || !profileName.MatchString(name) {
+			continue
+		}
+		summary := profileSummary{Name: name, Processors: make([]string, 0), Modified: f.ModTime()}
+		// Profiles that cannot be read are still listed so that they can be deleted
+		if p, err := ctr.readProfile(filepath.Join(ctr.profileDir, f.Name())); err == nil {
+			summary.Channel = p.Channel.Type
+			for _, pconf := range p.Processors {
+				summary.Processors = append(summary.Processors, pconf.Type)
+			}
+		}
+		msg.Profiles = append(msg.Profiles, summary)
+	}
+	sort.Slice(msg.Profiles, func(i, j int) bool { return msg.Profiles[i].Name < msg.Profiles[j].Name })
+	return json.Marshal(msg)
+}
+
+// Handle the deleteProfile command
+func (ctr *Controller) handleDeleteProfile(data []byte) error {
+	var (
+		cmd  profileCommand
+		file string
+		err  error
+	)
+	if err = json.Unmarshal(data, &cmd); err != nil {
+		return err
+	}
+	if file, err = ctr.profileFile(cmd.Name); err != nil {
+		return err
+	}
+	if err = os.Remove(file); err != nil && os.IsNotExist(err) {
+		return newError(codeNotFound, layerController, "", "Profile not found")
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package controller
+
+import (
+	"./channel"
+	"context"
+	"encoding/json"
+	"strconv"
+)
+
+// The number of messages that may be waiting to be sent in each session
+const maxSendQueue = 64
+
+// Returned by sendData when a send is cancelled before all fragments were sent
+var errSendCancelled error = newError(codeCancelled, layerController, "", "Send cancelled")
+
+// Written messages are not sent while handling the command, since some
+// channels take seconds to send each message. Instead, each message is queued
+// and sent by the send loop of the session. The client is told the ID of the
+// send, and each client receives a "queued", "sending" and then "sent" message
+// for it. If the send fails, an error message is sent instead of "sent", and if
+// it is cancelled, a "cancelled" message is sent.
+type sendMessage struct {
+	OpCode  string
+	Session string
+	SendID  uint64
+	Message string
+}
+
+// The cancel command
+type cancelCommand struct {
+	OpCode  string
+	Session string
+	SendID  uint64
+}
+
+// A message waiting to be sent, or being sent
+type sendJob struct {
+	id   uint64
+	data []byte
+	// The indexes of the peers to send to
+	peers []int
+	// If set, data is sent as a file rather than as a message
+	file *fileJob
+	// Closed to cancel the send
+	cancel chan interface{}
+}
+
+func toSendMessage(opcode string, session string, sendID uint64, msg string) []byte {
+	if data, err := json.Marshal(sendMessage{OpCode: opcode, Session: session, SendID: sendID, Message: msg}); err != nil {
+		return toSessionMessage("error", session, "Marshal Error")
+	} else {
+		return data
+	}
+}
+
+// Add a message to the send queue of a session
+// Returns the ID of the send
+// This is only called while handling a command, so nextSendID does not need to be locked
+func (ctr *Controller) queueSend(l *Layers, data []byte, peers []int) (uint64, error) {
+	return ctr.queueJob(l, &sendJob{data: data, peers: peers})
+}
+
+// Add a send to the send queue of a session
+// The ID and cancel channel of the job are set here
+func (ctr *Controller) queueJob(l *Layers, job *sendJob) (uint64, error) {
+	// Only commands add to the queue, so the send below cannot block
+	if len(l.sendQueue) == cap(l.sendQueue) {
+		return 0, newError(codeQueueFull, layerController, "", "Send queue full")
+	}
+	l.nextSendID++
+	job.id, job.cancel = l.nextSendID, make(chan interface{})
+	l.jobLock.Lock()
+	l.sendJobs[job.id] = job
+	l.jobLock.Unlock()
+
+	// The queued message is sent before the job is queued so that
+	// it always reaches the clients before the sending message
+	ctr.wsSend <- toSendMessage("queued", l.id, job.id, "Message queued")
+	l.sendQueue <- job
+	return job.id, nil
+}
+
+// Handle the cancel command
+func (ctr *Controller) handleCancel(id string, data []byte) error {
+	var (
+		cc cancelCommand
+		l  *Layers
+	)
+	if err := json.Unmarshal(data, &cc); err != nil {
+		return err
+	}
+	if l = ctr.getSession(id); l == nil {
+		return errChannelClosed
+	}
+	return l.cancelSend(cc.SendID)
+}
+
+// Cancel a queued or in-flight send
+// A send in progress stops before its next fragment. The fragment
+// being sent is only interrupted if the covert channel is a ContextChannel.
+func (l *Layers) cancelSend(sendID uint64) error {
+	l.jobLock.Lock()
+	defer l.jobLock.Unlock()
+	if job, ok := l.sendJobs[sendID]; !ok {
+		return newError(codeNotFound, layerController, "", "No queued or in-flight send with ID "+strconv.FormatUint(sendID, 10))
+	} else {
+		delete(l.sendJobs, sendID)
+		close(job.cancel)
+		return nil
+	}
+}
+
+// Remove a send once it is complete, so that it can no longer be cancelled
+func (l *Layers) finishSend(sendID uint64) {
+	l.jobLock.Lock()
+	defer l.jobLock.Unlock()
+	delete(l.sendJobs, sendID)
+}
+
+// Loop for sending the queued messages of a session
+// Each session has its own send loop. Messages still queued
+// when the session is closed are discarded.
+func (ctr *Controller) sendLoop(l *Layers) {
+	defer close(l.sendLoopDone)
+	for {
+		select {
+		case <-l.readClose:
+			return
+		case job := <-l.sendQueue:
+			select {
+			case <-job.cancel:
+				ctr.sendEvent(l, toSendMessage("cancelled", l.id, job.id, "Message send cancelled"))
+				continue
+			default:
+			}
+			ctr.sendEvent(l, toSendMessage("sending", l.id, job.id, "Message sending"))
+			var err error
+			if job.file != nil {
+				err = ctr.sendFile(l, job.file.name, job.data, job.file.chunkSize, job.cancel)
+			} else {
+				var n int
+				n, err = ctr.sendData(l, job.data, job.peers, job.cancel)
+				ctr.history.add(l, "send", job.data, n, err)
+			}
+			l.finishSend(job.id)
+			if err == errSendCancelled {
+				ctr.sendEvent(l, toSendMessage("cancelled", l.id, job.id, "Message send cancelled"))
+			} else if err != nil {
+				em := toError(l.id, "Unable to write to channel: ", err)
+				em.SendID = job.id
+				ctr.sendEvent(l, marshalError(em))
+			} else {
+				ctr.sendEvent(l, toSendMessage("sent", l.id, job.id, "Message write success"))
+			}
+		}
+	}
+}
+
+// Send a message to every client unless the session is closed or the controller is shut down
+func (ctr *Controller) sendEvent(l *Layers, data []byte) {
+	select {
+	case ctr.wsSend <- data:
+	case <-l.readClose:
+	case <-ctr.sendStop:
+	}
+}
+
+// A context that is cancelled once either go channel is closed
+// A nil go channel is never closed
+func cancelContext(cancel chan interface{}, closed chan interface{}) (context.Context, context.CancelFunc) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-cancel:
+			cancelFn()
+		case <-closed:
+			cancelFn()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancelFn
+}
+
+// Send a fragment along a covert channel to a peer, so that the send
+// is interrupted when the context is done if the channel supports it
+// Channels without peers can only send to the friend, which is peer 0
+func sendFragment(ctx context.Context, c channel.Channel, peer int, frag []byte) (uint64, error) {
+	if pc, ok := c.(channel.PeerChannel); ok {
+		return pc.SendTo(ctx, peer, frag)
+	}
+	if cc, ok := c.(channel.ContextChannel); ok {
+		return cc.SendContext(ctx, frag)
+	}
+	return c.Send(frag)
+}
@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The kinds of recorded messages
+const (
+	// A command from a websocket or HTTP client
+	recordCommand = "command"
+	// The reply to a command
+	recordReply = "reply"
+	// A message sent to every client
+	recordEvent = "event"
+)
+
+// A command, reply or event in a session file
+type recordEntry struct {
+	Time time.Time
+	// One of command, reply or event
+	Kind string
+	// The opcode of the command, which is not always in the JSON of commands
+	// from the HTTP API. Unset for events.
+	OpCode string
+	Data   json.RawMessage
+	// Set if the command was not valid JSON, in which case Data is the command as a JSON string
+	Invalid bool
+}
+
+// Records every command, reply and event to a session file, one JSON object per line
+// Nothing is recorded unless a file is set
+type recorder struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+// Record every command, reply and event to a session file, so that the
+// commands can be replayed with RunReplay
+// The file is replaced if it exists
+func (ctr *Controller) SetRecordFile(name string) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.New("Unable to open session file: " + err.Error())
+	}
+	ctr.recorder.lock.Lock()
+	defer ctr.recorder.lock.Unlock()
+	if ctr.recorder.file != nil {
+		ctr.recorder.file.Close()
+	}
+	ctr.recorder.file = file
+	return nil
+}
+
+func (r *recorder) add(kind string, opcode string, data []byte) {
+	var e recordEntry = recordEntry{Time: time.Now(), Kind: kind, OpCode: opcode, Data: data}
+	if !json.Valid(data) {
+		e.Data, _ = json.Marshal(string(data))
+		e.Invalid = true
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return
+	}
+	if b, err := json.Marshal(e); err != nil {
+		log.Println("Unable to encode session entry: " + err.Error())
+	} else if _, err = r.file.Write(append(b, '\n')); err != nil {
+		log.Println("Unable to write session file: " + err.Error())
+	}
+}
+
+// Close the session file
+func (r *recorder) close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// The configuration for replaying a recorded session
+type ReplayConfig struct {
+	// The session file to replay
+	Input io.Reader
+	// Every reply and event is written to Output, one per line
+	Output io.Writer
+	// Close to stop the replay
+	Stop chan interface{}
+}
+
+// Replay the commands of a session file with their original timing
+// Each command is run at the same time after the start of the replay as it
+// was after the first entry of the file. Replies and events in the file are
+// only used for timing, as the replay produces its own. This returns once the
+// time of the last entry has passed, so that the events that followed the last
+// command can be seen, or when Stop is closed.
+func (ctr *Controller) RunReplay(rc ReplayConfig) error {
+	var (
+		entries  []recordEntry
+		listener chan []byte      = ctr.addListener()
+		done     chan interface{} = make(chan interface{})
+		finished chan interface{} = make(chan interface{})
+		// Held while writing to Output, as replies and events are written by separate goroutines
+		outLock sync.Mutex
+	)
+	defer ctr.removeListener(listener)
+
+	scanner := bufio.NewScanner(rc.Input)
+	scanner.Buffer(make([]byte, 4096), maxHistoryLine)
+	for scanner.Scan() {
+		var e recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return errors.New("Invalid session file: " + err.Error())
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.New("Unable to read session file: " + err.Error())
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	output := func(data []byte) {
+		outLock.Lock()
+		rc.Output.Write(append(data, '\n'))
+		outLock.Unlock()
+	}
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case data, ok := <-listener:
+				if !ok {
+					log.Println("Replay output fell behind, no longer reporting events")
+					return
+				}
+				output(data)
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		<-finished
+	}()
+
+	var (
+		first time.Time = entries[0].Time
+		start time.Time = time.Now()
+	)
+	for _, e := range entries {
+		select {
+		case <-time.After(time.Until(start.Add(e.Time.Sub(first)))):
+		case <-rc.Stop:
+			return nil
+		}
+		if e.Kind != recordCommand {
+			continue
+		}
+		data := []byte(e.Data)
+		if e.Invalid {
+			var s string
+			if err := json.Unmarshal(e.Data, &s); err != nil {
+				return errors.New("Invalid session file: " + err.Error())
+			}
+			data = []byte(s)
+		}
+		output(withVersion(ctr.handleCommand(e.OpCode, data)))
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package controller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The largest request body accepted by the REST API
+const maxRequestSize = 16 * 1024 * 1024
+
+// The opcodes of the messages sent along the event stream
+var streamEvents map[string]bool = map[string]bool{
+	"read":         true,
+	"error":        true,
+	"file":         true,
+	"progress":     true,
+	"stats":        true,
+	"queued":       true,
+	"sending":      true,
+	"sent":         true,
+	"cancelled":    true,
+	"peer":         true,
+	"scheduled":    true,
+	"scheduleDone": true,
+}
+
+// The REST API provides the same operations as the websocket.
+// Request bodies use the same JSON as the websocket commands, though the
+// OpCode is determined by the endpoint. The response is the message that
+// would have been sent along the websocket, with a status of 400 if
+// the operation failed.
+
+// The HTTP handler for retrieving (GET) or updating (PUT) the configuration
+// Updating the configuration does not open a channel
+func (ctr *Controller) HandleConfig(w http.ResponseWriter, r *http.Request) {
+	if !ctr.authorize(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeReply(w, ctr.handleCommand("config", []byte("{}")))
+	case http.MethodPut:
+		if data, ok := readBody(w, r); ok {
+			writeReply(w, ctr.handleCommand("setConfig", data))
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		writeReplyStatus(w, http.StatusMethodNotAllowed, toCodeMessage(codeMethodNotAllowed, "Method not allowed"))
+	}
+}
+
+// The HTTP handler for opening a channel
+func (ctr *Controller) HandleOpen(w http.ResponseWriter, r *http.Request) {
+	ctr.handlePost(w, r, "open")
+}
+
+// The HTTP handler for closing a channel
+func (ctr *Controller) HandleClose(w http.ResponseWriter, r *http.Request) {
+	ctr.handlePost(w, r, "close")
+}
+
+// The HTTP handler for writing a message to a channel
+func (ctr *Controller) HandleWrite(w http.ResponseWriter, r *http.Request) {
+	ctr.handlePost(w, r, "write")
+}
+
+// The HTTP handler for cancelling a queued or in-flight send
+func (ctr *Controller) HandleCancel(w http.ResponseWriter, r *http.Request) {
+	ctr.handlePost(w, r, "cancel")
+}
+
+// The HTTP handler for listing (GET) or adding (POST) the schedules of a session
+// The optional session query parameter selects the session to list
+func (ctr *Controller) HandleSchedules(w http.ResponseWriter, r *http.Request) {
+	if !ctr.authorize(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if data, err := json.Marshal(command{Session: r.URL.Query().Get("session")}); err != nil {
+			writeReply(w, toErrorMessage("", "Could not encode schedule query: ", err))
+		} else {
+			writeReply(w, ctr.handleCommand("listSchedules", data))
+		}
+	case http.MethodPost:
+		if data, ok := readBody(w, r); ok {
+			writeReply(w, ctr.handleCommand("schedule", data))
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeReplyStatus(w, http.StatusMethodNotAllowed, toCodeMessage(codeMethodNotAllowed, "Method not allowed"))
+	}
+}
+
+// The HTTP handler for cancelling a schedule
+func (ctr *Controller) HandleCancelSchedule(w http.ResponseWriter, r *http.Request) {
+	ctr.handlePost(w, r, "cancelSchedule")
+}
+
+// The HTTP handler for retrieving the message history
+// The query parameters are the optional fields of the history command,
+// in lower case. Times use the RFC 3339 format
+func (ctr *Controller) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	if !ctr.authorize(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeReplyStatus(w, http.StatusMethodNotAllowed, toCodeMessage(codeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	var (
+		q      historyQuery = historyQuery{OpCode: "history"}
+		values url.Values   = r.URL.Query()
+		err    error
+	)
+	q.Session = values.Get("session")
+	q.Direction = values.Get("direction")
+	q.Channel = values.Get("channel")
+	q.Contains = values.Get("contains")
+	if s := values.Get("error"); s != "" {
+		var e bool
+		if e, err = strconv.ParseBool(s); err != nil {
+			writeReply(w, toCodeMessage(codeInvalidCommand, "Invalid error filter: "+s))
+			return
+		}
+		q.Error = &e
+	}
+	if s := values.Get("since"); s != "" {
+		if q.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			writeReply(w, toCodeMessage(codeInvalidCommand, "Invalid since time: "+s))
+			return
+		}
+	}
+	if s := values.Get("until"); s != "" {
+		if q.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			writeReply(w, toCodeMessage(codeInvalidCommand, "Invalid until time: "+s))
+			return
+		}
+	}
+	if s := values.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil {
+			writeReply(w, toCodeMessage(codeInvalidCommand, "Invalid offset: "+s))
+			return
+		}
+	}
+	if s := values.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil {
+			writeReply(w, toCodeMessage(codeInvalidCommand, "Invalid limit: "+s))
+			return
+		}
+	}
+	if data, err := json.Marshal(q); err != nil {
+		writeReply(w, toErrorMessage("", "Could not encode history query: ", err))
+	} else {
+		writeReply(w, ctr.handleCommand("history", data))
+	}
+}
+
+// The HTTP handler for retrieving the statistics of a session
+// The optional session query parameter selects the session, and the
+// optional interval query parameter sets the interval of the stats events
+func (ctr *Controller) HandleStats(w http.ResponseWriter, r *http.Request) {
+	if !ctr.authorize(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeReplyStatus(w, http.StatusMethodNotAllowed, toCodeMessage(codeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	var (
+		sc     statsCommand = statsCommand{OpCode: "stats"}
+		values url.Values   = r.URL.Query()
+	)
+	sc.Session = values.Get("session")
+	if s := values.Get("interval"); s != "" {
+		if interval, err := strconv.ParseUint(s, 10, 64); err != nil {
+			writeReply(w, toCodeMessage(codeInvalidCommand, "Invalid interval: "+s))
+			return
+		} else {
+			sc.Interval = &interval
+		}
+	}
+	if data, err := json.Marshal(sc); err != nil {
+		writeReply(w, toErrorMessage("", "Could not encode stats command: ", err))
+	} else {
+		writeReply(w, ctr.handleCommand("stats", data))
+	}
+}
+
+// The HTTP handler for retrieving the schema of every command and message
+func (ctr *Controller) HandleSchema(w http.ResponseWriter, r *http.Request) {
+	if !ctr.authorize(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeReplyStatus(w, http.StatusMethodNotAllowed, toCodeMessage(codeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	writeReply(w, ctr.handleCommand("schema", []byte("{}")))
+}
+
+// The HTTP handler for retrieving the JSON Schema of the configuration of channels and processors
+func (ctr *Controller) HandleConfigSchema(w http.ResponseWriter, r *http.Request) {
+	if !ctr.authorize(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeReplyStatus(w, http.StatusMethodNotAllowed, toCodeMessage(codeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	writeReply(w, ctr.handleCommand("configSchema", []byte("{}")))
+}
+
+// The HTTP handler for the Server-Sent Events stream
+// Read, error, file, progress, stats, send, peer and schedule messages are sent as events named by their opcode
+// The optional session query parameter selects the session
+func (ctr *Controller) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if !ctr.authorize(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeReplyStatus(w, http.StatusMethodNotAllowed, toCodeMessage(codeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeReplyStatus(w, http.StatusInternalServerError, toCodeMessage(codeFailed, "Streaming not supported"))
+		return
+	}
+
+	ctr.clientLock.Lock()
+	select {
+	case <-ctr.clientStop:
+		ctr.clientLock.Unlock()
+		return
+	default:
+	}
+	ctr.waitGroup.Add(1)
+	ctr.clientLock.Unlock()
+	defer ctr.waitGroup.Done()
+
+	var (
+		session  string      = r.URL.Query().Get("session")
+		listener chan []byte = ctr.addListener()
+	)
+	defer ctr.removeListener(listener)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case data, ok := <-listener:
+			// The client fell behind, so it must reconnect
+			if !ok {
+				return
+			}
+			var cmd command
+			if err := json.Unmarshal(data, &cmd); err != nil || !streamEvents[cmd.OpCode] {
+				continue
+			}
+			if session != "" && cmd.Session != session {
+				continue
+			}
+			if _, err := w.Write([]byte("event: " + cmd.OpCode + "\ndata: " + string(data) + "\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-time.After(time.Second * 15):
+			// Send a comment to keep the connection alive
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-ctr.clientStop:
+			return
+		}
+	}
+}
+
+// Perform a command sent in the body of a POST request
+func (ctr *Controller) handlePost(w http.ResponseWriter, r *http.Request, opcode string) {
+	if !ctr.authorize(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeReplyStatus(w, http.StatusMethodNotAllowed, toCodeMessage(codeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	if data, ok := readBody(w, r); ok {
+		writeReply(w, ctr.handleCommand(opcode, data))
+	}
+}
+
+// Read the body of a request
+// An empty body is treated as an empty JSON object
+// If the body cannot be read, an error is sent and false is returned
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		writeReply(w, toErrorMessage("", "Unable to read request: ", err))
+		return nil, false
+	}
+	if len(data) == 0 {
+		data = []byte("{}")
+	}
+	return data, true
+}
+
+// Send a reply, using the error status if it is an error message
+func writeReply(w http.ResponseWriter, data []byte) {
+	var cmd command
+	if err := json.Unmarshal(data, &cmd); err == nil && cmd.OpCode == "error" {
+		writeReplyStatus(w, http.StatusBadRequest, data)
+	} else {
+		writeReplyStatus(w, http.StatusOK, data)
+	}
+}
+
+func writeReplyStatus(w http.ResponseWriter, status int, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(withVersion(data))
+}
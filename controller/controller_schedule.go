@@ -0,0 +1,304 @@
+package controller
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The shortest interval between the sends of a schedule, in milliseconds
+const minScheduleInterval = 100
+
+// The number of schedules that may be added to each session
+const maxSchedules = 64
+
+// A schedule writes a message along the covert channel of a session at a
+// given time, and optionally repeats it at an interval. Each send goes through
+// the write command, so it is queued and reported the same way as a written
+// message. Every client is sent a "scheduled" message with the send ID each
+// time the message is queued, and a "scheduleDone" message once the schedule
+// is complete or cancelled. Schedules stop when the session is closed.
+type scheduleCommand struct {
+	OpCode   string
+	Session  string
+	Message  string
+	Encoding string
+	// The peers to send to, as for the write command
+	Peers []string
+	// The time of the first send
+	// If omitted or in the past, the message is sent immediately
+	Start time.Time
+	// The time between sends in milliseconds
+	// If zero, the message is only sent once
+	Interval uint64
+	// Each send is delayed by a random time of up to Jitter milliseconds
+	Jitter uint64
+	// The number of sends
+	// If zero, the message is repeated until Until or until the schedule is cancelled
+	Count uint64
+	// If set, no messages are sent after this time
+	Until time.Time
+}
+
+// The cancelSchedule command
+type cancelScheduleCommand struct {
+	OpCode     string
+	Session    string
+	ScheduleID uint64
+}
+
+// Reports a schedule to the client
+// This is used for the reply to the schedule command and for the
+// scheduled and scheduleDone messages
+type scheduleMessage struct {
+	OpCode     string
+	Session    string
+	ScheduleID uint64
+	// The send ID of the message queued by the schedule
+	SendID uint64
+	// The number of messages queued by the schedule
+	Runs    uint64
+	Message string
+}
+
+// A schedule in the reply to the listSchedules command
+type scheduleInfo struct {
+	ScheduleID uint64
+	Message    string
+	Encoding   string
+	Peers      []string
+	Start      time.Time
+	Interval   uint64
+	Jitter     uint64
+	Count      uint64
+	Until      time.Time
+	// The number of messages queued so far
+	Runs uint64
+	// The time of the next send
+	Next time.Time
+}
+
+type scheduleListMessage struct {
+	OpCode    string
+	Session   string
+	Schedules []scheduleInfo
+}
+
+// A schedule of a session
+type schedule struct {
+	// Runs and Next are updated by the schedule loop,
+	// so they must only be accessed while holding the schedule lock
+	info scheduleInfo
+	// The write command for each send
+	write []byte
+	// Closed to cancel the schedule
+	cancel chan interface{}
+}
+
+func toScheduleMessage(opcode string, session string, scheduleID uint64, sendID uint64, runs uint64, msg string) []byte {
+	if data, err := json.Marshal(scheduleMessage{OpCode: opcode, Session: session, ScheduleID: scheduleID, SendID: sendID, Runs: runs, Message: msg}); err != nil {
+		return toSessionMessage("error", session, "Marshal Error")
+	} else {
+		return data
+	}
+}
+
+// Handle the schedule command
+// Returns the ID of the schedule
+func (ctr *Controller) handleSchedule(id string, data []byte) (uint64, error) {
+	var (
+		sc  scheduleCommand
+		l   *Layers
+		err error
+	)
+	if err = json.Unmarshal(data, &sc); err != nil {
+		return 0, err
+	}
+	if l = ctr.getSession(id); l == nil {
+		return 0, errChannelClosed
+	}
+	if _, err = decodeMessage(messageType{Message: sc.Message, Encoding: sc.Encoding}); err != nil {
+		return 0, err
+	}
+	if _, err = l.peerIndexes(sc.Peers); err != nil {
+		return 0, err
+	}
+	if err = validSchedule(sc); err != nil {
+		return 0, err
+	}
+	if data, err = json.Marshal(writeCommand{OpCode: "write", Session: id, Message: sc.Message, Encoding: sc.Encoding, Peers: sc.Peers}); err != nil {
+		return 0, err
+	}
+
+	l.scheduleLock.Lock()
+	defer l.scheduleLock.Unlock()
+	if len(l.schedules) >= maxSchedules {
+		return 0, newError(codeQueueFull, layerController, "", "Too many schedules")
+	}
+	l.nextScheduleID++
+	s := &schedule{
+		info: scheduleInfo{
+			ScheduleID: l.nextScheduleID,
+			Message:    sc.Message,
+			Encoding:   sc.Encoding,
+			Peers:      append([]string{}, sc.Peers...),
+			Start:      sc.Start,
+			Interval:   sc.Interval,
+			Jitter:     sc.Jitter,
+			Count:      sc.Count,
+			Until:      sc.Until,
+		},
+		write:  data,
+		cancel: make(chan interface{}),
+	}
+	l.schedules[s.info.ScheduleID] = s
+	go ctr.scheduleLoop(l, s)
+	return s.info.ScheduleID, nil
+}
+
+// Check the timing of a new schedule
+func validSchedule(sc scheduleCommand) error {
+	if sc.Interval != 0 && sc.Interval < minScheduleInterval {
+		return newError(codeInvalidCommand, layerController, "", "Interval must be zero or at least "+strconv.Itoa(minScheduleInterval)+" milliseconds")
+	}
+	if sc.Interval == 0 && sc.Count > 1 {
+		return newError(codeInvalidCommand, layerController, "", "A count of more than 1 requires an interval")
+	}
+	if sc.Interval != 0 && sc.Jitter >= sc.Interval {
+		return newError(codeInvalidCommand, layerController, "", "Jitter must be less than the interval")
+	}
+	if !sc.Until.IsZero() && (sc.Until.Before(sc.Start) || sc.Until.Before(time.Now())) {
+		return newError(codeInvalidCommand, layerController, "", "Until must be after the start and in the future")
+	}
+	return nil
+}
+
+// Handle the listSchedules command
+func (ctr *Controller) handleListSchedules(id string) ([]byte, error) {
+	var l *Layers
+	if l = ctr.getSession(id); l == nil {
+		return nil, errChannelClosed
+	}
+	// This ensures that null is not sent to the client
+	var msg scheduleListMessage = scheduleListMessage{OpCode: "listSchedules", Session: id, Schedules: make([]scheduleInfo, 0)}
+	l.scheduleLock.Lock()
+	for _, s := range l.schedules {
+		msg.Schedules = append(msg.Schedules, s.info)
+	}
+	l.scheduleLock.Unlock()
+	sort.Slice(msg.Schedules, func(i, j int) bool { return msg.Schedules[i].ScheduleID < msg.Schedules[j].ScheduleID })
+	return json.Marshal(msg)
+}
+
+// Handle the cancelSchedule command
+// Messages already queued by the schedule are not cancelled
+func (ctr *Controller) handleCancelSchedule(id string, data []byte) error {
+	var (
+		cc cancelScheduleCommand
+		l  *Layers
+	)
+	if err := json.Unmarshal(data, &cc); err != nil {
+		return err
+	}
+	if l = ctr.getSession(id); l == nil {
+		return errChannelClosed
+	}
+	l.scheduleLock.Lock()
+	defer l.scheduleLock.Unlock()
+	if s, ok := l.schedules[cc.ScheduleID]; !ok {
+		return newError(codeNotFound, layerController, "", "No schedule with ID "+strconv.FormatUint(cc.ScheduleID, 10))
+	} else {
+		delete(l.schedules, cc.ScheduleID)
+		close(s.cancel)
+		return nil
+	}
+}
+
+// Loop for writing the message of a schedule at each of its times
+// The times do not drift, as each is the interval after the previous one,
+// before the jitter is added. Sends that were missed, for example because
+// the write command was blocked, are skipped.
+func (ctr *Controller) scheduleLoop(l *Layers, s *schedule) {
+	var (
+		r        *rand.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+		base     time.Time  = s.info.Start
+		interval            = time.Duration(s.info.Interval) * time.Millisecond
+		runs     uint64
+	)
+	for {
+		if now := time.Now(); base.Before(now) {
+			base = now
+		}
+		next := base
+		if s.info.Jitter > 0 {
+			next = next.Add(time.Duration(r.Int63n(int64(s.info.Jitter)+1)) * time.Millisecond)
+		}
+		if !s.info.Until.IsZero() && next.After(s.info.Until) {
+			ctr.finishSchedule(l, s, runs)
+			return
+		}
+		l.scheduleLock.Lock()
+		s.info.Next = next
+		l.scheduleLock.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-s.cancel:
+			timer.Stop()
+			ctr.finishSchedule(l, s, runs)
+			return
+		case <-l.readClose:
+			timer.Stop()
+			return
+		}
+
+		sendID, err := ctr.scheduledWrite(l, s)
+		runs++
+		l.scheduleLock.Lock()
+		s.info.Runs = runs
+		l.scheduleLock.Unlock()
+		if err == errChannelClosed {
+			return
+		} else if err != nil {
+			em := toError(l.id, "Unable to write scheduled message: ", err)
+			em.ScheduleID = s.info.ScheduleID
+			ctr.sendEvent(l, marshalError(em))
+		} else {
+			ctr.sendEvent(l, toScheduleMessage("scheduled", l.id, s.info.ScheduleID, sendID, runs, "Scheduled message queued"))
+		}
+
+		if interval == 0 || (s.info.Count > 0 && runs >= s.info.Count) {
+			ctr.finishSchedule(l, s, runs)
+			return
+		}
+		base = base.Add(interval)
+	}
+}
+
+// Queue the message of a schedule with the write command
+// Returns the ID of the send
+func (ctr *Controller) scheduledWrite(l *Layers, s *schedule) (uint64, error) {
+	ctr.cmdLock.Lock()
+	defer ctr.cmdLock.Unlock()
+	// The session may have been closed, or reopened, while waiting for the lock
+	if ctr.getSession(l.id) != l {
+		return 0, errChannelClosed
+	}
+	return ctr.handleWrite(l.id, s.write)
+}
+
+// Remove a schedule once it has stopped and tell the clients
+// If the schedule was already removed, it was cancelled
+func (ctr *Controller) finishSchedule(l *Layers, s *schedule, runs uint64) {
+	var msg string = "Schedule cancelled"
+	l.scheduleLock.Lock()
+	if _, ok := l.schedules[s.info.ScheduleID]; ok {
+		delete(l.schedules, s.info.ScheduleID)
+		msg = "Schedule complete"
+	}
+	l.scheduleLock.Unlock()
+	ctr.sendEvent(l, toScheduleMessage("scheduleDone", l.id, s.info.ScheduleID, 0, runs, msg))
+}
@@ -0,0 +1,262 @@
+package controller
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"time"
+
+	"./config"
+)
+
+// The version of the protocol used by the websocket, the REST API and the event stream
+// Every message sent to clients has a Version field with this value. It is increased
+// whenever the schema changes in a way that could break existing clients.
+const protocolVersion = 1
+
+// A JSON Schema (https://json-schema.org) describing a command or message
+type jsonSchema map[string]interface{}
+
+// The reply to the schema command
+// It describes every command and message, so that clients can be written against it
+type schemaMessage struct {
+	OpCode  string
+	Version int
+	// The schema of each command, indexed by opcode
+	Commands map[string]jsonSchema
+	// The schema of each message sent to clients, indexed by opcode
+	// Replies use the opcode of their command, unless they are errors
+	Messages map[string]jsonSchema
+	// The values of the Code and Layer fields of error messages
+	ErrorCodes []string
+	Layers     []string
+}
+
+// The reply to the configSchema command
+type configSchemaMessage struct {
+	OpCode string
+	// A JSON Schema of the configuration of the open and saveProfile commands,
+	// describing the params of every channel and processor
+	Schema jsonSchema
+}
+
+// The open command
+// This is only used for the schema, as the command is read by readConfig
+type openCommand struct {
+	Processors []processorConfig
+	Channel    channelConfig
+	Framing    framingConfig
+	Handshake  handshakeConfig
+	// The encoding used for read events
+	Encoding string
+}
+
+// The fields of every message sent to clients
+type messageFields struct {
+	Version int
+	// Copied from the command, for replies to commands with a RequestID
+	RequestID string
+}
+
+var timeType reflect.Type = reflect.TypeOf(time.Time{})
+
+// Set the protocol version of a message sent to clients
+func withVersion(msg []byte) []byte {
+	return withField(msg, "Version", protocolVersion)
+}
+
+// Handle the schema command
+func (ctr *Controller) handleSchema() ([]byte, error) {
+	return json.Marshal(schemaMessage{
+		OpCode:  "schema",
+		Version: protocolVersion,
+		Commands: map[string]jsonSchema{
+			"open":           payloadSchema(command{}, openCommand{}),
+			"close":          payloadSchema(command{}),
+			"write":          payloadSchema(command{}, writeCommand{}),
+			"cancel":         payloadSchema(command{}, cancelCommand{}),
+			"sendfile":       payloadSchema(command{}, sendFileCommand{}),
+			"schedule":       payloadSchema(command{}, scheduleCommand{}),
+			"listSchedules":  payloadSchema(command{}),
+			"cancelSchedule": payloadSchema(command{}, cancelScheduleCommand{}),
+			"saveProfile":    payloadSchema(command{}, openCommand{}, profileCommand{}),
+			"loadProfile":    payloadSchema(command{}, profileCommand{}),
+			"listProfiles":   payloadSchema(command{}),
+			"deleteProfile":  payloadSchema(command{}, profileCommand{}),
+			"history":        payloadSchema(command{}, historyQuery{}),
+			"stats":          payloadSchema(command{}, statsCommand{}),
+			"config":         payloadSchema(command{}),
+			"setConfig":      payloadSchema(command{}, openCommand{}),
+			"schema":         payloadSchema(command{}),
+			"configSchema":   payloadSchema(command{}),
+		},
+		Messages: map[string]jsonSchema{
+			"open":           payloadSchema(messageFields{}, messageType{}),
+			"close":          payloadSchema(messageFields{}, messageType{}),
+			"write":          payloadSchema(messageFields{}, sendMessage{}),
+			"cancel":         payloadSchema(messageFields{}, messageType{}),
+			"sendfile":       payloadSchema(messageFields{}, sendMessage{}),
+			"schedule":       payloadSchema(messageFields{}, scheduleMessage{}),
+			"listSchedules":  payloadSchema(messageFields{}, scheduleListMessage{}),
+			"cancelSchedule": payloadSchema(messageFields{}, messageType{}),
+			"saveProfile":    payloadSchema(messageFields{}, messageType{}),
+			"loadProfile":    payloadSchema(messageFields{}, configData{}),
+			"listProfiles":   payloadSchema(messageFields{}, profileListMessage{}),
+			"deleteProfile":  payloadSchema(messageFields{}, messageType{}),
+			"history":        payloadSchema(messageFields{}, historyMessage{}),
+			"stats":          payloadSchema(messageFields{}, statsMessage{}),
+			"config":         payloadSchema(messageFields{}, configData{}),
+			"setConfig":      payloadSchema(messageFields{}, configData{}),
+			"schema":         payloadSchema(messageFields{}, schemaMessage{}),
+			"configSchema":   payloadSchema(messageFields{}, configSchemaMessage{}),
+			"read":           payloadSchema(messageFields{}, readMessage{}),
+			"queued":         payloadSchema(messageFields{}, sendMessage{}),
+			"sending":        payloadSchema(messageFields{}, sendMessage{}),
+			"sent":           payloadSchema(messageFields{}, sendMessage{}),
+			"cancelled":      payloadSchema(messageFields{}, sendMessage{}),
+			"progress":       payloadSchema(messageFields{}, progressMessage{}),
+			"file":           payloadSchema(messageFields{}, fileMessage{}),
+			"peer":           payloadSchema(messageFields{}, peerMessage{}),
+			"scheduled":      payloadSchema(messageFields{}, scheduleMessage{}),
+			"scheduleDone":   payloadSchema(messageFields{}, scheduleMessage{}),
+			"error":          payloadSchema(messageFields{}, errorMessage{}),
+		},
+		ErrorCodes: errorCodes,
+		Layers:     []string{layerChannel, layerProcessor, layerController},
+	})
+}
+
+// Handle the configSchema command
+// The params of each channel and processor are described in the definitions of
+// the schema, and referred to from the Data of the channel and processors, so that
+// configs can be checked without the server. The checks of combinations of params
+// are not included.
+func (ctr *Controller) handleConfigSchema() ([]byte, error) {
+	var (
+		channels, processors, definitions jsonSchema = make(jsonSchema), make(jsonSchema), make(jsonSchema)
+		err                               error
+	)
+	if err = addConfigSchemas(channels, defaultChannel()); err != nil {
+		return nil, err
+	}
+	if err = addConfigSchemas(processors, defaultProcessor()); err != nil {
+		return nil, err
+	}
+	if definitions["framing"], err = config.ConfigSchema(defaultFraming()); err != nil {
+		return nil, err
+	}
+	if definitions["handshake"], err = config.ConfigSchema(defaultHandshake()); err != nil {
+		return nil, err
+	}
+	definitions["channels"], definitions["processors"] = channels, processors
+
+	return json.Marshal(configSchemaMessage{
+		OpCode: "configSchema",
+		Schema: jsonSchema{
+			"$schema":     "http://json-schema.org/draft-07/schema#",
+			"title":       "Covert channel configuration",
+			"type":        "object",
+			"definitions": definitions,
+			"properties": map[string]interface{}{
+				"Processors": jsonSchema{"type": "array", "items": layerSchema("processors", processors)},
+				"Channel":    layerSchema("channels", channels),
+				"Framing":    jsonSchema{"$ref": "#/definitions/framing"},
+				"Handshake":  jsonSchema{"$ref": "#/definitions/handshake"},
+				"Encoding":   jsonSchema{"type": "string", "enum": []string{encodingText, encodingBase64}},
+			},
+		},
+	})
+}
+
+// Add the schema of each config of a channelData or processorData
+func addConfigSchemas(schemas jsonSchema, data map[string]interface{}) error {
+	for name, c := range data {
+		s, err := config.ConfigSchema(c)
+		if err != nil {
+			return wrapError(name+" : ", err)
+		}
+		schemas[name] = s
+	}
+	return nil
+}
+
+// The schema of a channelConfig or processorConfig
+// The configs are defined in the given definitions of the config schema
+func layerSchema(definitions string, schemas jsonSchema) jsonSchema {
+	var (
+		names []string
+		data  map[string]interface{} = make(map[string]interface{})
+	)
+	for name := range schemas {
+		names = append(names, name)
+		data[name] = jsonSchema{"$ref": "#/definitions/" + definitions + "/" + name}
+	}
+	sort.Strings(names)
+	return jsonSchema{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"Type": jsonSchema{"type": "string", "enum": names},
+			"Data": jsonSchema{"type": "object", "properties": data},
+		},
+	}
+}
+
+// The schema of an object with the fields of every struct in values
+func payloadSchema(values ...interface{}) jsonSchema {
+	var properties map[string]interface{} = make(map[string]interface{})
+	for _, v := range values {
+		addProperties(properties, reflect.TypeOf(v))
+	}
+	return jsonSchema{"type": "object", "properties": properties}
+}
+
+// Add the schema of each exported field of a struct
+// The fields of embedded structs are added as if they were fields of the struct,
+// as they are by the JSON encoder
+func addProperties(properties map[string]interface{}, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			addProperties(properties, f.Type)
+		} else if f.PkgPath == "" {
+			properties[f.Name] = typeSchema(f.Type)
+		}
+	}
+}
+
+// The schema of a type, following the rules of the JSON encoder
+func typeSchema(t reflect.Type) jsonSchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonSchema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	case reflect.String:
+		return jsonSchema{"type": "string"}
+	case reflect.Slice:
+		// Byte slices are base64 encoded
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonSchema{"type": "string", "contentEncoding": "base64"}
+		}
+		return jsonSchema{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Array:
+		return jsonSchema{"type": "array", "items": typeSchema(t.Elem()), "minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t == timeType {
+			return jsonSchema{"type": "string", "format": "date-time"}
+		}
+		properties := make(map[string]interface{})
+		addProperties(properties, t)
+		return jsonSchema{"type": "object", "properties": properties}
+	default:
+		// Interfaces may hold any value, such as the config of a channel
+		return jsonSchema{}
+	}
+}
@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"./channel"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The categories of errors counted for each session
+const (
+	statsErrorProcess   = "process"
+	statsErrorUnprocess = "unprocess"
+	statsErrorFraming   = "framing"
+	statsErrorWrite     = "write"
+	statsErrorRead      = "read"
+	statsErrorFile      = "file"
+)
+
+// The shortest interval between pushed stats events, in milliseconds
+const minStatsInterval = 100
+
+// The stats command
+type statsCommand struct {
+	OpCode  string
+	Session string
+	// If set, a stats event is sent to every client at this interval,
+	// in milliseconds, until the session is closed. Set zero to stop
+	// the events. If omitted, the events are unchanged.
+	Interval *uint64
+}
+
+// The statistics of an open session
+// Bytes are counted before processing (Bytes) and after processing (ProcessedBytes),
+// so that the overhead of the processors and the channel can be compared.
+type statsMessage struct {
+	OpCode     string
+	Session    string
+	Channel    string
+	Processors []string
+	// The number of seconds since the session was opened
+	Uptime                 float64
+	MessagesSent           uint64
+	MessagesReceived       uint64
+	BytesSent              uint64
+	BytesReceived          uint64
+	ProcessedBytesSent     uint64
+	ProcessedBytesReceived uint64
+	// The number of successful calls to Send and Receive of the covert channel
+	// With framing enabled, each fragment is written and read separately
+	FragmentsWritten uint64
+	FragmentsRead    uint64
+	// The number of packets written and read by the covert channel, if it
+	// counts them (see channel.PacketCounter). Depending on the embedder,
+	// each fragment may take many packets.
+	PacketsWritten *uint64 `json:",omitempty"`
+	PacketsRead    *uint64 `json:",omitempty"`
+	// The number of errors in each category
+	Errors map[string]uint64
+	// The average time taken to process and send a message, in milliseconds
+	AverageSendTime float64
+	// The message bytes sent per second spent sending
+	SendGoodput float64
+	// The message bytes received per second since the session was opened
+	ReceiveGoodput float64
+}
+
+// The counters of a session
+// These are updated by the read loop and by every send, so they are locked
+type sessionStats struct {
+	opened                 time.Time
+	messagesSent           uint64
+	messagesReceived       uint64
+	bytesSent              uint64
+	bytesReceived          uint64
+	processedBytesSent     uint64
+	processedBytesReceived uint64
+	fragmentsWritten       uint64
+	fragmentsRead          uint64
+	errors                 map[string]uint64
+	// The total time spent sending messages that were sent successfully
+	sendTime time.Duration
+	lock     sync.Mutex
+}
+
+func newSessionStats() *sessionStats {
+	return &sessionStats{opened: time.Now(), errors: make(map[string]uint64)}
+}
+
+// Record a message that was sent successfully
+func (s *sessionStats) addSent(size int, processed int, d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.messagesSent++
+	s.bytesSent += uint64(size)
+	s.processedBytesSent += uint64(processed)
+	s.sendTime += d
+}
+
+// Record a message that was received successfully
+func (s *sessionStats) addReceived(size int, processed int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.messagesReceived++
+	s.bytesReceived += uint64(size)
+	s.processedBytesReceived += uint64(processed)
+}
+
+func (s *sessionStats) addFragmentWritten() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fragmentsWritten++
+}
+
+func (s *sessionStats) addFragmentRead() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fragmentsRead++
+}
+
+func (s *sessionStats) addError(category string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.errors[category]++
+}
+
+// Retrieve the current statistics of a session
+func (l *Layers) statsMessage() statsMessage {
+	var sm statsMessage = statsMessage{
+		OpCode:     "stats",
+		Session:    l.id,
+		Channel:    l.conf.Channel.Type,
+		Processors: make([]string, 0, len(l.conf.Processors)),
+		Errors:     make(map[string]uint64),
+	}
+	for _, p := range l.conf.Processors {
+		sm.Processors = append(sm.Processors, p.Type)
+	}
+	if pc, ok := l.channel.(channel.PacketCounter); ok {
+		written, read := pc.Packets()
+		sm.PacketsWritten, sm.PacketsRead = &written, &read
+	}
+
+	s := l.stats
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	uptime := time.Since(s.opened).Seconds()
+	sm.Uptime = uptime
+	sm.MessagesSent = s.messagesSent
+	sm.MessagesReceived = s.messagesReceived
+	sm.BytesSent = s.bytesSent
+	sm.BytesReceived = s.bytesReceived
+	sm.ProcessedBytesSent = s.processedBytesSent
+	sm.ProcessedBytesReceived = s.processedBytesReceived
+	sm.FragmentsWritten = s.fragmentsWritten
+	sm.FragmentsRead = s.fragmentsRead
+	for category, n := range s.errors {
+		sm.Errors[category] = n
+	}
+	if s.messagesSent > 0 {
+		sm.AverageSendTime = s.sendTime.Seconds() * 1000 / float64(s.messagesSent)
+	}
+	if s.sendTime > 0 {
+		sm.SendGoodput = float64(s.bytesSent) / s.sendTime.Seconds()
+	}
+	if uptime > 0 {
+		sm.ReceiveGoodput = float64(s.bytesReceived) / uptime
+	}
+	return sm
+}
+
+// Handle the stats command
+// The statistics are returned, and the periodic stats events
+// are started or stopped if an interval is given
+func (ctr *Controller) handleStats(id string, data []byte) ([]byte, error) {
+	var (
+		sc statsCommand
+		l  *Layers
+	)
+	if err := json.Unmarshal(data, &sc); err != nil {
+		return nil, err
+	}
+	if l = ctr.getSession(id); l == nil {
+		return nil, errChannelClosed
+	}
+	if sc.Interval != nil {
+		if *sc.Interval != 0 && *sc.Interval < minStatsInterval {
+			return nil, newError(codeInvalidCommand, layerController, "", "Interval must be zero or at least "+strconv.Itoa(minStatsInterval)+" milliseconds")
+		}
+		ctr.setStatsInterval(l, time.Duration(*sc.Interval)*time.Millisecond)
+	}
+	return json.Marshal(l.statsMessage())
+}
+
+// Start sending stats events for a session at the given interval,
+// replacing any previous events. A zero interval stops the events.
+// This is only called while handling a command, so statsStop does not need to be locked
+func (ctr *Controller) setStatsInterval(l *Layers, interval time.Duration) {
+	if l.statsStop != nil {
+		close(l.statsStop)
+		l.statsStop = nil
+	}
+	if interval > 0 {
+		l.statsStop = make(chan interface{})
+		go ctr.statsLoop(l, interval, l.statsStop)
+	}
+}
+
+// Loop for sending stats events until stopped or the session is closed
+func (ctr *Controller) statsLoop(l *Layers, interval time.Duration, stop chan interface{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			data, err := json.Marshal(l.statsMessage())
+			if err != nil {
+				data = toErrorMessage(l.id, "Could not encode stats: ", err)
+			}
+			select {
+			case ctr.wsSend <- data:
+			case <-stop:
+				return
+			case <-l.readClose:
+				return
+			}
+		case <-stop:
+			return
+		case <-l.readClose:
+			return
+		}
+	}
+}
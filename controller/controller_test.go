@@ -1,12 +1,34 @@
 package controller
 
 import (
+	"./channel"
+	"./channel/tcpHandshake"
+	"./channel/tcpNormal"
+	"./channel/tcpSyn"
+	"./channel/udpIP"
+	"./channel/udpNormal"
+	"./processor"
+	"./processor/caesar"
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"github.com/gorilla/websocket"
+	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -105,6 +127,46 @@ func TestRetrieveConfig(t *testing.T) {
 	checkClose(stop, done, t)
 }
 
+// Every registered entity must be in the config, and entities
+// that are not registered must be ignored when reading a config
+func TestEntityRegistry(t *testing.T) {
+	ctr, _ := CreateController()
+	defer ctr.Shutdown()
+
+	conf := DefaultConfig()
+	for _, name := range channel.Names() {
+		if _, ok := conf.Default.Channel[name]; !ok {
+			t.Errorf("Registered channel %s not in default config", name)
+		}
+	}
+	for _, name := range processor.Names() {
+		if _, ok := conf.Default.Processor[name]; !ok {
+			t.Errorf("Registered processor %s not in default config", name)
+		}
+	}
+
+	var cconf channelConfig
+	if err := json.Unmarshal([]byte("{\"Type\" : \"TcpSyn\", \"Data\" : {\"Unknown\" : {}, \"TcpSyn\" : {\"OriginPort\" : {\"Value\" : 1234}}}}"), &cconf); err != nil {
+		t.Fatalf("Unexpected unmarshal error: %s", err.Error())
+	}
+	if v := cconf.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value; v != 1234 {
+		t.Errorf("Expected %d: Found %d", 1234, v)
+	}
+	if v := cconf.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort; v != tcpSyn.GetDefault().FriendPort {
+		t.Errorf("Omitted param was not set to the default: %v", v)
+	}
+	if _, ok := cconf.Data["Unknown"]; ok {
+		t.Errorf("Unknown channel was read")
+	}
+
+	if _, err := ctr.channelConfigFrom(channelConfig{Type: "Unknown", Data: defaultChannel()}); err == nil {
+		t.Errorf("Expected error for unknown channel")
+	}
+	if _, err := toProcessor(&processorConfig{Type: "Unknown", Data: defaultProcessor()}); err == nil || err.Error() != "Invalid Processor Type" {
+		t.Errorf("Expected error %s: Found %v", "Invalid Processor Type", err)
+	}
+}
+
 // To confirm that the processing is really occurring,
 // we ommit the processors for the receiver side and confirm
 // that it changes the output message
@@ -112,43 +174,1777 @@ func TestWithProcessorNoUnprocess(t *testing.T) {
 	ctr1, _ := CreateController()
 	ctr2, _ := CreateController()
 
-	write1, read1, stop1, done1 := openConn("ws://127.0.0.1:9030/covert", "9030", ctr1, t)
-	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9040/covert", "9040", ctr2, t)
+	write1, read1, stop1, done1 := openConn("ws://127.0.0.1:9030/covert", "9030", ctr1, t)
+	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9040/covert", "9040", ctr2, t)
+
+	write1 <- []byte("{\"OpCode\" : \"config\"}")
+
+	conf := checkConfig(read1, DefaultConfig(), t)
+
+	conf.OpCode = "open"
+	conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 8090
+	conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 8091
+	conf.Processors = []processorConfig{
+		processorConfig{
+			Type: "Caesar", Data: defaultProcessor(),
+		},
+		processorConfig{
+			Type: "Caesar", Data: defaultProcessor(),
+		},
+	}
+	conf.Processors[0].Data["Caesar"].(*caesar.ConfigClient).Shift.Value = -1
+	conf.Processors[1].Data["Caesar"].(*caesar.ConfigClient).Shift.Value = 3
+	writeTestMsg(write1, conf, t)
+
+	conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 8091
+	conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 8090
+	conf.Processors = []processorConfig{}
+	writeTestMsg(write2, conf, t)
+
+	checkMsgType(read1, "open", "Open success", t)
+	checkMsgType(read2, "open", "Open success", t)
+
+	write1 <- []byte("{\"OpCode\" : \"write\", \"Message\" : \"Hello World!\"}")
+	checkMsgType(read2, "read", "Jgnnq\"Yqtnf#", t)
+
+	checkClose(stop1, done1, t)
+	checkClose(stop2, done2, t)
+}
+
+// Open two sessions with different channel types on the same pair of controllers
+// and confirm that messages are routed to the correct session
+func TestMultipleSessions(t *testing.T) {
+	ctr1, _ := CreateController()
+	ctr2, _ := CreateController()
+
+	write1, read1, stop1, done1 := openConn("ws://127.0.0.1:9050/covert", "9050", ctr1, t)
+	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9060/covert", "9060", ctr2, t)
+
+	tcpConf := DefaultConfig()
+	tcpConf.OpCode = "open"
+	tcpConf.Channel.Type = "TcpNormal"
+	udpConf := DefaultConfig()
+	udpConf.OpCode = "open"
+	udpConf.Channel.Type = "UdpNormal"
+
+	tcpConf.Channel.Data["TcpNormal"].(*tcpNormal.ConfigClient).FriendReceivePort.Value = 8090
+	tcpConf.Channel.Data["TcpNormal"].(*tcpNormal.ConfigClient).OriginReceivePort.Value = 8091
+	udpConf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8092
+	udpConf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8093
+	writeTestMsg(write1, sessionCommand{configData: tcpConf, Session: "tcp"}, t)
+	writeTestMsg(write1, sessionCommand{configData: udpConf, Session: "udp"}, t)
+
+	tcpConf.Channel.Data["TcpNormal"].(*tcpNormal.ConfigClient).FriendReceivePort.Value = 8091
+	tcpConf.Channel.Data["TcpNormal"].(*tcpNormal.ConfigClient).OriginReceivePort.Value = 8090
+	udpConf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8093
+	udpConf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8092
+	writeTestMsg(write2, sessionCommand{configData: tcpConf, Session: "tcp"}, t)
+	writeTestMsg(write2, sessionCommand{configData: udpConf, Session: "udp"}, t)
+
+	checkSessionMsg(read1, "open", "tcp", "Open success", t)
+	checkSessionMsg(read1, "open", "udp", "Open success", t)
+	checkSessionMsg(read2, "open", "tcp", "Open success", t)
+	checkSessionMsg(read2, "open", "udp", "Open success", t)
+
+	write1 <- []byte("{\"OpCode\" : \"config\"}")
+	select {
+	case data := <-read1:
+		var conf configData
+		if err := json.Unmarshal(data, &conf); err != nil {
+			t.Errorf("Unexpected unmarshal error: %s", err.Error())
+		} else if len(conf.Sessions) != 2 {
+			t.Errorf("Unexpected number of sessions: %d, want 2", len(conf.Sessions))
+		} else if conf.Sessions[0].ID != "tcp" || conf.Sessions[0].Channel.Type != "TcpNormal" ||
+			conf.Sessions[1].ID != "udp" || conf.Sessions[1].Channel.Type != "UdpNormal" {
+			t.Errorf("Unexpected session configs: %v", conf.Sessions)
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("Unexpected read timeout")
+	}
+
+	write1 <- []byte("{\"OpCode\" : \"write\", \"Session\" : \"tcp\", \"Message\" : \"Hello TCP!\"}")
+	checkWrite(read1, "tcp", "sent", t)
+	checkSessionMsg(read2, "read", "tcp", "Hello TCP!", t)
+
+	write2 <- []byte("{\"OpCode\" : \"write\", \"Session\" : \"udp\", \"Message\" : \"Hello UDP!\"}")
+	checkWrite(read2, "udp", "sent", t)
+	checkSessionMsg(read1, "read", "udp", "Hello UDP!", t)
+
+	// Closing one session must not affect the other
+	write1 <- []byte("{\"OpCode\" : \"close\", \"Session\" : \"udp\"}")
+	checkSessionMsg(read1, "close", "udp", "Close success", t)
+	write2 <- []byte("{\"OpCode\" : \"write\", \"Session\" : \"tcp\", \"Message\" : \"Still open\"}")
+	checkWrite(read2, "tcp", "sent", t)
+	checkSessionMsg(read1, "read", "tcp", "Still open", t)
+
+	write1 <- []byte("{\"OpCode\" : \"write\", \"Session\" : \"udp\", \"Message\" : \"Closed\"}")
+	checkSessionMsg(read1, "error", "udp", "Unable to write to channel: Channel closed", t)
+
+	checkClose(stop1, done1, t)
+	checkClose(stop2, done2, t)
+}
+
+// Confirm that arbitrary bytes are not changed when sent with the base64 encoding
+func TestBinaryMessage(t *testing.T) {
+	ctr1, _ := CreateController()
+	ctr2, _ := CreateController()
+
+	write1, read1, stop1, done1 := openConn("ws://127.0.0.1:9070/covert", "9070", ctr1, t)
+	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9080/covert", "9080", ctr2, t)
+
+	conf := DefaultConfig()
+	conf.OpCode = "open"
+	conf.Channel.Type = "UdpNormal"
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8094
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8095
+	writeTestMsg(write1, conf, t)
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8095
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8094
+	writeTestMsg(write2, conf, t)
+
+	checkMsgType(read1, "open", "Open success", t)
+	checkMsgType(read2, "open", "Open success", t)
+
+	messages := [][]byte{{0xFF, 0x00, 0xFE, 0x80}, []byte("Hello World!"), {0xC3, 0x28}}
+	for _, m := range messages {
+		writeTestMsg(write1, messageType{OpCode: "write", Message: base64.StdEncoding.EncodeToString(m), Encoding: "base64"}, t)
+		checkWrite(read1, defaultSession, "sent", t)
+		select {
+		case data := <-read2:
+			var mt messageType
+			if err := json.Unmarshal(data, &mt); err != nil {
+				t.Errorf("Unexpected unmarshal error: %s", err.Error())
+			} else if mt.OpCode != "read" {
+				t.Errorf("Message does not have correct opcode: %s, want read", mt.OpCode)
+			} else if b, err := decodeMessage(mt); err != nil {
+				t.Errorf("Unexpected decode error: %s", err.Error())
+			} else if !bytes.Equal(b, m) {
+				t.Errorf("Message does not have correct message: %v, want %v", b, m)
+			}
+		case <-time.After(time.Second * 10):
+			t.Errorf("Unexpected read timeout")
+		}
+	}
+
+	writeTestMsg(write1, messageType{OpCode: "write", Message: "abc", Encoding: "hex"}, t)
+	checkMsgType(read1, "error", "Unable to write to channel: Unknown message encoding: hex", t)
+
+	checkClose(stop1, done1, t)
+	checkClose(stop2, done2, t)
+}
+
+// Send a file split into several chunks and confirm that
+// it is reassembled by the receiver
+func TestSendFile(t *testing.T) {
+	ctr1, _ := CreateController()
+	ctr2, _ := CreateController()
+
+	write1, read1, stop1, done1 := openConn("ws://127.0.0.1:9070/covert", "9070", ctr1, t)
+	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9080/covert", "9080", ctr2, t)
+
+	conf := DefaultConfig()
+	conf.OpCode = "open"
+	conf.Channel.Type = "UdpNormal"
+	conf.Processors = []processorConfig{processorConfig{Type: "Caesar", Data: defaultProcessor()}}
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8094
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8095
+	writeTestMsg(write1, conf, t)
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8095
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8094
+	writeTestMsg(write2, conf, t)
+
+	checkMsgType(read1, "open", "Open success", t)
+	checkMsgType(read2, "open", "Open success", t)
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	file := make([]byte, 2100)
+	r.Read(file)
+
+	writeTestMsg(write1, sendFileCommand{OpCode: "sendfile", Name: "test.bin", Message: base64.StdEncoding.EncodeToString(file), Encoding: "base64", ChunkSize: 500}, t)
+
+	// The file is queued, and then sent with a progress message for each of the 5 chunks
+	var (
+		reply    bool
+		progress int
+		events   []string
+	)
+	for len(events) == 0 || events[len(events)-1] != "sent" {
+		var (
+			sm   sendMessage
+			pm   progressMessage
+			data json.RawMessage
+		)
+		if readTestMsg(read1, &data, t); data == nil {
+			break
+		}
+		json.Unmarshal(data, &sm)
+		switch sm.OpCode {
+		case "sendfile":
+			reply = true
+			if sm.Message != "File queued" || sm.SendID == 0 {
+				t.Errorf("Unexpected sendfile reply: %v", sm)
+			}
+		case "progress":
+			json.Unmarshal(data, &pm)
+			if pm.Direction != "send" || pm.Size != 2100 || pm.Name != "test.bin" {
+				t.Errorf("Unexpected progress message: %v", pm)
+			}
+			progress++
+		default:
+			events = append(events, sm.OpCode)
+		}
+	}
+	if !reply || progress != 5 || strings.Join(events, ",") != "queued,sending,sent" {
+		t.Errorf("Unexpected file send messages: reply %t, %d progress messages, %v", reply, progress, events)
+	}
+
+	// The manifest and the first four chunks are reported as progress
+	for i := 0; i < 5; i++ {
+		var pm progressMessage
+		readTestMsg(read2, &pm, t)
+		if pm.OpCode != "progress" || pm.Direction != "receive" || pm.Bytes != uint64(i*500) {
+			t.Errorf("Unexpected progress message: %v", pm)
+		}
+	}
+
+	var fm fileMessage
+	readTestMsg(read2, &fm, t)
+	if fm.OpCode != "file" || fm.Name != "test.bin" || fm.Size != 2100 {
+		t.Errorf("Unexpected file message: %s %s %d", fm.OpCode, fm.Name, fm.Size)
+	} else if b, err := base64.StdEncoding.DecodeString(fm.Message); err != nil {
+		t.Errorf("Unexpected decode error: %s", err.Error())
+	} else if !bytes.Equal(b, file) {
+		t.Errorf("Received file does not match sent file")
+	}
+
+	checkClose(stop1, done1, t)
+	checkClose(stop2, done2, t)
+}
+
+// File chunks must fit in a message of the session once processed
+func TestFileChunkSize(t *testing.T) {
+	pconf := processorConfig{Type: "Checksum", Data: defaultProcessor()}
+	p, _ := toProcessor(&pconf)
+	fconf := defaultFraming()
+	fconf.MaxMessageSize.Value = 100
+	l := &Layers{conf: sessionConfig{Processors: []processorConfig{pconf}}, processors: []processor.Processor{p}, framing: newFraming(fconf)}
+	file := make([]byte, 1000)
+
+	// The checksum adds 4 bytes to each chunk after its header
+	if n, err := l.fileChunkSize(file, 0); err != nil || n != uint64(100-fileChunkHeaderSize-4) {
+		t.Errorf("Unexpected chunk size: %d, %v", n, err)
+	}
+	if n, err := l.fileChunkSize(file, 81); err != nil || n != 81 {
+		t.Errorf("Unexpected chunk size: %d, %v", n, err)
+	}
+	for _, size := range []uint64{82, 1 << 40} {
+		if _, err := l.fileChunkSize(file, size); err == nil {
+			t.Errorf("Expected an error for chunks of %d bytes", size)
+		}
+	}
+	// Nothing is sent if the manifest does not fit
+	var ctr Controller
+	if err := ctr.sendFile(l, strings.Repeat("a", 100), file, 0, nil); err == nil || !strings.HasPrefix(err.Error(), "File name too long") {
+		t.Errorf("Unexpected manifest error: %v", err)
+	}
+	l.framing.maxSize = uint64(fileChunkHeaderSize + 4)
+	if _, err := l.fileChunkSize(file, 0); err == nil {
+		t.Errorf("Expected an error for a max message size too small for files")
+	}
+}
+
+// Incoming files are limited in number and size, and dropped if they stop making progress
+func TestFileTransferLimits(t *testing.T) {
+	l := &Layers{id: defaultSession, transfers: make(map[uint32]*fileTransfer)}
+	manifest := func(id uint32, size uint64) []byte {
+		data, _ := encodeManifest(fileManifest{ID: id, Name: "test.bin", Size: size, ChunkSize: maxDefaultChunkSize, Chunks: uint32((size + maxDefaultChunkSize - 1) / maxDefaultChunkSize)})
+		return data
+	}
+
+	for i := uint32(1); i <= maxTransfers; i++ {
+		if _, err := l.handleFileMessage(manifest(i, 1000)); err != nil {
+			t.Fatalf("Unexpected error: %s", err.Error())
+		}
+	}
+	if _, err := l.handleFileMessage(manifest(maxTransfers+1, 1000)); err == nil {
+		t.Errorf("Expected error for too many transfers")
+	}
+
+	// Old transfers are dropped, freeing their space
+	l.transfers[1].updated = time.Now().Add(-2 * transferTimeout)
+	l.expireTransfers(time.Now())
+	if _, ok := l.transfers[1]; ok || len(l.transfers) != maxTransfers-1 {
+		t.Errorf("Expected the stalled transfer to be dropped")
+	}
+	if _, err := l.handleFileMessage(manifest(maxTransfers+1, maxTransferBytes)); err == nil {
+		t.Errorf("Expected error for too many bytes")
+	}
+	if _, err := l.handleFileMessage(manifest(maxTransfers+1, 1000)); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+}
+
+// A buffer that can be written to while being read by the test
+type syncBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// Exchange messages between a headless controller and a controller using the websocket
+func TestHeadless(t *testing.T) {
+	ctr1, _ := CreateController()
+	ctr2, _ := CreateController()
+	defer ctr1.Shutdown()
+
+	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9080/covert", "9080", ctr2, t)
+
+	conf := DefaultConfig()
+	conf.OpCode = "open"
+	conf.Channel.Type = "UdpNormal"
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8095
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8094
+	writeTestMsg(write2, conf, t)
+	checkMsgType(read2, "open", "Open success", t)
+
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8094
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8095
+	b, _ := json.Marshal(conf)
+
+	var (
+		output syncBuffer
+		result chan error       = make(chan error)
+		stop   chan interface{} = make(chan interface{})
+	)
+	go func() {
+		result <- ctr1.RunHeadless(HeadlessConfig{
+			Config: b,
+			Input:  strings.NewReader("Hello\nWorld!\n"),
+			Output: &output,
+			Stop:   stop,
+		})
+	}()
+
+	checkMsgType(read2, "read", "Hello", t)
+	checkMsgType(read2, "read", "World!", t)
+
+	write2 <- []byte("{\"OpCode\" : \"write\", \"Message\" : \"Reply\"}")
+	checkWrite(read2, defaultSession, "sent", t)
+	time.Sleep(time.Millisecond * 100)
+
+	close(stop)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Unexpected headless error: %s", err.Error())
+		}
+	case <-time.After(time.Second * 10):
+		t.Errorf("Unexpected headless timeout")
+	}
+	if output.String() != "Reply\n" {
+		t.Errorf("Unexpected headless output: %s, want Reply", output.String())
+	}
+
+	checkClose(stop2, done2, t)
+}
+
+// The history must be kept in the file, whose directory is created, and support filtering and paging
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatalf("Unexpected temp dir error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "covert-channels", "history.jsonl")
+
+	ctr, _ := CreateController()
+	if err = ctr.SetHistoryFile(name); err != nil {
+		t.Fatalf("Unexpected history file error: %s", err.Error())
+	}
+	l := &Layers{id: "a", conf: sessionConfig{Channel: channelConfig{Type: "UdpNormal"}, Processors: []processorConfig{{Type: "Caesar"}}}}
+	for i := 0; i < 5; i++ {
+		ctr.history.add(l, "send", []byte("message "+strconv.Itoa(i)), 9, nil)
+	}
+	l.id = "b"
+	ctr.history.add(l, "receive", nil, 0, errors.New("Read fail"))
+	ctr.Shutdown()
+
+	// Reopening the file must keep the previous messages
+	ctr, _ = CreateController()
+	defer ctr.Shutdown()
+	if err = ctr.SetHistoryFile(name); err != nil {
+		t.Fatalf("Unexpected history file error: %s", err.Error())
+	}
+	ctr.history.add(l, "receive", []byte("message 5"), 9, nil)
+
+	var hm historyMessage
+	json.Unmarshal(ctr.handleCommand("history", []byte("{\"Session\" : \"a\", \"Offset\" : 1, \"Limit\" : 2}")), &hm)
+	if hm.Total != 5 || len(hm.Messages) != 2 || hm.Messages[0].Message != "message 2" || hm.Messages[1].Message != "message 3" {
+		t.Errorf("Unexpected history page: %v", hm)
+	} else if hm.Messages[0].Channel != "UdpNormal" || !reflect.DeepEqual(hm.Messages[0].Processors, []string{"Caesar"}) ||
+		hm.Messages[0].Bytes != 9 || hm.Messages[0].ProcessedBytes != 9 {
+		t.Errorf("Unexpected history entry: %v", hm.Messages[0])
+	}
+
+	json.Unmarshal(ctr.handleCommand("history", []byte("{\"Error\" : true}")), &hm)
+	if hm.Total != 1 || len(hm.Messages) != 1 || hm.Messages[0].Error != "Read fail" || hm.Messages[0].ID != 6 {
+		t.Errorf("Unexpected error history: %v", hm)
+	}
+
+	json.Unmarshal(ctr.handleCommand("history", []byte("{\"Direction\" : \"receive\", \"Contains\" : \"5\"}")), &hm)
+	if hm.Total != 1 || len(hm.Messages) != 1 || hm.Messages[0].ID != 7 {
+		t.Errorf("Unexpected filtered history: %v", hm)
+	}
+
+	checkMsgType(singleMsg(ctr.handleCommand("history", []byte("{\"Limit\" : -1}"))), "error", "Unable to retrieve history: Limit must be between 0 and 1000", t)
+}
+
+// Profiles must be saved, listed, loaded and deleted
+func TestProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	if err != nil {
+		t.Fatalf("Unexpected temp dir error: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctr, _ := CreateController()
+	defer ctr.Shutdown()
+	// The directory is only created once a profile is saved
+	dir = filepath.Join(dir, "profiles")
+	if err = ctr.SetProfileDir(dir); err != nil {
+		t.Fatalf("Unexpected profile dir error: %s", err.Error())
+	}
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Profile directory created before saving a profile")
+	}
+	var empty profileListMessage
+	if err = json.Unmarshal(ctr.handleCommand("listProfiles", []byte("{}")), &empty); err != nil || empty.OpCode != "listProfiles" || len(empty.Profiles) != 0 {
+		t.Errorf("Unexpected profile list: %v, %v", empty, err)
+	}
+
+	conf := DefaultConfig()
+	conf.OpCode = "saveProfile"
+	conf.Channel.Type = "UdpNormal"
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8000
+	conf.Processors = []processorConfig{{Type: "Caesar", Data: defaultProcessor()}}
+	conf.Processors[0].Data["Caesar"].(*caesar.ConfigClient).Shift.Value = 3
+	b, _ := json.Marshal(struct {
+		configData
+		Name string
+	}{conf, "udp-caesar"})
+	checkMsgType(singleMsg(ctr.handleCommand("saveProfile", b)), "saveProfile", "Profile saved", t)
+	checkMsgType(singleMsg(ctr.handleCommand("saveProfile", []byte("{\"Name\" : \"../escape\"}"))), "error",
+		"Unable to save profile: Invalid profile name: names may only contain letters, numbers, '-' and '_'", t)
+
+	var list profileListMessage
+	json.Unmarshal(ctr.handleCommand("listProfiles", []byte("{}")), &list)
+	if len(list.Profiles) != 1 || list.Profiles[0].Name != "udp-caesar" || list.Profiles[0].Channel != "UdpNormal" ||
+		!reflect.DeepEqual(list.Profiles[0].Processors, []string{"Caesar"}) {
+		t.Errorf("Unexpected profile list: %v", list)
+	}
+
+	// Remove a param from the saved profile, as though it was saved before the param was added
+	file := filepath.Join(dir, "udp-caesar.json")
+	saved, _ := ioutil.ReadFile(file)
+	var m map[string]interface{}
+	json.Unmarshal(saved, &m)
+	delete(m["Channel"].(map[string]interface{})["Data"].(map[string]interface{})["UdpNormal"].(map[string]interface{}), "DestinationPort")
+	saved, _ = json.Marshal(m)
+	ioutil.WriteFile(file, saved, 0600)
+
+	var loaded configData
+	json.Unmarshal(ctr.handleCommand("loadProfile", []byte("{\"Name\" : \"udp-caesar\"}")), &loaded)
+	if loaded.OpCode != "loadProfile" || loaded.Channel.Type != "UdpNormal" || loaded.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value != 8000 ||
+		len(loaded.Processors) != 1 || loaded.Processors[0].Data["Caesar"].(*caesar.ConfigClient).Shift.Value != 3 {
+		t.Errorf("Unexpected loaded config: %v", loaded)
+	}
+	if loaded.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort != DefaultConfig().Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort {
+		t.Errorf("Missing param was not set to the default: %v", loaded.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort)
+	}
+
+	checkMsgType(singleMsg(ctr.handleCommand("deleteProfile", []byte("{\"Name\" : \"udp-caesar\"}"))), "deleteProfile", "Profile deleted", t)
+	checkMsgType(singleMsg(ctr.handleCommand("loadProfile", []byte("{\"Name\" : \"udp-caesar\"}"))), "error", "Unable to load profile: Profile not found", t)
+}
+
+// Messages larger than the fragment size must be reassembled by the receiver
+func TestFraming(t *testing.T) {
+	ctr1, _ := CreateController()
+	ctr2, _ := CreateController()
+
+	write1, read1, stop1, done1 := openConn("ws://127.0.0.1:9070/covert", "9070", ctr1, t)
+	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9080/covert", "9080", ctr2, t)
+
+	conf := DefaultConfig()
+	conf.OpCode = "open"
+	conf.Channel.Type = "UdpNormal"
+	conf.Framing.Enable.Value = true
+	conf.Framing.FragmentSize.Value = 100
+	conf.Framing.MaxMessageSize.Value = 4000
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8094
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8095
+	writeTestMsg(write1, conf, t)
+	checkMsgType(read1, "open", "Open success", t)
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8095
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8094
+	writeTestMsg(write2, conf, t)
+	checkMsgType(read2, "open", "Open success", t)
+
+	for _, msg := range []string{"", "Hello", strings.Repeat("0123456789", 100), strings.Repeat("abcdefghij", 300)} {
+		writeTestMsg(write1, messageType{OpCode: "write", Message: msg}, t)
+		checkWrite(read1, defaultSession, "sent", t)
+		checkMsgType(read2, "read", msg, t)
+	}
+
+	writeTestMsg(write1, messageType{OpCode: "write", Message: strings.Repeat("a", 4001)}, t)
+	if sm := checkWrite(read1, defaultSession, "error", t); sm.Message != "Unable to write to channel: Message of 4001 bytes is larger than the maximum message size of 4000 bytes" {
+		t.Errorf("Unexpected error: %s, want error for message larger than the maximum", sm.Message)
+	}
+	var mt messageType
+
+	// Framing must validate the configuration
+	conf.Framing.FragmentSize.Value = 0
+	writeTestMsg(write2, conf, t)
+	readTestMsg(read2, &mt, t)
+	if mt.OpCode != "error" {
+		t.Errorf("Unexpected opcode: %s, want error for invalid fragment size", mt.OpCode)
+	}
+
+	// Without framing the whole message is received at once, so its size is limited
+	conf.Framing.Enable.Value = false
+	conf.Framing.FragmentSize.Value = 100
+	conf.Framing.MaxMessageSize.Value = maxUnframedMessageSize + 1
+	writeTestMsg(write2, conf, t)
+	var em errorMessage
+	if readTestMsg(read2, &em, t); em.OpCode != "error" || em.Fields["MaxMessageSize"] == "" {
+		t.Errorf("Unexpected message: %v, want error for max message size", em)
+	}
+
+	checkClose(stop1, done1, t)
+	checkClose(stop2, done2, t)
+}
+
+// The stats of each session must count the messages, bytes and packets
+// in both directions, and stats events must be sent at the requested interval
+func TestStats(t *testing.T) {
+	ctr1, _ := CreateController()
+	ctr2, _ := CreateController()
+
+	write1, read1, stop1, done1 := openConn("ws://127.0.0.1:9070/covert", "9070", ctr1, t)
+	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9080/covert", "9080", ctr2, t)
+
+	conf := DefaultConfig()
+	conf.OpCode = "open"
+	conf.Processors = []processorConfig{{Type: "Checksum", Data: defaultProcessor()}}
+	conf.Channel.Type = "UdpNormal"
+	conf.Framing.Enable.Value = true
+	conf.Framing.FragmentSize.Value = 8
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8094
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8095
+	writeTestMsg(write1, conf, t)
+	checkMsgType(read1, "open", "Open success", t)
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8095
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8094
+	writeTestMsg(write2, conf, t)
+	checkMsgType(read2, "open", "Open success", t)
+
+	// The checksum adds 4 bytes, so each message is sent in 2 fragments
+	for _, msg := range []string{"Hello", "World!"} {
+		writeTestMsg(write1, messageType{OpCode: "write", Message: msg}, t)
+		checkWrite(read1, defaultSession, "sent", t)
+		checkMsgType(read2, "read", msg, t)
+	}
+
+	var sm statsMessage
+	write1 <- []byte("{\"OpCode\" : \"stats\"}")
+	readTestMsg(read1, &sm, t)
+	if sm.OpCode != "stats" || sm.Session != defaultSession || sm.Channel != "UdpNormal" || !reflect.DeepEqual(sm.Processors, []string{"Checksum"}) {
+		t.Errorf("Unexpected stats session: %v", sm)
+	}
+	if sm.MessagesSent != 2 || sm.BytesSent != 11 || sm.ProcessedBytesSent != 19 || sm.FragmentsWritten != 4 || sm.MessagesReceived != 0 {
+		t.Errorf("Unexpected send stats: %v", sm)
+	}
+	if sm.AverageSendTime <= 0 || sm.SendGoodput <= 0 {
+		t.Errorf("Unexpected send time: %v", sm)
+	}
+	// UdpNormal counts its packets, which are one per fragment
+	if sm.PacketsWritten == nil || *sm.PacketsWritten != 4 || sm.PacketsRead == nil || *sm.PacketsRead != 0 {
+		t.Errorf("Unexpected packet counts: %v", sm)
+	}
+
+	write2 <- []byte("{\"OpCode\" : \"stats\", \"Interval\" : 100}")
+	readTestMsg(read2, &sm, t)
+	if sm.MessagesReceived != 2 || sm.BytesReceived != 11 || sm.ProcessedBytesReceived != 19 || sm.FragmentsRead != 4 || sm.MessagesSent != 0 {
+		t.Errorf("Unexpected receive stats: %v", sm)
+	}
+	if len(sm.Errors) != 0 {
+		t.Errorf("Unexpected errors: %v", sm.Errors)
+	}
+	// The stats event must be sent without another command
+	sm = statsMessage{}
+	readTestMsg(read2, &sm, t)
+	if sm.OpCode != "stats" || sm.MessagesReceived != 2 {
+		t.Errorf("Unexpected stats event: %v", sm)
+	}
+	write2 <- []byte("{\"OpCode\" : \"stats\", \"Interval\" : 0}")
+
+	// A message larger than the maximum must be counted as a framing error
+	writeTestMsg(write1, messageType{OpCode: "write", Message: strings.Repeat("a", 1024)}, t)
+	checkWrite(read1, defaultSession, "error", t)
+	write1 <- []byte("{\"OpCode\" : \"stats\"}")
+	readTestMsg(read1, &sm, t)
+	if sm.MessagesSent != 2 || sm.Errors[statsErrorFraming] != 1 {
+		t.Errorf("Unexpected error stats: %v", sm)
+	}
+
+	write1 <- []byte("{\"OpCode\" : \"stats\", \"Interval\" : 10}")
+	checkSessionMsg(read1, "error", defaultSession, "Unable to retrieve stats: Interval must be zero or at least 100 milliseconds", t)
+	write1 <- []byte("{\"OpCode\" : \"stats\", \"Session\" : \"other\"}")
+	checkSessionMsg(read1, "error", "other", "Unable to retrieve stats: Channel closed", t)
+
+	checkClose(stop1, done1, t)
+	checkClose(stop2, done2, t)
+}
+
+// The config schema must describe the params of every channel and processor
+func TestConfigSchema(t *testing.T) {
+	ctr, _ := CreateController()
+
+	var csm struct {
+		OpCode string
+		Schema struct {
+			Definitions struct {
+				Channels   map[string]jsonSchema
+				Processors map[string]jsonSchema
+				Framing    jsonSchema
+			}
+			Properties map[string]jsonSchema
+		}
+	}
+	readTestMsg(singleMsg(ctr.handleCommand("configSchema", []byte("{}"))), &csm, t)
+	if csm.OpCode != "configSchema" {
+		t.Errorf("Unexpected opcode: %s", csm.OpCode)
+	}
+	for _, name := range channel.Names() {
+		if _, ok := csm.Schema.Definitions.Channels[name]; !ok {
+			t.Errorf("Channel %s missing from config schema", name)
+		}
+	}
+	for _, name := range processor.Names() {
+		if _, ok := csm.Schema.Definitions.Processors[name]; !ok {
+			t.Errorf("Processor %s missing from config schema", name)
+		}
+	}
+	if _, ok := csm.Schema.Definitions.Framing["properties"].(map[string]interface{})["FragmentSize"]; !ok {
+		t.Errorf("Unexpected framing schema: %v", csm.Schema.Definitions.Framing)
+	}
+
+	// Ranges, enums, descriptions and groups are taken from the default configs
+	port := csm.Schema.Definitions.Channels["TcpSyn"]["properties"].(map[string]interface{})["BouncePort"].(map[string]interface{})
+	value := port["properties"].(map[string]interface{})["Value"]
+	if port["title"] != "Bouncer's Port" || port["x-group"] != "Bouncing" || port["description"] != "The bouncer's port." ||
+		!reflect.DeepEqual(value, map[string]interface{}{"type": "integer", "minimum": 0.0, "maximum": 65535.0, "default": 0.0}) {
+		t.Errorf("Unexpected BouncePort schema: %v", port)
+	}
+	delimiter := csm.Schema.Definitions.Channels["TcpSyn"]["properties"].(map[string]interface{})["Delimiter"].(map[string]interface{})
+	if value := delimiter["properties"].(map[string]interface{})["Value"].(map[string]interface{}); !reflect.DeepEqual(value["enum"], []interface{}{"buffer", "protocol"}) {
+		t.Errorf("Unexpected Delimiter schema: %v", value)
+	}
+	if ref := csm.Schema.Properties["Channel"]["properties"].(map[string]interface{})["Data"].(map[string]interface{})["properties"].(map[string]interface{})["TcpSyn"]; !reflect.DeepEqual(ref, map[string]interface{}{"$ref": "#/definitions/channels/TcpSyn"}) {
+		t.Errorf("Unexpected TcpSyn reference: %v", ref)
+	}
+}
+
+// Configurations may be given by a config file and generated flags
+func TestConfigFlags(t *testing.T) {
+	ctr, _ := CreateController()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("channel: TcpSyn\nprocessors: [Checksum]\nUdpNormal:\n  OriginPort: 8111\n  DestinationPort: 8112\nCaesar.Shift: 3\n"), 0600); err != nil {
+		t.Fatalf("Unable to write config file: %s", err.Error())
+	}
+
+	// Flags take precedence over the file, whatever their order
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cf := NewConfigFlags(fs)
+	if cf.IsSet() {
+		t.Errorf("Expected no flags to be set")
+	}
+	if err := fs.Parse([]string{"-UdpNormal.OriginPort=8113", "-config", file, "-channel", "UdpNormal", "-processors", "Caesar,Checksum", "-Framing.Enable"}); err != nil {
+		t.Fatalf("Unexpected parse error: %s", err.Error())
+	}
+	conf, err := cf.Config()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err = ctr.SetConfig(conf); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	udp := ctr.config.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient)
+	if ctr.config.Channel.Type != "UdpNormal" || udp.OriginPort.Value != 8113 || udp.DestinationPort.Value != 8112 {
+		t.Errorf("Unexpected channel config: %s %v", ctr.config.Channel.Type, udp)
+	}
+	if len(ctr.config.Processors) != 2 || ctr.config.Processors[0].Type != "Caesar" || ctr.config.Processors[1].Type != "Checksum" ||
+		ctr.config.Processors[0].Data["Caesar"].(*caesar.ConfigClient).Shift.Value != 3 {
+		t.Errorf("Unexpected processors: %v", ctr.config.Processors)
+	}
+	if !ctr.config.Framing.Enable.Value {
+		t.Errorf("Expected framing to be enabled")
+	}
+
+	// Each value is checked when the flag is parsed, and combinations when the config is used
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	cf = NewConfigFlags(fs)
+	if err := fs.Parse([]string{"-TcpSyn.FriendIP=10.0.0"}); err == nil {
+		t.Errorf("Expected error for invalid IP address")
+	}
+	if err := fs.Parse([]string{"-channel", "TcpSyn", "-TcpSyn.Bounce"}); err != nil {
+		t.Fatalf("Unexpected parse error: %s", err.Error())
+	}
+	if conf, err = cf.Config(); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if err = ctr.SetConfig(conf); err == nil || asCovertError(err).Fields["BouncePort"] == "" {
+		t.Errorf("Expected BouncePort error; found %v", err)
+	}
+
+	for _, args := range [][]string{{"-channel", "Unknown"}, {"-channel", "TcpSyn", "-processors", "Unknown"}, {"-Caesar.Shift=1"}} {
+		fs = flag.NewFlagSet("test", flag.ContinueOnError)
+		cf = NewConfigFlags(fs)
+		fs.Parse(args)
+		if _, err := cf.Config(); err == nil {
+			t.Errorf("Expected error for %v", args)
+		}
+	}
+}
+
+// Errors must carry a code, layer and entity, and every message must carry the protocol version
+func TestErrorCodes(t *testing.T) {
+	ctr1, _ := CreateController()
+	ctr2, _ := CreateController()
+
+	write1, read1, stop1, done1 := openConn("ws://127.0.0.1:9070/covert", "9070", ctr1, t)
+	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9080/covert", "9080", ctr2, t)
+
+	write1 <- []byte("{\"OpCode\" : \"unknown\"}")
+	checkError(read1, codeUnknownOpCode, layerController, "", t)
+	write1 <- []byte("{\"OpCode\" : \"write\", \"Message\" : \"Hello\"}")
+	if em := checkError(read1, codeSessionClosed, layerController, "", t); em.Message != "Unable to write to channel: Channel closed" {
+		t.Errorf("Unexpected message: %s", em.Message)
+	}
+	write1 <- []byte("{\"OpCode\" : \"config\", \"Version\" : 1000}")
+	checkError(read1, codeUnsupportedVersion, layerController, "", t)
+	write1 <- []byte("{\"OpCode\" : \"open\", \"Channel\" : 5}")
+	checkError(read1, codeInvalidCommand, layerController, "", t)
+
+	// Invalid combinations of params are reported by field
+	conf := DefaultConfig()
+	conf.OpCode = "open"
+	conf.Channel.Type = "TcpSyn"
+	conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Bounce.Value = true
+	writeTestMsg(write1, conf, t)
+	if em := checkError(read1, codeInvalidConfig, layerChannel, "TcpSyn", t); len(em.Fields) != 1 || em.Fields["BouncePort"] == "" {
+		t.Errorf("Unexpected fields: %v", em.Fields)
+	}
+
+	// Only the receiver uses the checksum, so every message fails it
+	conf = DefaultConfig()
+	conf.OpCode = "open"
+	conf.Processors = []processorConfig{{Type: "Checksum", Data: defaultProcessor()}}
+	conf.Channel.Type = "UdpNormal"
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8096
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8097
+	writeTestMsg(write1, conf, t)
+	checkMsgType(read1, "open", "Open success", t)
+	conf.Processors = []processorConfig{}
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8097
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8096
+	writeTestMsg(write2, conf, t)
+	checkMsgType(read2, "open", "Open success", t)
+
+	writeTestMsg(write2, messageType{OpCode: "write", Message: "Hello world"}, t)
+	checkWrite(read2, defaultSession, "sent", t)
+	if em := checkError(read1, codeChecksum, layerProcessor, "Checksum", t); em.Detail != "Checksum failure" || em.Session != defaultSession {
+		t.Errorf("Unexpected error: %v", em)
+	}
+
+	checkClose(stop1, done1, t)
+	checkClose(stop2, done2, t)
+}
+
+// The schema must describe every command and message
+func TestSchema(t *testing.T) {
+	ctr, _ := CreateController()
+	write, read, stop, done := openConn("ws://127.0.0.1:9070/covert", "9070", ctr, t)
+
+	var sm struct {
+		OpCode     string
+		Version    int
+		Commands   map[string]jsonSchema
+		Messages   map[string]jsonSchema
+		ErrorCodes []string
+	}
+	write <- []byte("{\"OpCode\" : \"schema\"}")
+	readTestMsg(read, &sm, t)
+	if sm.OpCode != "schema" || sm.Version != protocolVersion || !reflect.DeepEqual(sm.ErrorCodes, errorCodes) {
+		t.Errorf("Unexpected schema: %v", sm)
+	}
+	for _, opcode := range []string{"open", "close", "write", "cancel", "sendfile", "schedule", "listSchedules", "cancelSchedule", "saveProfile", "loadProfile", "listProfiles", "deleteProfile", "history", "stats", "config", "schema", "configSchema"} {
+		if _, ok := sm.Commands[opcode]; !ok {
+			t.Errorf("Command %s missing from schema", opcode)
+		}
+		if _, ok := sm.Messages[opcode]; !ok {
+			t.Errorf("Reply %s missing from schema", opcode)
+		}
+	}
+	for opcode := range streamEvents {
+		if _, ok := sm.Messages[opcode]; !ok {
+			t.Errorf("Event %s missing from schema", opcode)
+		}
+	}
+
+	properties := sm.Messages["error"]["properties"].(map[string]interface{})
+	for _, field := range []string{"Version", "Code", "Layer", "Entity", "Detail", "Message"} {
+		if _, ok := properties[field]; !ok {
+			t.Errorf("Error field %s missing from schema", field)
+		}
+	}
+	if fs, ok := sm.Commands["stats"]["properties"].(map[string]interface{})["Interval"]; !ok || !reflect.DeepEqual(fs, map[string]interface{}{"type": "integer"}) {
+		t.Errorf("Unexpected Interval schema: %v", fs)
+	}
+
+	checkClose(stop, done, t)
+}
+
+// The handshake must report matching, mismatched and missing friends
+func TestHandshake(t *testing.T) {
+	ctr1, _ := CreateController()
+	ctr2, _ := CreateController()
+
+	write1, read1, stop1, done1 := openConn("ws://127.0.0.1:9070/covert", "9070", ctr1, t)
+	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9080/covert", "9080", ctr2, t)
+
+	conf := DefaultConfig()
+	conf.OpCode = "open"
+	conf.Processors = []processorConfig{{Type: "Checksum", Data: defaultProcessor()}}
+	conf.Channel.Type = "UdpNormal"
+	conf.Handshake.Enable.Value = true
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8098
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8099
+	writeTestMsg(write1, conf, t)
+	checkMsgType(read1, "open", "Open success", t)
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8099
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8098
+	writeTestMsg(write2, conf, t)
+	checkOpenPeer(read2, peerConnected, "Peer connected", t)
+	checkPeer(read1, peerConnected, "Peer connected", t)
+
+	// Handshake packets must not be read as messages
+	writeTestMsg(write2, messageType{OpCode: "write", Message: "Hello world"}, t)
+	checkWrite(read2, defaultSession, "sent", t)
+	checkMsgType(read1, "read", "Hello world", t)
+
+	// Reopening with another processor must be reported by both friends
+	conf.Processors = append(conf.Processors, processorConfig{Type: "Caesar", Data: defaultProcessor()})
+	writeTestMsg(write2, conf, t)
+	checkOpenPeer(read2, peerMismatch, "Peer mismatch: processors differ at index 1", t)
+	checkPeer(read1, peerMismatch, "Peer mismatch: processors differ at index 1", t)
+
+	// Without the handshake, messages that look like handshake packets are read as messages
+	conf.Handshake.Enable.Value = false
+	writeTestMsg(write2, conf, t)
+	checkMsgType(read2, "open", "Open success", t)
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8098
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8099
+	writeTestMsg(write1, conf, t)
+	checkMsgType(read1, "open", "Open success", t)
+	hello := string(fingerprint{}.packet(handshakeHello))
+	writeTestMsg(write2, messageType{OpCode: "write", Message: hello}, t)
+	checkWrite(read2, defaultSession, "sent", t)
+	checkMsgType(read1, "read", hello, t)
+
+	// The handshake packets must fit in the receive buffer
+	conf.Handshake.Enable.Value = true
+	conf.Framing.Enable.Value = true
+	conf.Framing.FragmentSize.Value = 1
+	data, _ := json.Marshal(conf)
+	if _, err := ctr1.readConfig(data); err == nil || asCovertError(err).Fields["Enable"] == "" {
+		t.Errorf("Expected handshake size error; found %v", err)
+	}
+	conf.Framing = defaultFraming()
+
+	// Nobody is listening on these ports
+	conf.Handshake.Timeout.Value = 200
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8100
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8101
+	writeTestMsg(write1, conf, t)
+	checkMsgType(read1, "open", "Open success", t)
+	checkPeer(read1, peerUnreachable, "Peer unreachable", t)
+
+	checkClose(stop1, done1, t)
+	checkClose(stop2, done2, t)
+}
+
+// Scheduled messages must be written at their interval until complete or cancelled
+func TestSchedule(t *testing.T) {
+	ctr1, _ := CreateController()
+	ctr2, _ := CreateController()
+
+	write1, read1, stop1, done1 := openConn("ws://127.0.0.1:9070/covert", "9070", ctr1, t)
+	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9080/covert", "9080", ctr2, t)
+
+	conf := DefaultConfig()
+	conf.OpCode = "open"
+	conf.Channel.Type = "UdpNormal"
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8102
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8103
+	writeTestMsg(write1, conf, t)
+	checkMsgType(read1, "open", "Open success", t)
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8103
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8102
+	writeTestMsg(write2, conf, t)
+	checkMsgType(read2, "open", "Open success", t)
+
+	var sm scheduleMessage
+	start := time.Now()
+	writeTestMsg(write1, scheduleCommand{OpCode: "schedule", Message: "Tick", Interval: 200, Jitter: 50, Count: 3}, t)
+	if readTestMsg(read1, &sm, t); sm.OpCode != "schedule" || sm.ScheduleID != 1 {
+		t.Errorf("Unexpected schedule reply: %v", sm)
+	}
+	// The last send may finish after the schedule
+	var (
+		scheduled map[uint64]bool = make(map[uint64]bool)
+		sent      map[uint64]bool = make(map[uint64]bool)
+		done      bool
+	)
+	for !done || len(sent) < 3 {
+		var m scheduleMessage
+		if readTestMsg(read1, &m, t); t.Failed() {
+			break
+		}
+		switch m.OpCode {
+		case "scheduled":
+			scheduled[m.SendID] = true
+		case "sent":
+			sent[m.SendID] = true
+		case "scheduleDone":
+			done = true
+			if m.ScheduleID != 1 || m.Runs != 3 || m.Message != "Schedule complete" {
+				t.Errorf("Unexpected schedule done message: %v", m)
+			}
+		}
+	}
+	if !reflect.DeepEqual(scheduled, sent) {
+		t.Errorf("Scheduled sends %v do not match sent messages %v", scheduled, sent)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("Schedule completed after %s, expected at least 400ms", d)
+	}
+	for i := 0; i < 3; i++ {
+		checkMsgType(read2, "read", "Tick", t)
+	}
+
+	// A schedule in the future must be listed until it is cancelled
+	later := time.Now().Add(time.Hour).Truncate(time.Second)
+	writeTestMsg(write1, scheduleCommand{OpCode: "schedule", Message: "Later", Start: later, Interval: 1000}, t)
+	if readTestMsg(read1, &sm, t); sm.OpCode != "schedule" || sm.ScheduleID != 2 {
+		t.Errorf("Unexpected schedule reply: %v", sm)
+	}
+	var lm scheduleListMessage
+	write1 <- []byte("{\"OpCode\" : \"listSchedules\"}")
+	readTestMsg(read1, &lm, t)
+	if len(lm.Schedules) != 1 || lm.Schedules[0].ScheduleID != 2 || lm.Schedules[0].Message != "Later" || !lm.Schedules[0].Next.Equal(later) {
+		t.Errorf("Unexpected schedules: %v", lm)
+	}
+	writeTestMsg(write1, cancelScheduleCommand{OpCode: "cancelSchedule", ScheduleID: 2}, t)
+	for _, m := range readScheduleMessages(read1, []string{"cancelSchedule", "scheduleDone"}, t) {
+		if m.OpCode == "cancelSchedule" && m.Message != "Schedule cancelled" {
+			t.Errorf("Unexpected cancel reply: %v", m)
+		} else if m.OpCode == "scheduleDone" && (m.ScheduleID != 2 || m.Runs != 0 || m.Message != "Schedule cancelled") {
+			t.Errorf("Unexpected schedule done message: %v", m)
+		}
+	}
+	writeTestMsg(write1, cancelScheduleCommand{OpCode: "cancelSchedule", ScheduleID: 2}, t)
+	checkError(read1, codeNotFound, layerController, "", t)
+	writeTestMsg(write1, scheduleCommand{OpCode: "schedule", Message: "Fast", Interval: 50}, t)
+	checkError(read1, codeInvalidCommand, layerController, "", t)
+
+	checkClose(stop1, done1, t)
+	checkClose(stop2, done2, t)
+}
+
+// Read messages until a message with each of the opcodes has been received
+// The replies to commands may arrive before or after the events they cause
+func readScheduleMessages(ch chan []byte, opcodes []string, t *testing.T) []scheduleMessage {
+	var (
+		msgs []scheduleMessage
+		seen map[string]bool = make(map[string]bool)
+	)
+	for len(seen) < len(opcodes) {
+		var sm scheduleMessage
+		select {
+		case data := <-ch:
+			if err := json.Unmarshal(data, &sm); err != nil {
+				t.Errorf("Unexpected unmarshal error: %s", err.Error())
+			}
+		case <-time.After(time.Second * 10):
+			t.Errorf("Unexpected read timeout")
+			return msgs
+		}
+		msgs = append(msgs, sm)
+		for _, opcode := range opcodes {
+			if sm.OpCode == opcode {
+				seen[opcode] = true
+			}
+		}
+	}
+	return msgs
+}
+
+// An experiment must run every combination and report each run as a CSV row
+func TestExperiment(t *testing.T) {
+	ctr, _ := CreateController()
+	defer ctr.Shutdown()
+
+	var out bytes.Buffer
+	exp := `{
+		"Channels" : [{
+			"Type" : "UdpNormal",
+			"Sender" : {"DestinationPort" : {"Value" : 8104}, "OriginPort" : {"Value" : 8105}},
+			"Receiver" : {"DestinationPort" : {"Value" : 8105}, "OriginPort" : {"Value" : 8104}}
+		}],
+		"Processors" : [[], [{"Type" : "Checksum"}, {"Type" : "Caesar", "Data" : {"Caesar" : {"Shift" : {"Value" : 3}}}}]],
+		"MessageSizes" : [8, 100],
+		"Repetitions" : 3,
+		"Timeout" : 1000
+	}`
+	if err := ctr.RunExperiment(ExperimentConfig{Config: []byte(exp), Output: &out, Stop: make(chan interface{})}); err != nil {
+		t.Fatalf("Unexpected experiment error: %s", err.Error())
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatalf("Unexpected CSV error: %s", err.Error())
+	}
+	if len(rows) != 5 || !reflect.DeepEqual(rows[0], experimentColumns) {
+		t.Fatalf("Unexpected results: %v", rows)
+	}
+	for i, expt := range [][]string{{"", "8"}, {"", "100"}, {"Checksum+Caesar", "8"}, {"Checksum+Caesar", "100"}} {
+		row := rows[i+1]
+		if row[0] != "UdpNormal" || row[2] != expt[0] || row[3] != "false" || row[4] != expt[1] {
+			t.Errorf("Unexpected run: %v", row)
+		}
+		if row[5] != "3" || row[6] != "3" || row[7] != "0" || row[10] != "0" || row[11] != "" {
+			t.Errorf("Unexpected results: %v", row)
+		}
+	}
+
+	// An empty list varies every value of a select param
+	exp = `{"Channels" : [{"Type" : "TcpSyn", "Vary" : {"Embedder" : [], "Delimiter" : ["buffer"]}}], "MessageSizes" : [16, 32]}`
+	var e experiment
+	if err := json.Unmarshal([]byte(exp), &e); err != nil {
+		t.Fatalf("Unexpected unmarshal error: %s", err.Error())
+	}
+	runs, err := ctr.experimentRuns(e)
+	if err != nil {
+		t.Fatalf("Unexpected experiment error: %s", err.Error())
+	}
+	if len(runs) != 18 || runs[0].variant != "Delimiter=buffer;Embedder=sequence" || runs[2].variant != "Delimiter=buffer;Embedder=id" {
+		t.Errorf("Unexpected runs: %d", len(runs))
+	}
+	for _, run := range runs {
+		if run.sender.Data["TcpSyn"].(*tcpSyn.ConfigClient).Delimiter.Value != "buffer" || run.receiver.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value != strings.TrimPrefix(run.variant, "Delimiter=buffer;Embedder=") {
+			t.Errorf("Varied params not set for %s", run.variant)
+		}
+	}
+
+	// Unknown params cannot be varied
+	e = experiment{Channels: []experimentChannel{{Type: "TcpSyn", Vary: map[string][]json.RawMessage{"Unknown": nil}}}}
+	if _, err := ctr.experimentRuns(e); err == nil {
+		t.Errorf("Expected an error varying an unknown param")
+	}
+
+	// Errors and late messages are skipped while waiting for a message
+	reads := make(chan experimentRead)
+	late, msg := []byte("late message"), []byte("next message")
+	setSequence(late, 0)
+	setSequence(msg, 1)
+	go func() {
+		reads <- experimentRead{err: errors.New("Receive timeout")}
+		reads <- experimentRead{data: late}
+		reads <- experimentRead{data: msg}
+	}()
+	if read, err := awaitRead(reads, msg, time.Second); err != nil || !bytes.Equal(read.data, msg) {
+		t.Errorf("Unexpected read: %q, %v", read.data, err)
+	}
+	// The last error is reported if the message times out
+	go func() {
+		reads <- experimentRead{err: errors.New("Stray packet")}
+	}()
+	if _, err := awaitRead(reads, msg, time.Millisecond*100); err == nil || err.Error() != "Stray packet" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !sameSequence([]byte{1}, []byte{1, 2}) || sameSequence([]byte{1, 2}, []byte{1}) {
+		t.Errorf("Sequence numbers not compared correctly")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	ctr, _ := CreateController()
+	name := filepath.Join(t.TempDir(), "session.jsonl")
+	if err := ctr.SetRecordFile(name); err != nil {
+		t.Fatalf("Unexpected record error: %s", err.Error())
+	}
+	listener := ctr.addListener()
+
+	// The channel sends to itself
+	conf := DefaultConfig()
+	conf.OpCode = "open"
+	conf.Channel.Type = "UdpNormal"
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8106
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8106
+	open, _ := json.Marshal(conf)
+	checkMsgType(singleMsg(ctr.handleCommand("open", open)), "open", "Open success", t)
+	checkMsgType(singleMsg(ctr.handleCommand("write", []byte("{\"Message\" : \"Hello\"}"))), "write", "Message queued", t)
+	for {
+		var m messageType
+		if readTestMsg(listener, &m, t); t.Failed() || m.OpCode == "read" {
+			break
+		}
+	}
+	// The replay must wait as long before closing
+	time.Sleep(200 * time.Millisecond)
+	checkMsgType(singleMsg(ctr.handleCommand("close", []byte("{}"))), "close", "Close success", t)
+	ctr.removeListener(listener)
+	ctr.Shutdown()
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Unexpected read error: %s", err.Error())
+	}
+	var commands []string
+	var read bool
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e recordEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Unexpected unmarshal error: %s", err.Error())
+		}
+		if e.Kind == recordCommand {
+			commands = append(commands, e.OpCode)
+		} else if e.Kind == recordEvent && strings.Contains(string(e.Data), "\"read\"") {
+			read = true
+		}
+	}
+	if !reflect.DeepEqual(commands, []string{"open", "write", "close"}) || !read {
+		t.Errorf("Unexpected session file: %s", data)
+	}
+
+	// The replay must produce the same replies and read the message again
+	ctr, _ = CreateController()
+	defer ctr.Shutdown()
+	var out bytes.Buffer
+	start := time.Now()
+	if err := ctr.RunReplay(ReplayConfig{Input: bytes.NewReader(data), Output: &out, Stop: make(chan interface{})}); err != nil {
+		t.Fatalf("Unexpected replay error: %s", err.Error())
+	}
+	var opcodes []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var m messageType
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("Unexpected unmarshal error: %s", err.Error())
+		}
+		if m.OpCode == "read" && m.Message != "Hello" {
+			t.Errorf("Unexpected read: %v", m)
+		}
+		opcodes = append(opcodes, m.OpCode)
+	}
+	if len(opcodes) == 0 || opcodes[0] != "open" || opcodes[len(opcodes)-1] != "close" || !strings.Contains(strings.Join(opcodes, ","), "read") {
+		t.Errorf("Unexpected replay output: %s", out.String())
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("Replay finished after %s, expected at least 200ms", d)
+	}
+
+	if err := ctr.RunReplay(ReplayConfig{Input: strings.NewReader("{"), Output: &out}); err == nil {
+		t.Errorf("Expected an error replaying an invalid session file")
+	}
+}
+
+// A listener that falls behind is disconnected rather than blocking the clients
+func TestSlowListener(t *testing.T) {
+	ctr, _ := CreateController()
+	defer ctr.Shutdown()
+	slow := ctr.addListener()
+	defer ctr.removeListener(slow)
+	fast := ctr.addListener()
+	defer ctr.removeListener(fast)
+
+	for i := 0; i <= maxListenerBuffer; i++ {
+		select {
+		case ctr.wsSend <- toSessionMessage("read", defaultSession, strconv.Itoa(i)):
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Sending blocked by slow listener")
+		}
+		checkMsgType(fast, "read", strconv.Itoa(i), t)
+	}
+	for i := 0; i < maxListenerBuffer; i++ {
+		checkMsgType(slow, "read", strconv.Itoa(i), t)
+	}
+	if _, ok := <-slow; ok {
+		t.Errorf("Expected slow listener to be closed")
+	}
+}
 
-	write1 <- []byte("{\"OpCode\" : \"config\"}")
+// Messages must be written to the selected peers and read with the name of their sender
+func TestPeers(t *testing.T) {
+	var (
+		ctrs      []*Controller
+		listeners []chan []byte
+	)
+	for i, friend := range []string{"127.0.0.2", "127.0.0.1", "127.0.0.1"} {
+		ctr, _ := CreateController()
+		defer ctr.Shutdown()
+		listener := ctr.addListener()
+		defer ctr.removeListener(listener)
 
-	conf := checkConfig(read1, DefaultConfig(), t)
+		conf := DefaultConfig()
+		conf.OpCode = "open"
+		conf.Channel.Type = "UdpNormal"
+		cc := conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient)
+		cc.FriendIP.Value = friend
+		cc.OriginIP.Value = "127.0.0." + strconv.Itoa(i+1)
+		cc.DestinationPort.Value = 8108
+		cc.OriginPort.Value = 8108
+		if i == 0 {
+			cc.Peers.Value = "carol=127.0.0.3"
+		}
+		open, _ := json.Marshal(conf)
+		checkMsgType(singleMsg(ctr.handleCommand("open", open)), "open", "Open success", t)
+		ctrs = append(ctrs, ctr)
+		listeners = append(listeners, listener)
+	}
+	alice, bob, carol := ctrs[0], ctrs[1], ctrs[2]
+
+	checkMsgType(singleMsg(alice.handleCommand("write", []byte(`{"Message" : "Hello all", "Peers" : ["*"]}`))), "write", "Message queued", t)
+	checkRead(listeners[1], "friend", "Hello all", t)
+	checkRead(listeners[2], "friend", "Hello all", t)
+
+	// Bob must not receive a message written only to carol
+	checkMsgType(singleMsg(alice.handleCommand("write", []byte(`{"Message" : "Hello carol", "Peers" : ["carol"]}`))), "write", "Message queued", t)
+	checkRead(listeners[2], "friend", "Hello carol", t)
+	checkMsgType(singleMsg(alice.handleCommand("write", []byte(`{"Message" : "Hello bob"}`))), "write", "Message queued", t)
+	checkRead(listeners[1], "friend", "Hello bob", t)
+
+	checkMsgType(singleMsg(bob.handleCommand("write", []byte(`{"Message" : "From bob"}`))), "write", "Message queued", t)
+	checkRead(listeners[0], "friend", "From bob", t)
+	checkMsgType(singleMsg(carol.handleCommand("write", []byte(`{"Message" : "From carol"}`))), "write", "Message queued", t)
+	checkRead(listeners[0], "carol", "From carol", t)
+
+	checkError(singleMsg(alice.handleCommand("write", []byte(`{"Message" : "Hello", "Peers" : ["dave"]}`))), codeInvalidCommand, layerController, "", t)
+	checkError(singleMsg(bob.handleCommand("write", []byte(`{"Message" : "Hello", "Peers" : ["carol"]}`))), codeInvalidCommand, layerController, "", t)
+}
+
+// A covert channel that passes each sent packet to blockingSends and
+// then waits for blockingRelease, so that tests control when sends complete
+type blockingChannel struct {
+	closed chan interface{}
+}
+
+type blockingConfig struct{}
+
+var (
+	blockingSends   chan []byte      = make(chan []byte)
+	blockingRelease chan interface{} = make(chan interface{})
+)
+
+func init() {
+	channel.Register("Blocking", func() blockingConfig { return blockingConfig{} }, func(blockingConfig) (*blockingChannel, error) {
+		return &blockingChannel{closed: make(chan interface{})}, nil
+	})
+}
+
+func (c *blockingChannel) Send(data []byte) (uint64, error) {
+	select {
+	case blockingSends <- data:
+	case <-c.closed:
+		return 0, errors.New("Channel closed")
+	}
+	select {
+	case <-blockingRelease:
+		return uint64(len(data)), nil
+	case <-c.closed:
+		return 0, errors.New("Channel closed")
+	}
+}
 
+func (c *blockingChannel) Receive(data []byte) (uint64, error) {
+	<-c.closed
+	return 0, errors.New("Channel closed")
+}
+
+func (c *blockingChannel) Close() error {
+	close(c.closed)
+	return nil
+}
+
+// A covert channel whose receives only return once their context is done
+type waitingChannel struct {
+	blockingChannel
+}
+
+func (c *waitingChannel) ReceiveContext(ctx context.Context, data []byte) (uint64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (c *waitingChannel) SendContext(ctx context.Context, data []byte) (uint64, error) {
+	return c.Send(data)
+}
+
+// Receives must be given the context of the session
+func TestReceiveContext(t *testing.T) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	c := &waitingChannel{blockingChannel{closed: make(chan interface{})}}
+	defer c.Close()
+	done := make(chan error)
+	go func() {
+		_, _, err := receiveFragment(ctx, c, make([]byte, 10))
+		done <- err
+	}()
+	cancelFn()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Unexpected error: %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("Receive was not interrupted by the context")
+	}
+}
+
+// Channels without peers must reject named peers
+func TestChannelWithoutPeers(t *testing.T) {
+	ctr, _ := CreateController()
+	defer ctr.Shutdown()
+	conf := DefaultConfig()
 	conf.OpCode = "open"
-	conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 8090
-	conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 8091
-	conf.Processors = []processorConfig{
-		processorConfig{
-			Type: "Caesar", Data: defaultProcessor(),
-		},
-		processorConfig{
-			Type: "Caesar", Data: defaultProcessor(),
-		},
+	conf.Channel.Type = "Blocking"
+	open, _ := json.Marshal(conf)
+	checkMsgType(singleMsg(ctr.handleCommand("open", open)), "open", "Open success", t)
+	checkMsgType(singleMsg(ctr.handleCommand("write", []byte(`{"Message" : "Hello", "Peers" : ["bob"]}`))), "error", "Unable to write to channel: The Blocking channel only supports the friend peer, not bob", t)
+}
+
+// Read the send messages and replies to write and cancel commands, which may arrive in any order
+// Returns the opcodes of the messages for each send ID
+func readSendMessages(ch chan []byte, n int, t *testing.T) map[uint64][]string {
+	var opcodes map[uint64][]string = make(map[uint64][]string)
+	for i := 0; i < n; i++ {
+		var sm sendMessage
+		readTestMsg(ch, &sm, t)
+		opcodes[sm.SendID] = append(opcodes[sm.SendID], sm.OpCode)
 	}
-	conf.Processors[0].Data.Caesar.Shift.Value = -1
-	conf.Processors[1].Data.Caesar.Shift.Value = 3
-	writeTestMsg(write1, conf, t)
+	return opcodes
+}
 
-	conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 8091
-	conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 8090
-	conf.Processors = []processorConfig{}
-	writeTestMsg(write2, conf, t)
+// Writes must be queued, and cancelling a send must stop it before its next
+// fragment or before it starts, without closing the channel
+func TestCancel(t *testing.T) {
+	ctr, _ := CreateController()
+	write, read, stop, done := openConn("ws://127.0.0.1:9070/covert", "9070", ctr, t)
+
+	conf := DefaultConfig()
+	conf.OpCode = "open"
+	conf.Channel.Type = "Blocking"
+	conf.Framing.Enable.Value = true
+	conf.Framing.FragmentSize.Value = 5
+	writeTestMsg(write, conf, t)
+	checkMsgType(read, "open", "Open success", t)
+
+	nextSend := func() {
+		select {
+		case <-blockingSends:
+		case <-time.After(time.Second * 5):
+			t.Errorf("Unexpected send timeout")
+		}
+	}
+
+	// The first message is sent in two fragments
+	write <- []byte("{\"OpCode\" : \"write\", \"Message\" : \"0123456789\"}")
+	if ops := readSendMessages(read, 3, t); !reflect.DeepEqual(ops[1], []string{"queued", "write", "sending"}) && !reflect.DeepEqual(ops[1], []string{"queued", "sending", "write"}) {
+		t.Errorf("Unexpected send messages: %v", ops)
+	}
+	nextSend()
+
+	// The second message must wait for the first
+	write <- []byte("{\"OpCode\" : \"write\", \"Message\" : \"Second\"}")
+	if ops := readSendMessages(read, 2, t); !reflect.DeepEqual(ops[2], []string{"queued", "write"}) {
+		t.Errorf("Unexpected send messages: %v", ops)
+	}
+
+	write <- []byte("{\"OpCode\" : \"cancel\", \"SendID\" : 2}")
+	checkMsgType(read, "cancel", "Cancel success", t)
+	write <- []byte("{\"OpCode\" : \"cancel\", \"SendID\" : 1}")
+	checkMsgType(read, "cancel", "Cancel success", t)
+	write <- []byte("{\"OpCode\" : \"cancel\", \"SendID\" : 1}")
+	checkMsgType(read, "error", "Unable to cancel send: No queued or in-flight send with ID 1", t)
+
+	// Once the first fragment is sent, the second must not be
+	blockingRelease <- nil
+	if ops := readSendMessages(read, 2, t); !reflect.DeepEqual(ops, map[uint64][]string{1: {"cancelled"}, 2: {"cancelled"}}) {
+		t.Errorf("Unexpected send messages: %v", ops)
+	}
+
+	// The channel must still be open
+	write <- []byte("{\"OpCode\" : \"write\", \"Message\" : \"Third\"}")
+	go func() {
+		nextSend()
+		blockingRelease <- nil
+	}()
+	if sm := checkWrite(read, defaultSession, "sent", t); sm.SendID != 3 {
+		t.Errorf("Unexpected send ID: %d, want 3", sm.SendID)
+	}
+
+	hm, _ := ctr.history.query(historyQuery{})
+	if len(hm.Messages) != 2 || hm.Messages[0].Error != "Send cancelled" || hm.Messages[1].Message != "Third" {
+		t.Errorf("Unexpected history: %v", hm.Messages)
+	}
+
+	checkClose(stop, done, t)
+}
+
+// Replies must only be sent to the client that sent the command,
+// while read events are sent to every client
+func TestRequestID(t *testing.T) {
+	ctr1, _ := CreateController()
+	ctr2, _ := CreateController()
+
+	write1, read1, stop1, done1 := openConn("ws://127.0.0.1:9070/covert", "9070", ctr1, t)
+	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9080/covert", "9080", ctr2, t)
+
+	// A second client of the first controller
+	other, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:9070/covert", nil)
+	if err != nil {
+		t.Fatalf("Unexpected dial error: %s", err.Error())
+	}
+	defer other.Close()
 
+	conf := DefaultConfig()
+	conf.OpCode = "open"
+	conf.Channel.Type = "UdpNormal"
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8094
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8095
+	writeTestMsg(write1, conf, t)
 	checkMsgType(read1, "open", "Open success", t)
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8095
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8094
+	writeTestMsg(write2, conf, t)
 	checkMsgType(read2, "open", "Open success", t)
 
-	write1 <- []byte("{\"OpCode\" : \"write\", \"Message\" : \"Hello World!\"}")
-	checkMsgType(read2, "read", "Jgnnq\"Yqtnf#", t)
+	write1 <- []byte("{\"OpCode\" : \"invalid\", \"RequestID\" : \"1\"}")
+	var reply command
+	readTestMsg(read1, &reply, t)
+	if reply.OpCode != "error" || reply.RequestID != "1" {
+		t.Errorf("Unexpected reply: %v, want error with request ID 1", reply)
+	}
+
+	write2 <- []byte("{\"OpCode\" : \"write\", \"Message\" : \"Hello\"}")
+	checkWrite(read2, defaultSession, "sent", t)
+	checkMsgType(read1, "read", "Hello", t)
+
+	// The other client must receive the read event, but not the error
+	other.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, data, err := other.ReadMessage(); err != nil {
+		t.Errorf("Unexpected read error: %s", err.Error())
+	} else {
+		checkMsgType(singleMsg(data), "read", "Hello", t)
+	}
 
 	checkClose(stop1, done1, t)
 	checkClose(stop2, done2, t)
 }
 
+// Clients must provide the token and come from an allowed origin
+func TestAuth(t *testing.T) {
+	ctr, _ := CreateController()
+	defer ctr.Shutdown()
+	ctr.SetAuth(AuthConfig{Token: "secret", Origins: []string{"https://allowed.example"}})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/login", ctr.HandleLogin)
+	mux.HandleFunc("/api/ws", ctr.HandleFunc)
+	mux.HandleFunc("/api/config", ctr.HandleConfig)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/ws"
+
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil {
+		t.Errorf("Unexpected websocket connection without token")
+	} else if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Unexpected dial error: %s, want status %d", err.Error(), http.StatusUnauthorized)
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	header.Set("Origin", "https://denied.example")
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, header); err == nil {
+		t.Errorf("Unexpected websocket connection from denied origin")
+	} else if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Unexpected dial error: %s, want status %d", err.Error(), http.StatusForbidden)
+	}
+
+	header.Set("Origin", "https://allowed.example")
+	if client, _, err := websocket.DefaultDialer.Dial(wsURL, header); err != nil {
+		t.Errorf("Unexpected dial error: %s", err.Error())
+	} else {
+		client.Close()
+	}
+
+	if resp := doREST(t, "GET", srv.URL+"/api/config", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Unexpected status: %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	// Logging in sets a cookie that authorizes later requests
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.PostForm(srv.URL+"/api/login", url.Values{"token": {"secret"}})
+	if err != nil {
+		t.Fatalf("Unexpected login error: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusSeeOther || len(resp.Cookies()) != 1 {
+		t.Fatalf("Unexpected login response: %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/api/config", nil)
+	req.AddCookie(resp.Cookies()[0])
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Errorf("Unexpected request error: %s", err.Error())
+	} else if resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status: %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Drive a controller through the REST API and event stream
+// A config set through the REST API must be recorded, so that opening with
+// it is replayed the same way
+func TestRecordReplayREST(t *testing.T) {
+	ctr, _ := CreateController()
+	name := filepath.Join(t.TempDir(), "session.jsonl")
+	if err := ctr.SetRecordFile(name); err != nil {
+		t.Fatalf("Unexpected record error: %s", err.Error())
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/config", ctr.HandleConfig)
+	mux.HandleFunc("/api/open", ctr.HandleOpen)
+	mux.HandleFunc("/api/close", ctr.HandleClose)
+	srv := httptest.NewServer(mux)
+
+	conf := DefaultConfig()
+	conf.Channel.Type = "UdpNormal"
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8107
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8107
+	b, _ := json.Marshal(conf)
+	for _, req := range [][2]string{{"PUT", "/api/config"}, {"POST", "/api/open"}, {"POST", "/api/close"}} {
+		body := ""
+		if req[0] == "PUT" {
+			body = string(b)
+		}
+		if resp := doREST(t, req[0], srv.URL+req[1], body); resp.StatusCode != http.StatusOK {
+			t.Errorf("Unexpected status for %s %s: %d", req[0], req[1], resp.StatusCode)
+		}
+	}
+	srv.Close()
+	ctr.Shutdown()
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("Unexpected read error: %s", err.Error())
+	}
+	var commands []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e recordEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Unexpected unmarshal error: %s", err.Error())
+		}
+		if e.Kind == recordCommand {
+			commands = append(commands, e.OpCode)
+		}
+	}
+	if !reflect.DeepEqual(commands, []string{"setConfig", "open", "close"}) {
+		t.Errorf("Unexpected session file: %s", data)
+	}
+
+	// The replay must open the channel with the recorded config
+	ctr, _ = CreateController()
+	defer ctr.Shutdown()
+	var out bytes.Buffer
+	if err := ctr.RunReplay(ReplayConfig{Input: bytes.NewReader(data), Output: &out, Stop: make(chan interface{})}); err != nil {
+		t.Fatalf("Unexpected replay error: %s", err.Error())
+	}
+	var replies []messageType
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var m messageType
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("Unexpected unmarshal error: %s", err.Error())
+		}
+		replies = append(replies, m)
+	}
+	if len(replies) != 3 || replies[0].OpCode != "config" || replies[1].Message != "Open success" || replies[2].Message != "Close success" {
+		t.Errorf("Unexpected replay output: %s", out.String())
+	}
+	if ctr.config.Channel.Type != "UdpNormal" {
+		t.Errorf("Config was not replayed: %v", ctr.config.Channel)
+	}
+}
+
+func TestREST(t *testing.T) {
+	ctr1, _ := CreateController()
+	ctr2, _ := CreateController()
+	defer ctr1.Shutdown()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/config", ctr1.HandleConfig)
+	mux.HandleFunc("/api/open", ctr1.HandleOpen)
+	mux.HandleFunc("/api/close", ctr1.HandleClose)
+	mux.HandleFunc("/api/write", ctr1.HandleWrite)
+	mux.HandleFunc("/api/history", ctr1.HandleHistory)
+	mux.HandleFunc("/api/events", ctr1.HandleEvents)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	write2, read2, stop2, done2 := openConn("ws://127.0.0.1:9080/covert", "9080", ctr2, t)
+
+	conf := DefaultConfig()
+	conf.OpCode = "open"
+	conf.Channel.Type = "UdpNormal"
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8095
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8094
+	writeTestMsg(write2, conf, t)
+	checkMsgType(read2, "open", "Open success", t)
+
+	if resp := doREST(t, "DELETE", srv.URL+"/api/open", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status: %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	// An invalid config must be rejected without changing the current config
+	if resp := doREST(t, "PUT", srv.URL+"/api/config", "{\"Channel\" : {\"Type\" : \"Invalid\"}}"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected status: %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8094
+	conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8095
+	b, _ := json.Marshal(conf)
+	if resp := doREST(t, "PUT", srv.URL+"/api/config", string(b)); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status: %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	resp := doREST(t, "GET", srv.URL+"/api/config", "")
+	var readConf configData
+	if err := json.NewDecoder(resp.Body).Decode(&readConf); err != nil {
+		t.Errorf("Unexpected decode error: %s", err.Error())
+	} else if readConf.Channel.Type != "UdpNormal" || readConf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value != 8095 {
+		t.Errorf("Config was not updated: %v", readConf.Channel)
+	}
+
+	// Opening with an empty body uses the updated config
+	if resp := doREST(t, "POST", srv.URL+"/api/open", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status: %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	events, err := http.Get(srv.URL + "/api/events")
+	if err != nil {
+		t.Fatalf("Unexpected event stream error: %s", err.Error())
+	}
+	defer events.Body.Close()
+	if events.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Unexpected content type: %s", events.Header.Get("Content-Type"))
+	}
+
+	write2 <- []byte("{\"OpCode\" : \"write\", \"Message\" : \"Hello\"}")
+	checkWrite(read2, defaultSession, "sent", t)
+
+	scanner := bufio.NewScanner(events.Body)
+	var event, data string
+	for (event == "" || data == "") && scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "event: ") {
+			event = strings.TrimPrefix(scanner.Text(), "event: ")
+		} else if strings.HasPrefix(scanner.Text(), "data: ") {
+			data = strings.TrimPrefix(scanner.Text(), "data: ")
+		}
+	}
+	if event != "read" {
+		t.Errorf("Unexpected event: %s, want read", event)
+	}
+	checkMsgType(singleMsg([]byte(data)), "read", "Hello", t)
+
+	if resp := doREST(t, "POST", srv.URL+"/api/write", "{\"Message\" : \"World\"}"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status: %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	checkMsgType(read2, "read", "World", t)
+	// The message is recorded in the history before it is reported as sent
+	for event = ""; event != "sent" && scanner.Scan(); {
+		if strings.HasPrefix(scanner.Text(), "event: ") {
+			event = strings.TrimPrefix(scanner.Text(), "event: ")
+		}
+	}
+	if event != "sent" {
+		t.Errorf("Missing sent event")
+	}
+
+	resp = doREST(t, "GET", srv.URL+"/api/history?limit=2", "")
+	var hm historyMessage
+	if err := json.NewDecoder(resp.Body).Decode(&hm); err != nil {
+		t.Errorf("Unexpected decode error: %s", err.Error())
+	} else if len(hm.Messages) != 2 || hm.Messages[0].Message != "Hello" || hm.Messages[0].Direction != "receive" ||
+		hm.Messages[1].Message != "World" || hm.Messages[1].Direction != "send" {
+		t.Errorf("Unexpected history: %v", hm.Messages)
+	}
+
+	if resp := doREST(t, "POST", srv.URL+"/api/close", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status: %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp := doREST(t, "POST", srv.URL+"/api/write", "{\"Message\" : \"Closed\"}"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Unexpected status: %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	checkClose(stop2, done2, t)
+}
+
+func doREST(t *testing.T, method string, url string, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unexpected request error: %s", err.Error())
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected request error: %s", err.Error())
+	}
+	return resp
+}
+
+// A channel holding a single message, for use with the check functions
+func singleMsg(data []byte) chan []byte {
+	ch := make(chan []byte, 1)
+	ch <- data
+	return ch
+}
+
+func readTestMsg(ch chan []byte, v interface{}, t *testing.T) {
+	select {
+	case data := <-ch:
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Errorf("Unexpected unmarshal error: %s", err.Error())
+		}
+	case <-time.After(time.Second * 10):
+		t.Errorf("Unexpected read timeout")
+	}
+}
+
 func checkClose(stop chan interface{}, done chan interface{}, t *testing.T) {
 	close(stop)
 	select {
@@ -185,11 +1981,129 @@ func checkMsgType(ch chan []byte, opcode string, msg string, t *testing.T) {
 	}
 }
 
+func checkSessionMsg(ch chan []byte, opcode string, session string, msg string, t *testing.T) {
+	select {
+	case data := <-ch:
+		var mt messageType
+		if err := json.Unmarshal(data, &mt); err != nil {
+			t.Errorf("Unexpected unmarshal error: %s", err.Error())
+		} else {
+			if mt.OpCode != opcode {
+				t.Errorf("Message does not have correct opcode: %s, want %s", mt.OpCode, opcode)
+			}
+			if mt.Session != session {
+				t.Errorf("Message does not have correct session: %s, want %s", mt.Session, session)
+			}
+			if mt.Message != msg {
+				t.Errorf("Message does not have correct message: %s, want %s", mt.Message, msg)
+			}
+		}
+	case <-time.After(time.Second * 10):
+		t.Errorf("Unexpected read timeout")
+	}
+}
+
+// Check that an error message has the expected code, layer and entity
+func checkError(ch chan []byte, code string, layer string, entity string, t *testing.T) errorMessage {
+	var em errorMessage
+	readTestMsg(ch, &em, t)
+	if em.OpCode != "error" || em.Code != code || em.Layer != layer || em.Entity != entity {
+		t.Errorf("Unexpected error: %v, want code %s, layer %s and entity %s", em, code, layer, entity)
+	}
+	return em
+}
+
+// Check the status and message of a peer message
+func checkPeer(ch chan []byte, status string, msg string, t *testing.T) {
+	var pm peerMessage
+	readTestMsg(ch, &pm, t)
+	if pm.OpCode != "peer" || pm.Session != defaultSession || pm.Status != status || pm.Message != msg {
+		t.Errorf("Unexpected peer message: %v, want status %s and message %s", pm, status, msg)
+	}
+}
+
+// Check the reply to an open command and the peer message that follows it
+// The friend may answer the handshake before the reply is sent
+func checkOpenPeer(ch chan []byte, status string, msg string, t *testing.T) {
+	for i := 0; i < 2; i++ {
+		var pm peerMessage
+		readTestMsg(ch, &pm, t)
+		if pm.OpCode == "open" {
+			if pm.Message != "Open success" {
+				t.Errorf("Unexpected open reply: %s", pm.Message)
+			}
+		} else if pm.OpCode != "peer" || pm.Status != status || pm.Message != msg {
+			t.Errorf("Unexpected peer message: %v, want status %s and message %s", pm, status, msg)
+		}
+	}
+}
+
+// Wait for a read message and check its peer and message
+func checkRead(ch chan []byte, peer string, msg string, t *testing.T) {
+	for {
+		var rm readMessage
+		if readTestMsg(ch, &rm, t); t.Failed() {
+			return
+		} else if rm.OpCode == "read" {
+			if rm.Peer != peer || rm.Message != msg {
+				t.Errorf("Unexpected read message: %v, want peer %s and message %s", rm, peer, msg)
+			}
+			return
+		}
+	}
+}
+
+// Check the reply and messages of a write command
+// Every client receives "queued", "sending" and then result for the send,
+// while the reply may arrive at any point after "queued"
+// Returns the result message
+func checkWrite(ch chan []byte, session string, result string, t *testing.T) sendMessage {
+	var (
+		events []sendMessage
+		reply  bool
+		sendID uint64
+	)
+	for i := 0; i < 4; i++ {
+		var sm sendMessage
+		readTestMsg(ch, &sm, t)
+		if sm.Session != session {
+			t.Errorf("Message does not have correct session: %s, want %s", sm.Session, session)
+		}
+		if sendID == 0 {
+			sendID = sm.SendID
+		} else if sm.SendID != sendID {
+			t.Errorf("Message does not have correct send ID: %d, want %d", sm.SendID, sendID)
+		}
+		if sm.OpCode == "write" && !reply {
+			reply = true
+			if sm.Message != "Message queued" {
+				t.Errorf("Message does not have correct message: %s, want Message queued", sm.Message)
+			}
+		} else {
+			events = append(events, sm)
+		}
+	}
+	if !reply {
+		t.Errorf("Missing write reply")
+	} else if events[0].OpCode != "queued" || events[1].OpCode != "sending" || events[2].OpCode != result {
+		t.Errorf("Unexpected send messages: %v, want queued, sending and %s", events, result)
+	} else {
+		return events[2]
+	}
+	return sendMessage{}
+}
+
 // Checks that two strings are equal in terms of utf characters
 func utf8Equal() {
 
 }
 
+// An open command for a specific session
+type sessionCommand struct {
+	configData
+	Session string
+}
+
 func checkConfig(ch chan []byte, expt configData, t *testing.T) configData {
 	var conf configData
 	select {
@@ -207,6 +2121,17 @@ func checkConfig(ch chan []byte, expt configData, t *testing.T) configData {
 	return conf
 }
 
+// Copy a config so that changes to the entity configs of the copy do not affect the original
+func copyTestConfig(conf configData, t *testing.T) configData {
+	var cp configData
+	if data, err := json.Marshal(conf); err != nil {
+		t.Errorf("Unexpected marshal error: %s", err.Error())
+	} else if err := json.Unmarshal(data, &cp); err != nil {
+		t.Errorf("Unexpected unmarshal error: %s", err.Error())
+	}
+	return cp
+}
+
 type channelTest struct {
 	name     string
 	f1       func(*configData)
@@ -236,7 +2161,9 @@ func runMultiChannelWrite(t *testing.T, cl []channelTest, messages []string, tim
 
 		conf.Channel.Type = cl[i].name
 		cl[i].f1(&conf)
-		varCurrConf1 = conf
+		// The configs of the entities are pointers, so the expected config
+		// must be a copy to be unaffected by the changes for the second controller
+		varCurrConf1 = copyTestConfig(conf, t)
 
 		conf.OpCode = "open"
 		writeTestMsg(write1, conf, t)
@@ -257,10 +2184,10 @@ func runMultiChannelWrite(t *testing.T, cl []channelTest, messages []string, tim
 
 				// Check message sending in both directions
 				write1 <- b
-				checkMsgType(read1, "write", "Message write success", t)
+				checkWrite(read1, defaultSession, "sent", t)
 				checkMsgType(read2, "read", msg.Message, t)
 				write2 <- b
-				checkMsgType(read2, "write", "Message write success", t)
+				checkWrite(read2, defaultSession, "sent", t)
 				checkMsgType(read1, "read", msg.Message, t)
 			} else {
 				t.Errorf("Marshal Error: %s", err.Error())
@@ -283,126 +2210,126 @@ func TestMessageExchange(t *testing.T) {
 		channelTest{
 			name: "TcpNormal",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpNormal.FriendReceivePort.Value = 8090
-				conf.Channel.Data.TcpNormal.OriginReceivePort.Value = 8091
+				conf.Channel.Data["TcpNormal"].(*tcpNormal.ConfigClient).FriendReceivePort.Value = 8090
+				conf.Channel.Data["TcpNormal"].(*tcpNormal.ConfigClient).OriginReceivePort.Value = 8091
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpNormal.FriendReceivePort.Value = 8091
-				conf.Channel.Data.TcpNormal.OriginReceivePort.Value = 8090
+				conf.Channel.Data["TcpNormal"].(*tcpNormal.ConfigClient).FriendReceivePort.Value = 8091
+				conf.Channel.Data["TcpNormal"].(*tcpNormal.ConfigClient).OriginReceivePort.Value = 8090
 			},
 		},
 		channelTest{
 			name: "TcpHandshake",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 8090
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 8091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 8090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 8091
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 8091
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 8090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 8091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 8090
 			},
 		},
 		channelTest{
 			name: "TcpHandshake",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 8090
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 8091
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "urgflg"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 8090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 8091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "urgflg"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 8091
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 8090
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "urgflg"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 8091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 8090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "urgflg"
 			},
 		},
 		channelTest{
 			name: "TcpHandshake",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 8090
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 8091
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "urgptr"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 8090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 8091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "urgptr"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 8091
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 8090
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "urgptr"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 8091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 8090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "urgptr"
 			},
 		},
 		channelTest{
 			name: "TcpHandshake",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 9090
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 9091
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "ecn"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 9090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 9091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "ecn"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 9091
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 9090
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "ecn"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 9091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 9090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "ecn"
 			},
 		},
 		channelTest{
 			name: "TcpHandshake",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 9090
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 9091
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "timestamp"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 9090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 9091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "timestamp"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 9091
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 9090
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "timestamp"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 9091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 9090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "timestamp"
 			},
 			isTiming: true,
 		},
 		channelTest{
 			name: "TcpHandshake",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 9090
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 9091
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "temporal"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 9090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 9091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "temporal"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 9091
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 9090
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "temporal"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 9091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 9090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "temporal"
 			},
 			isTiming: true,
 		},
 		channelTest{
 			name: "TcpHandshake",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 9090
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 9091
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "frequency"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 9090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 9091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "frequency"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 9091
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 9090
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "frequency"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 9091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 9090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "frequency"
 			},
 			isTiming: true,
 		},
 		channelTest{
 			name: "TcpHandshake",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 9090
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 9091
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "ecntemporal"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 9090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 9091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "ecntemporal"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 9091
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 9090
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "ecntemporal"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 9091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 9090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "ecntemporal"
 			},
 			isTiming: true,
 		},
 		channelTest{
 			name: "TcpHandshake",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 8090
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 8091
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "id"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 8090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 8091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "id"
 
 				conf.Processors = []processorConfig{
 					processorConfig{
@@ -414,9 +2341,9 @@ func TestMessageExchange(t *testing.T) {
 				}
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 8091
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 8090
-				conf.Channel.Data.TcpHandshake.Embedder.Value = "id"
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 8091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 8090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).Embedder.Value = "id"
 
 				conf.Processors = []processorConfig{
 					processorConfig{
@@ -431,8 +2358,8 @@ func TestMessageExchange(t *testing.T) {
 		channelTest{
 			name: "TcpHandshake",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 8090
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 8091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 8090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 8091
 
 				conf.Processors = []processorConfig{
 					processorConfig{
@@ -441,8 +2368,8 @@ func TestMessageExchange(t *testing.T) {
 				}
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpHandshake.FriendReceivePort.Value = 8091
-				conf.Channel.Data.TcpHandshake.OriginReceivePort.Value = 8090
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).FriendReceivePort.Value = 8091
+				conf.Channel.Data["TcpHandshake"].(*tcpHandshake.ConfigClient).OriginReceivePort.Value = 8090
 
 				conf.Processors = []processorConfig{
 					processorConfig{
@@ -454,140 +2381,140 @@ func TestMessageExchange(t *testing.T) {
 		channelTest{
 			name: "TcpSyn",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8090
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8091
-				conf.Channel.Data.TcpSyn.Embedder.Value = "sequence"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "sequence"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8091
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8090
-				conf.Channel.Data.TcpSyn.Embedder.Value = "sequence"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "sequence"
 			},
 		},
 		channelTest{
 			name: "TcpSyn",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8090
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8091
-				conf.Channel.Data.TcpSyn.Embedder.Value = "urgflg"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "urgflg"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8091
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8090
-				conf.Channel.Data.TcpSyn.Embedder.Value = "urgflg"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "urgflg"
 			},
 		},
 		channelTest{
 			name: "TcpSyn",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8090
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8091
-				conf.Channel.Data.TcpSyn.Embedder.Value = "urgptr"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "urgptr"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8091
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8090
-				conf.Channel.Data.TcpSyn.Embedder.Value = "urgptr"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "urgptr"
 			},
 		},
 		channelTest{
 			name: "TcpSyn",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8090
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8091
-				conf.Channel.Data.TcpSyn.Embedder.Value = "timestamp"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "timestamp"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8091
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8090
-				conf.Channel.Data.TcpSyn.Embedder.Value = "timestamp"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "timestamp"
 			},
 			isTiming: true,
 		},
 		channelTest{
 			name: "TcpSyn",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8090
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8091
-				conf.Channel.Data.TcpSyn.Embedder.Value = "id"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "id"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8091
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8090
-				conf.Channel.Data.TcpSyn.Embedder.Value = "id"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "id"
 			},
 		},
 		channelTest{
 			name: "TcpSyn",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8090
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8091
-				conf.Channel.Data.TcpSyn.Embedder.Value = "ecn"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "ecn"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8091
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8090
-				conf.Channel.Data.TcpSyn.Embedder.Value = "ecn"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "ecn"
 			},
 		},
 		channelTest{
 			name: "TcpSyn",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8090
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8091
-				conf.Channel.Data.TcpSyn.Embedder.Value = "temporal"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "temporal"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8091
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8090
-				conf.Channel.Data.TcpSyn.Embedder.Value = "temporal"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "temporal"
 			},
 			isTiming: true,
 		},
 		channelTest{
 			name: "TcpSyn",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8090
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8091
-				conf.Channel.Data.TcpSyn.Embedder.Value = "frequency"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "frequency"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8091
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8090
-				conf.Channel.Data.TcpSyn.Embedder.Value = "frequency"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "frequency"
 			},
 			isTiming: true,
 		},
 		channelTest{
 			name: "TcpSyn",
 			f1: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8090
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8091
-				conf.Channel.Data.TcpSyn.Embedder.Value = "ecntemporal"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "ecntemporal"
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.TcpSyn.FriendPort.Value = 8091
-				conf.Channel.Data.TcpSyn.OriginPort.Value = 8090
-				conf.Channel.Data.TcpSyn.Embedder.Value = "ecntemporal"
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).FriendPort.Value = 8091
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).OriginPort.Value = 8090
+				conf.Channel.Data["TcpSyn"].(*tcpSyn.ConfigClient).Embedder.Value = "ecntemporal"
 			},
 			isTiming: true,
 		},
 		channelTest{
 			name: "UdpNormal",
 			f1: func(conf *configData) {
-				conf.Channel.Data.UdpNormal.DestinationPort.Value = 8090
-				conf.Channel.Data.UdpNormal.OriginPort.Value = 8091
+				conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8090
+				conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8091
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.UdpNormal.DestinationPort.Value = 8091
-				conf.Channel.Data.UdpNormal.OriginPort.Value = 8090
+				conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).DestinationPort.Value = 8091
+				conf.Channel.Data["UdpNormal"].(*udpNormal.ConfigClient).OriginPort.Value = 8090
 			},
 		},
 		channelTest{
 			name: "UdpIP",
 			f1: func(conf *configData) {
-				conf.Channel.Data.UdpIP.FriendReceivePort.Value = 8090
-				conf.Channel.Data.UdpIP.OriginReceivePort.Value = 8091
+				conf.Channel.Data["UdpIP"].(*udpIP.ConfigClient).FriendReceivePort.Value = 8090
+				conf.Channel.Data["UdpIP"].(*udpIP.ConfigClient).OriginReceivePort.Value = 8091
 
 				conf.Processors = []processorConfig{
 					processorConfig{
@@ -596,8 +2523,8 @@ func TestMessageExchange(t *testing.T) {
 				}
 			},
 			f2: func(conf *configData) {
-				conf.Channel.Data.UdpIP.FriendReceivePort.Value = 8091
-				conf.Channel.Data.UdpIP.OriginReceivePort.Value = 8090
+				conf.Channel.Data["UdpIP"].(*udpIP.ConfigClient).FriendReceivePort.Value = 8091
+				conf.Channel.Data["UdpIP"].(*udpIP.ConfigClient).OriginReceivePort.Value = 8090
 
 				conf.Processors = []processorConfig{
 					processorConfig{
@@ -4,23 +4,7 @@ import (
 	"sync"
 
 	"./channel"
-	"./channel/httpCovert"
-	"./channel/httpNormal"
-	"./channel/icmpIP"
-	"./channel/icmpNormal"
-	"./channel/tcpHandshake"
-	"./channel/tcpNormal"
-	"./channel/tcpSyn"
-	"./channel/udpIP"
-	"./channel/udpNormal"
 	"./processor"
-	"./processor/asymmetricEncryption"
-	"./processor/caesar"
-	"./processor/checksum"
-	"./processor/gZipCompression"
-	"./processor/none"
-	"./processor/symmetricEncryption"
-	"./processor/zLibCompression"
 
 	"github.com/gorilla/websocket"
 )
@@ -35,11 +19,30 @@ import (
 // struct for communication
 type command struct {
 	OpCode string
+	// The session the command applies to
+	// If empty, the default session is used
+	Session string
+	// An optional ID chosen by the client
+	// It is copied to the reply so that the client can match them
+	RequestID string
+	// The optional protocol version the client was written for
+	// If set, the command is rejected unless it is protocolVersion
+	Version int
+}
+
+// A message from or to a single websocket client
+type clientMessage struct {
+	data   []byte
+	client *websocket.Conn
 }
 
 type messageType struct {
 	OpCode  string
 	Message string
+	Session string
+	// The encoding of Message for messages that carry covert data
+	// (see encodingText and encodingBase64)
+	Encoding string
 }
 
 type defaultConfig struct {
@@ -52,6 +55,22 @@ type configData struct {
 	Default    defaultConfig
 	Processors []processorConfig
 	Channel    channelConfig
+	Framing    framingConfig
+	Handshake  handshakeConfig
+	// The configuration of every open session
+	// This is only reported to the client, it is
+	// ignored when opening a channel
+	Sessions []sessionConfig
+}
+
+type sessionConfig struct {
+	ID         string
+	Processors []processorConfig
+	Channel    channelConfig
+	Framing    framingConfig
+	Handshake  handshakeConfig
+	// The encoding used for read events
+	Encoding string
 }
 
 type processorConfig struct {
@@ -64,42 +83,69 @@ type channelConfig struct {
 	Data channelData
 }
 
-type channelData struct {
-	IcmpIP       icmpIP.ConfigClient
-	IcmpNormal   icmpNormal.ConfigClient
-	TcpSyn       tcpSyn.ConfigClient
-	TcpHandshake tcpHandshake.ConfigClient
-	TcpNormal    tcpNormal.ConfigClient
-	HttpCovert   httpCovert.ConfigClient
-	HttpNormal   httpNormal.ConfigClient
-	UdpNormal    udpNormal.ConfigClient
-	UdpIP        udpIP.ConfigClient
-}
+// The config of each registered channel, indexed by name
+// Each value is a pointer to the ConfigClient of the channel
+type channelData map[string]interface{}
 
-type processorData struct {
-	None                 none.ConfigClient
-	Caesar               caesar.ConfigClient
-	Checksum             checksum.ConfigClient
-	SymmetricEncryption  symmetricEncryption.ConfigClient
-	AsymmetricEncryption asymmetricEncryption.ConfigClient
-	GZipCompression      gZipCompression.ConfigClient
-	ZLibCompression      zLibCompression.ConfigClient
-}
+// The config of each registered processor, indexed by name
+// Each value is a pointer to the ConfigClient of the processor
+type processorData map[string]interface{}
 
 type Layers struct {
+	// The session ID
+	id string
+	// The encoding used for read events
+	encoding   string
 	processors []processor.Processor
 	channel    channel.Channel
+	// The names of the peers of the channel, starting with the friend
+	peers []string
+	// The configuration used to open the session
+	conf sessionConfig
+	// Splits outgoing messages and reassembles incoming messages
+	framing *framing
+	// Compares the configuration with the friend's
+	handshake *handshake
+	// Held while sending so that the fragments of messages are not interleaved
+	sendLock sync.Mutex
+	// Written messages waiting to be sent by the send loop
+	sendQueue chan *sendJob
+	// The queued and in-flight sends that can be cancelled, indexed by send ID
+	sendJobs map[uint64]*sendJob
+	jobLock  sync.Mutex
+	// The ID of the most recently queued send
+	// This must only be accessed while handling a command
+	nextSendID uint64
+	// The schedules that have not finished, indexed by schedule ID
+	schedules    map[uint64]*schedule
+	scheduleLock sync.Mutex
+	// The ID of the most recently added schedule
+	// This must only be accessed while handling a command
+	nextScheduleID uint64
+	// File transfers being received, indexed by transfer ID
+	// This must only be accessed by the read loop
+	transfers map[uint32]*fileTransfer
+	// The counters reported by the stats command
+	stats *sessionStats
+	// Closed to stop the stats events of the session
+	// This must only be accessed while handling a command
+	statsStop chan interface{}
 
 	// Chans for handling closing of the covert channel
 	readClose     chan interface{}
 	readCloseDone chan interface{}
+	sendLoopDone  chan interface{}
 }
 
 type Controller struct {
-	config     configData
-	layers     *Layers
-	upgrader   websocket.Upgrader
-	clients    map[*websocket.Conn]bool
+	config configData
+	// The open sessions, indexed by session ID
+	sessions    map[string]*Layers
+	sessionLock sync.Mutex
+	upgrader    websocket.Upgrader
+	clients     map[*websocket.Conn]bool
+	// Go channels that receive a copy of every message sent to the clients
+	listeners  map[chan []byte]bool
 	clientLock sync.Mutex
 	waitGroup  sync.WaitGroup
 	clientStop chan interface{}
@@ -108,5 +154,17 @@ type Controller struct {
 	doneWsSend chan interface{}
 	doneWsRecv chan interface{}
 	wsSend     chan []byte
-	wsRecv     chan []byte
+	wsRecv     chan clientMessage
+	// Replies to commands, which are only sent to the client that sent the command
+	wsReply chan clientMessage
+	// Held while handling a command from a client
+	cmdLock sync.Mutex
+	// The most recent messages sent and received
+	history *history
+	// Records the commands and messages of the session, if a file is set
+	recorder *recorder
+	// The access control for the websocket and the HTTP API
+	auth AuthConfig
+	// The directory that profiles are saved in
+	profileDir string
 }
@@ -8,9 +8,20 @@ import (
 	"time"
 )
 
+// The number of messages that may be waiting for each listener
+// A listener that falls further behind is disconnected, so that
+// one slow listener cannot block sending to the clients
+const maxListenerBuffer = 64
+
 // The HTTP handler function for initializing and running the websocket
 func (ctr *Controller) HandleFunc(w http.ResponseWriter, r *http.Request) {
 
+	// Check the client before upgrading so that unauthorized clients
+	// never reach the command loop
+	if !ctr.authorize(w, r) {
+		return
+	}
+
 	ctr.clientLock.Lock()
 
 	select {
@@ -45,7 +56,7 @@ loop:
 		_, data, err := ws.ReadMessage()
 		if err == nil {
 			select {
-			case ctr.wsRecv <- data:
+			case ctr.wsRecv <- clientMessage{data: data, client: ws}:
 			case <-ctr.clientStop:
 				break loop
 			case <-time.After(time.Second):
@@ -60,20 +71,22 @@ loop:
 // A loop for processing incomming messages from the client
 func (ctr *Controller) webReceiveLoop() {
 	defer close(ctr.doneWsRecv)
-	defer ctr.handleClose()
+	defer ctr.closeAllSessions()
 
 loop:
 	for {
 		select {
 		case <-ctr.recvStop:
 			break loop
-		case data := <-ctr.wsRecv:
-			ctr.wsSend <- ctr.handleMessage(data)
+		case msg := <-ctr.wsRecv:
+			ctr.wsReply <- clientMessage{data: ctr.handleMessage(msg.data), client: msg.client}
 		}
 	}
 }
 
-// A loop for broadcasting outgoing messages along all websockets
+// A loop for sending outgoing messages along the websockets
+// Replies are sent only to the client that sent the command,
+// while all other messages are broadcast along all websockets
 func (ctr *Controller) webSendLoop() {
 	defer close(ctr.doneWsSend)
 
@@ -82,18 +95,59 @@ loop:
 		select {
 		case <-ctr.sendStop:
 			break loop
+		case msg := <-ctr.wsReply:
+			ctr.clientLock.Lock()
+			// The client may have disconnected while the command was handled
+			if ctr.clients[msg.client] {
+				if err := msg.client.WriteMessage(websocket.TextMessage, withVersion(msg.data)); err != nil {
+					log.Println("Websocket write error: " + err.Error())
+				}
+			}
+			ctr.clientLock.Unlock()
 		case data := <-ctr.wsSend:
+			ctr.recorder.add(recordEvent, "", data)
+			data = withVersion(data)
 			ctr.clientLock.Lock()
 			for ws, _ := range ctr.clients {
 				if err := ws.WriteMessage(websocket.TextMessage, data); err != nil {
 					log.Println("Websocket write error: " + err.Error())
 				}
 			}
+			for l := range ctr.listeners {
+				select {
+				case l <- data:
+				default:
+					log.Println("Listener too slow, disconnecting")
+					delete(ctr.listeners, l)
+					close(l)
+				}
+			}
 			ctr.clientLock.Unlock()
 		}
 	}
 }
 
+// Add a listener that receives a copy of every message sent to the clients
+// The listener is closed if it falls more than maxListenerBuffer messages behind
+func (ctr *Controller) addListener() chan []byte {
+	var l chan []byte = make(chan []byte, maxListenerBuffer)
+	ctr.clientLock.Lock()
+	ctr.listeners[l] = true
+	ctr.clientLock.Unlock()
+	return l
+}
+
+// Stop sending messages to a listener
+// The listener is closed, unless it was already disconnected for falling behind
+func (ctr *Controller) removeListener(l chan []byte) {
+	ctr.clientLock.Lock()
+	defer ctr.clientLock.Unlock()
+	if ctr.listeners[l] {
+		delete(ctr.listeners, l)
+		close(l)
+	}
+}
+
 // Shutdown the websocket and all send and receive loops
 func (ctr *Controller) webShutdown() error {
 	var err error
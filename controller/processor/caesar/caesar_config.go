@@ -2,12 +2,17 @@ package caesar
 
 import (
 	"../../config"
+	"../../processor"
 )
 
 type ConfigClient struct {
 	Shift config.I8Param
 }
 
+func init() {
+	processor.Register("Caesar", GetDefault, ToProcessor)
+}
+
 func GetDefault() ConfigClient {
 	return ConfigClient{
 		// Julius Caesar crossed the Rubicon in 49 AD
@@ -6,6 +6,12 @@ import (
 	"hash/crc32"
 )
 
+// Returned by Unprocess when the checksum does not match the data
+var ErrChecksumFailure error = errors.New("Checksum failure")
+
+// Returned by Unprocess when the data is too short to hold a checksum
+var ErrChecksumLength error = errors.New("Insufficient length for checksum")
+
 type Checksum struct {
 	// A table with lookup values for the crc32 polynomial.
 	// Created with hash/crc32.MakeTable
@@ -33,12 +39,12 @@ func (cs *Checksum) Process(data []byte) ([]byte, error) {
 // or if the crc32 checksums don't match.
 func (cs *Checksum) Unprocess(data []byte) ([]byte, error) {
 	if len(data) < 4 {
-		return nil, errors.New("Insufficient length for checksum")
+		return nil, ErrChecksumLength
 	}
 	check := crc32.Checksum(data[:len(data)-4], cs.table)
 	inputCheck := binary.BigEndian.Uint32(data[len(data)-4:])
 	if inputCheck != check {
-		return nil, errors.New("Checksum failure")
+		return nil, ErrChecksumFailure
 	}
 	newData := make([]byte, len(data)-4)
 	// It's not strictly necessary to copy that data.
@@ -2,6 +2,7 @@ package checksum
 
 import (
 	"../../config"
+	"../../processor"
 	"errors"
 	"hash/crc32"
 )
@@ -10,6 +11,10 @@ type ConfigClient struct {
 	Polynomial config.SelectParam
 }
 
+func init() {
+	processor.Register("Checksum", GetDefault, ToProcessor)
+}
+
 func GetDefault() ConfigClient {
 	return ConfigClient{
 		// We only allow three common polynomials.
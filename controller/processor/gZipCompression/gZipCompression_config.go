@@ -1,8 +1,16 @@
 package gZipCompression
 
+import (
+	"../../processor"
+)
+
 type ConfigClient struct {
 }
 
+func init() {
+	processor.Register("GZipCompression", GetDefault, ToProcessor)
+}
+
 func GetDefault() ConfigClient {
 	return ConfigClient{}
 }
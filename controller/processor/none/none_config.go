@@ -2,6 +2,7 @@ package none
 
 import (
 	"../../config"
+	"../../processor"
 )
 
 type ConfigClient struct {
@@ -9,6 +10,10 @@ type ConfigClient struct {
 	Keytest      config.HexKeyParam
 }
 
+func init() {
+	processor.Register("None", GetDefault, ToProcessor)
+}
+
 func GetDefault() ConfigClient {
 	return ConfigClient{
 		Exactu64Test: config.MakeExactU64(12345, config.Display{Description: "Test for exact u64 type"}),
@@ -1,6 +1,46 @@
 package processor
 
+import (
+	"reflect"
+
+	"../registry"
+)
+
 type Processor interface {
 	Process(data []byte) ([]byte, error)
 	Unprocess(data []byte) ([]byte, error)
 }
+
+var processors *registry.Registry = registry.New("Processor", reflect.TypeOf((*Processor)(nil)).Elem())
+
+// Make a processor available to the controller
+// This should be called from the init function of the processor's package:
+//
+//	func init() {
+//		processor.Register("Caesar", GetDefault, ToProcessor)
+//	}
+//
+// getDefault must be a func() ConfigClient and toProcessor a func(ConfigClient) (*Processor, error),
+// where ConfigClient is the struct of config params for the processor.
+func Register(name string, getDefault interface{}, toProcessor interface{}) {
+	processors.Register(name, getDefault, toProcessor)
+}
+
+// The names of every registered processor, in alphabetical order
+func Names() []string {
+	return processors.Names()
+}
+
+// Retrieve a pointer to the default ConfigClient of a processor
+func GetDefault(name string) (interface{}, error) {
+	return processors.GetDefault(name)
+}
+
+// Create a processor from its ConfigClient
+func ToProcessor(name string, conf interface{}) (Processor, error) {
+	if p, err := processors.Create(name, conf); err != nil {
+		return nil, err
+	} else {
+		return p.(Processor), nil
+	}
+}
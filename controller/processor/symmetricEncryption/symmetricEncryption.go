@@ -98,8 +98,11 @@ func Pad(data []byte) []byte {
 }
 
 func UnPad(data []byte) ([]byte, error) {
+	if len(data) < padAmount {
+		return nil, errors.New("Failed to unprocess data, as data was not processed correctly")
+	}
 	lenOfData := binary.BigEndian.Uint64(data[:padAmount])
-	if lenOfData < uint64(len(data)-padAmount) {
+	if lenOfData > uint64(len(data)-padAmount) {
 		return nil, errors.New("Failed to unprocess data, as data was not processed correctly")
 	}
 	data = data[padAmount:]
@@ -125,9 +128,7 @@ func (c *SymmetricEncryption) Unprocess(data []byte) ([]byte, error) {
 		return nil, errors.New("Undefined mode selected")
 	}
 
-	data, _ = UnPad(data)
-
-	return data, nil
+	return UnPad(data)
 }
 
 func CBCDecrypter(block cipher.Block, data []byte, blockSize int) []byte {
@@ -5,8 +5,11 @@ import (
 	"crypto/cipher"
 	"crypto/des"
 	"errors"
+	"strconv"
+	"strings"
 
 	"../../config"
+	"../../processor"
 )
 
 type ConfigClient struct {
@@ -15,9 +18,47 @@ type ConfigClient struct {
 	Key       config.HexKeyParam
 }
 
+func init() {
+	processor.Register("SymmetricEncryption", GetDefault, ToProcessor)
+}
+
+// The supported algorithms, in the order they are listed
+// The first is the default
+var algorithms []algorithm = []algorithm{
+	{name: "Advanced Encryption Standard (AES)", keyLengths: []int{16, 24, 32}, blockSize: aes.BlockSize, newCipher: aes.NewCipher},
+	{name: "Data Encryption Standard (DES)", keyLengths: []int{8}, blockSize: des.BlockSize, newCipher: des.NewCipher},
+	{name: "Triple Data Encryption Standard (3DES)", keyLengths: []int{24}, blockSize: des.BlockSize, newCipher: des.NewTripleDESCipher},
+}
+
+type algorithm struct {
+	name string
+	// The key lengths in bytes accepted by the algorithm
+	keyLengths []int
+	blockSize  int
+	newCipher  func(key []byte) (cipher.Block, error)
+}
+
+// Find an algorithm by name
+func findAlgorithm(name string) (algorithm, bool) {
+	for _, a := range algorithms {
+		if a.name == name {
+			return a, true
+		}
+	}
+	return algorithm{}, false
+}
+
+func algorithmNames() []string {
+	var names []string
+	for _, a := range algorithms {
+		names = append(names, a.name)
+	}
+	return names
+}
+
 func GetDefault() ConfigClient {
 	return ConfigClient{
-		Algorithm: config.MakeSelect("Advanced Encryption Standard (AES)", []string{"Advanced Encryption Standard (AES)", "Data Encryption Standard (DES)", "Triple Data Encryption Standard (3DES)"}, config.Display{Description: "Select an encryption algorithm", Name: "Encryption Algorithm", Group: "Symmetric Encryption"}),
+		Algorithm: config.MakeSelect(algorithms[0].name, algorithmNames(), config.Display{Description: "Select an encryption algorithm", Name: "Encryption Algorithm", Group: "Symmetric Encryption"}),
 		Mode:      config.MakeSelect("Cipher Block Chaining (CBC)", []string{"Cipher Block Chaining (CBC)", "Cipher Feedback (CFB)", "Counter (CTR)", "Output Feedback (OFB)"}, config.Display{Description: "Select the mode of operation", Name: "Mode of Operation", Group: "Symmetric Encryption"}),
 		// AES-128 = key size 32 characters long, AES-192 = key size 48
 		//characters long, and AES-256 = key size 64 characters long
@@ -26,31 +67,32 @@ func GetDefault() ConfigClient {
 		Key: config.MakeHexKey(make([]byte, 32), []int{8, 16, 24, 32}, config.Display{Description: "The shared secret key used for Advanced Encryption Standard (AES) must be 32, 48 or 64 characters in length, for Data Encryption Standard (DES) must be 16 characters in length, and for Triple Data Encryption Standard (3DES) must be 48 characters in length", Name: "Shared Secret Key", Group: "Symmetric Encryption"})}
 }
 
-func ToProcessor(cc ConfigClient) (*SymmetricEncryption, error) {
-	var (
-		blockSize int
-		block     cipher.Block
-		err       error
-	)
+// The key must have a length accepted by the selected algorithm
+func (cc ConfigClient) ValidateAll() config.FieldErrors {
+	var valid []string
+	a, ok := findAlgorithm(cc.Algorithm.Value)
+	if !ok {
+		return nil
+	}
+	for _, l := range a.keyLengths {
+		if len(cc.Key.Value) == l {
+			return nil
+		}
+		valid = append(valid, strconv.Itoa(l*2))
+	}
+	return config.FieldErrors{"Key": "The key for " + cc.Algorithm.Value + " must be " + strings.Join(valid, ", ") + " characters in length"}
+}
 
+func ToProcessor(cc ConfigClient) (*SymmetricEncryption, error) {
 	// based on the users choice of symmetric algorithm create a cipher
-	switch cc.Algorithm.Value {
-	case "Advanced Encryption Standard (AES)":
-		block, err = aes.NewCipher(cc.Key.Value)
-		blockSize = 16
-	case "Data Encryption Standard (DES)":
-		block, err = des.NewCipher(cc.Key.Value)
-		blockSize = 8
-	case "Triple Data Encryption Standard (3DES)":
-		block, err = des.NewTripleDESCipher(cc.Key.Value)
-		blockSize = 8
-	default:
+	a, ok := findAlgorithm(cc.Algorithm.Value)
+	if !ok {
 		return nil, errors.New("Undefined algorithm selected")
 	}
-
+	block, err := a.newCipher(cc.Key.Value)
 	if err != nil {
 		return nil, err
 	}
 
-	return &SymmetricEncryption{algorithm: cc.Algorithm.Value, mode: cc.Mode.Value, key: cc.Key.Value, block: block, blockSize: blockSize}, nil
+	return &SymmetricEncryption{algorithm: cc.Algorithm.Value, mode: cc.Mode.Value, key: cc.Key.Value, block: block, blockSize: a.blockSize}, nil
 }
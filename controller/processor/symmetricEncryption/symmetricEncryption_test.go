@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"reflect"
 	"testing"
+
+	"../../config"
 )
 
 func TestAESEncodeDecode(t *testing.T) {
@@ -33,7 +35,10 @@ func TestPadUnpad(t *testing.T) {
 		t.Errorf("Array not padded correctly")
 	}
 
-	b = UnPad(b)
+	b, err := UnPad(b)
+	if err != nil {
+		t.Errorf("err = '%s'; want nil", err.Error())
+	}
 	if !reflect.DeepEqual(b, []byte{76, 42, 98, 34, 88, 12, 45, 32, 76}) {
 		t.Errorf("Array not unpadded correctly")
 	}
@@ -77,3 +82,25 @@ func encodeDecode(t *testing.T, key []byte, algo string, mode string, b []byte)
 		t.Errorf("Original array not restored on decode")
 	}
 }
+
+func TestValidateAll(t *testing.T) {
+	cc := GetDefault()
+	if err := config.Validate(cc); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	}
+
+	// A 16 byte key is valid on its own, but not for 3DES
+	cc.Algorithm.Value = "Triple Data Encryption Standard (3DES)"
+	cc.Key.Value = make([]byte, 16)
+	err := config.Validate(cc)
+	if fe, ok := err.(config.FieldErrors); !ok {
+		t.Errorf("Expected field errors; found %v", err)
+	} else if len(fe) != 1 || fe["Key"] != "The key for Triple Data Encryption Standard (3DES) must be 48 characters in length" {
+		t.Errorf("Unexpected field errors %v", fe)
+	}
+
+	cc.Key.Value = make([]byte, 24)
+	if err := config.Validate(cc); err != nil {
+		t.Errorf("Expected no error; found %s", err.Error())
+	}
+}
@@ -1,8 +1,16 @@
 package zLibCompression
 
+import (
+	"../../processor"
+)
+
 type ConfigClient struct {
 }
 
+func init() {
+	processor.Register("ZLibCompression", GetDefault, ToProcessor)
+}
+
 func GetDefault() ConfigClient {
 	return ConfigClient{}
 }
@@ -0,0 +1,133 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// A set of entities of one kind, such as covert channels or processors
+// Each entity is registered with a function returning its default ConfigClient
+// and a function creating the entity from a ConfigClient. Since every entity
+// has its own ConfigClient type, the functions are called through reflection.
+type Registry struct {
+	kind     string
+	iface    reflect.Type
+	entities map[string]entity
+	lock     sync.RWMutex
+}
+
+type entity struct {
+	config     reflect.Type
+	getDefault reflect.Value
+	construct  reflect.Value
+}
+
+var errorType reflect.Type = reflect.TypeOf((*error)(nil)).Elem()
+
+// Create a registry for a kind of entity
+// iface is the interface that every entity must implement, e.g.
+// reflect.TypeOf((*Channel)(nil)).Elem()
+func New(kind string, iface reflect.Type) *Registry {
+	return &Registry{kind: kind, iface: iface, entities: make(map[string]entity)}
+}
+
+// Add an entity to the registry
+// getDefault must be a func() C, where C is the struct of config params
+// used by the entity, and construct must be a func(C) (T, error), where
+// T implements the interface of the registry.
+// This is meant to be called from the init function of the entity's package,
+// so it panics if the functions are invalid or the name is already used.
+func (r *Registry) Register(name string, getDefault interface{}, construct interface{}) {
+	e, err := r.makeEntity(getDefault, construct)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to register %s %s: %s", r.kind, name, err.Error()))
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if name == "" {
+		panic(fmt.Sprintf("Unable to register %s: name is empty", r.kind))
+	}
+	if _, ok := r.entities[name]; ok {
+		panic(fmt.Sprintf("Unable to register %s %s: name already registered", r.kind, name))
+	}
+	r.entities[name] = e
+}
+
+func (r *Registry) makeEntity(getDefault interface{}, construct interface{}) (entity, error) {
+	var (
+		dv reflect.Value = reflect.ValueOf(getDefault)
+		cv reflect.Value = reflect.ValueOf(construct)
+	)
+	if dv.Kind() != reflect.Func || dv.Type().NumIn() != 0 || dv.Type().NumOut() != 1 {
+		return entity{}, errors.New("GetDefault must take no arguments and return a config")
+	}
+	ct := dv.Type().Out(0)
+	if ct.Kind() != reflect.Struct {
+		return entity{}, errors.New("The config must be a struct")
+	}
+	if cv.Kind() != reflect.Func || cv.Type().NumIn() != 1 || cv.Type().In(0) != ct {
+		return entity{}, errors.New("The constructor must take the config returned by GetDefault")
+	}
+	if cv.Type().NumOut() != 2 || !cv.Type().Out(0).Implements(r.iface) || cv.Type().Out(1) != errorType {
+		return entity{}, errors.New("The constructor must return a " + r.iface.String() + " and an error")
+	}
+	return entity{config: ct, getDefault: dv, construct: cv}, nil
+}
+
+// The names of every registered entity, in alphabetical order
+func (r *Registry) Names() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	names := make([]string, 0, len(r.entities))
+	for name := range r.entities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Retrieve a pointer to a new default config of an entity
+// A pointer is returned so that the values of the config can be
+// set by the json and config packages.
+func (r *Registry) GetDefault(name string) (interface{}, error) {
+	e, err := r.entity(name)
+	if err != nil {
+		return nil, err
+	}
+	conf := reflect.New(e.config)
+	conf.Elem().Set(e.getDefault.Call(nil)[0])
+	return conf.Interface(), nil
+}
+
+// Create an entity from its config, which may be a pointer
+func (r *Registry) Create(name string, conf interface{}) (interface{}, error) {
+	e, err := r.entity(name)
+	if err != nil {
+		return nil, err
+	}
+	v := reflect.ValueOf(conf)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.Type() != e.config {
+		return nil, errors.New("Invalid " + r.kind + " config for " + name)
+	}
+	out := e.construct.Call([]reflect.Value{v})
+	if err, _ := out[1].Interface().(error); err != nil {
+		return nil, err
+	}
+	return out[0].Interface(), nil
+}
+
+func (r *Registry) entity(name string) (entity, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if e, ok := r.entities[name]; ok {
+		return e, nil
+	}
+	return entity{}, errors.New("Invalid " + r.kind + " Type")
+}
@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type entityInterface interface {
+	Shift() int
+}
+
+type testEntity struct {
+	shift int
+}
+
+func (e *testEntity) Shift() int {
+	return e.shift
+}
+
+type testConfig struct {
+	Shift int
+}
+
+func getDefault() testConfig {
+	return testConfig{Shift: 3}
+}
+
+func toEntity(c testConfig) (*testEntity, error) {
+	if c.Shift < 0 {
+		return nil, errors.New("Negative shift")
+	}
+	return &testEntity{shift: c.Shift}, nil
+}
+
+func newTestRegistry() *Registry {
+	return New("Test", reflect.TypeOf((*entityInterface)(nil)).Elem())
+}
+
+func TestRegister(t *testing.T) {
+	r := newTestRegistry()
+	r.Register("B", getDefault, toEntity)
+	r.Register("A", getDefault, toEntity)
+
+	if names := r.Names(); !reflect.DeepEqual(names, []string{"A", "B"}) {
+		t.Errorf("Expected %v: Found %v", []string{"A", "B"}, names)
+	}
+
+	conf, err := r.GetDefault("A")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	c, ok := conf.(*testConfig)
+	if !ok || c.Shift != 3 {
+		t.Fatalf("Expected a pointer to the default config: Found %v", conf)
+	}
+
+	c.Shift = 5
+	if e, err := r.Create("A", c); err != nil {
+		t.Errorf("Unexpected error %s", err.Error())
+	} else if e.(entityInterface).Shift() != 5 {
+		t.Errorf("Expected %d: Found %d", 5, e.(entityInterface).Shift())
+	}
+	// Configs may also be passed by value
+	if e, err := r.Create("A", testConfig{Shift: 6}); err != nil {
+		t.Errorf("Unexpected error %s", err.Error())
+	} else if e.(entityInterface).Shift() != 6 {
+		t.Errorf("Expected %d: Found %d", 6, e.(entityInterface).Shift())
+	}
+
+	if _, err := r.Create("A", testConfig{Shift: -1}); err == nil || err.Error() != "Negative shift" {
+		t.Errorf("Expected error %s: Found %v", "Negative shift", err)
+	}
+	if _, err := r.Create("A", 5); err == nil || err.Error() != "Invalid Test config for A" {
+		t.Errorf("Expected error %s: Found %v", "Invalid Test config for A", err)
+	}
+	if _, err := r.Create("C", c); err == nil || err.Error() != "Invalid Test Type" {
+		t.Errorf("Expected error %s: Found %v", "Invalid Test Type", err)
+	}
+	if _, err := r.GetDefault("C"); err == nil || err.Error() != "Invalid Test Type" {
+		t.Errorf("Expected error %s: Found %v", "Invalid Test Type", err)
+	}
+}
+
+func TestRegisterInvalid(t *testing.T) {
+	type registerTestCase struct {
+		name       string
+		getDefault interface{}
+		construct  interface{}
+	}
+
+	var cases []registerTestCase = []registerTestCase{
+		registerTestCase{"", getDefault, toEntity},
+		registerTestCase{"A", getDefault, toEntity},
+		registerTestCase{"B", 5, toEntity},
+		registerTestCase{"B", func() int { return 0 }, toEntity},
+		registerTestCase{"B", getDefault, func(c testConfig) *testEntity { return nil }},
+		registerTestCase{"B", getDefault, func(c int) (*testEntity, error) { return nil, nil }},
+		registerTestCase{"B", getDefault, func(c testConfig) (testEntity, error) { return testEntity{}, nil }},
+	}
+
+	r := newTestRegistry()
+	r.Register("A", getDefault, toEntity)
+	for i, c := range cases {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Case %d : Expected panic", i)
+				}
+			}()
+			r.Register(c.name, c.getDefault, c.construct)
+		}()
+	}
+	if names := r.Names(); !reflect.DeepEqual(names, []string{"A"}) {
+		t.Errorf("Expected %v: Found %v", []string{"A"}, names)
+	}
+}
@@ -2,59 +2,55 @@
 package main
 
 import (
-	"./ipv4TCP"
+	"../controller"
 	"flag"
 	"fmt"
 	"log"
-	"net"
-	"time"
+	"os"
+	"os/signal"
 )
 
+// Write each message received over a covert channel to standard output
+// The channel is configured with a config file or the flags of its params, e.g.
+//
+//	go run receiver.go -TcpSyn.FriendIP=10.0.0.1 -TcpSyn.Embedder=temporal
 func main() {
 	fmt.Println("Covert Channel Receiver!")
 
-	// Parse flags for destination and bounce IPs
-	fa := flag.String("fa", "127.0.0.1", "The friend IP")
-	oa := flag.String("oa", "127.0.0.1", "The origin IP")
-	fp := flag.Int("fp", 8082, "The friend port")
-	op := flag.Int("op", 8081, "The origin port")
-
+	cf := controller.NewConfigFlags(flag.CommandLine)
+	// The defaults match those of the sender
+	flag.Set("channel", "TcpSyn")
+	flag.Set("TcpSyn.FriendPort", "8082")
+	flag.Set("TcpSyn.OriginPort", "8081")
+	flag.Set("TcpSyn.ReadTimeout", "5000")
 	flag.Parse()
 
-	fIP := net.ParseIP(*fa)
-	oIP := net.ParseIP(*oa)
-
-	if fIP == nil {
-		log.Fatal("Invalid Friend IP")
+	conf, err := cf.Config()
+	if err != nil {
+		log.Fatal(err.Error())
 	}
-	if oIP == nil {
-		log.Fatal("Invalid Origin IP")
-	}
-
-	conf := ipv4TCP.Config{
-		FriendPort: uint16(*fp),
-		OriginPort: uint16(*op),
-		Delimiter:  ipv4TCP.Protocol,
 
-		ReadTimeout: time.Second * 5,
+	ctr, err := controller.CreateController()
+	if err != nil {
+		log.Fatal(err.Error())
 	}
+	defer ctr.Shutdown()
 
-	copy(conf.FriendIP[:], fIP.To4())
-	copy(conf.OriginIP[:], oIP.To4())
-
-	for {
-
-		ch, _ := ipv4TCP.MakeChannel(conf)
-
-		fmt.Println("Waiting for message")
+	hc := controller.HeadlessConfig{
+		Config: conf,
+		Output: os.Stdout,
+		Stop:   make(chan interface{}),
+	}
 
-		var data [1024]byte
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	go func() {
+		<-signalChan
+		close(hc.Stop)
+	}()
 
-		n, err := ch.Receive(data[:], nil)
-		if err != nil {
-			fmt.Println("error: " + err.Error())
-		} else {
-			fmt.Println("Msg Received: " + string(data[:n]))
-		}
+	fmt.Println("Waiting for messages")
+	if err = ctr.RunHeadless(hc); err != nil {
+		log.Println(err.Error())
 	}
 }
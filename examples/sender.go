@@ -2,65 +2,57 @@
 package main
 
 import (
-	"./ipv4TCP"
-	"bufio"
+	"../controller"
 	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
+	"os/signal"
+	"time"
 )
 
+// Send each line of standard input over a covert channel
+// The channel is configured with a config file or the flags of its params, e.g.
+//
+//	go run sender.go -TcpSyn.FriendIP=10.0.0.2 -TcpSyn.Embedder=temporal
 func main() {
 	fmt.Println("Covert Channel Sender!")
 
-	// Parse flags for destination and bounce IPs
-	fa := flag.String("fa", "127.0.0.1", "The friend IP")
-	oa := flag.String("oa", "127.0.0.1", "The origin IP")
-	fp := flag.Int("fp", 8081, "The friend port")
-	op := flag.Int("op", 8082, "The origin port")
-
+	cf := controller.NewConfigFlags(flag.CommandLine)
+	// The defaults match those of the receiver
+	flag.Set("channel", "TcpSyn")
+	flag.Set("TcpSyn.FriendPort", "8081")
+	flag.Set("TcpSyn.OriginPort", "8082")
 	flag.Parse()
 
-	fIP := net.ParseIP(*fa)
-	oIP := net.ParseIP(*oa)
-
-	if fIP == nil {
-		log.Fatal("Invalid Friend IP")
-	}
-	if oIP == nil {
-		log.Fatal("Invalid Origin IP")
+	conf, err := cf.Config()
+	if err != nil {
+		log.Fatal(err.Error())
 	}
 
-	conf := ipv4TCP.Config{
-		FriendPort: uint16(*fp),
-		OriginPort: uint16(*op),
-		Delimiter:  ipv4TCP.Protocol,
+	ctr, err := controller.CreateController()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer ctr.Shutdown()
+
+	hc := controller.HeadlessConfig{
+		Config: conf,
+		Input:  os.Stdin,
+		Output: os.Stdout,
+		Linger: time.Second,
+		Stop:   make(chan interface{}),
 	}
 
-	copy(conf.FriendIP[:], fIP.To4())
-	copy(conf.OriginIP[:], oIP.To4())
-
-	ch, _ := ipv4TCP.MakeChannel(conf)
-
-	scanner := bufio.NewScanner(os.Stdin)
-
-	for {
-		fmt.Println("Write your message")
-
-		scanner.Scan()
-		text := scanner.Text()
-		fmt.Printf("%d bytes read\n", len(text)+1)
-		data := []byte(text + "\n")
-		if len(data) > 1024 {
-			data = data[:1024]
-		}
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	go func() {
+		<-signalChan
+		close(hc.Stop)
+	}()
 
-		_, err := ch.Send(data, nil)
-		if err != nil {
-			fmt.Println("error: " + err.Error())
-		} else {
-			fmt.Println("Msg sent")
-		}
+	fmt.Println("Write your messages")
+	if err = ctr.RunHeadless(hc); err != nil {
+		log.Println(err.Error())
 	}
 }
@@ -4,11 +4,14 @@ import (
 	"./controller"
 	"context"
 	"flag"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,39 +19,224 @@ func main() {
 
 	//Intercept the kill signal to ensure proper shutdown
 	//of the process
-	signalChan := make(chan os.Signal)
+	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt)
 
 	var p *int = flag.Int("p", 3000, "the port for the webpage and websocket")
+	var addr *string = flag.String("addr", "", "the address to bind the server to, e.g. 127.0.0.1. All interfaces if empty")
+	var cert *string = flag.String("cert", "", "the TLS certificate file. The server uses TLS if this and -key are set")
+	var key *string = flag.String("key", "", "the TLS private key file")
+	var tokenFile *string = flag.String("tokenfile", "", "a file containing the token clients must provide. No token is required if empty")
+	var origins *string = flag.String("origins", "", "a comma separated list of origins allowed to connect in addition to the server itself")
+	var profileDir *string = flag.String("profiles", "profiles", "the directory that configuration profiles are saved in")
+	var historyFile *string = flag.String("history", controller.DefaultHistoryFile(), "the file that every message sent and received is appended to, including the plaintext of each message. Only recent messages are kept in memory if empty")
+	var headless *string = flag.String("headless", "", "run without the web interface, using the JSON channel configuration in this file")
+	var files *string = flag.String("files", "", "in headless mode, a comma separated list of files to send once standard input is exhausted")
+	var fileDir *string = flag.String("filedir", ".", "in headless mode, the directory to save received files to")
+	var linger *time.Duration = flag.Duration("linger", 0, "in headless mode, how long to keep receiving once all input has been sent. Zero to receive until interrupted")
+	var experiment *string = flag.String("experiment", "", "run the JSON experiment in this file without the web interface, and exit")
+	var results *string = flag.String("results", "", "the file to write the CSV results of the experiment to. Standard output if empty")
+	var record *string = flag.String("record", "", "record every command, reply and event to this session file, replacing it if it exists")
+	var replay *string = flag.String("replay", "", "replay the commands of this session file with their original timing without the web interface, and exit")
+	var configFlags *controller.ConfigFlags = controller.NewConfigFlags(flag.CommandLine)
 	flag.Parse()
 
 	ctr, err := controller.CreateController()
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+
+	if *historyFile != "" {
+		if err = ctr.SetHistoryFile(*historyFile); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
+	if err = ctr.SetProfileDir(*profileDir); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// The config file and flags give the initial configuration of the web interface
+	if configFlags.IsSet() {
+		conf, err := configFlags.Config()
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if err = ctr.SetConfig(conf); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
+	if *record != "" {
+		if err = ctr.SetRecordFile(*record); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+
+	if *replay != "" {
+		runReplay(ctr, *replay, signalChan)
+		return
+	}
+
+	if *experiment != "" {
+		runExperiment(ctr, *experiment, *results, signalChan)
+		return
+	}
+
+	if *headless != "" {
+		runHeadless(ctr, *headless, *files, *fileDir, *linger, signalChan)
+		return
+	}
+
+	if (*cert == "") != (*key == "") {
+		log.Fatal("Both -cert and -key must be set to use TLS")
+	}
+	ac := controller.AuthConfig{Secure: *cert != ""}
+	if *tokenFile != "" {
+		if token, err := ioutil.ReadFile(*tokenFile); err != nil {
+			log.Fatal(err.Error())
+		} else if ac.Token = strings.TrimSpace(string(token)); ac.Token == "" {
+			log.Fatal("Token file is empty")
+		}
+	}
+	if *origins != "" {
+		ac.Origins = strings.Split(*origins, ",")
+	}
+	ctr.SetAuth(ac)
+
 	//Create each of the possible websocket connections
 	mux := http.NewServeMux()
 
+	mux.HandleFunc("/api/login", ctr.HandleLogin)
 	mux.HandleFunc("/api/ws", ctr.HandleFunc)
-	mux.Handle("/", http.FileServer(http.Dir("client/build")))
+	mux.HandleFunc("/api/config", ctr.HandleConfig)
+	mux.HandleFunc("/api/open", ctr.HandleOpen)
+	mux.HandleFunc("/api/close", ctr.HandleClose)
+	mux.HandleFunc("/api/write", ctr.HandleWrite)
+	mux.HandleFunc("/api/cancel", ctr.HandleCancel)
+	mux.HandleFunc("/api/schedules", ctr.HandleSchedules)
+	mux.HandleFunc("/api/schedules/cancel", ctr.HandleCancelSchedule)
+	mux.HandleFunc("/api/history", ctr.HandleHistory)
+	mux.HandleFunc("/api/stats", ctr.HandleStats)
+	mux.HandleFunc("/api/schema", ctr.HandleSchema)
+	mux.HandleFunc("/api/configschema", ctr.HandleConfigSchema)
+	mux.HandleFunc("/api/events", ctr.HandleEvents)
+	mux.Handle("/", ctr.LoginRequired(http.FileServer(http.Dir("client/build"))))
 
 	defer ctr.Shutdown()
 
-	srv := &http.Server{Addr: ":" + strconv.Itoa(*p), Handler: mux}
+	srv := &http.Server{Addr: net.JoinHostPort(*addr, strconv.Itoa(*p)), Handler: mux}
 
-	log.Println("http server started on :" + strconv.Itoa(*p))
+	log.Println("http server started on " + srv.Addr)
 
 	//Go routine to listen to kill signals for this process
 	go func() {
 		<-signalChan
-		ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 		srv.Shutdown(ctx)
 	}()
 
 	//Start and listen for websocket connections
-	err = srv.ListenAndServe()
+	if *cert != "" {
+		err = srv.ListenAndServeTLS(*cert, *key)
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if err != nil {
 		log.Println("ListenAndServer: ", err)
 	}
 	log.Println("Shutting down")
 }
+
+// Run the controller without the web interface
+// Lines from standard input are sent as covert messages, and
+// received messages are written to standard output
+func runHeadless(ctr *controller.Controller, confFile string, files string, fileDir string, linger time.Duration, signalChan chan os.Signal) {
+	defer ctr.Shutdown()
+
+	conf, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	hc := controller.HeadlessConfig{
+		Config:  conf,
+		Input:   os.Stdin,
+		Output:  os.Stdout,
+		FileDir: fileDir,
+		Linger:  linger,
+		Stop:    make(chan interface{}),
+	}
+	if files != "" {
+		hc.Files = strings.Split(files, ",")
+	}
+
+	go func() {
+		<-signalChan
+		close(hc.Stop)
+	}()
+
+	if err = ctr.RunHeadless(hc); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Run an experiment and write the results as CSV
+func runExperiment(ctr *controller.Controller, expFile string, results string, signalChan chan os.Signal) {
+	defer ctr.Shutdown()
+
+	conf, err := ioutil.ReadFile(expFile)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	ec := controller.ExperimentConfig{
+		Config: conf,
+		Output: os.Stdout,
+		Stop:   make(chan interface{}),
+	}
+	if results != "" {
+		f, err := os.Create(results)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		defer f.Close()
+		ec.Output = f
+	}
+
+	go func() {
+		<-signalChan
+		close(ec.Stop)
+	}()
+
+	if err = ctr.RunExperiment(ec); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Replay a recorded session and write the replies and events to standard output
+func runReplay(ctr *controller.Controller, sessionFile string, signalChan chan os.Signal) {
+	defer ctr.Shutdown()
+
+	f, err := os.Open(sessionFile)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	defer f.Close()
+
+	rc := controller.ReplayConfig{
+		Input:  f,
+		Output: os.Stdout,
+		Stop:   make(chan interface{}),
+	}
+
+	go func() {
+		<-signalChan
+		close(rc.Stop)
+	}()
+
+	if err = ctr.RunReplay(rc); err != nil {
+		log.Println(err.Error())
+	}
+}